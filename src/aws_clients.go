@@ -0,0 +1,331 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/emr"
+	"github.com/aws/aws-sdk-go/service/emr/emriface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	log "github.com/sirupsen/logrus"
+)
+
+// serviceEndpointIDs maps the services whose endpoint can be overridden to their SDK identifiers
+var serviceEndpointIDs = map[string]string{
+	"emr":            emr.EndpointsID,
+	"s3":             s3.EndpointsID,
+	"sts":            sts.EndpointsID,
+	"ssm":            ssm.EndpointsID,
+	"secretsmanager": secretsmanager.EndpointsID,
+	"dynamodb":       dynamodb.EndpointsID,
+}
+
+// operationDoneKey holds the function notifying the observers that a request to AWS is done in
+// the context of the request
+type operationDoneKey struct{}
+
+// defaultAwsClients is shared by the components so that sessions are only built once per run
+var defaultAwsClients = NewAwsClients("")
+
+// AwsClients builds the AWS clients of every component, a session being shared by the clients of
+// a region and set of credentials
+type AwsClients struct {
+	// Endpoint is the URL of a stand-in for the AWS services, e.g. LocalStack, used instead of the
+	// AWS endpoints if it is set
+	Endpoint string
+	// ServiceEndpoints overrides the endpoint of single services, indexed by SDK identifier, see
+	// ParseServiceEndpoints
+	ServiceEndpoints map[string]string
+	// HTTPClient sends the requests of every client if it is set, see NewHTTPClient
+	HTTPClient *http.Client
+	// Debug logs the service, operation, retries, status and error of the requests at the debug
+	// level, never their headers or bodies which hold credentials and secret values
+	Debug bool
+	// Observers are notified of the requests which were retried
+	Observers Observers
+
+	mu       sync.Mutex
+	sessions map[string]*session.Session
+	shared   *session.Session
+}
+
+// NewAwsClients builds an AwsClients using the given endpoint, empty for the AWS endpoints
+func NewAwsClients(endpoint string) *AwsClients {
+	return &AwsClients{Endpoint: endpoint, sessions: make(map[string]*session.Session)}
+}
+
+// Session returns the session of a region and the credentials of a config
+func (ac *AwsClients) Session(region string, record *CredentialsRecord) (*session.Session, error) {
+	if record == nil {
+		record = &CredentialsRecord{}
+	}
+	key := region + "|" + InterfaceToJSONString(record, false)
+
+	ac.mu.Lock()
+	sess, ok := ac.sessions[key]
+	ac.mu.Unlock()
+	if ok {
+		return sess, nil
+	}
+
+	creds, err := configCredentials(record, region, ac.STS, ac.SharedConfigSession)
+	if err != nil {
+		return nil, err
+	}
+	sess, err = ac.newSession(session.Options{Config: *ac.config(region, creds)})
+	if err != nil {
+		return nil, err
+	}
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if existing, ok := ac.sessions[key]; ok {
+		return existing, nil
+	}
+	ac.sessions[key] = sess
+	return sess, nil
+}
+
+// DefaultSession returns the session whose region and credentials are resolved through the
+// default chain and the shared config, used by the components which aren't configured with
+// credentials such as the locks
+func (ac *AwsClients) DefaultSession() (*session.Session, error) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	if ac.shared != nil {
+		return ac.shared, nil
+	}
+	sess, err := ac.SharedConfigSession("", "")
+	if err != nil {
+		return nil, err
+	}
+	ac.shared = sess
+	return sess, nil
+}
+
+// EMR builds an EMR client for a region and the credentials of a config
+func (ac *AwsClients) EMR(region string, record *CredentialsRecord) (emriface.EMRAPI, error) {
+	sess, err := ac.Session(region, record)
+	if err != nil {
+		return nil, err
+	}
+	return emr.New(sess), nil
+}
+
+// S3 builds a S3 client for a region and the credentials of a config
+func (ac *AwsClients) S3(region string, record *CredentialsRecord) (s3iface.S3API, error) {
+	sess, err := ac.Session(region, record)
+	if err != nil {
+		return nil, err
+	}
+	return s3.New(sess), nil
+}
+
+// SharedConfigSession builds a session whose credentials are resolved through the shared config,
+// see SharedConfigSession. The roles the profiles assume are assumed through the same endpoints
+// and HTTP client as the other requests.
+func (ac *AwsClients) SharedConfigSession(region, profile string) (*session.Session, error) {
+	return ac.newSession(session.Options{
+		Profile:           profile,
+		SharedConfigState: session.SharedConfigEnable,
+		Config:            *ac.config(region, nil),
+	})
+}
+
+// STS builds the STS client used to assume roles, see STSClient
+func (ac *AwsClients) STS(region string, creds *credentials.Credentials) (stsiface.STSAPI, error) {
+	sess, err := ac.newSession(session.Options{Config: *ac.config(region, creds)})
+	if err != nil {
+		return nil, err
+	}
+	return sts.New(sess), nil
+}
+
+// newSession builds a session notifying the observers of the requests, retries included
+func (ac *AwsClients) newSession(options session.Options) (*session.Session, error) {
+	sess, err := session.NewSessionWithOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	// requests are only validated once, no matter how many times they're retried
+	sess.Handlers.Validate.PushFront(func(r *request.Request) {
+		service := serviceName(r.ClientInfo.ServiceName)
+		ctx, done := ac.Observers.OperationStarted(r.Context(), service+"."+r.Operation.Name, log.Fields{
+			"service":   service,
+			"operation": r.Operation.Name,
+		})
+		r.SetContext(context.WithValue(ctx, operationDoneKey{}, done))
+	})
+	sess.Handlers.Complete.PushBack(func(r *request.Request) {
+		if r.RetryCount > 0 {
+			ac.Observers.AwsRequestRetried(r.ClientInfo.ServiceName, r.Operation.Name, r.RetryCount)
+		}
+		if done, ok := r.Context().Value(operationDoneKey{}).(func(error)); ok {
+			done(r.Error)
+		}
+	})
+	if ac.Debug {
+		sess.Handlers.Send.PushFront(func(r *request.Request) {
+			log.WithFields(requestFields(r)).Debug("Sending AWS request")
+		})
+		sess.Handlers.Retry.PushBack(func(r *request.Request) {
+			log.WithFields(requestFields(r)).Debug("AWS request attempt failed")
+		})
+		sess.Handlers.Complete.PushBack(func(r *request.Request) {
+			log.WithFields(requestFields(r)).Debug("AWS request done")
+		})
+	}
+	return sess, nil
+}
+
+// requestFields are the fields describing a request in the debug logs, the status and error
+// being only known once it was sent
+func requestFields(r *request.Request) log.Fields {
+	fields := log.Fields{
+		"service":   serviceName(r.ClientInfo.ServiceName),
+		"operation": r.Operation.Name,
+		"retries":   r.RetryCount,
+	}
+	if r.HTTPResponse != nil {
+		fields["status"] = r.HTTPResponse.StatusCode
+	}
+	if r.Error != nil {
+		fields["error"] = r.Error.Error()
+	}
+	return fields
+}
+
+// serviceName is the name of a service as it's given to --aws-service-endpoint, its SDK
+// identifier if it's not one of them
+func serviceName(endpointsID string) string {
+	for name, id := range serviceEndpointIDs {
+		if id == endpointsID {
+			return name
+		}
+	}
+	return endpointsID
+}
+
+// config is the configuration of the sessions for a region and credentials, S3 buckets being
+// addressed in the path as stand-ins usually don't support virtual hosts
+func (ac *AwsClients) config(region string, creds *credentials.Credentials) *aws.Config {
+	config := &aws.Config{
+		Credentials:      creds,
+		EndpointResolver: endpoints.ResolverFunc(ac.resolveEndpoint),
+		HTTPClient:       ac.HTTPClient,
+	}
+	if region != "" {
+		config.Region = aws.String(region)
+	}
+	if ac.Endpoint != "" || ac.ServiceEndpoints[s3.EndpointsID] != "" {
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+	return config
+}
+
+// resolveEndpoint resolves the endpoint of a service to its override, to Endpoint or to the AWS
+// endpoint in that order. The instance metadata service the default credentials chain reads is
+// never overridden.
+func (ac *AwsClients) resolveEndpoint(service, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+	if service == endpoints.Ec2metadataServiceID {
+		return endpoints.DefaultResolver().EndpointFor(service, region, opts...)
+	}
+	endpoint := ac.ServiceEndpoints[service]
+	if endpoint == "" {
+		endpoint = ac.Endpoint
+	}
+	if endpoint == "" {
+		return endpoints.DefaultResolver().EndpointFor(service, region, opts...)
+	}
+	return endpoints.ResolvedEndpoint{URL: endpoint, SigningRegion: region}, nil
+}
+
+// ParseServiceEndpoints parses endpoint overrides given as service=URL, the services being those
+// of serviceEndpointIDs
+func ParseServiceEndpoints(overrides []string) (map[string]string, error) {
+	services := make([]string, 0, len(serviceEndpointIDs))
+	for service := range serviceEndpointIDs {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	parsed := make(map[string]string)
+	for _, override := range overrides {
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, errors.New("invalid service endpoint " + override + ", expected service=URL")
+		}
+		id, ok := serviceEndpointIDs[parts[0]]
+		if !ok {
+			return nil, errors.New("unknown service " + parts[0] + ", possible values are " +
+				strings.Join(services, ","))
+		}
+		if _, err := url.ParseRequestURI(parts[1]); err != nil {
+			return nil, errors.New("invalid endpoint for " + parts[0] + ": " + err.Error())
+		}
+		parsed[id] = parts[1]
+	}
+	return parsed, nil
+}
+
+// NewHTTPClient builds the HTTP client of the AWS clients, sending the requests through proxy and
+// trusting the certificates of the PEM file caBundle on top of the system ones. The proxy
+// environment variables are used if proxy is empty.
+func NewHTTPClient(proxy string, caBundle string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, errors.New("invalid proxy URL " + proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if caBundle != "" {
+		pem, err := ioutil.ReadFile(caBundle)
+		if err != nil {
+			return nil, errors.New("couldn't read CA bundle " + caBundle + ": " + err.Error())
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in CA bundle " + caBundle)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: transport}, nil
+}
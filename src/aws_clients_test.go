@@ -0,0 +1,323 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/emr"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAwsClients_Session(t *testing.T) {
+	assert := assert.New(t)
+	clients := NewAwsClients("")
+
+	creds := &CredentialsRecord{AccessKeyId: "access", SecretAccessKey: "secret"}
+	sess, err := clients.Session("eu-west-1", creds)
+	assert.Nil(err)
+	same, err := clients.Session("eu-west-1", &CredentialsRecord{AccessKeyId: "access", SecretAccessKey: "secret"})
+	assert.Nil(err)
+	assert.True(sess == same)
+
+	other, err := clients.Session("us-east-1", creds)
+	assert.Nil(err)
+	assert.False(sess == other)
+	assert.Equal("us-east-1", *other.Config.Region)
+
+	_, err = clients.Session("eu-west-1", &CredentialsRecord{AccessKeyId: "env", SecretAccessKey: "nv"})
+	assert.NotNil(err)
+	assert.Equal("access-key and secret-key must both be set to 'env', or neither", err.Error())
+}
+
+func TestAwsClients_STS(t *testing.T) {
+	assert := assert.New(t)
+	clients := NewAwsClients("")
+
+	svc, err := clients.STS("eu-west-1", credentials.AnonymousCredentials)
+	assert.Nil(err)
+	assert.NotNil(svc)
+
+	// sessions which can't be built make resolving credentials fail rather than panic
+	os.Setenv("AWS_CA_BUNDLE", "/tmp/missing-ca-bundle.pem")
+	defer os.Unsetenv("AWS_CA_BUNDLE")
+	svc, err = clients.STS("eu-west-1", credentials.AnonymousCredentials)
+	assert.Nil(svc)
+	assert.NotNil(err)
+
+	_, err = configCredentials(&CredentialsRecord{RoleArn: "arn:aws:iam::123456789012:role/pipeline"},
+		"eu-west-1", clients.STS, clients.SharedConfigSession)
+	assert.NotNil(err)
+	if err != nil {
+		assert.Contains(err.Error(), "LoadCustomCABundleError")
+	}
+}
+
+func TestAwsClients_Endpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	var targets []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		targets = append(targets, r.Header.Get("X-Amz-Target"))
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.Write([]byte(`{"Cluster": {"Id": "j-123", "Status": {"State": "WAITING"}}}`))
+	}))
+	defer server.Close()
+
+	record, _ := CR.ParseClusterRecord([]byte(ClusterRecord1), nil, "")
+	record.Credentials = &CredentialsRecord{AccessKeyId: "access", SecretAccessKey: "secret"}
+	ec, err := InitEmrCluster(*record, NewAwsClients(server.URL))
+	assert.Nil(err)
+
+	out, err := ec.Svc.DescribeCluster(&emr.DescribeClusterInput{ClusterId: aws.String("j-123")})
+	assert.Nil(err)
+	assert.Equal("WAITING", *out.Cluster.Status.State)
+	assert.Equal([]string{"ElasticMapReduce.DescribeCluster"}, targets)
+}
+
+func TestAwsClients_SharedConfigEndpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	var actions []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		actions = append(actions, r.Form.Get("Action"))
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(`<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult><Credentials><AccessKeyId>stand-in</AccessKeyId><SecretAccessKey>secret</SecretAccessKey>
+  <SessionToken>token</SessionToken><Expiration>2100-01-01T00:00:00Z</Expiration></Credentials></AssumeRoleResult>
+</AssumeRoleResponse>`))
+	}))
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "test-shared-config")
+	defer os.RemoveAll(dir)
+	credentialsFile := writeConfigFile(t, dir, "credentials", "[default]\naws_access_key_id = default-access\naws_secret_access_key = default-secret\n"+
+		"[pipeline]\naws_access_key_id = profile-access\naws_secret_access_key = profile-secret\n")
+	configFile := writeConfigFile(t, dir, "config", "[profile chained]\nrole_arn = arn:aws:iam::123456789012:role/pipeline\nsource_profile = pipeline\n")
+	os.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsFile)
+	defer os.Unsetenv("AWS_SHARED_CREDENTIALS_FILE")
+	os.Setenv("AWS_CONFIG_FILE", configFile)
+	defer os.Unsetenv("AWS_CONFIG_FILE")
+
+	// the roles assumed by profiles and by the default chain go through the stand-in
+	clients := NewAwsClients(server.URL)
+	for _, record := range []*CredentialsRecord{
+		{Profile: "chained"},
+		{RoleArn: "arn:aws:iam::123456789012:role/other"},
+	} {
+		sess, err := clients.Session("eu-west-1", record)
+		assert.Nil(err)
+		value, err := sess.Config.Credentials.Get()
+		assert.Nil(err)
+		assert.Equal("stand-in", value.AccessKeyID)
+	}
+	assert.Equal([]string{"AssumeRole", "AssumeRole"}, actions)
+}
+
+func TestAwsClients_ServiceEndpoints(t *testing.T) {
+	assert := assert.New(t)
+
+	var hosts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts = append(hosts, r.Host)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.Write([]byte(`{"Cluster": {"Id": "j-123", "Status": {"State": "WAITING"}}}`))
+	}))
+	defer server.Close()
+
+	// the requests go through the proxy, the EMR override winning over the global endpoint
+	serviceEndpoints, err := ParseServiceEndpoints([]string{"emr=http://emr.internal:4566"})
+	assert.Nil(err)
+	httpClient, err := NewHTTPClient(server.URL, "")
+	assert.Nil(err)
+	clients := NewAwsClients("http://localstack:4566")
+	clients.ServiceEndpoints = serviceEndpoints
+	clients.HTTPClient = httpClient
+	clients.Debug = true
+
+	svc, err := clients.EMR("eu-west-1", &CredentialsRecord{AccessKeyId: "access", SecretAccessKey: "secret"})
+	assert.Nil(err)
+	out, err := svc.DescribeCluster(&emr.DescribeClusterInput{ClusterId: aws.String("j-123")})
+	assert.Nil(err)
+	assert.Equal("WAITING", *out.Cluster.Status.State)
+	assert.Equal([]string{"emr.internal:4566"}, hosts)
+
+	endpoint, err := clients.resolveEndpoint("s3", "eu-west-1")
+	assert.Nil(err)
+	assert.Equal("http://localstack:4566", endpoint.URL)
+	endpoint, err = NewAwsClients("").resolveEndpoint("elasticmapreduce", "eu-west-1")
+	assert.Nil(err)
+	assert.Equal("https://elasticmapreduce.eu-west-1.amazonaws.com", endpoint.URL)
+}
+
+func TestParseServiceEndpoints(t *testing.T) {
+	assert := assert.New(t)
+
+	res, err := ParseServiceEndpoints([]string{"s3=http://localhost:4566", "secretsmanager=https://vpce.internal"})
+	assert.Nil(err)
+	assert.Equal(map[string]string{"s3": "http://localhost:4566", "secretsmanager": "https://vpce.internal"}, res)
+
+	for override, message := range map[string]string{
+		"s3":                  "invalid service endpoint s3, expected service=URL",
+		"s3=":                 "invalid service endpoint s3=, expected service=URL",
+		"glue=http://glue":    "unknown service glue, possible values are dynamodb,emr,s3,secretsmanager,ssm,sts",
+		"emr=not a valid url": "invalid endpoint for emr: parse \"not a valid url\": invalid URI for request",
+	} {
+		_, err := ParseServiceEndpoints([]string{override})
+		assert.NotNil(err)
+		if err != nil {
+			assert.Equal(message, err.Error())
+		}
+	}
+}
+
+func TestNewHTTPClient(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "test-http-client")
+	defer os.RemoveAll(dir)
+	bundle := writeConfigFile(t, dir, "bundle.pem", string(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	})))
+
+	// the certificate of the server is only trusted through the bundle
+	_, err := http.DefaultClient.Get(server.URL)
+	assert.NotNil(err)
+	client, err := NewHTTPClient("", bundle)
+	assert.Nil(err)
+	resp, err := client.Get(server.URL)
+	assert.Nil(err)
+	if err == nil {
+		resp.Body.Close()
+		assert.Equal(http.StatusOK, resp.StatusCode)
+	}
+
+	empty := writeConfigFile(t, dir, "empty.pem", "")
+	for message, args := range map[string][]string{
+		"invalid proxy URL proxy.internal":            {"proxy.internal", ""},
+		"no certificates found in CA bundle " + empty: {"", empty},
+		"couldn't read CA bundle " + dir + "/missing.pem: open " + dir + "/missing.pem: no such file or directory": {"", dir + "/missing.pem"},
+	} {
+		_, err := NewHTTPClient(args[0], args[1])
+		assert.NotNil(err)
+		if err != nil {
+			assert.Equal(message, err.Error())
+		}
+	}
+}
+
+type requestsObserver struct {
+	NopObserver
+	retries    map[string]int
+	operations []string
+}
+
+func (o *requestsObserver) AwsRequestRetried(service, operation string, retries int) {
+	o.retries[service+"."+operation] += retries
+}
+
+func (o *requestsObserver) OperationStarted(ctx context.Context, name string, fields log.Fields) (context.Context, func(err error)) {
+	o.operations = append(o.operations, name+" started")
+	return ctx, func(err error) {
+		o.operations = append(o.operations, name+" done")
+	}
+}
+
+func TestAwsClients_Retries(t *testing.T) {
+	assert := assert.New(t)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"Cluster": {"Id": "j-123", "Status": {"State": "WAITING"}}}`))
+	}))
+	defer server.Close()
+
+	observer := &requestsObserver{retries: make(map[string]int)}
+	clients := NewAwsClients(server.URL)
+	clients.Observers = Observers{observer}
+	svc, err := clients.EMR("eu-west-1", &CredentialsRecord{AccessKeyId: "access", SecretAccessKey: "secret"})
+	assert.Nil(err)
+	_, err = svc.DescribeCluster(&emr.DescribeClusterInput{ClusterId: aws.String("j-123")})
+	assert.Nil(err)
+	assert.Equal(2, requests)
+	assert.Equal(map[string]int{"elasticmapreduce.DescribeCluster": 1}, observer.retries)
+	// requests are a single operation no matter how many times they're retried
+	assert.Equal([]string{"emr.DescribeCluster started", "emr.DescribeCluster done"}, observer.operations)
+}
+
+func TestAwsClients_DebugLogs(t *testing.T) {
+	assert := assert.New(t)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"Cluster": {"Id": "j-123", "Status": {"State": "WAITING"}}}`))
+	}))
+	defer server.Close()
+
+	var buffer bytes.Buffer
+	log.SetOutput(&buffer)
+	log.SetLevel(log.DebugLevel)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetLevel(log.InfoLevel)
+	}()
+
+	clients := NewAwsClients(server.URL)
+	clients.Debug = true
+	svc, err := clients.EMR("eu-west-1", &CredentialsRecord{AccessKeyId: "access", SecretAccessKey: "secret"})
+	assert.Nil(err)
+	_, err = svc.DescribeCluster(&emr.DescribeClusterInput{ClusterId: aws.String("j-123")})
+	assert.Nil(err)
+
+	// every attempt is logged without the headers and body of the request
+	logs := buffer.String()
+	assert.Equal(2, strings.Count(logs, "Sending AWS request"))
+	assert.Contains(logs, "AWS request attempt failed")
+	assert.Contains(logs, "status=503")
+	assert.Contains(logs, "AWS request done")
+	assert.Contains(logs, "operation=DescribeCluster retries=1 service=emr status=200")
+	assert.NotContains(logs, "Authorization")
+	assert.NotContains(logs, "Credential=access")
+	assert.NotContains(logs, "j-123")
+}
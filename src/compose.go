@@ -0,0 +1,500 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	extendsKey  = "extends"
+	includeKey  = "include"
+	profilesKey = "profiles"
+	// replaceKey is the only field of an object replacing the value merged so far, e.g. a list
+	// which would be merged element by element otherwise
+	replaceKey = "$replace"
+	// profileVar is the template variable holding the active profile
+	profileVar = "profile"
+)
+
+// listMergeKeys are the fields identifying the elements of lists which are merged rather than
+// replaced: steps and bootstrap actions by name, tags by key and configurations by classification
+var listMergeKeys = []string{"name", "key", "classification"}
+
+// composer renders a config along with the configs it extends and includes. A config extends at
+// most one base config and includes any number of fragments, they are merged in this order and
+// the config itself is merged last. Paths and URLs are relative to the including config.
+type composer struct {
+	loader      *ConfigLoader
+	variables   map[string]interface{}
+	funcs       template.FuncMap
+	visiting    map[string]bool
+	sources     []string
+	usesSecrets bool
+	usedVars    map[string]bool
+	// depth is the number of configs being composed which reference the one being rendered
+	depth int
+	// lines are the source lines of the fields of the root config indexed by JSON pointer
+	lines map[string]int
+}
+
+// newComposer builds a composer rendering templates with additional functions
+func newComposer(loader *ConfigLoader, variables map[string]interface{}, funcs template.FuncMap) *composer {
+	return &composer{
+		loader:    loader,
+		variables: variables,
+		funcs:     funcs,
+		visiting:  make(map[string]bool),
+		usedVars:  make(map[string]bool),
+	}
+}
+
+// ConfigVariables lists the top-level variables referenced by a config file and by the configs it
+// extends or includes
+func ConfigVariables(location string, variables map[string]interface{}) ([]string, error) {
+	rawBytes, err := defaultConfigLoader.Load(location)
+	if err != nil {
+		return nil, err
+	}
+
+	c := newComposer(defaultConfigLoader, variables, placeholderSecretFuncs)
+	if _, err := c.composeRoot(rawBytes, location, configName(location)); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name := range c.usedVars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// composeRoot renders the config the user specified, location is empty if it wasn't loaded in
+// which case relative paths are resolved from the working directory
+func (c *composer) composeRoot(rawBytes []byte, location, templateName string) ([]byte, error) {
+	if location != "" {
+		key, err := configKey(location)
+		if err != nil {
+			return nil, err
+		}
+		c.visiting[key] = true
+	}
+	jsonBytes, err := c.compose(rawBytes, location, templateName)
+	if err != nil {
+		return nil, err
+	}
+	if location != "" {
+		c.loader.setSources(location, c.sources)
+	}
+	profile, _ := c.variables[profileVar].(string)
+	jsonBytes, err = applyProfile(jsonBytes, profile, sourceName(location, templateName))
+	if err != nil {
+		return nil, err
+	}
+	return resolveReplaces(jsonBytes)
+}
+
+// applyProfile merges the overrides of the active profile, found in the profiles object of the
+// composed config, on top of the config. Configs without profiles are left untouched whatever the
+// active profile.
+func applyProfile(jsonBytes []byte, profile, source string) ([]byte, error) {
+	document, err := decodeJSONObject(jsonBytes)
+	if err != nil || document[profilesKey] == nil {
+		return jsonBytes, nil
+	}
+	profiles, ok := document[profilesKey].(map[string]interface{})
+	if !ok {
+		return nil, errors.New(profilesKey + " must be an object of profile names to overrides")
+	}
+	delete(document, profilesKey)
+	if profile == "" {
+		return json.Marshal(document)
+	}
+
+	overrides, ok := profiles[profile]
+	if !ok {
+		var names []string
+		for name := range profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, errors.New("profile " + profile + " is not defined, defined profiles are " +
+			strings.Join(names, ","))
+	}
+	if _, ok := overrides.(map[string]interface{}); !ok {
+		return nil, errors.New("the overrides of profile " + profile + " must be an object")
+	}
+	err = checkMergeKeys(document, "")
+	if err == nil {
+		err = checkMergeKeys(overrides, "/"+profilesKey+"/"+escapeJSONPointer(profile))
+	}
+	if err != nil {
+		return nil, errors.New("config " + source + " " + err.Error())
+	}
+	return json.Marshal(mergeConfigValues(document, overrides))
+}
+
+// resolveReplaces replaces the objects holding the replace directive with their value once every
+// config is merged
+func resolveReplaces(jsonBytes []byte) ([]byte, error) {
+	if !bytes.Contains(jsonBytes, []byte(replaceKey)) {
+		return jsonBytes, nil
+	}
+	document, err := decodeJSONObject(jsonBytes)
+	if err != nil {
+		// left for the record parsing to report
+		return jsonBytes, nil
+	}
+	return json.Marshal(stripReplaces(document))
+}
+
+// sourceName names a config in error messages, configs which weren't loaded are named after
+// their template
+func sourceName(location, templateName string) string {
+	if location == "" {
+		return templateName
+	}
+	return location
+}
+
+// compose renders a config and merges it on top of the configs it references, configs which
+// don't reference any other config are returned as rendered
+func (c *composer) compose(rawBytes []byte, location, templateName string) ([]byte, error) {
+	templateBytes, templateLines, err := templateWithSourceLines(rawBytes, c.variables, templateName, c.funcs)
+	if err != nil {
+		return nil, err
+	}
+	format := configFormat(templateName, templateBytes)
+	jsonBytes, err := toJSON(templateBytes, format)
+	if err != nil {
+		return nil, err
+	}
+
+	variables, err := TemplateVariables(rawBytes, templateName)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range variables {
+		c.usedVars[name] = true
+	}
+	if usesSecrets(rawBytes, templateName) {
+		c.usesSecrets = true
+	}
+
+	document, err := decodeJSONObject(jsonBytes)
+	if err != nil {
+		// left for the record parsing to report
+		return jsonBytes, nil
+	}
+	refs, err := composedConfigs(document)
+	if err != nil || len(refs) == 0 {
+		// the fields of a composed config don't necessarily come from the root one so lines are
+		// only known for standalone configs
+		if c.depth == 0 && err == nil {
+			c.lines = sourceLines(templateBytes, format)
+			// point at the lines of the template rather than the ones of its output
+			for pointer, line := range c.lines {
+				if line > 0 && line <= len(templateLines) {
+					c.lines[pointer] = templateLines[line-1]
+				}
+			}
+		}
+		if err == nil && c.depth > 0 {
+			err = checkConfigMergeKeys(document, location, templateName)
+		}
+		return jsonBytes, err
+	}
+	if err := checkConfigMergeKeys(document, location, templateName); err != nil {
+		return nil, err
+	}
+
+	var merged interface{} = map[string]interface{}{}
+	for _, ref := range refs {
+		base, err := c.composeRef(resolveConfigLocation(location, ref))
+		if err != nil {
+			return nil, err
+		}
+		merged = mergeConfigValues(merged, base)
+	}
+	delete(document, extendsKey)
+	delete(document, includeKey)
+	return json.Marshal(mergeConfigValues(merged, document))
+}
+
+// composeRef renders a config referenced by another one
+func (c *composer) composeRef(location string) (map[string]interface{}, error) {
+	key, err := configKey(location)
+	if err != nil {
+		return nil, err
+	}
+	if c.visiting[key] {
+		return nil, errors.New("config " + location + " extends or includes itself")
+	}
+	c.visiting[key] = true
+	c.depth++
+	defer func() {
+		delete(c.visiting, key)
+		c.depth--
+	}()
+
+	rawBytes, err := c.loader.Load(location)
+	if err != nil {
+		return nil, err
+	}
+	c.addSource(location)
+	jsonBytes, err := c.compose(rawBytes, location, configName(location))
+	if err != nil {
+		return nil, err
+	}
+	document, err := decodeJSONObject(jsonBytes)
+	if err != nil {
+		return nil, errors.New("config " + location + " is not an object: " + err.Error())
+	}
+	return document, nil
+}
+
+// addSource records a config referenced by the one being composed, once however many times it is
+// referenced
+func (c *composer) addSource(location string) {
+	for _, source := range c.sources {
+		if source == location {
+			return
+		}
+	}
+	c.sources = append(c.sources, location)
+}
+
+// composedConfigs lists the configs extended then included by a config
+func composedConfigs(document map[string]interface{}) ([]string, error) {
+	var refs []string
+	switch extends := document[extendsKey].(type) {
+	case nil:
+	case string:
+		refs = append(refs, extends)
+	default:
+		return nil, errors.New(extendsKey + " must be the path of a config")
+	}
+
+	switch include := document[includeKey].(type) {
+	case nil:
+	case string:
+		refs = append(refs, include)
+	case []interface{}:
+		for _, ref := range include {
+			s, ok := ref.(string)
+			if !ok {
+				return nil, errors.New(includeKey + " must be a path or a list of paths of configs")
+			}
+			refs = append(refs, s)
+		}
+	default:
+		return nil, errors.New(includeKey + " must be a path or a list of paths of configs")
+	}
+	return refs, nil
+}
+
+// decodeJSONObject decodes a JSON object, numbers being kept as is
+func decodeJSONObject(jsonBytes []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(jsonBytes))
+	decoder.UseNumber()
+
+	var document map[string]interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+	if document == nil {
+		return nil, errors.New("expected an object")
+	}
+	return document, nil
+}
+
+// checkConfigMergeKeys rejects a config which is merged with others if one of its lists holds
+// several elements with the same identifier
+func checkConfigMergeKeys(document map[string]interface{}, location, templateName string) error {
+	if err := checkMergeKeys(document, ""); err != nil {
+		return errors.New("config " + sourceName(location, templateName) + " " + err.Error())
+	}
+	return nil
+}
+
+// checkMergeKeys checks that the elements of the lists identified by one of listMergeKeys are
+// unique, an overlay couldn't tell which one to merge into otherwise
+func checkMergeKeys(value interface{}, pointer string) error {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if err := checkMergeKeys(v[k], pointer+"/"+escapeJSONPointer(k)); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if key := listMergeKey(v, v); key != "" {
+			seen := make(map[string]bool, len(v))
+			for _, elem := range v {
+				id := elem.(map[string]interface{})[key].(string)
+				if seen[id] {
+					return errors.New("has several elements with " + key + " " + strconv.Quote(id) +
+						" in " + pointer + ", they must be unique to be merged with other configs")
+				}
+				seen[id] = true
+			}
+		}
+		for i, elem := range v {
+			if err := checkMergeKeys(elem, pointer+"/"+strconv.Itoa(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replacement returns the value of an object holding the replace directive only
+func replacement(value interface{}) (interface{}, bool) {
+	obj, ok := value.(map[string]interface{})
+	if !ok || len(obj) != 1 {
+		return nil, false
+	}
+	v, ok := obj[replaceKey]
+	return v, ok
+}
+
+// stripReplaces replaces the objects holding the replace directive with their value
+func stripReplaces(value interface{}) interface{} {
+	if v, ok := replacement(value); ok {
+		return stripReplaces(v)
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		stripped := make(map[string]interface{}, len(v))
+		for k, elem := range v {
+			stripped[k] = stripReplaces(elem)
+		}
+		return stripped
+	case []interface{}:
+		stripped := make([]interface{}, len(v))
+		for i, elem := range v {
+			stripped[i] = stripReplaces(elem)
+		}
+		return stripped
+	default:
+		return value
+	}
+}
+
+// mergeConfigValues deep merges overlay on top of base. Objects are merged key by key, lists of
+// objects identified by one of listMergeKeys are merged element by element and any other value,
+// including an empty list, replaces the base one. An object holding the replace directive
+// replaces the base value whatever it is, the values merged on top of it being merged into its
+// value until the directive is resolved.
+func mergeConfigValues(base, overlay interface{}) interface{} {
+	if _, ok := replacement(overlay); ok {
+		return overlay
+	}
+	if b, ok := replacement(base); ok {
+		return map[string]interface{}{replaceKey: mergeConfigValues(b, overlay)}
+	}
+
+	switch o := overlay.(type) {
+	case map[string]interface{}:
+		b, ok := base.(map[string]interface{})
+		if !ok {
+			return o
+		}
+		merged := make(map[string]interface{}, len(b)+len(o))
+		for k, v := range b {
+			merged[k] = v
+		}
+		for k, v := range o {
+			if bv, ok := merged[k]; ok {
+				merged[k] = mergeConfigValues(bv, v)
+			} else {
+				merged[k] = v
+			}
+		}
+		return merged
+	case []interface{}:
+		b, ok := base.([]interface{})
+		if !ok {
+			return o
+		}
+		return mergeConfigLists(b, o)
+	default:
+		return overlay
+	}
+}
+
+// mergeConfigLists merges the elements of two lists sharing the same identifying field, elements
+// of the overlay which aren't in the base are appended. Other lists are replaced.
+func mergeConfigLists(base, overlay []interface{}) []interface{} {
+	key := listMergeKey(base, overlay)
+	if key == "" {
+		return overlay
+	}
+
+	merged := make([]interface{}, len(base))
+	copy(merged, base)
+	indexes := make(map[string]int)
+	for i, elem := range merged {
+		indexes[elem.(map[string]interface{})[key].(string)] = i
+	}
+	for _, elem := range overlay {
+		id := elem.(map[string]interface{})[key].(string)
+		if i, ok := indexes[id]; ok {
+			merged[i] = mergeConfigValues(merged[i], elem)
+		} else {
+			indexes[id] = len(merged)
+			merged = append(merged, elem)
+		}
+	}
+	return merged
+}
+
+// listMergeKey finds the field identifying all the elements of both lists, empty if there is none
+func listMergeKey(base, overlay []interface{}) string {
+	if len(base) == 0 || len(overlay) == 0 {
+		return ""
+	}
+	for _, key := range listMergeKeys {
+		if identifiedBy(base, key) && identifiedBy(overlay, key) {
+			return key
+		}
+	}
+	return ""
+}
+
+// identifiedBy checks whether or not all the elements of a list are objects with a string field
+func identifiedBy(list []interface{}, key string) bool {
+	for _, elem := range list {
+		obj, ok := elem.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if _, ok := obj[key].(string); !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,260 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const basePlaybook = `{
+  "schema": "iglu:com.snowplowanalytics.dataflowrunner/PlaybookConfig/avro/1-0-1",
+  "data": {
+    "region": "us-east-1",
+    "credentials": {"accessKeyId": "env", "secretAccessKey": "env"},
+    "steps": [
+      {"type": "CUSTOM_JAR", "name": "Copy", "actionOnFailure": "CANCEL_AND_WAIT", "jar": "copy.jar", "arguments": ["--src", "{{.src}}"]},
+      {"type": "CUSTOM_JAR", "name": "Enrich", "actionOnFailure": "CANCEL_AND_WAIT", "jar": "enrich.jar", "arguments": ["--dev"]}
+    ],
+    "tags": [{"key": "team", "value": "data"}, {"key": "environment", "value": "dev"}]
+  }
+}`
+
+const fragmentPlaybook = `data:
+  steps:
+    - type: CUSTOM_JAR
+      name: Load
+      actionOnFailure: CONTINUE
+      jar: load.jar
+      arguments: []
+`
+
+const prodPlaybook = `{
+  "extends": "base/playbook.json",
+  "include": ["base/fragment.yml"],
+  "data": {
+    "region": "eu-west-1",
+    "steps": [{"name": "Enrich", "arguments": ["--prod"]}],
+    "tags": [{"key": "environment", "value": "prod"}]
+  }
+}`
+
+func writeConfigFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParsePlaybookRecordFromFile_Compose(t *testing.T) {
+	assert := assert.New(t)
+	ar, _ := InitConfigResolver()
+
+	dir, _ := ioutil.TempDir("", "test-compose")
+	defer os.RemoveAll(dir)
+	writeConfigFile(t, dir, "base/playbook.json", basePlaybook)
+	writeConfigFile(t, dir, "base/fragment.yml", fragmentPlaybook)
+	prod := writeConfigFile(t, dir, "prod.json", prodPlaybook)
+
+	res, err := ar.ParsePlaybookRecordFromFile(prod, map[string]interface{}{"src": "s3://bucket/"})
+	assert.Nil(err)
+	assert.NotNil(res)
+	assert.Equal("eu-west-1", res.Region)
+	assert.Equal("env", res.Credentials.AccessKeyId)
+
+	assert.Equal(3, len(res.Steps))
+	assert.Equal("Copy", res.Steps[0].Name)
+	assert.Equal([]string{"--src", "s3://bucket/"}, res.Steps[0].Arguments)
+	assert.Equal("Enrich", res.Steps[1].Name)
+	assert.Equal("enrich.jar", res.Steps[1].Jar)
+	assert.Equal([]string{"--prod"}, res.Steps[1].Arguments)
+	assert.Equal("Load", res.Steps[2].Name)
+
+	assert.Equal(2, len(res.Tags))
+	assert.Equal("team", res.Tags[0].Key)
+	assert.Equal("prod", res.Tags[1].Value)
+
+	variables, err := ConfigVariables(prod, map[string]interface{}{"src": "s3://bucket/"})
+	assert.Nil(err)
+	assert.Equal([]string{"src"}, variables)
+
+	// a missing base config
+	missing := writeConfigFile(t, dir, "missing.json", `{"extends": "nope.json", "data": {}}`)
+	_, err = ar.ParsePlaybookRecordFromFile(missing, nil)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "nope.json")
+
+	// configs including themselves
+	writeConfigFile(t, dir, "a.json", `{"include": "b.json"}`)
+	cyclic := writeConfigFile(t, dir, "b.json", `{"extends": "a.json"}`)
+	_, err = ar.ParsePlaybookRecordFromFile(cyclic, nil)
+	assert.NotNil(err)
+	assert.Equal("config "+cyclic+" extends or includes itself", err.Error())
+
+	invalid := writeConfigFile(t, dir, "invalid.json", `{"include": [1]}`)
+	_, err = ar.ParsePlaybookRecordFromFile(invalid, nil)
+	assert.NotNil(err)
+	assert.Equal("include must be a path or a list of paths of configs", err.Error())
+}
+
+func TestMergeConfigValues(t *testing.T) {
+	assert := assert.New(t)
+
+	decode := func(s string) interface{} {
+		var v interface{}
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	// objects are merged, scalars replaced
+	assert.Equal(decode(`{"a": {"b": 1, "c": 3}, "d": "e"}`),
+		mergeConfigValues(decode(`{"a": {"b": 1, "c": 2}, "d": "d"}`), decode(`{"a": {"c": 3}, "d": "e"}`)))
+
+	// lists of configurations are merged by classification
+	assert.Equal(decode(`[{"classification": "spark", "properties": {"a": "1", "b": "3"}}, {"classification": "hive"}]`),
+		mergeConfigValues(decode(`[{"classification": "spark", "properties": {"a": "1", "b": "2"}}]`),
+			decode(`[{"classification": "hive"}, {"classification": "spark", "properties": {"b": "3"}}]`)))
+
+	// other lists are replaced, including empty ones
+	assert.Equal(decode(`["c"]`), mergeConfigValues(decode(`["a", "b"]`), decode(`["c"]`)))
+	assert.Equal(decode(`[]`), mergeConfigValues(decode(`[{"name": "a"}]`), decode(`[]`)))
+	assert.Equal(decode(`[{"key": "b"}]`), mergeConfigValues(decode(`[{"name": "a"}]`), decode(`[{"key": "b"}]`)))
+	assert.Equal(decode(`{"a": 1}`), mergeConfigValues(decode(`[1]`), decode(`{"a": 1}`)))
+
+	// the replace directive replaces lists which would be merged otherwise, values merged on top
+	// of it being merged into its value
+	replaced := mergeConfigValues(decode(`{"l": [{"name": "a"}, {"name": "b"}]}`),
+		decode(`{"l": {"$replace": [{"name": "b", "v": 1}]}}`))
+	assert.Equal(decode(`{"l": {"$replace": [{"name": "b", "v": 1}]}}`), replaced)
+	replaced = mergeConfigValues(replaced, decode(`{"l": [{"name": "b", "v": 2}, {"name": "c"}]}`))
+	assert.Equal(decode(`{"l": [{"name": "b", "v": 2}, {"name": "c"}]}`), stripReplaces(replaced))
+}
+
+func TestParsePlaybookRecordFromFile_ComposeLists(t *testing.T) {
+	assert := assert.New(t)
+	ar, _ := InitConfigResolver()
+
+	dir, _ := ioutil.TempDir("", "test-compose-lists")
+	defer os.RemoveAll(dir)
+	writeConfigFile(t, dir, "base/playbook.json", basePlaybook)
+	writeConfigFile(t, dir, "base/fragment.yml", fragmentPlaybook)
+
+	// lists are replaced rather than merged with the replace directive
+	replacing := writeConfigFile(t, dir, "replacing.yml", `extends: base/playbook.json
+data:
+  steps:
+    $replace:
+      - type: CUSTOM_JAR
+        name: Load
+        actionOnFailure: CONTINUE
+        jar: load.jar
+        arguments: []
+`)
+	res, err := ar.ParsePlaybookRecordFromFile(replacing, map[string]interface{}{"src": "s3://bucket/"})
+	assert.Nil(err)
+	assert.Equal(1, len(res.Steps))
+	assert.Equal("Load", res.Steps[0].Name)
+	assert.Equal(2, len(res.Tags))
+
+	// configs replaced by the ones including them still merge into the replaced list
+	writeConfigFile(t, dir, "base/replaced.yml", `data:
+  steps:
+    $replace: []
+`)
+	merging := writeConfigFile(t, dir, "merging.json", `{
+  "extends": "base/playbook.json",
+  "include": ["base/replaced.yml", "base/fragment.yml"]
+}`)
+	res, err = ar.ParsePlaybookRecordFromFile(merging, map[string]interface{}{"src": "s3://bucket/"})
+	assert.Nil(err)
+	assert.Equal(1, len(res.Steps))
+	assert.Equal("Load", res.Steps[0].Name)
+
+	// elements of merged lists must be unique, whether they are in the base or the overlay
+	writeConfigFile(t, dir, "base/duplicated.json", `{"data": {"steps": [{"name": "Copy"}, {"name": "Copy"}]}}`)
+	duplicatedBase := writeConfigFile(t, dir, "duplicated-base.json", `{
+  "extends": "base/duplicated.json",
+  "data": {"steps": [{"name": "Copy", "arguments": []}]}
+}`)
+	_, err = ar.ParsePlaybookRecordFromFile(duplicatedBase, nil)
+	assert.NotNil(err)
+	assert.Equal("config "+filepath.Join(dir, "base/duplicated.json")+" has several elements with "+
+		`name "Copy" in /data/steps, they must be unique to be merged with other configs`, err.Error())
+
+	duplicatedOverlay := writeConfigFile(t, dir, "duplicated-overlay.json", `{
+  "extends": "base/playbook.json",
+  "data": {"tags": [{"key": "team", "value": "a"}, {"key": "team", "value": "b"}]}
+}`)
+	_, err = ar.ParsePlaybookRecordFromFile(duplicatedOverlay, nil)
+	assert.NotNil(err)
+	assert.Equal("config "+duplicatedOverlay+" has several elements with key \"team\" in /data/tags, "+
+		"they must be unique to be merged with other configs", err.Error())
+}
+
+func TestParsePlaybookRecord_Profiles(t *testing.T) {
+	assert := assert.New(t)
+	ar, _ := InitConfigResolver()
+
+	playbook := `{
+  "schema": "iglu:com.snowplowanalytics.dataflowrunner/PlaybookConfig/avro/1-0-1",
+  "data": {
+    "region": "us-east-1",
+    "credentials": {"accessKeyId": "env", "secretAccessKey": "env"},
+    "steps": [
+      {"type": "CUSTOM_JAR", "name": "Copy", "actionOnFailure": "CANCEL_AND_WAIT", "jar": "copy.jar", "arguments": ["--profile", "{{.profile}}"]}
+    ],
+    "tags": [{"key": "environment", "value": "dev"}]
+  },
+  "profiles": {
+    "prod": {"data": {"region": "eu-west-1", "tags": [{"key": "environment", "value": "prod"}]}},
+    "staging": {"data": {"tags": [{"key": "environment", "value": "staging"}]}}
+  }
+}`
+
+	res, err := ar.ParsePlaybookRecord([]byte(playbook), map[string]interface{}{profileVar: ""}, "")
+	assert.Nil(err)
+	assert.Equal("us-east-1", res.Region)
+	assert.Equal("dev", res.Tags[0].Value)
+
+	res, err = ar.ParsePlaybookRecord([]byte(playbook), map[string]interface{}{profileVar: "prod"}, "")
+	assert.Nil(err)
+	assert.Equal("eu-west-1", res.Region)
+	assert.Equal(1, len(res.Tags))
+	assert.Equal("prod", res.Tags[0].Value)
+	assert.Equal([]string{"--profile", "prod"}, res.Steps[0].Arguments)
+
+	_, err = ar.ParsePlaybookRecord([]byte(playbook), map[string]interface{}{profileVar: "qa"}, "")
+	assert.NotNil(err)
+	assert.Equal("profile qa is not defined, defined profiles are prod,staging", err.Error())
+
+	// configs without profiles can be used with any profile
+	res, err = ar.ParsePlaybookRecord([]byte(PlaybookRecord1), map[string]interface{}{profileVar: "qa"}, "")
+	assert.Nil(err)
+	assert.Equal("us-east-1", res.Region)
+
+	_, err = ar.ParsePlaybookRecord([]byte(`{"profiles": []}`), nil, "")
+	assert.NotNil(err)
+	assert.Equal("profiles must be an object of profile names to overrides", err.Error())
+}
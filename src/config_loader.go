@@ -0,0 +1,301 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const (
+	// stdinConfig is the location of a config read from the standard input
+	stdinConfig = "-"
+	// defaultBucketRegion is the region used to look up the region of buckets when none is
+	// configured
+	defaultBucketRegion = "us-east-1"
+	// configHTTPTimeout bounds the download of a config from a HTTP(S) URL
+	configHTTPTimeout = 30 * time.Second
+)
+
+// defaultConfigLoader is shared so that remote configs and the standard input are only read once
+// per run
+var defaultConfigLoader = NewConfigLoader()
+
+// ConfigLoader reads configs from local files, S3 (s3://bucket/key), HTTP(S) URLs or the standard
+// input (-). A location can be pinned by appending #sha256=<hex digest> or, for S3 and HTTP(S),
+// #etag=<ETag>, in which case the content is rejected if it doesn't match.
+type ConfigLoader struct {
+	newS3  func(bucket string) (s3iface.S3API, error)
+	client *http.Client
+	stdin  io.Reader
+
+	mu    sync.Mutex
+	cache map[string]loadedConfig
+	// sources are the configs extended and included by the configs composed so far, indexed by
+	// the location of the composed config
+	sources map[string][]string
+}
+
+// loadedConfig is the content of a config along with its ETag if it is remote
+type loadedConfig struct {
+	content []byte
+	etag    string
+}
+
+// NewConfigLoader builds a ConfigLoader reading from S3 with the default credentials chain, like
+// the S3 lock does
+func NewConfigLoader() *ConfigLoader {
+	return &ConfigLoader{
+		newS3:   newS3ConfigClient,
+		client:  &http.Client{Timeout: configHTTPTimeout},
+		stdin:   os.Stdin,
+		cache:   make(map[string]loadedConfig),
+		sources: make(map[string][]string),
+	}
+}
+
+// UseHTTPClient downloads the HTTP(S) configs through the transport of client, e.g. the one built
+// by NewHTTPClient so that configs go through the same proxy and trust the same CA bundle as the
+// AWS requests, the downloads still timing out after configHTTPTimeout
+func (cl *ConfigLoader) UseHTTPClient(client *http.Client) {
+	cl.client = &http.Client{Transport: client.Transport, Timeout: configHTTPTimeout}
+}
+
+// newS3ConfigClient builds a S3 client for the region of a bucket
+func newS3ConfigClient(bucket string) (s3iface.S3API, error) {
+	sess, err := defaultAwsClients.DefaultSession()
+	if err != nil {
+		return nil, err
+	}
+	hint := aws.StringValue(sess.Config.Region)
+	if hint == "" {
+		hint = defaultBucketRegion
+	}
+	region, err := s3manager.GetBucketRegion(aws.BackgroundContext(), sess, bucket, hint)
+	if err != nil {
+		return nil, errors.New("couldn't find the region of bucket " + bucket + ": " + err.Error())
+	}
+	return s3.New(sess, &aws.Config{Region: aws.String(region)}), nil
+}
+
+// Load reads the config at a location, checking its pin if it has one
+func (cl *ConfigLoader) Load(location string) ([]byte, error) {
+	location, pinKind, pin, err := splitConfigPin(location)
+	if err != nil {
+		return nil, err
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	config, ok := cl.cache[location]
+	if !ok {
+		config.content, config.etag, err = cl.fetch(location)
+		if err != nil {
+			return nil, err
+		}
+		cl.cache[location] = config
+	}
+
+	switch pinKind {
+	case "sha256":
+		digest := sha256.Sum256(config.content)
+		if actual := hex.EncodeToString(digest[:]); !strings.EqualFold(actual, pin) {
+			return nil, errors.New("config " + location + " has a sha256 digest of " + actual +
+				", expected " + pin)
+		}
+	case "etag":
+		if config.etag == "" {
+			return nil, errors.New("config " + location + " has no ETag to check the pin against")
+		}
+		if strings.Trim(config.etag, `"`) != strings.Trim(pin, `"`) {
+			return nil, errors.New("config " + location + " has an ETag of " + config.etag +
+				", expected " + pin)
+		}
+	}
+	return config.content, nil
+}
+
+// Sources lists the locations of the configs extended and included, directly or not, by the
+// config at a location when it was last composed
+func (cl *ConfigLoader) Sources(location string) []string {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.sources[location]
+}
+
+// setSources records the configs extended and included by a composed config
+func (cl *ConfigLoader) setSources(location string, sources []string) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.sources[location] = sources
+}
+
+// fetch reads a config and returns its ETag if it is remote
+func (cl *ConfigLoader) fetch(location string) ([]byte, string, error) {
+	switch {
+	case location == stdinConfig:
+		content, err := ioutil.ReadAll(cl.stdin)
+		return content, "", err
+	case strings.HasPrefix(location, "s3://"):
+		return cl.fetchS3(location)
+	case strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://"):
+		return cl.fetchHTTP(location)
+	default:
+		content, err := ioutil.ReadFile(location)
+		return content, "", err
+	}
+}
+
+// fetchS3 downloads a config from S3
+func (cl *ConfigLoader) fetchS3(location string) ([]byte, string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, "", err
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, "", errors.New("invalid S3 location " + location + ", expected s3://bucket/key")
+	}
+
+	svc, err := cl.newS3(u.Host)
+	if err != nil {
+		return nil, "", err
+	}
+	out, err := svc.GetObject(&s3.GetObjectInput{Bucket: aws.String(u.Host), Key: aws.String(key)})
+	if err != nil {
+		return nil, "", errors.New("couldn't download config " + location + ": " + err.Error())
+	}
+	defer out.Body.Close()
+
+	content, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return content, aws.StringValue(out.ETag), nil
+}
+
+// fetchHTTP downloads a config from a HTTP(S) URL
+func (cl *ConfigLoader) fetchHTTP(location string) ([]byte, string, error) {
+	resp, err := cl.client.Get(location)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", errors.New("couldn't download config " + location + ": HTTP status " +
+			strconv.Itoa(resp.StatusCode))
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return content, resp.Header.Get("ETag"), nil
+}
+
+// splitConfigPin separates a location from its #sha256= or #etag= pin, locations without such a
+// suffix aren't pinned
+func splitConfigPin(location string) (string, string, string, error) {
+	i := strings.LastIndex(location, "#")
+	if i < 0 {
+		return location, "", "", nil
+	}
+	kv := strings.SplitN(location[i+1:], "=", 2)
+	if len(kv) != 2 || (kv[0] != "sha256" && kv[0] != "etag") {
+		return location, "", "", nil
+	}
+	if kv[1] == "" {
+		return "", "", "", errors.New("empty " + kv[0] + " pin in config location " + location)
+	}
+	return location[:i], kv[0], kv[1], nil
+}
+
+// isRemoteConfig checks whether or not a config location is a S3 or HTTP(S) URL
+func isRemoteConfig(location string) bool {
+	return strings.HasPrefix(location, "s3://") || strings.HasPrefix(location, "http://") ||
+		strings.HasPrefix(location, "https://")
+}
+
+// resolveConfigLocation resolves the location of a config referenced by another one, relative
+// references being resolved from the directory of the referencing config. Configs read from the
+// standard input or from memory resolve them from the working directory.
+func resolveConfigLocation(base, ref string) string {
+	if isRemoteConfig(ref) || filepath.IsAbs(ref) {
+		return ref
+	}
+	if isRemoteConfig(base) {
+		base, _, _, _ = splitConfigPin(base)
+		u, err := url.Parse(base)
+		if err != nil {
+			return ref
+		}
+		// the pin of the reference is kept out of the path so that it isn't escaped
+		pin := ""
+		if i := strings.LastIndex(ref, "#"); i >= 0 {
+			ref, pin = ref[:i], ref[i:]
+		}
+		u.Path = path.Join(path.Dir(u.Path), ref)
+		u.RawPath = ""
+		u.RawQuery = ""
+		return u.String() + pin
+	}
+	if base == "" || base == stdinConfig {
+		return ref
+	}
+	return filepath.Join(filepath.Dir(base), ref)
+}
+
+// configName is the name of the template of a config, used for error messages and to determine
+// the format of the config from its extension
+func configName(location string) string {
+	location, _, _, _ = splitConfigPin(location)
+	switch {
+	case location == stdinConfig:
+		return "stdin"
+	case isRemoteConfig(location):
+		u, err := url.Parse(location)
+		if err != nil {
+			return location
+		}
+		return path.Base(u.Path)
+	default:
+		return filepath.Base(location)
+	}
+}
+
+// configKey identifies a config to detect the ones which reference themselves
+func configKey(location string) (string, error) {
+	location, _, _, _ = splitConfigPin(location)
+	if location == stdinConfig || isRemoteConfig(location) {
+		return location, nil
+	}
+	return filepath.Abs(location)
+}
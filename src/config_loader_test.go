@@ -0,0 +1,206 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockS3APIConfig struct {
+	s3iface.S3API
+	objects map[string]string
+	calls   int
+}
+
+func (m *mockS3APIConfig) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	m.calls++
+	content, ok := m.objects[*input.Bucket+"/"+*input.Key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	return &s3.GetObjectOutput{
+		Body: ioutil.NopCloser(strings.NewReader(content)),
+		ETag: aws.String(`"etag-` + *input.Key + `"`),
+	}, nil
+}
+
+func mockConfigLoader(svc *mockS3APIConfig, stdin string) *ConfigLoader {
+	cl := NewConfigLoader()
+	cl.newS3 = func(bucket string) (s3iface.S3API, error) {
+		return svc, nil
+	}
+	cl.stdin = bytes.NewReader([]byte(stdin))
+	return cl
+}
+
+func TestConfigLoader(t *testing.T) {
+	assert := assert.New(t)
+
+	svc := &mockS3APIConfig{objects: map[string]string{"bucket/configs/playbook.json": "{}"}}
+	cl := mockConfigLoader(svc, "stdin content")
+
+	// S3 objects are only downloaded once
+	content, err := cl.Load("s3://bucket/configs/playbook.json")
+	assert.Nil(err)
+	assert.Equal("{}", string(content))
+	content, err = cl.Load("s3://bucket/configs/playbook.json#etag=etag-configs/playbook.json")
+	assert.Nil(err)
+	assert.Equal("{}", string(content))
+	assert.Equal(1, svc.calls)
+
+	_, err = cl.Load("s3://bucket/configs/playbook.json#etag=other")
+	assert.NotNil(err)
+	assert.Equal(`config s3://bucket/configs/playbook.json has an ETag of "etag-configs/playbook.json", expected other`,
+		err.Error())
+
+	_, err = cl.Load("s3://bucket/missing.json")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "couldn't download config s3://bucket/missing.json: NoSuchKey")
+
+	_, err = cl.Load("s3://bucket")
+	assert.NotNil(err)
+	assert.Equal("invalid S3 location s3://bucket, expected s3://bucket/key", err.Error())
+
+	// the standard input can be read several times
+	for i := 0; i < 2; i++ {
+		content, err = cl.Load(stdinConfig)
+		assert.Nil(err)
+		assert.Equal("stdin content", string(content))
+	}
+
+	digest := sha256.Sum256([]byte("stdin content"))
+	_, err = cl.Load(stdinConfig + "#sha256=" + hex.EncodeToString(digest[:]))
+	assert.Nil(err)
+	_, err = cl.Load(stdinConfig + "#sha256=abc")
+	assert.NotNil(err)
+	assert.Equal("config - has a sha256 digest of "+hex.EncodeToString(digest[:])+", expected abc",
+		err.Error())
+	_, err = cl.Load(stdinConfig + "#etag=abc")
+	assert.NotNil(err)
+	assert.Equal("config - has no ETag to check the pin against", err.Error())
+	_, err = cl.Load(stdinConfig + "#sha256=")
+	assert.NotNil(err)
+	assert.Equal("empty sha256 pin in config location -#sha256=", err.Error())
+
+	// HTTP resources
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/configs/playbook.json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	content, err = cl.Load(server.URL + "/configs/playbook.json#etag=v1")
+	assert.Nil(err)
+	assert.Equal("{}", string(content))
+
+	_, err = cl.Load(server.URL + "/missing.json")
+	assert.NotNil(err)
+	assert.Equal("couldn't download config "+server.URL+"/missing.json: HTTP status 404", err.Error())
+}
+
+func TestConfigLoader_HTTPClient(t *testing.T) {
+	assert := assert.New(t)
+
+	cl := NewConfigLoader()
+	assert.Equal(configHTTPTimeout, cl.client.Timeout)
+
+	// configs are downloaded through the proxy of the AWS clients
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"proxied":"` + r.URL.String() + `"}`))
+	}))
+	defer proxy.Close()
+	httpClient, err := NewHTTPClient(proxy.URL, "")
+	assert.Nil(err)
+	cl.UseHTTPClient(httpClient)
+	assert.Equal(configHTTPTimeout, cl.client.Timeout)
+
+	content, err := cl.Load("http://example.invalid/playbook.json")
+	assert.Nil(err)
+	assert.Equal(`{"proxied":"http://example.invalid/playbook.json"}`, string(content))
+
+	// downloads don't hang on unresponsive servers
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	cl = NewConfigLoader()
+	cl.client.Timeout = 100 * time.Millisecond
+	_, err = cl.Load(server.URL + "/playbook.json")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "Client.Timeout exceeded")
+}
+
+func TestResolveConfigLocation(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("s3://bucket/base/cluster.json", resolveConfigLocation("s3://bucket/prod/cluster.json", "../base/cluster.json"))
+	assert.Equal("https://example.com/configs/base.json#sha256=abc",
+		resolveConfigLocation("https://example.com/configs/prod.json?v=1#etag=1", "base.json#sha256=abc"))
+	assert.Equal("s3://bucket/base.json", resolveConfigLocation("configs/prod.json", "s3://bucket/base.json"))
+	assert.Equal(filepath.Join("configs", "base.json"), resolveConfigLocation("configs/prod.json", "base.json"))
+	assert.Equal("base.json", resolveConfigLocation(stdinConfig, "base.json"))
+	assert.Equal("base.json", resolveConfigLocation("", "base.json"))
+
+	assert.Equal("cluster.yml", configName("s3://bucket/prod/cluster.yml#etag=1"))
+	assert.Equal("stdin", configName(stdinConfig))
+	assert.Equal("cluster.json", configName("prod/cluster.json"))
+}
+
+func TestParsePlaybookRecordFromFile_Remote(t *testing.T) {
+	assert := assert.New(t)
+	ar, _ := InitConfigResolver()
+
+	dir, _ := ioutil.TempDir("", "test-remote-config")
+	defer os.RemoveAll(dir)
+	writeConfigFile(t, dir, "fragment.yml", fragmentPlaybook)
+
+	svc := &mockS3APIConfig{objects: map[string]string{
+		"bucket/base/playbook.json": basePlaybook,
+	}}
+	ar.Loader = mockConfigLoader(svc, `{
+  "extends": "s3://bucket/base/playbook.json",
+  "include": "`+filepath.Join(dir, "fragment.yml")+`",
+  "data": {"region": "eu-west-1"}
+}`)
+
+	res, err := ar.ParsePlaybookRecordFromFile(stdinConfig, map[string]interface{}{"src": "s3://src/"})
+	assert.Nil(err)
+	assert.NotNil(res)
+	assert.Equal("eu-west-1", res.Region)
+	assert.Equal(3, len(res.Steps))
+	assert.Equal([]string{"--src", "s3://src/"}, res.Steps[0].Arguments)
+}
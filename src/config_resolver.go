@@ -22,10 +22,13 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"text/template"
+	"text/template/parse"
 	"time"
 
 	"github.com/elodina/go-avro"
+	"gopkg.in/yaml.v3"
 )
 
 const (
@@ -33,6 +36,12 @@ const (
 	playbookSchemaPath = "avro/playbook.avsc"
 )
 
+const (
+	configFormatJSON  = "json"
+	configFormatJSONC = "jsonc"
+	configFormatYAML  = "yaml"
+)
+
 var (
 	templFuncs = template.FuncMap{
 		"nowWithFormat": func(format string) string {
@@ -62,6 +71,20 @@ var (
 			}
 			return base64.StdEncoding.EncodeToString(content), nil
 		},
+		"dateAdd":      dateAdd,
+		"dateTrunc":    dateTrunc,
+		"dateRange":    dateRange,
+		"lower":        strings.ToLower,
+		"replace":      replaceAll,
+		"join":         joinList,
+		"split":        splitString,
+		"default":      defaultValue,
+		"required":     required,
+		"toJson":       toJSONString,
+		"uuid":         newUUID,
+		"sha256":       sha256Hex,
+		"fileContents": fileContents,
+		"env":          envOrDefault,
 	}
 )
 
@@ -82,50 +105,71 @@ func (sdr SelfDescribingRecord) GetDataByteArray() []byte {
 type ConfigResolver struct {
 	ClusterSchema  avro.Schema
 	PlaybookSchema avro.Schema
+	Secrets        *SecretResolver
+	Loader         *ConfigLoader
+	// Strict rejects records with fields their schema doesn't define
+	Strict bool
+	// schemas are the Avro schemas of every supported version indexed by asset path
+	schemas map[string]avro.Schema
 }
 
 // InitConfigResolver creates a new ConfigResolver instance
 func InitConfigResolver() (*ConfigResolver, error) {
-	var err error
-
-	// Load Schemas from bindata
-	clusterSchemaRaw, err := Asset(clusterSchemaPath)
-	if err != nil {
-		return nil, err
-	}
-	playbookSchemaRaw, err := Asset(playbookSchemaPath)
-	if err != nil {
-		return nil, err
-	}
-
-	// Parse and store schemas
-	clusterSchema, err := avro.ParseSchema(string(clusterSchemaRaw))
-	if err != nil {
-		return nil, err
-	}
-	playbookSchema, err := avro.ParseSchema(string(playbookSchemaRaw))
-	if err != nil {
-		return nil, err
+	// Load and parse the schemas of every supported version from bindata
+	schemas := make(map[string]avro.Schema)
+	for _, cs := range []configSchema{clusterConfigSchema, playbookConfigSchema} {
+		for _, asset := range cs.assets {
+			if _, ok := schemas[asset]; ok {
+				continue
+			}
+			schemaRaw, err := Asset(asset)
+			if err != nil {
+				return nil, err
+			}
+			schema, err := avro.ParseSchema(string(schemaRaw))
+			if err != nil {
+				return nil, err
+			}
+			schemas[asset] = schema
+		}
 	}
 
-	return &ConfigResolver{ClusterSchema: clusterSchema, PlaybookSchema: playbookSchema}, nil
+	return &ConfigResolver{
+		ClusterSchema:  schemas[clusterConfigSchema.assets[clusterConfigSchema.current]],
+		PlaybookSchema: schemas[playbookConfigSchema.assets[playbookConfigSchema.current]],
+		Secrets:        defaultSecretResolver,
+		Loader:         defaultConfigLoader,
+		schemas:        schemas,
+	}, nil
 }
 
 // --- Class
 
-// ParseClusterRecordFromFile attempts to parse a JSON file to a ClusterConfig
+// ParseClusterRecordFromFile attempts to parse a JSON file or URL to a ClusterConfig, along with the
+// configs it extends or includes
 func (cr ConfigResolver) ParseClusterRecordFromFile(filePath string, variables map[string]interface{}) (*ClusterConfig, error) {
-	jsonBytes, err := ioutil.ReadFile(filePath)
+	rendered, err := cr.renderFile(filePath, variables)
 	if err != nil {
 		return nil, err
 	}
 
-	return cr.ParseClusterRecord(jsonBytes, variables, filepath.Base(filePath))
+	return cr.decodeClusterRecord(rendered)
 }
 
-// ParseClusterRecord attempts to parse a JSON file to a ClusterConfig
+// ParseClusterRecord attempts to parse a JSON file to a ClusterConfig, invalid records being
+// reported as ValidationErrors
 func (cr ConfigResolver) ParseClusterRecord(jsonBytes []byte, variables map[string]interface{}, templateName string) (*ClusterConfig, error) {
-	sdr, err := toSelfDescribingRecord(jsonBytes, variables, templateName)
+	rendered, err := cr.render(jsonBytes, variables, "", templateName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cr.decodeClusterRecord(rendered)
+}
+
+// decodeClusterRecord validates a rendered config and decodes it to a ClusterConfig
+func (cr ConfigResolver) decodeClusterRecord(rendered *renderedConfig) (*ClusterConfig, error) {
+	sdr, err := cr.upgradeRecord(clusterConfigSchema, rendered)
 	if err != nil {
 		return nil, err
 	}
@@ -149,19 +193,31 @@ func (cr ConfigResolver) ParseClusterRecord(jsonBytes []byte, variables map[stri
 	return decodedRecord, nil
 }
 
-// ParsePlaybookRecordFromFile attempts to parse a JSON file to a PlaybookConfig
+// ParsePlaybookRecordFromFile attempts to parse a JSON file or URL to a PlaybookConfig, along with the
+// configs it extends or includes
 func (cr ConfigResolver) ParsePlaybookRecordFromFile(filePath string, variables map[string]interface{}) (*PlaybookConfig, error) {
-	jsonBytes, err := ioutil.ReadFile(filePath)
+	rendered, err := cr.renderFile(filePath, variables)
 	if err != nil {
 		return nil, err
 	}
 
-	return cr.ParsePlaybookRecord(jsonBytes, variables, filepath.Base(filePath))
+	return cr.decodePlaybookRecord(rendered)
 }
 
-// ParsePlaybookRecord attempts to parse a JSON file to a PlaybookConfig
+// ParsePlaybookRecord attempts to parse a JSON file to a PlaybookConfig, invalid records being
+// reported as ValidationErrors
 func (cr ConfigResolver) ParsePlaybookRecord(jsonBytes []byte, variables map[string]interface{}, templateName string) (*PlaybookConfig, error) {
-	sdr, err := toSelfDescribingRecord(jsonBytes, variables, templateName)
+	rendered, err := cr.render(jsonBytes, variables, "", templateName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cr.decodePlaybookRecord(rendered)
+}
+
+// decodePlaybookRecord validates a rendered config and decodes it to a PlaybookConfig
+func (cr ConfigResolver) decodePlaybookRecord(rendered *renderedConfig) (*PlaybookConfig, error) {
+	sdr, err := cr.upgradeRecord(playbookConfigSchema, rendered)
 	if err != nil {
 		return nil, err
 	}
@@ -185,6 +241,51 @@ func (cr ConfigResolver) ParsePlaybookRecord(jsonBytes []byte, variables map[str
 	return decodedRecord, nil
 }
 
+// upgradeRecord parses a rendered record and checks that it has a supported version of its
+// schema. The record is validated against the Avro schema of this version, along with its unknown
+// fields in strict mode, and its data is upgraded to the current version.
+func (cr ConfigResolver) upgradeRecord(cs configSchema, rendered *renderedConfig) (*SelfDescribingRecord, error) {
+	sdr, err := parseSelfDescribingRecord(rendered.json)
+	if err != nil {
+		return nil, err
+	}
+	key, err := cs.resolve(sdr.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cr.validateRecord(cs.assets[key.Version], rendered); err != nil {
+		return nil, err
+	}
+	if err := cs.upgrade(key.Version, sdr.Data); err != nil {
+		return nil, err
+	}
+	return sdr, nil
+}
+
+// validateRecord checks a rendered record against the Avro schema at the given asset path,
+// returning every invalid field as ValidationErrors
+func (cr ConfigResolver) validateRecord(asset string, rendered *renderedConfig) error {
+	avsc, err := Asset(asset)
+	if err != nil {
+		return err
+	}
+	var avroSchema interface{}
+	if err := json.Unmarshal(avsc, &avroSchema); err != nil {
+		return err
+	}
+	record, err := decodeJSONObject(rendered.json)
+	if err != nil {
+		return err
+	}
+
+	errs := validateRecord(avroSchema, record, rendered.lines, cr.Strict)
+	if len(errs) > 0 {
+		return &ValidationErrors{Config: rendered.name, Errors: errs}
+	}
+	return nil
+}
+
 // --- Static
 
 // parseRecordAsJSON unmarshalles a byte array to an interface
@@ -204,7 +305,9 @@ func parseRecordAsAvro(schema avro.Schema, recordJSON interface{}, decodedRecord
 	buffer := new(bytes.Buffer)
 	encoder := avro.NewBinaryEncoder(buffer)
 
-	writer.Write(recordJSON, encoder)
+	if err := writer.Write(recordJSON, encoder); err != nil {
+		return err
+	}
 
 	// Read and decode record using Avro reader
 	reader := avro.NewSpecificDatumReader()
@@ -215,36 +318,451 @@ func parseRecordAsAvro(schema avro.Schema, recordJSON interface{}, decodedRecord
 	return reader.Read(decodedRecord, decoder)
 }
 
-// toSelfDescribingRecord takes a byte array and returns a SelfDescribingRecord
-func toSelfDescribingRecord(jsonBytes []byte, variables map[string]interface{}, templateName string) (*SelfDescribingRecord, error) {
-	templateBytes, err := templateRawBytes(jsonBytes, variables, templateName)
+// renderedConfig is a config rendered to JSON along with the source lines of its fields, which
+// are only known for configs which don't extend or include others
+type renderedConfig struct {
+	name  string
+	json  []byte
+	lines map[string]int
+}
+
+// Render templates a config and converts it to JSON, resolving the secrets it references and
+// merging the configs it extends or includes relatively to the working directory
+func (cr ConfigResolver) Render(rawBytes []byte, variables map[string]interface{}, templateName string) ([]byte, error) {
+	rendered, err := cr.render(rawBytes, variables, "", templateName)
+	if err != nil {
+		return nil, err
+	}
+	return rendered.json, nil
+}
+
+// RenderFile templates a config file, S3 object, HTTP(S) resource or the standard input (see
+// ConfigLoader) and converts it to JSON, resolving the secrets it references and merging the
+// configs it extends or includes relatively to its location
+func (cr ConfigResolver) RenderFile(location string, variables map[string]interface{}) ([]byte, error) {
+	rendered, err := cr.renderFile(location, variables)
+	if err != nil {
+		return nil, err
+	}
+	return rendered.json, nil
+}
+
+// renderFile loads and renders a config
+func (cr ConfigResolver) renderFile(location string, variables map[string]interface{}) (*renderedConfig, error) {
+	rawBytes, err := cr.Loader.Load(location)
+	if err != nil {
+		return nil, err
+	}
+	rendered, err := cr.render(rawBytes, variables, location, configName(location))
+	if err != nil {
+		return nil, err
+	}
+	// errors are reported with the location the user specified
+	rendered.name = location
+	return rendered, nil
+}
+
+// render composes a config, the secrets being resolved in a second pass once the region and
+// credentials of the composed config are known
+func (cr ConfigResolver) render(rawBytes []byte, variables map[string]interface{}, location, templateName string) (*renderedConfig, error) {
+	c := newComposer(cr.Loader, variables, placeholderSecretFuncs)
+	jsonBytes, err := c.composeRoot(rawBytes, location, templateName)
 	if err != nil {
 		return nil, err
 	}
+	if cr.Secrets == nil || !c.usesSecrets {
+		return &renderedConfig{name: templateName, json: jsonBytes, lines: c.lines}, nil
+	}
 
+	// the secrets are fetched with the region and credentials of the config itself
+	var config struct {
+		Data struct {
+			Region      string
+			Credentials *CredentialsRecord
+		}
+	}
+	if err := json.Unmarshal(jsonBytes, &config); err != nil {
+		return nil, err
+	}
+	secretFuncs := cr.Secrets.Funcs(config.Data.Region, config.Data.Credentials)
+	c = newComposer(cr.Loader, variables, secretFuncs)
+	jsonBytes, err = c.composeRoot(rawBytes, location, templateName)
+	if err != nil {
+		return nil, err
+	}
+	return &renderedConfig{name: templateName, json: jsonBytes, lines: c.lines}, nil
+}
+
+// parseSelfDescribingRecord unmarshals a SelfDescribingRecord
+func parseSelfDescribingRecord(jsonBytes []byte) (*SelfDescribingRecord, error) {
 	recordJSON := new(SelfDescribingRecord)
-	err1 := json.Unmarshal(templateBytes, &recordJSON)
-	if err1 != nil {
-		return nil, err1
+	err := json.Unmarshal(jsonBytes, &recordJSON)
+	if err != nil {
+		return nil, err
 	}
 
 	return recordJSON, nil
 }
 
-// templateRawBytes runs the raw config through the golang templater
-func templateRawBytes(rawBytes []byte, variables map[string]interface{}, templateName string) ([]byte, error) {
+// templateRawBytesWithFuncs runs the raw config through the golang templater with functions
+// complementing templFuncs
+func templateRawBytesWithFuncs(rawBytes []byte, variables map[string]interface{}, templateName string, funcs template.FuncMap) ([]byte, error) {
+	filled, _, err := templateWithSourceLines(rawBytes, variables, templateName, funcs)
+	return filled, err
+}
+
+// templateWithSourceLines runs the raw config through the golang templater like
+// templateRawBytesWithFuncs and also returns the line of the raw config each line of the output
+// comes from, the output of an action such as a multi-line toJson being attributed to the line of
+// the action
+func templateWithSourceLines(rawBytes []byte, variables map[string]interface{}, templateName string, funcs template.FuncMap) ([]byte, []int, error) {
 	t, err := template.New(templateName).
 		Funcs(templFuncs).
+		Funcs(funcs).
 		Option("missingkey=error").
 		Parse(string(rawBytes))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	filled := &sourceLineWriter{texts: make(map[*byte]int), line: 1}
+	for _, tmpl := range t.Templates() {
+		if tmpl.Tree == nil {
+			continue
+		}
+		walkTemplateNode(tmpl.Tree.Root, func(node parse.Node) {
+			if text, ok := node.(*parse.TextNode); ok && len(text.Text) > 0 {
+				filled.texts[&text.Text[0]] = 1 + bytes.Count(rawBytes[:text.Pos], []byte("\n"))
+			}
+		})
+	}
+	if err := t.Execute(filled, variables); err != nil {
+		return nil, nil, err
+	}
+
+	return filled.Bytes(), filled.lines, nil
+}
+
+// sourceLineWriter buffers the output of a template while recording the source line of each
+// output line. The templater writes the text between actions as is, the text nodes being
+// recognized by their backing array.
+type sourceLineWriter struct {
+	bytes.Buffer
+	// texts are the source lines of the text nodes of the template indexed by their first byte
+	texts map[*byte]int
+	// lines are the source lines of the lines written so far
+	lines []int
+	// line is the source line of the text being written
+	line int
+}
+
+func (w *sourceLineWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	line, isText := w.texts[&p[0]]
+	if isText {
+		w.line = line
+	}
+	for _, c := range p {
+		if w.Len() == 0 || w.Bytes()[w.Len()-1] == '\n' {
+			w.lines = append(w.lines, w.line)
+		}
+		w.WriteByte(c)
+		if c == '\n' && isText {
+			w.line++
+		}
+	}
+	return len(p), nil
+}
+
+// TemplateVariables lists the top-level variables referenced by a template, either as .var or as
+// $.var
+func TemplateVariables(rawBytes []byte, templateName string) ([]string, error) {
+	seen := make(map[string]bool)
+	var variables []string
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			variables = append(variables, name)
+		}
+	}
+
+	err := walkTemplate(rawBytes, templateName, func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.FieldNode:
+			add(n.Ident[0])
+		case *parse.VariableNode:
+			if len(n.Ident) > 1 && n.Ident[0] == "$" {
+				add(n.Ident[1])
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return variables, nil
+}
+
+// usesSecrets checks whether or not a template calls the functions resolving secrets
+func usesSecrets(rawBytes []byte, templateName string) bool {
+	uses := false
+	walkTemplate(rawBytes, templateName, func(node parse.Node) {
+		if n, ok := node.(*parse.IdentifierNode); ok && StringInSlice(n.Ident, secretFuncNames) {
+			uses = true
+		}
+	})
+	return uses
+}
+
+// walkTemplate parses a template and calls visit with each of its nodes
+func walkTemplate(rawBytes []byte, templateName string, visit func(parse.Node)) error {
+	t, err := template.New(templateName).
+		Funcs(templFuncs).
+		Funcs(placeholderSecretFuncs).
+		Parse(string(rawBytes))
+	if err != nil {
+		return err
+	}
+
+	for _, tmpl := range t.Templates() {
+		if tmpl.Tree != nil {
+			walkTemplateNode(tmpl.Tree.Root, visit)
+		}
+	}
+	return nil
+}
+
+// walkTemplateNode calls visit with a node and all its descendants
+func walkTemplateNode(node parse.Node, visit func(parse.Node)) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			walkTemplateNode(child, visit)
+		}
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			walkTemplateNode(cmd, visit)
+		}
+	case *parse.ActionNode:
+		walkTemplateNode(n.Pipe, visit)
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			walkTemplateNode(arg, visit)
+		}
+	case *parse.ChainNode:
+		walkTemplateNode(n.Node, visit)
+	case *parse.IfNode:
+		walkBranchNode(&n.BranchNode, visit)
+	case *parse.RangeNode:
+		walkBranchNode(&n.BranchNode, visit)
+	case *parse.WithNode:
+		walkBranchNode(&n.BranchNode, visit)
+	case *parse.TemplateNode:
+		walkTemplateNode(n.Pipe, visit)
+	}
+	visit(node)
+}
+
+// walkBranchNode walks the pipeline and both lists of an if, range or with node
+func walkBranchNode(n *parse.BranchNode, visit func(parse.Node)) {
+	walkTemplateNode(n.Pipe, visit)
+	walkTemplateNode(n.List, visit)
+	walkTemplateNode(n.ElseList, visit)
+}
+
+// configFormat determines the format of a config from the extension of its file name, falling
+// back on its content: JSON documents start with a brace or a comment, anything else is YAML
+func configFormat(fileName string, content []byte) string {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		return configFormatYAML
+	case ".jsonc":
+		return configFormatJSONC
+	case ".json":
+		return configFormatJSON
+	}
+
+	trimmed := bytes.TrimSpace(content)
+	if len(trimmed) == 0 || trimmed[0] == '{' || trimmed[0] == '/' {
+		return configFormatJSONC
+	}
+	return configFormatYAML
+}
+
+// toJSON converts a config in the given format to JSON
+func toJSON(content []byte, format string) ([]byte, error) {
+	switch format {
+	case configFormatYAML:
+		return yamlToJSON(content)
+	case configFormatJSONC:
+		return stripJSONComments(content), nil
+	default:
+		return content, nil
+	}
+}
+
+// yamlToJSON converts a YAML document to JSON
+func yamlToJSON(content []byte) ([]byte, error) {
+	document, err := parseYAML(content)
 	if err != nil {
 		return nil, err
 	}
+	return json.Marshal(document)
+}
 
-	var filled bytes.Buffer
-	if err := t.Execute(&filled, variables); err != nil {
+// parseYAML decodes a YAML document into values which can be marshalled to JSON
+func parseYAML(content []byte) (interface{}, error) {
+	var node yaml.Node
+	if err := yaml.Unmarshal(content, &node); err != nil {
 		return nil, err
 	}
+	d := &yamlDecoder{expanding: make(map[*yaml.Node]bool)}
+	return d.value(&node)
+}
+
+// yamlMaxAliasedNodes caps the number of nodes aliases can expand into, so that documents nesting
+// aliases don't expand exponentially
+const yamlMaxAliasedNodes = 1000000
+
+// yamlDecoder decodes YAML nodes, timestamps are kept as they are written instead of being turned
+// into times and mapping keys are always strings. It keeps track of the anchors being expanded to
+// reject the ones containing themselves.
+type yamlDecoder struct {
+	expanding map[*yaml.Node]bool
+	aliased   int
+}
+
+// value decodes a YAML node
+func (d *yamlDecoder) value(node *yaml.Node) (interface{}, error) {
+	if len(d.expanding) > 0 {
+		d.aliased++
+		if d.aliased > yamlMaxAliasedNodes {
+			return nil, fmt.Errorf("yaml: line %d: document is too large once its aliases are expanded",
+				node.Line)
+		}
+	}
+
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return nil, nil
+		}
+		return d.value(node.Content[0])
+	case yaml.AliasNode:
+		if d.expanding[node.Alias] {
+			return nil, fmt.Errorf("yaml: line %d: anchor '%s' value contains itself", node.Line, node.Value)
+		}
+		d.expanding[node.Alias] = true
+		defer delete(d.expanding, node.Alias)
+		return d.value(node.Alias)
+	case yaml.SequenceNode:
+		values := make([]interface{}, 0, len(node.Content))
+		for _, item := range node.Content {
+			value, err := d.value(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	case yaml.MappingNode:
+		values := make(map[string]interface{}, len(node.Content)/2)
+		// keys merged through << are overridden by the ones of the mapping itself
+		for _, merge := range []bool{true, false} {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key, item := node.Content[i], node.Content[i+1]
+				if (key.ShortTag() == "!!merge") != merge {
+					continue
+				}
+				value, err := d.value(item)
+				if err != nil {
+					return nil, err
+				}
+				if !merge {
+					values[key.Value] = value
+					continue
+				}
+				if err := mergeYAMLValues(values, value, key.Line); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return values, nil
+	default:
+		if node.ShortTag() == "!!timestamp" {
+			return node.Value, nil
+		}
+		var value interface{}
+		if err := node.Decode(&value); err != nil {
+			return nil, err
+		}
+		return value, nil
+	}
+}
+
+// mergeYAMLValues merges a mapping or a sequence of mappings referenced by a << key
+func mergeYAMLValues(values map[string]interface{}, merged interface{}, line int) error {
+	switch m := merged.(type) {
+	case map[string]interface{}:
+		for k, v := range m {
+			values[k] = v
+		}
+	case []interface{}:
+		// earlier mappings take precedence over later ones
+		for i := len(m) - 1; i >= 0; i-- {
+			if err := mergeYAMLValues(values, m[i], line); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("yaml: line %d: map merge requires map or sequence of maps as the value", line)
+	}
+	return nil
+}
 
-	return filled.Bytes(), nil
+// stripJSONComments blanks out the // and /* */ comments outside of JSON strings, newlines are
+// kept so that positions in the document are preserved
+func stripJSONComments(content []byte) []byte {
+	stripped := make([]byte, len(content))
+	copy(stripped, content)
+
+	inString := false
+	for i := 0; i < len(stripped); i++ {
+		c := stripped[i]
+		switch {
+		case inString:
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '/' && i+1 < len(stripped) && stripped[i+1] == '/':
+			for ; i < len(stripped) && stripped[i] != '\n'; i++ {
+				stripped[i] = ' '
+			}
+		case c == '/' && i+1 < len(stripped) && stripped[i+1] == '*':
+			end := bytes.Index(stripped[i+2:], []byte("*/"))
+			if end < 0 {
+				end = len(stripped)
+			} else {
+				end += i + 4
+			}
+			for ; i < end; i++ {
+				if stripped[i] != '\n' {
+					stripped[i] = ' '
+				}
+			}
+			i--
+		}
+	}
+	return stripped
 }
@@ -14,6 +14,7 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"strconv"
@@ -86,8 +87,9 @@ func TestParseClusterRecord_Fail(t *testing.T) {
 	assert.Equal("unexpected end of JSON input", err.Error())
 
 	res, err = ar.ParseClusterRecord([]byte("{}"), nil, "")
-	assert.NotNil(res)
-	assert.Nil(err)
+	assert.Nil(res)
+	assert.NotNil(err)
+	assert.Equal("the config has no schema, expected iglu:com.snowplowanalytics.dataflowrunner/ClusterConfig/avro/1-1-1", err.Error())
 
 	res, err = ar.ParseClusterRecord([]byte(`{"schema":{},"data":"iglu:com.snowplowanalytics.dataflow-runner/Cluster/avro/1-0-0"}`), nil, "")
 	assert.Nil(res)
@@ -128,6 +130,99 @@ func TestParsePlaybookRecord_Success(t *testing.T) {
 	}
 }
 
+func TestParsePlaybookRecord_Formats(t *testing.T) {
+	assert := assert.New(t)
+
+	ar, _ := InitConfigResolver()
+	expected, err := ar.ParsePlaybookRecord([]byte(PlaybookRecord1), nil, "")
+	assert.Nil(err)
+
+	// YAML is detected from the extension or the content and is templated beforehand
+	varMap := map[string]interface{}{"output": "hdfs:///local/recovery/"}
+	for _, templateName := range []string{"playbook.yml", "playbook.yaml", ""} {
+		res, err := ar.ParsePlaybookRecord([]byte(PlaybookRecordYAML), varMap, templateName)
+		assert.Nil(err)
+		assert.Equal(expected, res)
+	}
+
+	for _, templateName := range []string{"playbook.jsonc", ""} {
+		res, err := ar.ParsePlaybookRecord([]byte(PlaybookRecordJSONC), nil, templateName)
+		assert.Nil(err)
+		assert.Equal(expected, res)
+	}
+
+	// comments are only allowed with the .jsonc extension when it is specified
+	res, err := ar.ParsePlaybookRecord([]byte(PlaybookRecordJSONC), nil, "playbook.json")
+	assert.Nil(res)
+	assert.NotNil(err)
+	assert.Equal("invalid character '/' looking for beginning of value", err.Error())
+
+	res, err = ar.ParsePlaybookRecord([]byte("schema: [\n"), nil, "playbook.yml")
+	assert.Nil(res)
+	assert.NotNil(err)
+	assert.Equal("yaml: line 1: did not find expected node content", err.Error())
+}
+
+func TestParseYAML(t *testing.T) {
+	assert := assert.New(t)
+
+	// timestamps are kept as written and anchors can be merged
+	document, err := parseYAML([]byte("defaults: &defaults\n  a: 1\n  b: 2\n" +
+		"step:\n  <<: *defaults\n  b: 3\n  date: 2022-01-01\n  ids: [1, x]\n"))
+	assert.Nil(err)
+	assert.Equal(map[string]interface{}{
+		"defaults": map[string]interface{}{"a": 1, "b": 2},
+		"step": map[string]interface{}{
+			"a": 1, "b": 3, "date": "2022-01-01", "ids": []interface{}{1, "x"},
+		},
+	}, document)
+
+	document, err = parseYAML([]byte("a:\n  <<: 1\n"))
+	assert.Nil(document)
+	assert.NotNil(err)
+	assert.Equal("yaml: line 2: map merge requires map or sequence of maps as the value", err.Error())
+
+	// anchors containing themselves and aliases expanding exponentially are rejected
+	document, err = parseYAML([]byte("a: &a [*a]\n"))
+	assert.Nil(document)
+	assert.NotNil(err)
+	assert.Equal("yaml: line 1: anchor 'a' value contains itself", err.Error())
+
+	laughs := "a: &a [x, x, x, x, x, x, x, x, x, x]\n"
+	for i := 'b'; i <= 'h'; i++ {
+		laughs += fmt.Sprintf("%c: &%c [*%c, *%c, *%c, *%c, *%c, *%c, *%c, *%c, *%c, *%c]\n",
+			i, i, i-1, i-1, i-1, i-1, i-1, i-1, i-1, i-1, i-1, i-1)
+	}
+	document, err = parseYAML([]byte(laughs))
+	assert.Nil(document)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "document is too large once its aliases are expanded")
+}
+
+func TestTemplateVariables(t *testing.T) {
+	assert := assert.New(t)
+
+	variables, err := TemplateVariables([]byte(`{"a":"{{.a}}","b":"{{.b.c | base64}}",`+
+		`"c":"{{if .c}}{{range $i, $d := .d}}{{$.e}}{{end}}{{end}}","f":"{{systemEnv "HOME"}}"}`), "template")
+	assert.Nil(err)
+	assert.Equal([]string{"a", "b", "c", "d", "e"}, variables)
+
+	variables, err = TemplateVariables([]byte(`{{.a`), "template")
+	assert.Nil(variables)
+	assert.NotNil(err)
+}
+
+func TestStripJSONComments(t *testing.T) {
+	assert := assert.New(t)
+
+	stripped := stripJSONComments([]byte("{\"a\": \"//b/*\\\"\", // c\n/* d\ne */ \"f\": 1}"))
+	assert.Equal("{\"a\": \"//b/*\\\"\",     \n    \n     \"f\": 1}", string(stripped))
+
+	// unterminated comments run until the end of the document
+	stripped = stripJSONComments([]byte("{} /* a"))
+	assert.Equal("{}     ", string(stripped))
+}
+
 func TestParsePlaybookRecord_Fail(t *testing.T) {
 	assert := assert.New(t)
 
@@ -138,8 +233,9 @@ func TestParsePlaybookRecord_Fail(t *testing.T) {
 	assert.Equal("unexpected end of JSON input", err.Error())
 
 	res, err = ar.ParsePlaybookRecord([]byte("{}"), nil, "")
-	assert.NotNil(res)
-	assert.Nil(err)
+	assert.Nil(res)
+	assert.NotNil(err)
+	assert.Equal("the config has no schema, expected iglu:com.snowplowanalytics.dataflowrunner/PlaybookConfig/avro/1-0-2", err.Error())
 
 	res, err = ar.ParsePlaybookRecord([]byte(`{"schema":{},"data":"iglu:com.snowplowanalytics.dataflow-runner/Cluster/avro/1-0-0"}`), nil, "")
 	assert.Nil(res)
@@ -152,14 +248,15 @@ func TestParsePlaybookRecord_Fail(t *testing.T) {
 	assert.Equal("open playbook_record.json: no such file or directory", err.Error())
 }
 
-func TestToSelfDescribingRecord(t *testing.T) {
+func TestParseClusterRecord_UndefinedFunction(t *testing.T) {
 	assert := assert.New(t)
 
+	ar, _ := InitConfigResolver()
 	byteArr := []byte(`{"schema":"iglu:com.snowplowanalytics.dataflow-runner/Cluster/avro/1-0-0","data":{"key":"{{systemEnvs "TEST_ENV_VAR"}}","key2":"{{ .someVar}}","key3":"{{nowWithFormat "2006"}}"}}`)
 	templateName := "template"
-	sdr, err := toSelfDescribingRecord(byteArr, nil, templateName)
+	res, err := ar.ParseClusterRecord(byteArr, nil, templateName)
 
-	assert.Nil(sdr)
+	assert.Nil(res)
 	assert.NotNil(err)
 	assert.Equal("template: "+templateName+":1: function \"systemEnvs\" not defined", err.Error())
 }
@@ -172,14 +269,14 @@ func TestTemplateRawBytes(t *testing.T) {
 	}
 
 	byteArr := []byte(`{"key":"{{.someVar}}"}`)
-	templatedByteArr, err := templateRawBytes(byteArr, varMap, "")
+	templatedByteArr, err := templateRawBytesWithFuncs(byteArr, varMap, "", nil)
 	assert.NotNil(templatedByteArr)
 	assert.Nil(err)
 	assert.Equal(`{"key":"golangTestVar"}`, string(templatedByteArr))
 
 	byteArr = []byte(`{"key":"{{.someOtherVar}}"}`)
 	templateName := "template"
-	templateByteArr, err := templateRawBytes(byteArr, varMap, templateName)
+	templateByteArr, err := templateRawBytesWithFuncs(byteArr, varMap, templateName, nil)
 	assert.Nil(templateByteArr)
 	assert.NotNil(err)
 	assert.Equal(
@@ -192,7 +289,7 @@ func TestTemplateRawBytes_nowWithFormat(t *testing.T) {
 	currYear := strconv.Itoa(time.Now().Year())
 
 	byteArr := []byte(`{"key":"{{nowWithFormat "2006"}}"}`)
-	templatedByteArr, err := templateRawBytes(byteArr, nil, "")
+	templatedByteArr, err := templateRawBytesWithFuncs(byteArr, nil, "", nil)
 	assert.NotNil(t, templatedByteArr)
 	assert.Nil(t, err)
 	assert.Equal(t, `{"key":"`+currYear+`"}`, string(templatedByteArr))
@@ -202,14 +299,14 @@ func TestTemplateRawBytes_timeWithFormat(t *testing.T) {
 	assert := assert.New(t)
 
 	byteArr := []byte(`{"key":"{{timeWithFormat "1494930397" "2006"}}"}`)
-	templatedByteArr, err := templateRawBytes(byteArr, nil, "")
+	templatedByteArr, err := templateRawBytesWithFuncs(byteArr, nil, "", nil)
 	assert.NotNil(templatedByteArr)
 	assert.Nil(err)
 	assert.Equal(`{"key":"2017"}`, string(templatedByteArr))
 
 	byteArr = []byte(`{"key":"{{timeWithFormat "qwerty" "2006"}}"}`)
 	templateName := "template"
-	templatedByteArr, err = templateRawBytes(byteArr, nil, templateName)
+	templatedByteArr, err = templateRawBytesWithFuncs(byteArr, nil, templateName, nil)
 	assert.Nil(templatedByteArr)
 	assert.NotNil(err)
 	assert.Equal(`template: `+templateName+`:1:10: executing "`+templateName+
@@ -223,14 +320,14 @@ func TestTemplateRawBytes_systemEnv(t *testing.T) {
 	assert.Nil(err)
 
 	byteArr := []byte(`{"key":"{{systemEnv "TEST_ENV_VAR"}}"}`)
-	templatedByteArr, err := templateRawBytes(byteArr, nil, "")
+	templatedByteArr, err := templateRawBytesWithFuncs(byteArr, nil, "", nil)
 	assert.NotNil(templatedByteArr)
 	assert.Nil(err)
 	assert.Equal(`{"key":"golangTestEnvVar"}`, string(templatedByteArr))
 
 	byteArr = []byte(`{"key":"{{systemEnv "DOESNT_EXIST"}}"}`)
 	templateName := "template"
-	templatedByteArr, err = templateRawBytes(byteArr, nil, templateName)
+	templatedByteArr, err = templateRawBytesWithFuncs(byteArr, nil, templateName, nil)
 	assert.NotNil(err)
 	assert.Nil(templatedByteArr)
 	assert.Equal(
@@ -241,7 +338,7 @@ func TestTemplateRawBytes_systemEnv(t *testing.T) {
 
 func TestTemplateRawBytes_base64(t *testing.T) {
 	byteArr := []byte(`{"key":"{{base64 "abc"}}"}`)
-	templatedByteArr, err := templateRawBytes(byteArr, nil, "")
+	templatedByteArr, err := templateRawBytesWithFuncs(byteArr, nil, "", nil)
 	assert.NotNil(t, templatedByteArr)
 	assert.Nil(t, err)
 	assert.Equal(t, `{"key":"YWJj"}`, string(templatedByteArr))
@@ -260,14 +357,14 @@ func TestTemplateRawBytes_base64File(t *testing.T) {
 	assert.Nil(err)
 
 	byteArr := []byte(`{"key":"{{base64File "` + tmpFile.Name() + `"}}"}`)
-	templatedByteArr, err := templateRawBytes(byteArr, nil, "")
+	templatedByteArr, err := templateRawBytesWithFuncs(byteArr, nil, "", nil)
 	assert.NotNil(templatedByteArr)
 	assert.Nil(err)
 	assert.Equal(`{"key":"YWJj"}`, string(templatedByteArr))
 
 	byteArr = []byte(`{"key":"{{base64File "/tmp/doesnt/exist"}}"}`)
 	templateName := "template"
-	templatedByteArr, err = templateRawBytes(byteArr, nil, templateName)
+	templatedByteArr, err = templateRawBytesWithFuncs(byteArr, nil, templateName, nil)
 	assert.NotNil(err)
 	assert.Nil(templatedByteArr)
 	assert.Equal(
@@ -279,7 +376,7 @@ func TestTemplateRawBytes_base64File(t *testing.T) {
 func TestTemplateRawBytes_doesntExist(t *testing.T) {
 	byteArr := []byte(`{"key":"{{doesntExist "TEST_ENV_VAR"}}"}`)
 	templateName := "template"
-	templatedByteArr, err := templateRawBytes(byteArr, nil, templateName)
+	templatedByteArr, err := templateRawBytesWithFuncs(byteArr, nil, templateName, nil)
 	assert.Nil(t, templatedByteArr)
 	assert.NotNil(t, err)
 	assert.Equal(t, "template: "+templateName+":1: function \"doesntExist\" not defined", err.Error())
@@ -0,0 +1,119 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+)
+
+// defaultRoleSessionName identifies the sessions of the roles assumed by dataflow-runner when the
+// config doesn't name them
+const defaultRoleSessionName = "dataflow-runner"
+
+// STSClient builds the STS client used to assume roles for a region with the given credentials
+type STSClient func(region string, creds *credentials.Credentials) (stsiface.STSAPI, error)
+
+// SharedConfigSession builds a session for a region whose credentials are resolved through the
+// shared config of a profile, the default one and the default chain if it's empty
+type SharedConfigSession func(region, profile string) (*session.Session, error)
+
+// configCredentials resolves the credentials of a config, the roles being assumed with the given
+// STS client and profiles being loaded with the given sessions. The base credentials come from
+// one of:
+// 1. accessKeyId and secretAccessKey, see GetCredentialsProvider
+// 2. profile, a named profile of the shared config and credentials files
+// 3. webIdentityTokenFile, a token exchanged for the credentials of webIdentityRoleArn
+// If roleArn is set, the role is then assumed with the base credentials, the default credentials
+// chain being used if there are none.
+func configCredentials(record *CredentialsRecord, region string, newSTS STSClient, newSession SharedConfigSession) (*credentials.Credentials, error) {
+	if record == nil {
+		record = &CredentialsRecord{}
+	}
+	sessionName := record.RoleSessionName
+	if sessionName == "" {
+		sessionName = defaultRoleSessionName
+	}
+
+	hasKeys := record.AccessKeyId != "" || record.SecretAccessKey != ""
+	sources := 0
+	for _, set := range []bool{hasKeys, record.Profile != "", record.WebIdentityTokenFile != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return nil, errors.New("only one of accessKeyId and secretAccessKey, profile and webIdentityTokenFile can be set")
+	}
+	if record.RoleArn == "" && (record.ExternalId != "" || record.DurationSeconds != 0) {
+		return nil, errors.New("externalId and durationSeconds can only be set along with roleArn")
+	}
+
+	var base *credentials.Credentials
+	switch {
+	case record.Profile != "":
+		sess, err := newSession(region, record.Profile)
+		if err != nil {
+			return nil, errors.New("couldn't load profile " + record.Profile + ": " + err.Error())
+		}
+		base = sess.Config.Credentials
+	case record.WebIdentityTokenFile != "":
+		if record.WebIdentityRoleArn == "" {
+			return nil, errors.New("webIdentityRoleArn must be set along with webIdentityTokenFile")
+		}
+		svc, err := newSTS(region, credentials.AnonymousCredentials)
+		if err != nil {
+			return nil, err
+		}
+		provider := stscreds.NewWebIdentityRoleProvider(svc, record.WebIdentityRoleArn, sessionName,
+			record.WebIdentityTokenFile)
+		base = credentials.NewCredentials(provider)
+	case !hasKeys && record.RoleArn != "":
+		sess, err := newSession(region, "")
+		if err != nil {
+			return nil, err
+		}
+		base = sess.Config.Credentials
+	default:
+		creds, err := GetCredentialsProvider(record.AccessKeyId, record.SecretAccessKey)
+		if err != nil {
+			return nil, err
+		}
+		base = creds
+	}
+
+	if record.RoleArn == "" {
+		return base, nil
+	}
+	svc, err := newSTS(region, base)
+	if err != nil {
+		return nil, err
+	}
+	return stscreds.NewCredentialsWithClient(svc, record.RoleArn,
+		func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = sessionName
+			if record.ExternalId != "" {
+				p.ExternalID = aws.String(record.ExternalId)
+			}
+			if record.DurationSeconds > 0 {
+				p.Duration = time.Duration(record.DurationSeconds) * time.Second
+			}
+		}), nil
+}
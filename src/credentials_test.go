@@ -0,0 +1,156 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockSTSAPI struct {
+	stsiface.STSAPI
+	base          *credentials.Credentials
+	assumeRole    []*sts.AssumeRoleInput
+	webIdentities []*sts.AssumeRoleWithWebIdentityInput
+}
+
+func (m *mockSTSAPI) AssumeRoleWithContext(ctx aws.Context, input *sts.AssumeRoleInput, opts ...request.Option) (*sts.AssumeRoleOutput, error) {
+	m.assumeRole = append(m.assumeRole, input)
+	base, err := m.base.Get()
+	if err != nil {
+		return nil, err
+	}
+	return &sts.AssumeRoleOutput{Credentials: &sts.Credentials{
+		AccessKeyId:     aws.String("assumed-by-" + base.AccessKeyID),
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      aws.Time(time.Now().Add(time.Hour)),
+	}}, nil
+}
+
+func (m *mockSTSAPI) AssumeRoleWithWebIdentityRequest(input *sts.AssumeRoleWithWebIdentityInput) (*request.Request, *sts.AssumeRoleWithWebIdentityOutput) {
+	m.webIdentities = append(m.webIdentities, input)
+	out := &sts.AssumeRoleWithWebIdentityOutput{Credentials: &sts.Credentials{
+		AccessKeyId:     aws.String("web-identity"),
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      aws.Time(time.Now().Add(time.Hour)),
+	}}
+	return request.New(aws.Config{}, metadata.ClientInfo{}, request.Handlers{}, nil,
+		&request.Operation{Name: "AssumeRoleWithWebIdentity"}, input, out), out
+}
+
+func mockSTSClient(clients *[]*mockSTSAPI) STSClient {
+	return func(region string, creds *credentials.Credentials) (stsiface.STSAPI, error) {
+		svc := &mockSTSAPI{base: creds}
+		*clients = append(*clients, svc)
+		return svc, nil
+	}
+}
+
+func TestConfigCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	// static keys as the base credentials of an assumed role
+	var clients []*mockSTSAPI
+	creds, err := configCredentials(&CredentialsRecord{
+		AccessKeyId:     "access",
+		SecretAccessKey: "secret",
+		RoleArn:         "arn:aws:iam::123456789012:role/pipeline",
+		ExternalId:      "customer",
+		DurationSeconds: 1800,
+	}, "eu-west-1", mockSTSClient(&clients), NewAwsClients("").SharedConfigSession)
+	assert.Nil(err)
+	value, err := creds.Get()
+	assert.Nil(err)
+	assert.Equal("assumed-by-access", value.AccessKeyID)
+	assert.Equal(1, len(clients))
+	input := clients[0].assumeRole[0]
+	assert.Equal("arn:aws:iam::123456789012:role/pipeline", *input.RoleArn)
+	assert.Equal("customer", *input.ExternalId)
+	assert.Equal(defaultRoleSessionName, *input.RoleSessionName)
+	assert.Equal(int64(1800), *input.DurationSeconds)
+
+	// a web identity chained with an assumed role
+	dir, _ := ioutil.TempDir("", "test-credentials")
+	defer os.RemoveAll(dir)
+	tokenFile := writeConfigFile(t, dir, "token", "web-identity-token")
+
+	clients = nil
+	creds, err = configCredentials(&CredentialsRecord{
+		WebIdentityTokenFile: tokenFile,
+		WebIdentityRoleArn:   "arn:aws:iam::111111111111:role/runner",
+		RoleArn:              "arn:aws:iam::123456789012:role/pipeline",
+		RoleSessionName:      "nightly",
+	}, "eu-west-1", mockSTSClient(&clients), NewAwsClients("").SharedConfigSession)
+	assert.Nil(err)
+	value, err = creds.Get()
+	assert.Nil(err)
+	assert.Equal("assumed-by-web-identity", value.AccessKeyID)
+	assert.Equal(2, len(clients))
+	assert.Equal("arn:aws:iam::111111111111:role/runner", *clients[0].webIdentities[0].RoleArn)
+	assert.Equal("web-identity-token", *clients[0].webIdentities[0].WebIdentityToken)
+	assert.Equal("nightly", *clients[1].assumeRole[0].RoleSessionName)
+
+	// named profiles
+	credentialsFile := writeConfigFile(t, dir, "credentials", "[pipeline]\naws_access_key_id = profile-access\naws_secret_access_key = profile-secret\n")
+	os.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsFile)
+	defer os.Unsetenv("AWS_SHARED_CREDENTIALS_FILE")
+	creds, err = configCredentials(&CredentialsRecord{Profile: "pipeline"}, "eu-west-1", mockSTSClient(&clients), NewAwsClients("").SharedConfigSession)
+	assert.Nil(err)
+	value, err = creds.Get()
+	assert.Nil(err)
+	assert.Equal("profile-access", value.AccessKeyID)
+
+	for message, record := range map[string]*CredentialsRecord{
+		"only one of accessKeyId and secretAccessKey, profile and webIdentityTokenFile can be set": {
+			AccessKeyId: "env", SecretAccessKey: "env", Profile: "pipeline"},
+		"externalId and durationSeconds can only be set along with roleArn": {
+			AccessKeyId: "env", SecretAccessKey: "env", ExternalId: "customer"},
+		"webIdentityRoleArn must be set along with webIdentityTokenFile": {
+			WebIdentityTokenFile: tokenFile},
+		"access-key and secret-key must both be set to 'env', or neither": {
+			AccessKeyId: "env", SecretAccessKey: "nv", RoleArn: "arn:aws:iam::123456789012:role/pipeline"},
+	} {
+		_, err := configCredentials(record, "eu-west-1", mockSTSClient(&clients), NewAwsClients("").SharedConfigSession)
+		assert.NotNil(err)
+		if err != nil {
+			assert.Equal(message, err.Error())
+		}
+	}
+}
+
+func TestParsePlaybookRecord_AssumeRole(t *testing.T) {
+	assert := assert.New(t)
+	ar, _ := InitConfigResolver()
+
+	playbook := strings.Replace(PlaybookRecord1, `"secretAccessKey": "env"`,
+		`"secretAccessKey": "env", "roleArn": "arn:aws:iam::123456789012:role/pipeline", "durationSeconds": 3600`, 1)
+	playbook = strings.Replace(playbook, "PlaybookConfig/avro/1-0-1", "PlaybookConfig/avro/1-0-2", 1)
+	res, err := ar.ParsePlaybookRecord([]byte(playbook), nil, "")
+	assert.Nil(err)
+	assert.Equal("arn:aws:iam::123456789012:role/pipeline", res.Credentials.RoleArn)
+	assert.Equal(int32(3600), res.Credentials.DurationSeconds)
+}
@@ -0,0 +1,318 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+const (
+	dynamoDBLockKey       = "lockId"
+	dynamoDBLockOwner     = "owner"
+	dynamoDBLockHolder    = "holder"
+	dynamoDBLockExpiresAt = "expiresAt"
+	dynamoDBLockCounter   = "fencingToken"
+	dynamoDBLockLease     = 5 * time.Minute
+)
+
+// DynamoDBLock is for DynamoDB-based locks, materialized by an item in a table whose partition
+// key is a string named lockId. The lock is leased and expires if it isn't refreshed, unless it
+// has no lease. The fencing token is an atomic counter stored in a sibling item suffixed with
+// #fence. The owner of the item read by Holder is remembered so that releasing the lock can check
+// whether someone else acquired it in the meantime.
+type DynamoDBLock struct {
+	svc    dynamodbiface.DynamoDBAPI
+	table  string
+	key    string
+	lease  time.Duration
+	owner  string
+	token  int64
+	holder LockHolder
+	seen   string
+}
+
+// InitDynamoDBLock builds a DynamoDBLock (an item in a DynamoDB table) with the name argument as
+// key, the region and credentials are resolved through the default chain. Persistent locks have
+// no lease as nothing refreshes them once the process exits.
+func InitDynamoDBLock(table, name string, persistent bool, clients *AwsClients) (Lock, error) {
+	sess, err := clients.DefaultSession()
+	if err != nil {
+		return nil, err
+	}
+	lease := dynamoDBLockLease
+	if persistent {
+		lease = 0
+	}
+	return &DynamoDBLock{
+		svc:   dynamodb.New(sess),
+		table: table,
+		key:   name,
+		lease: lease,
+	}, nil
+}
+
+// TryLock tries to acquire a lock from DynamoDB, a lock whose lease has expired can be acquired
+func (dl *DynamoDBLock) TryLock() error {
+	owner, err := newLockOwner()
+	if err != nil {
+		return err
+	}
+
+	// tokens are handed out before the lock is acquired, failed acquisitions leave gaps
+	token, err := dl.nextFencingToken()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	holder := NewLockHolder()
+	holder.FencingToken = token
+	item := map[string]*dynamodb.AttributeValue{
+		dynamoDBLockKey:    {S: aws.String(dl.key)},
+		dynamoDBLockOwner:  {S: aws.String(owner)},
+		dynamoDBLockHolder: {S: aws.String(string(holder.Bytes()))},
+	}
+	// items without an expiry are held until they're released
+	if dl.lease > 0 {
+		item[dynamoDBLockExpiresAt] = &dynamodb.AttributeValue{N: aws.String(unixString(now.Add(dl.lease)))}
+	}
+	_, err = dl.svc.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(dl.table),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(#key) OR #expiresAt < :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#key":       aws.String(dynamoDBLockKey),
+			"#expiresAt": aws.String(dynamoDBLockExpiresAt),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {N: aws.String(unixString(now))},
+		},
+	})
+	if isConditionalCheckFailed(err) {
+		return LockHeldError("lock already held at " + dl.key)
+	}
+	if err != nil {
+		return err
+	}
+
+	dl.owner = owner
+	dl.token = token
+	dl.holder = holder
+	dl.seen = ""
+	return nil
+}
+
+// Unlock tries to release the lock from DynamoDB. The item is only deleted if it still has the
+// owner read by Holder or, failing that, the one we created through TryLock, it is deleted
+// unconditionally only when neither happened, i.e. when force-releasing a lock whose owner can't
+// be read.
+func (dl *DynamoDBLock) Unlock() error {
+	owner := dl.seen
+	if owner == "" {
+		owner = dl.owner
+	}
+	input := &dynamodb.DeleteItemInput{
+		TableName:           aws.String(dl.table),
+		Key:                 dl.itemKey(),
+		ConditionExpression: aws.String("attribute_exists(#key)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#key": aws.String(dynamoDBLockKey),
+		},
+	}
+	if owner != "" {
+		input.ConditionExpression = aws.String("#owner = :owner")
+		input.ExpressionAttributeNames = map[string]*string{
+			"#owner": aws.String(dynamoDBLockOwner),
+		}
+		input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+			":owner": {S: aws.String(owner)},
+		}
+	}
+
+	// the owner is only forgotten once the item is deleted so that retries keep the condition
+	_, err := dl.svc.DeleteItem(input)
+	if isConditionalCheckFailed(err) {
+		if owner == "" {
+			return errors.New("lock not held")
+		}
+		return dl.modifiedError()
+	}
+	if err != nil {
+		return err
+	}
+	dl.owner = ""
+	dl.seen = ""
+	return nil
+}
+
+// modifiedError tells apart a lock which was released from one which was acquired by someone
+// else once a conditional release failed
+func (dl *DynamoDBLock) modifiedError() error {
+	out, err := dl.svc.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(dl.table),
+		Key:            dl.itemKey(),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return err
+	}
+	if out.Item == nil {
+		return errors.New("lock not held")
+	}
+	return errors.New("lock at " + dl.key + " was modified by someone else, it wasn't released")
+}
+
+// Holder retrieves the metadata of the lock's holder from DynamoDB, nil if the lock is not held
+// or if its lease has expired. The owner of the item is remembered even if its holder can't be
+// parsed so that only what was read gets released.
+func (dl *DynamoDBLock) Holder() (*LockHolder, error) {
+	out, err := dl.svc.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(dl.table),
+		Key:            dl.itemKey(),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	dl.seen = ""
+	if out.Item == nil {
+		return nil, nil
+	}
+	if owner, ok := out.Item[dynamoDBLockOwner]; ok && owner.S != nil {
+		dl.seen = *owner.S
+	}
+
+	if expiresAt, ok := out.Item[dynamoDBLockExpiresAt]; ok && expiresAt.N != nil {
+		e, err := strconv.ParseInt(*expiresAt.N, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if e < time.Now().Unix() {
+			return nil, nil
+		}
+	}
+
+	holder, ok := out.Item[dynamoDBLockHolder]
+	if !ok || holder.S == nil {
+		return nil, errors.New("no holder found for the lock at " + dl.key)
+	}
+	return ParseLockHolder([]byte(*holder.S))
+}
+
+// Refresh extends the lease of the lock, if it has one, as long as we still own it
+func (dl *DynamoDBLock) Refresh() error {
+	if dl.owner == "" {
+		return errors.New("lock at " + dl.key + " was not acquired")
+	}
+
+	holder := dl.holder.refreshed()
+	input := &dynamodb.UpdateItemInput{
+		TableName:           aws.String(dl.table),
+		Key:                 dl.itemKey(),
+		UpdateExpression:    aws.String("SET #holder = :holder"),
+		ConditionExpression: aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]*string{
+			"#owner":  aws.String(dynamoDBLockOwner),
+			"#holder": aws.String(dynamoDBLockHolder),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":owner":  {S: aws.String(dl.owner)},
+			":holder": {S: aws.String(string(holder.Bytes()))},
+		},
+	}
+	if dl.lease > 0 {
+		input.UpdateExpression = aws.String("SET #expiresAt = :expiresAt, #holder = :holder")
+		input.ExpressionAttributeNames["#expiresAt"] = aws.String(dynamoDBLockExpiresAt)
+		input.ExpressionAttributeValues[":expiresAt"] = &dynamodb.AttributeValue{
+			N: aws.String(unixString(time.Now().Add(dl.lease))),
+		}
+	}
+	_, err := dl.svc.UpdateItem(input)
+	if isConditionalCheckFailed(err) {
+		return errors.New("lock at " + dl.key + " is not held anymore")
+	}
+	if err != nil {
+		return err
+	}
+	dl.holder = holder
+	return nil
+}
+
+// FencingToken returns the token obtained when acquiring the lock
+func (dl *DynamoDBLock) FencingToken() int64 {
+	return dl.token
+}
+
+// nextFencingToken atomically increments the counter of the lock
+func (dl *DynamoDBLock) nextFencingToken() (int64, error) {
+	out, err := dl.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(dl.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamoDBLockKey: {S: aws.String(dl.key + "#fence")},
+		},
+		UpdateExpression: aws.String("ADD #counter :one"),
+		ExpressionAttributeNames: map[string]*string{
+			"#counter": aws.String(dynamoDBLockCounter),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one": {N: aws.String("1")},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueUpdatedNew),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	counter, ok := out.Attributes[dynamoDBLockCounter]
+	if !ok || counter.N == nil {
+		return 0, errors.New("no fencing token returned for the lock at " + dl.key)
+	}
+	return strconv.ParseInt(*counter.N, 10, 64)
+}
+
+// itemKey builds the key of the lock's item
+func (dl *DynamoDBLock) itemKey() map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		dynamoDBLockKey: {S: aws.String(dl.key)},
+	}
+}
+
+// newLockOwner generates a random token identifying a lock acquisition
+func newLockOwner() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// isConditionalCheckFailed checks whether or not a DynamoDB write failed its condition
+func isConditionalCheckFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+// unixString formats a time as a unix timestamp in seconds
+func unixString(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
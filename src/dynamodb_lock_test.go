@@ -0,0 +1,353 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockDynamoDBAPI is an in-memory table mimicking the conditions used by DynamoDBLock
+type mockDynamoDBAPI struct {
+	dynamodbiface.DynamoDBAPI
+	mu      sync.Mutex
+	items   map[string]map[string]*dynamodb.AttributeValue
+	updates int
+	// deleteErrors is the number of deletions failing before they succeed
+	deleteErrors int
+}
+
+func newMockDynamoDBAPI() *mockDynamoDBAPI {
+	return &mockDynamoDBAPI{items: make(map[string]map[string]*dynamodb.AttributeValue)}
+}
+
+func conditionalCheckFailed() error {
+	return awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+}
+
+func (m *mockDynamoDBAPI) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	if *input.TableName == "error" {
+		return nil, errors.New("PutItem failed")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := *input.Item[dynamoDBLockKey].S
+	if item, ok := m.items[key]; ok {
+		// items without an expiry never expire
+		if _, ok := item[dynamoDBLockExpiresAt]; !ok {
+			return nil, conditionalCheckFailed()
+		}
+		expiresAt, _ := strconv.ParseInt(*item[dynamoDBLockExpiresAt].N, 10, 64)
+		now, _ := strconv.ParseInt(*input.ExpressionAttributeValues[":now"].N, 10, 64)
+		if expiresAt >= now {
+			return nil, conditionalCheckFailed()
+		}
+	}
+	m.items[key] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (m *mockDynamoDBAPI) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.deleteErrors > 0 {
+		m.deleteErrors--
+		return nil, errors.New("DeleteItem failed")
+	}
+	key := *input.Key[dynamoDBLockKey].S
+	item, ok := m.items[key]
+	if !ok {
+		return nil, conditionalCheckFailed()
+	}
+	if owner, ok := input.ExpressionAttributeValues[":owner"]; ok && *owner.S != *item[dynamoDBLockOwner].S {
+		return nil, conditionalCheckFailed()
+	}
+	delete(m.items, key)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func (m *mockDynamoDBAPI) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := *input.Key[dynamoDBLockKey].S
+	item, ok := m.items[key]
+
+	// fencing token counter
+	if strings.HasPrefix(*input.UpdateExpression, "ADD") {
+		if !ok {
+			item = map[string]*dynamodb.AttributeValue{dynamoDBLockCounter: {N: aws.String("0")}}
+			m.items[key] = item
+		}
+		counter, _ := strconv.ParseInt(*item[dynamoDBLockCounter].N, 10, 64)
+		item[dynamoDBLockCounter] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(counter+1, 10))}
+		return &dynamodb.UpdateItemOutput{
+			Attributes: map[string]*dynamodb.AttributeValue{dynamoDBLockCounter: item[dynamoDBLockCounter]},
+		}, nil
+	}
+
+	if !ok || *input.ExpressionAttributeValues[":owner"].S != *item[dynamoDBLockOwner].S {
+		return nil, conditionalCheckFailed()
+	}
+	if expiresAt, ok := input.ExpressionAttributeValues[":expiresAt"]; ok {
+		item[dynamoDBLockExpiresAt] = expiresAt
+	}
+	item[dynamoDBLockHolder] = input.ExpressionAttributeValues[":holder"]
+	m.updates++
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (m *mockDynamoDBAPI) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return &dynamodb.GetItemOutput{Item: m.items[*input.Key[dynamoDBLockKey].S]}, nil
+}
+
+func (m *mockDynamoDBAPI) getUpdates() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.updates
+}
+
+func mockDynamoDBLock(svc *mockDynamoDBAPI, table, name string) *DynamoDBLock {
+	return &DynamoDBLock{svc: svc, table: table, key: name, lease: dynamoDBLockLease}
+}
+
+func TestDynamoDBLock(t *testing.T) {
+	assert := assert.New(t)
+
+	svc := newMockDynamoDBAPI()
+	lockName := "lock"
+	dl := mockDynamoDBLock(svc, "locks", lockName)
+
+	holder, err := dl.Holder()
+	assert.Nil(err)
+	assert.Nil(holder)
+
+	err = dl.TryLock()
+	assert.Nil(err)
+	assert.Equal(int64(1), dl.FencingToken())
+
+	holder, err = dl.Holder()
+	assert.Nil(err)
+	assert.NotNil(holder)
+	assert.True(holder.IsCurrent())
+	assert.Equal(int64(1), holder.FencingToken)
+
+	// fail if already locked
+	other := mockDynamoDBLock(svc, "locks", lockName)
+	err = other.TryLock()
+	assert.NotNil(err)
+	assert.Equal(LockHeldError("lock already held at "+lockName), err)
+	assert.Equal(int64(0), other.FencingToken())
+
+	// fail if already unlocked
+	err = dl.Unlock()
+	assert.Nil(err)
+
+	err = dl.Unlock()
+	assert.NotNil(err)
+	assert.Equal("lock not held", err.Error())
+
+	// fail if the table can't be written to
+	dl = mockDynamoDBLock(svc, "error", lockName)
+	err = dl.TryLock()
+	assert.NotNil(err)
+	assert.Equal("PutItem failed", err.Error())
+}
+
+func TestDynamoDBLock_Expiry(t *testing.T) {
+	assert := assert.New(t)
+
+	svc := newMockDynamoDBAPI()
+	lockName := "lock"
+	expired := LockHolder{Hostname: "other-host", User: "other-user", Pid: 1}
+	svc.items[lockName] = map[string]*dynamodb.AttributeValue{
+		dynamoDBLockKey:       {S: aws.String(lockName)},
+		dynamoDBLockOwner:     {S: aws.String("other-owner")},
+		dynamoDBLockHolder:    {S: aws.String(string(expired.Bytes()))},
+		dynamoDBLockExpiresAt: {N: aws.String(unixString(time.Now().Add(-time.Minute)))},
+	}
+
+	// an expired lock is not held and can be acquired
+	dl := mockDynamoDBLock(svc, "locks", lockName)
+	holder, err := dl.Holder()
+	assert.Nil(err)
+	assert.Nil(holder)
+
+	err = dl.TryLock()
+	assert.Nil(err)
+
+	// the previous holder can't refresh or release it anymore
+	previous := &DynamoDBLock{svc: svc, table: "locks", key: lockName, lease: dynamoDBLockLease,
+		owner: "other-owner"}
+	err = previous.Refresh()
+	assert.NotNil(err)
+	assert.Equal("lock at "+lockName+" is not held anymore", err.Error())
+	err = previous.Unlock()
+	assert.NotNil(err)
+	assert.Equal("lock at "+lockName+" was modified by someone else, it wasn't released", err.Error())
+
+	err = dl.Unlock()
+	assert.Nil(err)
+}
+
+func TestDynamoDBLock_Refresh(t *testing.T) {
+	assert := assert.New(t)
+
+	svc := newMockDynamoDBAPI()
+	lockName := "lock"
+	dl := mockDynamoDBLock(svc, "locks", lockName)
+
+	err := dl.Refresh()
+	assert.NotNil(err)
+	assert.Equal("lock at "+lockName+" was not acquired", err.Error())
+
+	err = dl.TryLock()
+	assert.Nil(err)
+
+	err = dl.Refresh()
+	assert.Nil(err)
+	assert.Equal(1, svc.getUpdates())
+
+	holder, err := dl.Holder()
+	assert.Nil(err)
+	assert.False(holder.RefreshedAt.IsZero())
+
+	// fencing tokens keep increasing across acquisitions
+	err = dl.Unlock()
+	assert.Nil(err)
+	err = dl.TryLock()
+	assert.Nil(err)
+	assert.Equal(int64(2), dl.FencingToken())
+
+	err = dl.Unlock()
+	assert.Nil(err)
+}
+
+func TestDynamoDBLock_UnlockRetry(t *testing.T) {
+	assert := assert.New(t)
+
+	svc := newMockDynamoDBAPI()
+	lockName := "lock"
+	dl := mockDynamoDBLock(svc, "locks", lockName)
+	err := dl.TryLock()
+	assert.Nil(err)
+
+	// a failed release can be retried
+	svc.deleteErrors = 1
+	err = dl.Unlock()
+	assert.NotNil(err)
+	assert.Equal("DeleteItem failed", err.Error())
+	err = dl.Unlock()
+	assert.Nil(err)
+
+	// a retried release doesn't delete the lock of the next holder
+	err = dl.TryLock()
+	assert.Nil(err)
+	svc.deleteErrors = 1
+	err = dl.Unlock()
+	assert.NotNil(err)
+	svc.items[lockName][dynamoDBLockOwner] = &dynamodb.AttributeValue{S: aws.String("next-owner")}
+	err = dl.Unlock()
+	assert.NotNil(err)
+	assert.Equal("lock at "+lockName+" was modified by someone else, it wasn't released", err.Error())
+	_, ok := svc.items[lockName]
+	assert.True(ok)
+}
+
+func TestDynamoDBLock_StaleHolder(t *testing.T) {
+	assert := assert.New(t)
+
+	svc := newMockDynamoDBAPI()
+	lockName := "lock"
+	first := mockDynamoDBLock(svc, "locks", lockName)
+	assert.Nil(first.TryLock())
+
+	// the lock changes hands between reading its holder and releasing it
+	reader := mockDynamoDBLock(svc, "locks", lockName)
+	holder, err := reader.Holder()
+	assert.Nil(err)
+	assert.Equal(int64(1), holder.FencingToken)
+	assert.Nil(first.Unlock())
+	second := mockDynamoDBLock(svc, "locks", lockName)
+	assert.Nil(second.TryLock())
+
+	err = reader.Unlock()
+	assert.NotNil(err)
+	assert.Equal("lock at "+lockName+" was modified by someone else, it wasn't released", err.Error())
+	assert.Equal(second.owner, *svc.items[lockName][dynamoDBLockOwner].S)
+
+	// the lock is released if it's still the one which was read, even if it can't be parsed
+	svc.items[lockName][dynamoDBLockHolder] = &dynamodb.AttributeValue{S: aws.String("garbage")}
+	_, err = reader.Holder()
+	assert.NotNil(err)
+	assert.Nil(reader.Unlock())
+	_, ok := svc.items[lockName]
+	assert.False(ok)
+
+	// a lock released in the meantime is reported as not held
+	assert.Nil(first.TryLock())
+	_, err = reader.Holder()
+	assert.Nil(err)
+	assert.Nil(first.Unlock())
+	err = reader.Unlock()
+	assert.NotNil(err)
+	assert.Equal("lock not held", err.Error())
+}
+
+func TestDynamoDBLock_Persistent(t *testing.T) {
+	assert := assert.New(t)
+
+	svc := newMockDynamoDBAPI()
+	hard := &DynamoDBLock{svc: svc, table: "locks", key: "hard"}
+	soft := &DynamoDBLock{svc: svc, table: "locks", key: "soft", lease: time.Second}
+	assert.Nil(hard.TryLock())
+	assert.Nil(soft.TryLock())
+	_, ok := svc.items["hard"][dynamoDBLockExpiresAt]
+	assert.False(ok)
+
+	// nothing refreshes the locks once the process holding them stopped
+	time.Sleep(2100 * time.Millisecond)
+
+	other := mockDynamoDBLock(svc, "locks", "soft")
+	assert.Nil(other.TryLock())
+
+	other = mockDynamoDBLock(svc, "locks", "hard")
+	holder, err := other.Holder()
+	assert.Nil(err)
+	assert.NotNil(holder)
+	assert.Equal(int64(1), holder.FencingToken)
+	err = other.TryLock()
+	assert.Equal(LockHeldError("lock already held at hard"), err)
+
+	// refreshing doesn't give the lock an expiry
+	assert.Nil(hard.Refresh())
+	_, ok = svc.items["hard"][dynamoDBLockExpiresAt]
+	assert.False(ok)
+	assert.Nil(hard.Unlock())
+}
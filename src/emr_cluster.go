@@ -20,7 +20,6 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/emr"
 	"github.com/aws/aws-sdk-go/service/emr/emriface"
 	log "github.com/sirupsen/logrus"
@@ -35,22 +34,17 @@ const (
 
 // EmrCluster is used for starting and terminating clusters
 type EmrCluster struct {
-	Config ClusterConfig
-	Svc    emriface.EMRAPI
+	Config    ClusterConfig
+	Svc       emriface.EMRAPI
+	Observers Observers
 }
 
 // InitEmrCluster creates a new EmrCluster instance
-func InitEmrCluster(clusterConfig ClusterConfig) (*EmrCluster, error) {
-	creds, err := GetCredentialsProvider(
-		clusterConfig.Credentials.AccessKeyId, clusterConfig.Credentials.SecretAccessKey)
+func InitEmrCluster(clusterConfig ClusterConfig, clients *AwsClients) (*EmrCluster, error) {
+	svc, err := clients.EMR(clusterConfig.Region, clusterConfig.Credentials)
 	if err != nil {
 		return nil, err
 	}
-
-	svc := emr.New(session.Must(session.NewSession()), &aws.Config{
-		Region:      aws.String(clusterConfig.Region),
-		Credentials: creds,
-	})
 	return &EmrCluster{
 		Config: clusterConfig,
 		Svc:    svc,
@@ -70,7 +64,7 @@ func (ec EmrCluster) TerminateJobFlow(jobflowID string) error {
 		return err
 	}
 
-	log.Info("Terminating EMR cluster with jobflow id '" + jobflowID + "'...")
+	log.WithField(fieldJobflowID, jobflowID).Info("Terminating EMR cluster with jobflow id '" + jobflowID + "'...")
 
 	_, err = ec.waitForState(jobflowID, "TERMINATED",
 		[]string{"TERMINATED_WITH_ERRORS", "TERMINATED"})
@@ -101,7 +95,9 @@ func (ec EmrCluster) runJobFlow(sleepTime int) (string, error) {
 			return "", err
 		}
 
-		log.Info("Launching EMR cluster with name '" + ec.Config.Name + "'...")
+		ec.Observers.ClusterLaunched(*resp.(*emr.RunJobFlowOutput).JobFlowId, ec.Config.Name)
+		log.WithField(fieldJobflowID, *resp.(*emr.RunJobFlowOutput).JobFlowId).
+			Info("Launching EMR cluster with name '" + ec.Config.Name + "'...")
 
 		clusterStatus, err := ec.waitForState(*resp.(*emr.RunJobFlowOutput).JobFlowId, "WAITING",
 			[]string{"TERMINATED_WITH_ERRORS", "TERMINATED", "TERMINATING", "WAITING"})
@@ -114,9 +110,13 @@ func (ec EmrCluster) runJobFlow(sleepTime int) (string, error) {
 			*clusterStatus.StateChangeReason.Code == "BOOTSTRAP_FAILURE" {
 
 			retryCount--
+			ec.Observers.ClusterBootstrapFailed(*resp.(*emr.RunJobFlowOutput).JobFlowId)
 
 			timeout := rand.Intn(sleepTime)
-			log.Error("Bootstrap failure detected, retrying in " + strconv.Itoa(timeout) + " seconds...")
+			log.WithFields(log.Fields{
+				fieldJobflowID: *resp.(*emr.RunJobFlowOutput).JobFlowId,
+				fieldState:     *clusterStatus.State,
+			}).Error("Bootstrap failure detected, retrying in " + strconv.Itoa(timeout) + " seconds...")
 			time.Sleep(time.Second * time.Duration(timeout))
 		} else {
 			done = true
@@ -138,30 +138,52 @@ func (ec EmrCluster) runJobFlow(sleepTime int) (string, error) {
 
 // waitForState blocks waiting for the EMR cluster to enter a certain state or
 // a failure exit state
-func (ec EmrCluster) waitForState(jobflowID string, neededState string, exitStates []string) (*emr.ClusterStatus, error) {
-	cluster := &emr.DescribeClusterInput{ClusterId: aws.String(jobflowID)}
-
-	resp, err := retry.ExponentialWithInterface(3, time.Second, "emr.DescribeCluster", func() (interface{}, error) {
-		return ec.Svc.DescribeCluster(cluster)
+func (ec EmrCluster) waitForState(jobflowID string, neededState string, exitStates []string) (status *emr.ClusterStatus, err error) {
+	ctx, done := ec.Observers.OperationStarted(aws.BackgroundContext(), "waitForState", log.Fields{
+		fieldJobflowID: jobflowID,
+		fieldState:     neededState,
 	})
+	defer func() { done(err) }()
+
+	cluster, err := ec.describeCluster(ctx, jobflowID)
 	if err != nil {
 		return nil, err
 	}
 
-	for !StringInSlice(*resp.(*emr.DescribeClusterOutput).Cluster.Status.State, exitStates) {
-		log.Info("EMR cluster is in state " + *resp.(*emr.DescribeClusterOutput).Cluster.Status.State + " - need state " + neededState + ", checking again in " + strconv.Itoa(invalidStateSleepSeconds) + " seconds...")
+	for !StringInSlice(*cluster.Status.State, exitStates) {
+		log.WithFields(log.Fields{
+			fieldJobflowID: jobflowID,
+			fieldState:     *cluster.Status.State,
+		}).Info("EMR cluster is in state " + *cluster.Status.State + " - need state " + neededState + ", checking again in " + strconv.Itoa(invalidStateSleepSeconds) + " seconds...")
 
 		time.Sleep(time.Second * invalidStateSleepSeconds)
 
-		resp, err = retry.ExponentialWithInterface(3, time.Second, "emr.DescribeCluster", func() (interface{}, error) {
-			return ec.Svc.DescribeCluster(cluster)
-		})
+		cluster, err = ec.describeCluster(ctx, jobflowID)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	return resp.(*emr.DescribeClusterOutput).Cluster.Status, nil
+	return cluster.Status, nil
+}
+
+// DescribeCluster retrieves the state of a cluster, notifying the observers
+func (ec EmrCluster) DescribeCluster(jobflowID string) (*emr.Cluster, error) {
+	return ec.describeCluster(aws.BackgroundContext(), jobflowID)
+}
+
+// describeCluster retrieves the state of a cluster within the context of an operation
+func (ec EmrCluster) describeCluster(ctx aws.Context, jobflowID string) (*emr.Cluster, error) {
+	input := &emr.DescribeClusterInput{ClusterId: aws.String(jobflowID)}
+	resp, err := retry.ExponentialWithInterface(3, time.Second, "emr.DescribeCluster", func() (interface{}, error) {
+		return ec.Svc.DescribeClusterWithContext(ctx, input)
+	})
+	if err != nil {
+		return nil, err
+	}
+	cluster := resp.(*emr.DescribeClusterOutput).Cluster
+	ec.Observers.ClusterChanged(cluster)
+	return cluster, nil
 }
 
 // --- Parameter builders
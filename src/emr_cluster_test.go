@@ -20,6 +20,7 @@ import (
 	"errors"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/emr"
 	"github.com/aws/aws-sdk-go/service/emr/emriface"
 	"github.com/stretchr/testify/assert"
@@ -36,6 +37,10 @@ func (m *mockEMRAPICluster) TerminateJobFlows(input *emr.TerminateJobFlowsInput)
 	return &emr.TerminateJobFlowsOutput{}, nil
 }
 
+func (m *mockEMRAPICluster) DescribeClusterWithContext(ctx aws.Context, input *emr.DescribeClusterInput, opts ...request.Option) (*emr.DescribeClusterOutput, error) {
+	return m.DescribeCluster(input)
+}
+
 // Mock using the cluster id of input to set the cluster state
 // ClusterId = "j-STARTING" will result in a cluster with the STARTING state
 func (m *mockEMRAPICluster) DescribeCluster(input *emr.DescribeClusterInput) (*emr.DescribeClusterOutput, error) {
@@ -98,21 +103,21 @@ func TestInitEmrCluster(t *testing.T) {
 
 	record, _ := CR.ParseClusterRecord([]byte(ClusterRecord1), nil, "")
 
-	ec, _ := InitEmrCluster(*record)
+	ec, _ := InitEmrCluster(*record, defaultAwsClients)
 	assert.NotNil(ec)
 
 	record.Credentials.SecretAccessKey = "hello"
-	_, err := InitEmrCluster(*record)
+	_, err := InitEmrCluster(*record, defaultAwsClients)
 	assert.NotNil(err)
 	assert.Equal("access-key and secret-key must both be set to 'env', or neither", err.Error())
 
 	record, _ = CR.ParseClusterRecord([]byte(ClusterRecord2), nil, "")
 
-	ec, _ = InitEmrCluster(*record)
+	ec, _ = InitEmrCluster(*record, defaultAwsClients)
 	assert.NotNil(ec)
 
 	record.Credentials.SecretAccessKey = "hello"
-	_, err = InitEmrCluster(*record)
+	_, err = InitEmrCluster(*record, defaultAwsClients)
 	assert.NotNil(err)
 	assert.Equal("access-key and secret-key must both be set to 'iam', or neither", err.Error())
 }
@@ -197,7 +202,7 @@ func TestGetJobFlowInput_Success(t *testing.T) {
 	record.Ec2.Instances.Core.Count = 1
 	record.Ec2.Instances.Task.Count = 1
 
-	ec, _ := InitEmrCluster(*record)
+	ec, _ := InitEmrCluster(*record, defaultAwsClients)
 	res, _ := ec.GetJobFlowInput(true)
 
 	assert.Equal(3, len(res.Instances.InstanceGroups))
@@ -206,7 +211,7 @@ func TestGetJobFlowInput_Success(t *testing.T) {
 	record.Ec2.Instances.Core.Count = 0
 	record.Ec2.Instances.Task.Count = 1
 
-	ec, _ = InitEmrCluster(*record)
+	ec, _ = InitEmrCluster(*record, defaultAwsClients)
 	res, _ = ec.GetJobFlowInput(true)
 
 	assert.Equal(2, len(res.Instances.InstanceGroups))
@@ -215,7 +220,7 @@ func TestGetJobFlowInput_Success(t *testing.T) {
 	record.Ec2.Instances.Core.Count = 1
 	record.Ec2.Instances.Task.Count = 0
 
-	ec, _ = InitEmrCluster(*record)
+	ec, _ = InitEmrCluster(*record, defaultAwsClients)
 	res, _ = ec.GetJobFlowInput(true)
 
 	assert.Equal(2, len(res.Instances.InstanceGroups))
@@ -224,7 +229,7 @@ func TestGetJobFlowInput_Success(t *testing.T) {
 	record.Ec2.Instances.Core.Count = 0
 	record.Ec2.Instances.Task.Count = 0
 
-	ec, _ = InitEmrCluster(*record)
+	ec, _ = InitEmrCluster(*record, defaultAwsClients)
 	res, _ = ec.GetJobFlowInput(true)
 
 	assert.Equal(1, len(res.Instances.InstanceGroups))
@@ -234,7 +239,7 @@ func TestGetJobFlowInput_Success(t *testing.T) {
 	record.Ec2.Location.Vpc = nil
 	record.Ec2.Location.Classic = &ClassicRecord{AvailabilityZone: "us-east-1a"}
 
-	ec, _ = InitEmrCluster(*record)
+	ec, _ = InitEmrCluster(*record, defaultAwsClients)
 	res, _ = ec.GetJobFlowInput(true)
 
 	assert.Equal("us-east-1a", *res.Instances.Placement.AvailabilityZone)
@@ -244,7 +249,7 @@ func TestGetJobFlowInput_Success(t *testing.T) {
 
 	record.Ec2.AmiVersion = "3.0.0"
 
-	ec, _ = InitEmrCluster(*record)
+	ec, _ = InitEmrCluster(*record, defaultAwsClients)
 	res, _ = ec.GetJobFlowInput(true)
 
 	assert.Equal("3.0.0", *res.AmiVersion)
@@ -253,7 +258,7 @@ func TestGetJobFlowInput_Success(t *testing.T) {
 
 	record.Ec2.AmiVersion = "4.5.0"
 
-	ec, _ = InitEmrCluster(*record)
+	ec, _ = InitEmrCluster(*record, defaultAwsClients)
 	res, _ = ec.GetJobFlowInput(true)
 
 	assert.Equal("emr-4.5.0", *res.ReleaseLabel)
@@ -262,7 +267,7 @@ func TestGetJobFlowInput_Success(t *testing.T) {
 
 	record.Ec2.AmiVersion = "hello"
 
-	ec, _ = InitEmrCluster(*record)
+	ec, _ = InitEmrCluster(*record, defaultAwsClients)
 	_, err := ec.GetJobFlowInput(true)
 
 	assert.Equal("strconv.Atoi: parsing \"h\": invalid syntax", err.Error())
@@ -274,7 +279,7 @@ func TestGetJobFlowInput_Fail(t *testing.T) {
 	record, _ := CR.ParseClusterRecord([]byte(ClusterRecord1), nil, "")
 
 	// fails if GetLocation fails
-	ec, _ := InitEmrCluster(*record)
+	ec, _ := InitEmrCluster(*record, defaultAwsClients)
 	res, err := ec.GetJobFlowInput(true)
 	assert.Nil(res)
 	assert.NotNil(err)
@@ -282,7 +287,7 @@ func TestGetJobFlowInput_Fail(t *testing.T) {
 
 	record.Ec2.Location.Vpc = nil
 	record.Ec2.Location.Classic = nil
-	ec, _ = InitEmrCluster(*record)
+	ec, _ = InitEmrCluster(*record, defaultAwsClients)
 	res, err = ec.GetJobFlowInput(true)
 	assert.Nil(res)
 	assert.NotNil(err)
@@ -291,7 +296,7 @@ func TestGetJobFlowInput_Fail(t *testing.T) {
 	// fails if GetApplications fails
 	record, _ = CR.ParseClusterRecord([]byte(ClusterRecord2), nil, "")
 	record.Applications = []string{"Snowplow"}
-	ec, _ = InitEmrCluster(*record)
+	ec, _ = InitEmrCluster(*record, defaultAwsClients)
 
 }
 
@@ -299,7 +304,7 @@ func TestGetInstanceGroups_NoEBS(t *testing.T) {
 	assert := assert.New(t)
 
 	record, _ := CR.ParseClusterRecord([]byte(ClusterRecord1), nil, "")
-	ec, _ := InitEmrCluster(*record)
+	ec, _ := InitEmrCluster(*record, defaultAwsClients)
 	groups := ec.GetInstanceGroups()
 	assert.Len(groups, 3)
 	expected := []*emr.InstanceGroupConfig{
@@ -330,7 +335,7 @@ func TestGetInstanceGroups_WithEBS(t *testing.T) {
 	assert := assert.New(t)
 
 	record, _ := CR.ParseClusterRecord([]byte(ClusterRecordWithEBS), nil, "")
-	ec, _ := InitEmrCluster(*record)
+	ec, _ := InitEmrCluster(*record, defaultAwsClients)
 	groups := ec.GetInstanceGroups()
 	assert.Len(groups, 3)
 	expected := []*emr.InstanceGroupConfig{
@@ -399,7 +404,7 @@ func TestGetInstanceGroups_WithGP3(t *testing.T) {
 	assert := assert.New(t)
 
 	record, _ := CR.ParseClusterRecord([]byte(ClusterRecordWithGP3), nil, "")
-	ec, _ := InitEmrCluster(*record)
+	ec, _ := InitEmrCluster(*record, defaultAwsClients)
 	groups := ec.GetInstanceGroups()
 	assert.Len(groups, 3)
 	expected := []*emr.InstanceGroupConfig{
@@ -466,13 +471,13 @@ func TestGetInstanceGroups_WithGP3(t *testing.T) {
 
 func TestGetTags_NoTags(t *testing.T) {
 	record, _ := CR.ParseClusterRecord([]byte(ClusterRecord1), nil, "")
-	ec, _ := InitEmrCluster(*record)
+	ec, _ := InitEmrCluster(*record, defaultAwsClients)
 	assert.Nil(t, ec.GetTags())
 }
 
 func TestGetTags_WithTags(t *testing.T) {
 	record, _ := CR.ParseClusterRecord([]byte(ClusterRecordWithTags), nil, "")
-	ec, _ := InitEmrCluster(*record)
+	ec, _ := InitEmrCluster(*record, defaultAwsClients)
 	tags := ec.GetTags()
 	assert.Len(t, tags, 1)
 	expected := &emr.Tag{
@@ -484,13 +489,13 @@ func TestGetTags_WithTags(t *testing.T) {
 
 func TestGetBootstrapActions_NoActions(t *testing.T) {
 	record, _ := CR.ParseClusterRecord([]byte(ClusterRecord1), nil, "")
-	ec, _ := InitEmrCluster(*record)
+	ec, _ := InitEmrCluster(*record, defaultAwsClients)
 	assert.Nil(t, ec.GetBootstrapActions())
 }
 
 func TestGetBootstrapActions_WithActions(t *testing.T) {
 	record, _ := CR.ParseClusterRecord([]byte(ClusterRecordWithActions), nil, "")
-	ec, _ := InitEmrCluster(*record)
+	ec, _ := InitEmrCluster(*record, defaultAwsClients)
 	actions := ec.GetBootstrapActions()
 	assert.Len(t, actions, 1)
 	expected := &emr.BootstrapActionConfig{
@@ -505,13 +510,13 @@ func TestGetBootstrapActions_WithActions(t *testing.T) {
 
 func TestGetConfigurations_NoConfigs(t *testing.T) {
 	record, _ := CR.ParseClusterRecord([]byte(ClusterRecord1), nil, "")
-	ec, _ := InitEmrCluster(*record)
+	ec, _ := InitEmrCluster(*record, defaultAwsClients)
 	assert.Nil(t, ec.GetConfigurations())
 }
 
 func TestGetConfigurations_WithConfigs(t *testing.T) {
 	record, _ := CR.ParseClusterRecord([]byte(ClusterRecordWithConfigs), nil, "")
-	ec, _ := InitEmrCluster(*record)
+	ec, _ := InitEmrCluster(*record, defaultAwsClients)
 	configs := ec.GetConfigurations()
 	assert.Len(t, configs, 1)
 	expected := &emr.Configuration{
@@ -523,7 +528,7 @@ func TestGetConfigurations_WithConfigs(t *testing.T) {
 
 func TestGetApplications_NoApps(t *testing.T) {
 	record, _ := CR.ParseClusterRecord([]byte(ClusterRecord1), nil, "")
-	ec, _ := InitEmrCluster(*record)
+	ec, _ := InitEmrCluster(*record, defaultAwsClients)
 	apps, err := ec.GetApplications()
 	assert.Nil(t, apps)
 	assert.Nil(t, err)
@@ -532,7 +537,7 @@ func TestGetApplications_NoApps(t *testing.T) {
 func TestGetApplications_WithApps(t *testing.T) {
 	assert := assert.New(t)
 	record, _ := CR.ParseClusterRecord([]byte(ClusterRecordWithApps), nil, "")
-	ec, _ := InitEmrCluster(*record)
+	ec, _ := InitEmrCluster(*record, defaultAwsClients)
 	apps, _ := ec.GetApplications()
 	assert.Len(apps, 2)
 	assert.Equal(aws.String("Hadoop"), apps[0].Name)
@@ -542,7 +547,7 @@ func TestGetApplications_WithApps(t *testing.T) {
 func TestGetLocation_Fail(t *testing.T) {
 	assert := assert.New(t)
 	record, _ := CR.ParseClusterRecord([]byte(ClusterRecord1), nil, "")
-	ec, _ := InitEmrCluster(*record)
+	ec, _ := InitEmrCluster(*record, defaultAwsClients)
 
 	_, _, err := ec.GetLocation()
 	assert.NotNil(err)
@@ -559,7 +564,7 @@ func TestGetLocation_Success(t *testing.T) {
 	assert := assert.New(t)
 
 	record, _ := CR.ParseClusterRecord([]byte(ClusterRecord2), nil, "")
-	ec, _ := InitEmrCluster(*record)
+	ec, _ := InitEmrCluster(*record, defaultAwsClients)
 
 	s, p, err := ec.GetLocation()
 	assert.Nil(err)
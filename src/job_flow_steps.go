@@ -20,7 +20,6 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/emr"
 	"github.com/aws/aws-sdk-go/service/emr/emriface"
 	"github.com/hashicorp/errwrap"
@@ -34,21 +33,16 @@ type JobFlowSteps struct {
 	JobflowID  string
 	IsBlocking bool
 	EmrSvc     emriface.EMRAPI
+	Observers  Observers
 }
 
 // InitJobFlowSteps creates a new JobFlowSteps instance
-func InitJobFlowSteps(playbookConfig PlaybookConfig, jobflowID string, isAsync bool) (*JobFlowSteps, error) {
-	creds, err := GetCredentialsProvider(
-		playbookConfig.Credentials.AccessKeyId, playbookConfig.Credentials.SecretAccessKey)
+func InitJobFlowSteps(playbookConfig PlaybookConfig, jobflowID string, isAsync bool, clients *AwsClients) (*JobFlowSteps, error) {
+	emrSvc, err := clients.EMR(playbookConfig.Region, playbookConfig.Credentials)
 	if err != nil {
 		return nil, err
 	}
 
-	emrSvc := emr.New(session.Must(session.NewSession()), &aws.Config{
-		Region:      aws.String(playbookConfig.Region),
-		Credentials: creds,
-	})
-
 	return &JobFlowSteps{
 		Config:     playbookConfig,
 		JobflowID:  jobflowID,
@@ -67,8 +61,8 @@ func (jfs JobFlowSteps) GetFailedStepIDs() ([]string, error) {
 	done := false
 	errorCount := 0
 	failedStepsIDs := []string{}
-	historicalInfoLogs := []string{}
-	historicalErrorLogs := []string{}
+	historicalInfoLogs := []StepLog{}
+	historicalErrorLogs := []StepLog{}
 
 	for done == false && jfs.IsBlocking == true {
 		successCount, errCount, fStepsIDs, infoLogs, errorLogs, err :=
@@ -78,11 +72,11 @@ func (jfs JobFlowSteps) GetFailedStepIDs() ([]string, error) {
 		}
 		errorCount = errCount
 
-		for _, l := range Diff(historicalInfoLogs, infoLogs) {
-			log.Info(l)
+		for _, l := range DiffStepLogs(historicalInfoLogs, infoLogs) {
+			log.WithFields(l.Fields).Info(l.Message)
 		}
-		for _, l := range Diff(historicalErrorLogs, errorLogs) {
-			log.Error(l)
+		for _, l := range DiffStepLogs(historicalErrorLogs, errorLogs) {
+			log.WithFields(l.Fields).Error(l.Message)
 		}
 		historicalInfoLogs = infoLogs
 		historicalErrorLogs = errorLogs
@@ -114,8 +108,8 @@ func (jfs JobFlowSteps) AddJobFlowSteps() ([]string, error) {
 	done := false
 	errorCount := 0
 	failedStepsIDs := []string{}
-	historicalInfoLogs := []string{}
-	historicalErrorLogs := []string{}
+	historicalInfoLogs := []StepLog{}
+	historicalErrorLogs := []StepLog{}
 
 	addJobFlowStepsOutput, err := retry.ExponentialWithInterface(3, time.Second, "emr.AddJobFlowSteps", func() (interface{}, error) {
 		return jfs.EmrSvc.AddJobFlowSteps(params)
@@ -123,8 +117,9 @@ func (jfs JobFlowSteps) AddJobFlowSteps() ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
+	jfs.Observers.StepsSubmitted(jfs.JobflowID, params.Steps, addJobFlowStepsOutput.(*emr.AddJobFlowStepsOutput).StepIds)
 
-	log.Info("Successfully added " + strconv.Itoa(len(jfs.Config.Steps)) +
+	log.WithField(fieldJobflowID, jfs.JobflowID).Info("Successfully added " + strconv.Itoa(len(jfs.Config.Steps)) +
 		" steps to the EMR cluster with jobflow id '" + jfs.JobflowID + "'...")
 
 	for done == false && jfs.IsBlocking == true {
@@ -135,11 +130,11 @@ func (jfs JobFlowSteps) AddJobFlowSteps() ([]string, error) {
 		}
 		errorCount = errCount
 
-		for _, l := range Diff(historicalInfoLogs, infoLogs) {
-			log.Info(l)
+		for _, l := range DiffStepLogs(historicalInfoLogs, infoLogs) {
+			log.WithFields(l.Fields).Info(l.Message)
 		}
-		for _, l := range Diff(historicalErrorLogs, errorLogs) {
-			log.Error(l)
+		for _, l := range DiffStepLogs(historicalErrorLogs, errorLogs) {
+			log.WithFields(l.Fields).Error(l.Message)
 		}
 		historicalInfoLogs = infoLogs
 		historicalErrorLogs = errorLogs
@@ -184,9 +179,9 @@ func (jfs JobFlowSteps) GetStepIDs() ([]*string, error) {
 
 // RetrieveStepsStates retrieves the states of all the steps for a job flow returning the state
 // of every step as well as information about success or failure for each one
-func (jfs JobFlowSteps) RetrieveStepsStates(stepIDs []*string) (int, int, []string, []string, []string, error) {
-	infoLogs := make([]string, 0)
-	errorLogs := make([]string, 0)
+func (jfs JobFlowSteps) RetrieveStepsStates(stepIDs []*string) (int, int, []string, []StepLog, []StepLog, error) {
+	infoLogs := make([]StepLog, 0)
+	errorLogs := make([]StepLog, 0)
 	failedStepsIDs := make([]string, 0)
 	successCount := 0
 	errorCount := 0
@@ -212,7 +207,7 @@ func (jfs JobFlowSteps) RetrieveStepsStates(stepIDs []*string) (int, int, []stri
 
 // RetrieveStepState retrieves the state of a particular step, optionally retrieving the logs if
 // it failed, also returns the step status
-func (jfs JobFlowSteps) RetrieveStepState(stepID string) (string, []string, error) {
+func (jfs JobFlowSteps) RetrieveStepState(stepID string) (string, []StepLog, error) {
 	describeStepInput := &emr.DescribeStepInput{
 		ClusterId: aws.String(jfs.JobflowID),
 		StepId:    aws.String(stepID),
@@ -224,22 +219,64 @@ func (jfs JobFlowSteps) RetrieveStepState(stepID string) (string, []string, erro
 		return "", nil, errwrap.Wrapf("Couldn't retrieve step "+stepID+" state: {{err}}", err)
 	}
 
-	logs := make([]string, 0)
+	jfs.Observers.StepChanged(jfs.JobflowID, dso.(*emr.DescribeStepOutput).Step)
+
+	logs := make([]StepLog, 0)
+	fields := jfs.stepFields(dso.(*emr.DescribeStepOutput).Step)
 	logMessageHead := "Step '" + *dso.(*emr.DescribeStepOutput).Step.Name + "' with id '" + *dso.(*emr.DescribeStepOutput).Step.Id
 	if *dso.(*emr.DescribeStepOutput).Step.Status.State == "COMPLETED" {
-		logs = append(logs, logMessageHead+"' completed successfully"+jfs.CreateStepStartFinishTimeLog(dso.(*emr.DescribeStepOutput)))
+		logs = append(logs, StepLog{logMessageHead + "' completed successfully" + jfs.CreateStepStartFinishTimeLog(dso.(*emr.DescribeStepOutput)), fields})
 	} else if *dso.(*emr.DescribeStepOutput).Step.Status.State == "FAILED" {
-		logs = append(logs, logMessageHead+"' was FAILED"+jfs.CreateStepStartFinishTimeLog(dso.(*emr.DescribeStepOutput)))
+		logs = append(logs, StepLog{logMessageHead + "' was FAILED" + jfs.CreateStepStartFinishTimeLog(dso.(*emr.DescribeStepOutput)), fields})
 	} else if *dso.(*emr.DescribeStepOutput).Step.Status.State == "CANCELLED" {
-		logs = append(logs, logMessageHead+"' was CANCELLED")
+		logs = append(logs, StepLog{logMessageHead + "' was CANCELLED", fields})
 	}
 	return *dso.(*emr.DescribeStepOutput).Step.Status.State, logs, nil
 }
 
+// stepFields returns the log fields describing a step and its state
+func (jfs JobFlowSteps) stepFields(step *emr.Step) log.Fields {
+	fields := log.Fields{
+		fieldJobflowID: jfs.JobflowID,
+		fieldStepID:    aws.StringValue(step.Id),
+		fieldStepName:  aws.StringValue(step.Name),
+		fieldState:     aws.StringValue(step.Status.State),
+	}
+	if timeline := step.Status.Timeline; timeline != nil {
+		if timeline.StartDateTime != nil {
+			fields[fieldStartTime] = timeline.StartDateTime.Format(logTimeFormat)
+		}
+		if timeline.EndDateTime != nil {
+			fields[fieldEndTime] = timeline.EndDateTime.Format(logTimeFormat)
+		}
+	}
+	return fields
+}
+
+// StepLog is a message about the state of a step along with the fields describing the step
+type StepLog struct {
+	Message string
+	Fields  log.Fields
+}
+
+// DiffStepLogs returns the logs of b whose message isn't in a
+func DiffStepLogs(a, b []StepLog) []StepLog {
+	m := make(map[string]bool)
+	for _, l := range a {
+		m[l.Message] = true
+	}
+	d := make([]StepLog, 0)
+	for _, l := range b {
+		if !m[l.Message] {
+			d = append(d, l)
+		}
+	}
+	return d
+}
+
 func (jfs JobFlowSteps) CreateStepStartFinishTimeLog(dso *emr.DescribeStepOutput) string {
-	timeFormat := "2006-01-02T15:04:05Z"
-	return " - StartTime: " + (*dso.Step.Status.Timeline.StartDateTime).Format(timeFormat) +
-		" - EndTime: " + (*dso.Step.Status.Timeline.EndDateTime).Format(timeFormat)
+	return " - StartTime: " + (*dso.Step.Status.Timeline.StartDateTime).Format(logTimeFormat) +
+		" - EndTime: " + (*dso.Step.Status.Timeline.EndDateTime).Format(logTimeFormat)
 }
 
 // GetJobFlowStepsInput parses the config given to it and
@@ -25,6 +25,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/emr"
 	"github.com/aws/aws-sdk-go/service/emr/emriface"
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -94,21 +95,21 @@ func TestInitJobFlowSteps(t *testing.T) {
 
 	record, _ := CR.ParsePlaybookRecord([]byte(PlaybookRecord1), nil, "")
 
-	jfs, _ := InitJobFlowSteps(*record, "j-id", true)
+	jfs, _ := InitJobFlowSteps(*record, "j-id", true, defaultAwsClients)
 	assert.NotNil(jfs)
 
 	record.Credentials.SecretAccessKey = "hello"
-	_, err := InitJobFlowSteps(*record, "j-id", true)
+	_, err := InitJobFlowSteps(*record, "j-id", true, defaultAwsClients)
 	assert.NotNil(err)
 	assert.Equal("access-key and secret-key must both be set to 'env', or neither", err.Error())
 
 	record.Credentials.AccessKeyId = "iam"
-	_, err = InitJobFlowSteps(*record, "j-id", true)
+	_, err = InitJobFlowSteps(*record, "j-id", true, defaultAwsClients)
 	assert.NotNil(err)
 	assert.Equal("access-key and secret-key must both be set to 'iam', or neither", err.Error())
 
 	record.Credentials.SecretAccessKey = "iam"
-	jfs, _ = InitJobFlowSteps(*record, "j-id", true)
+	jfs, _ = InitJobFlowSteps(*record, "j-id", true, defaultAwsClients)
 	assert.NotNil(jfs)
 }
 
@@ -158,7 +159,7 @@ func TestGetJobFlowStepsInput_Success(t *testing.T) {
 	assert := assert.New(t)
 
 	record, _ := CR.ParsePlaybookRecord([]byte(PlaybookRecord1), nil, "")
-	jfs, _ := InitJobFlowSteps(*record, "jobflow-id", true)
+	jfs, _ := InitJobFlowSteps(*record, "jobflow-id", true, defaultAwsClients)
 
 	assert.NotNil(jfs)
 
@@ -173,7 +174,7 @@ func TestGetJobFlowStepsInput_Fail(t *testing.T) {
 	assert := assert.New(t)
 
 	record, _ := CR.ParsePlaybookRecord([]byte(PlaybookRecord1), nil, "")
-	jfs, _ := InitJobFlowSteps(*record, "jobflow-id", true)
+	jfs, _ := InitJobFlowSteps(*record, "jobflow-id", true, defaultAwsClients)
 
 	assert.NotNil(jfs)
 
@@ -201,7 +202,7 @@ func TestRetrieveStepsStates(t *testing.T) {
 	assert.NotNil(failedStepsIds)
 	assert.Equal(0, len(failedStepsIds))
 	assert.NotNil(infoLogs)
-	assert.Equal([]string{"Step 'step' with id 'step-id' completed successfully - StartTime: 2019-10-10T23:00:00Z - EndTime: 2019-10-10T23:00:00Z"}, infoLogs)
+	assert.Equal([]string{"Step 'step' with id 'step-id' completed successfully - StartTime: 2019-10-10T23:00:00Z - EndTime: 2019-10-10T23:00:00Z"}, stepLogMessages(infoLogs))
 	assert.NotNil(errorLogs)
 	assert.Equal(0, len(errorLogs))
 	assert.Nil(err)
@@ -215,7 +216,7 @@ func TestRetrieveStepsStates(t *testing.T) {
 	assert.NotNil(infoLogs)
 	assert.Equal(0, len(infoLogs))
 	assert.NotNil(errorLogs)
-	assert.Equal([]string{"Step 'step' with id 'step-id' was CANCELLED"}, errorLogs)
+	assert.Equal([]string{"Step 'step' with id 'step-id' was CANCELLED"}, stepLogMessages(errorLogs))
 	assert.Nil(err)
 }
 
@@ -243,7 +244,15 @@ func TestRetrieveStepState(t *testing.T) {
 	state, logs, err := jfs.RetrieveStepState(stepID)
 	assert.Equal("COMPLETED", state)
 	assert.NotNil(logs)
-	assert.Equal([]string{"Step 'step' with id 'step-id' completed successfully - StartTime: 2019-10-10T23:00:00Z - EndTime: 2019-10-10T23:00:00Z"}, logs)
+	assert.Equal([]string{"Step 'step' with id 'step-id' completed successfully - StartTime: 2019-10-10T23:00:00Z - EndTime: 2019-10-10T23:00:00Z"}, stepLogMessages(logs))
+	assert.Equal(log.Fields{
+		"jobflow_id": "j-COMPLETED",
+		"step_id":    "step-id",
+		"step_name":  "step",
+		"state":      "COMPLETED",
+		"start_time": "2019-10-10T23:00:00Z",
+		"end_time":   "2019-10-10T23:00:00Z",
+	}, logs[0].Fields)
 	assert.Nil(err)
 
 	// log cancelled steps
@@ -251,7 +260,7 @@ func TestRetrieveStepState(t *testing.T) {
 	state, logs, err = jfs.RetrieveStepState(stepID)
 	assert.Equal("CANCELLED", state)
 	assert.NotNil(logs)
-	assert.Equal([]string{"Step 'step' with id 'step-id' was CANCELLED"}, logs)
+	assert.Equal([]string{"Step 'step' with id 'step-id' was CANCELLED"}, stepLogMessages(logs))
 	assert.Nil(err)
 
 	// outputs the failed step log
@@ -259,17 +268,34 @@ func TestRetrieveStepState(t *testing.T) {
 	state, logs, err = jfs.RetrieveStepState(stepID)
 	assert.Equal("FAILED", state)
 	assert.NotNil(logs)
-	assert.Equal([]string{"Step 'step' with id 'step-id' was FAILED - StartTime: 2019-10-10T23:00:00Z - EndTime: 2019-10-10T23:00:00Z"}, logs)
+	assert.Equal([]string{"Step 'step' with id 'step-id' was FAILED - StartTime: 2019-10-10T23:00:00Z - EndTime: 2019-10-10T23:00:00Z"}, stepLogMessages(logs))
 	assert.Nil(err)
 
 	// ignores steps that are running
 	jfs = mockJobFlowStepsWithoutPlaybook("j-RUNNING")
 	state, logs, err = jfs.RetrieveStepState(stepID)
 	assert.Equal("RUNNING", state)
-	assert.Equal([]string{}, logs)
+	assert.Equal([]StepLog{}, logs)
 	assert.Nil(err)
 }
 
+func TestDiffStepLogs(t *testing.T) {
+	assert := assert.New(t)
+
+	a := StepLog{"a", log.Fields{fieldStepID: "a"}}
+	b := StepLog{"b", log.Fields{fieldStepID: "b"}}
+	assert.Equal([]StepLog{a}, DiffStepLogs([]StepLog{b}, []StepLog{a, b}))
+	assert.Equal([]StepLog{}, DiffStepLogs([]StepLog{a, b}, []StepLog{a}))
+}
+
+func stepLogMessages(logs []StepLog) []string {
+	messages := make([]string, len(logs))
+	for i, l := range logs {
+		messages[i] = l.Message
+	}
+	return messages
+}
+
 func TestRetrieveStepState_Fail(t *testing.T) {
 	assert := assert.New(t)
 	stepID := "step-id"
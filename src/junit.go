@@ -0,0 +1,226 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/emr"
+)
+
+const (
+	// junitDefaultName names the test suite if the report isn't named
+	junitDefaultName = "dataflow-runner"
+	// junitStderrTailLines is the number of lines at the end of the stderr of a failed step
+	// which are reported
+	junitStderrTailLines = 50
+)
+
+// JUnitReport renders the steps of a run as the test cases of a JUnit XML report
+type JUnitReport struct {
+	NopObserver
+	// Name names the test suite and classifies its test cases, usually the playbook
+	Name string
+
+	mu        sync.Mutex
+	jobflowID string
+	steps     []*junitStep
+}
+
+type junitStep struct {
+	id       string
+	name     string
+	state    string
+	duration float64
+	reason   string
+	message  string
+	stderr   string
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name       string           `xml:"name,attr"`
+	Tests      int              `xml:"tests,attr"`
+	Failures   int              `xml:"failures,attr"`
+	Errors     int              `xml:"errors,attr"`
+	Skipped    int              `xml:"skipped,attr"`
+	Time       string           `xml:"time,attr"`
+	Properties *junitProperties `xml:"properties"`
+	TestCases  []junitTestCase  `xml:"testcase"`
+}
+
+type junitProperties struct {
+	Properties []junitProperty `xml:"property"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestCase struct {
+	Name      string       `xml:"name,attr"`
+	ClassName string       `xml:"classname,attr"`
+	Time      string       `xml:"time,attr"`
+	Failure   *junitResult `xml:"failure,omitempty"`
+	Error     *junitResult `xml:"error,omitempty"`
+	Skipped   *junitResult `xml:"skipped,omitempty"`
+}
+
+type junitResult struct {
+	Message string `xml:"message,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+// NewJUnitReport builds an empty JUnitReport
+func NewJUnitReport() *JUnitReport {
+	return &JUnitReport{Name: junitDefaultName}
+}
+
+// StepsSubmitted adds the steps as test cases which haven't run yet
+func (r *JUnitReport) StepsSubmitted(jobflowID string, steps []*emr.StepConfig, stepIDs []*string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.jobflowID = jobflowID
+	for i, stepID := range stepIDs {
+		step := r.step(aws.StringValue(stepID))
+		if i < len(steps) {
+			step.name = Redact(aws.StringValue(steps[i].Name))
+		}
+		if step.state == "" {
+			step.state = emr.StepStatePending
+		}
+	}
+}
+
+// StepChanged records the outcome and duration of a step
+func (r *JUnitReport) StepChanged(jobflowID string, step *emr.Step) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.jobflowID = jobflowID
+	reported := r.step(aws.StringValue(step.Id))
+	reported.name = Redact(aws.StringValue(step.Name))
+	if status := step.Status; status != nil {
+		reported.state = aws.StringValue(status.State)
+		if timeline := status.Timeline; timeline != nil && timeline.StartDateTime != nil && timeline.EndDateTime != nil {
+			reported.duration = timeline.EndDateTime.Sub(*timeline.StartDateTime).Seconds()
+		}
+		if details := status.FailureDetails; details != nil {
+			reported.reason = Redact(aws.StringValue(details.Reason))
+			reported.message = Redact(aws.StringValue(details.Message))
+		}
+	}
+}
+
+// StepLogs records the end of the stderr of a step
+func (r *JUnitReport) StepLogs(jobflowID, stepID string, logs map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for name, content := range logs {
+		if strings.HasPrefix(name, "stderr") {
+			r.step(stepID).stderr = tailLines(Redact(content), junitStderrTailLines)
+		}
+	}
+}
+
+// WriteFile writes the report as JUnit XML to a file. Failed steps are reported as failures,
+// interrupted ones as errors and the ones which were cancelled or didn't finish as skipped.
+func (r *JUnitReport) WriteFile(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	suite := junitTestSuite{Name: r.Name, Tests: len(r.steps), TestCases: []junitTestCase{}}
+	if r.jobflowID != "" {
+		suite.Properties = &junitProperties{[]junitProperty{{Name: fieldJobflowID, Value: r.jobflowID}}}
+	}
+	total := 0.0
+	for _, step := range r.steps {
+		testCase := junitTestCase{Name: step.name, ClassName: r.Name, Time: junitTime(step.duration)}
+		switch step.state {
+		case emr.StepStateCompleted:
+		case emr.StepStateFailed:
+			suite.Failures++
+			testCase.Failure = &junitResult{Message: step.failureMessage(), Text: step.failureText()}
+		case emr.StepStateInterrupted:
+			suite.Errors++
+			testCase.Error = &junitResult{Message: "Step " + step.id + " was INTERRUPTED"}
+		default:
+			suite.Skipped++
+			testCase.Skipped = &junitResult{Message: "Step " + step.id + " was " + step.state}
+		}
+		total += step.duration
+		suite.TestCases = append(suite.TestCases, testCase)
+	}
+	suite.Time = junitTime(total)
+
+	content, err := xml.MarshalIndent(junitTestSuites{Suites: []junitTestSuite{suite}}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append([]byte(xml.Header), append(content, '\n')...), 0644)
+}
+
+// step returns the reported step with the given id, adding it if it's not reported yet
+func (r *JUnitReport) step(stepID string) *junitStep {
+	for _, step := range r.steps {
+		if step.id == stepID {
+			return step
+		}
+	}
+	step := &junitStep{id: stepID}
+	r.steps = append(r.steps, step)
+	return step
+}
+
+func (s *junitStep) failureMessage() string {
+	if s.reason != "" {
+		return s.reason
+	}
+	return "Step " + s.id + " was FAILED"
+}
+
+func (s *junitStep) failureText() string {
+	parts := []string{}
+	for _, part := range []string{s.message, s.stderr} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+func junitTime(seconds float64) string {
+	return strconv.FormatFloat(seconds, 'f', 3, 64)
+}
+
+// tailLines returns the last n lines of a string
+func tailLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
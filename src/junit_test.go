@@ -0,0 +1,132 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/emr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJUnitReport(t *testing.T) {
+	assert := assert.New(t)
+	report := NewJUnitReport()
+	report.Name = "playbook.json"
+
+	names := []string{"load", "check", "cleanup", "archive"}
+	steps := make([]*emr.StepConfig, len(names))
+	stepIDs := make([]*string, len(names))
+	for i, name := range names {
+		steps[i] = &emr.StepConfig{Name: aws.String(name)}
+		stepIDs[i] = aws.String("s-" + strconv.Itoa(i))
+	}
+	observers := Observers{report}
+	observers.StepsSubmitted("j-123", steps, stepIDs)
+
+	start := time.Date(2019, time.October, 10, 23, 0, 0, 0, time.UTC)
+	end := start.Add(90 * time.Second)
+	observers.StepChanged("j-123", &emr.Step{Id: stepIDs[0], Name: aws.String("load"), Status: &emr.StepStatus{
+		State:    aws.String("COMPLETED"),
+		Timeline: &emr.StepTimeline{StartDateTime: &start, EndDateTime: &end},
+	}})
+	observers.StepChanged("j-123", &emr.Step{Id: stepIDs[1], Name: aws.String("check"), Status: &emr.StepStatus{
+		State:          aws.String("FAILED"),
+		Timeline:       &emr.StepTimeline{StartDateTime: &end, EndDateTime: &end},
+		FailureDetails: &emr.FailureDetails{Reason: aws.String("Unknown Error."), Message: aws.String("Exit code 1")},
+	}})
+	observers.StepChanged("j-123", &emr.Step{Id: stepIDs[2], Name: aws.String("cleanup"), Status: &emr.StepStatus{
+		State: aws.String("CANCELLED"),
+	}})
+	stderr := []string{}
+	for i := 0; i < 60; i++ {
+		stderr = append(stderr, "line "+strconv.Itoa(i))
+	}
+	observers.StepLogs("j-123", "s-1", map[string]string{
+		"stdout.gz": "ignored",
+		"stderr.gz": strings.Join(stderr, "\n") + "\n",
+	})
+
+	dir, _ := ioutil.TempDir("", "test-junit")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "junit.xml")
+	assert.Nil(report.WriteFile(path))
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+
+	assert.Equal(`<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="playbook.json" tests="4" failures="1" errors="0" skipped="2" time="90.000">
+    <properties>
+      <property name="jobflow_id" value="j-123"></property>
+    </properties>
+    <testcase name="load" classname="playbook.json" time="90.000"></testcase>
+    <testcase name="check" classname="playbook.json" time="0.000">
+      <failure message="Unknown Error.">Exit code 1&#xA;`+strings.Join(stderr[10:], "&#xA;")+`</failure>
+    </testcase>
+    <testcase name="cleanup" classname="playbook.json" time="0.000">
+      <skipped message="Step s-2 was CANCELLED"></skipped>
+    </testcase>
+    <testcase name="archive" classname="playbook.json" time="0.000">
+      <skipped message="Step s-3 was PENDING"></skipped>
+    </testcase>
+  </testsuite>
+</testsuites>
+`, string(content))
+}
+
+func TestJUnitReport_Redacted(t *testing.T) {
+	assert := assert.New(t)
+	report := NewJUnitReport()
+
+	// secrets passed to the steps don't end up in the report
+	MarkSensitive("junit-secret")
+	observers := Observers{report}
+	observers.StepsSubmitted("j-123", []*emr.StepConfig{{Name: aws.String("load junit-secret")}},
+		[]*string{aws.String("s-0")})
+	observers.StepChanged("j-123", &emr.Step{Id: aws.String("s-0"), Name: aws.String("load junit-secret"),
+		Status: &emr.StepStatus{
+			State: aws.String("FAILED"),
+			FailureDetails: &emr.FailureDetails{
+				Reason:  aws.String("Wrong password junit-secret"),
+				Message: aws.String("Login failed with junit-secret"),
+			},
+		}})
+
+	dir, _ := ioutil.TempDir("", "test-junit")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "junit.xml")
+	assert.Nil(report.WriteFile(path))
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+
+	assert.NotContains(string(content), "junit-secret")
+	assert.Contains(string(content), `<testcase name="load `+redacted+`"`)
+	assert.Contains(string(content), `<failure message="Wrong password `+redacted+`">Login failed with `+redacted+`</failure>`)
+}
+
+func TestTailLines(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("b\nc", tailLines("a\nb\nc\n", 2))
+	assert.Equal("a\nb", tailLines("a\nb", 5))
+	assert.Equal("", tailLines("", 5))
+}
@@ -14,16 +14,38 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
+	"os/user"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"io/ioutil"
 
 	"github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
 )
 
+const (
+	LockBackendFile     = "file"
+	LockBackendConsul   = "consul"
+	LockBackendDynamoDB = "dynamodb"
+	LockBackendS3       = "s3"
+)
+
+const (
+	lockRefreshInterval         = time.Minute
+	fileFenceGuardTimeout       = 10 * time.Second
+	fileFenceGuardRetryInterval = 10 * time.Millisecond
+)
+
+var lockBackends = []string{LockBackendFile, LockBackendConsul, LockBackendDynamoDB, LockBackendS3}
+
 type LockHeldError string
 
 func (l LockHeldError) Error() string { return string(l) }
@@ -32,11 +54,212 @@ func (l LockHeldError) Error() string { return string(l) }
 type Lock interface {
 	TryLock() error
 	Unlock() error
+	Holder() (*LockHolder, error)
+	// Refresh proves the holder is still alive, failing if the lock was released or acquired by
+	// someone else in the meantime
+	Refresh() error
+	// FencingToken is strictly greater than the token of any previous acquisition of the lock,
+	// 0 until the lock is acquired
+	FencingToken() int64
+}
+
+// LockConfig specifies where locks are materialized, locks with more than one slot are
+// semaphores. Persistent locks, i.e. hard locks and the ones acquired by lock acquire, outlive
+// the process holding them and never expire.
+type LockConfig struct {
+	Backend    string
+	Consul     string
+	Table      string
+	Bucket     string
+	Slots      int
+	Persistent bool
+}
+
+// GetBackend returns the lock backend, defaulting to consul if an address was provided and to
+// file otherwise
+func (lc LockConfig) GetBackend() string {
+	if lc.Backend != "" {
+		return lc.Backend
+	}
+	if lc.Consul != "" {
+		return LockBackendConsul
+	}
+	return LockBackendFile
+}
+
+// LockHolder is the metadata stored alongside a lock describing who acquired it
+type LockHolder struct {
+	Hostname     string    `json:"hostname"`
+	User         string    `json:"user"`
+	Pid          int       `json:"pid"`
+	AcquiredAt   time.Time `json:"acquiredAt"`
+	RefreshedAt  time.Time `json:"refreshedAt"`
+	FencingToken int64     `json:"fencingToken"`
+}
+
+// NewLockHolder builds the LockHolder describing the current process
+func NewLockHolder() LockHolder {
+	hostname, _ := os.Hostname()
+	username := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	return LockHolder{
+		Hostname:   hostname,
+		User:       username,
+		Pid:        os.Getppid(),
+		AcquiredAt: time.Now().UTC(),
+	}
+}
+
+// ParseLockHolder reads the content of a lock, locks created by older versions only contain
+// the pid of the holder
+func ParseLockHolder(content []byte) (*LockHolder, error) {
+	var holder LockHolder
+	if err := json.Unmarshal(content, &holder); err == nil {
+		return &holder, nil
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, errors.New("unrecognized lock content: " + string(content))
+	}
+	return &LockHolder{Pid: pid}, nil
+}
+
+// IsCurrent checks whether or not the lock was acquired by the current user on the current host
+func (h LockHolder) IsCurrent() bool {
+	current := NewLockHolder()
+	return h.Hostname == current.Hostname && h.User == current.User
+}
+
+// Bytes serializes the holder as it is stored in the lock
+func (h LockHolder) Bytes() []byte {
+	return []byte(InterfaceToJSONString(h, false))
+}
+
+func (h LockHolder) String() string {
+	return fmt.Sprintf(
+		"hostname: %s, user: %s, pid: %d, acquired at: %s, refreshed at: %s, fencing token: %d",
+		orUnknown(h.Hostname), orUnknown(h.User), h.Pid, timeOrUnknown(h.AcquiredAt),
+		timeOrUnknown(h.RefreshedAt), h.FencingToken)
+}
+
+// refreshed returns a copy of the holder marked as alive now
+func (h LockHolder) refreshed() LockHolder {
+	h.RefreshedAt = time.Now().UTC()
+	return h
+}
+
+// orUnknown replaces empty metadata with a placeholder
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// timeOrUnknown formats a time, replacing the zero time with a placeholder
+func timeOrUnknown(t time.Time) string {
+	if t.IsZero() {
+		return "unknown"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// checkRefreshable checks that the lock is still held by the holder with the given token
+func checkRefreshable(name string, holder *LockHolder, token int64) error {
+	if token == 0 {
+		return errors.New("lock at " + name + " was not acquired")
+	}
+	if holder == nil {
+		return errors.New("lock at " + name + " is not held anymore")
+	}
+	if holder.FencingToken != token {
+		return errors.New("lock at " + name + " was acquired by someone else (" +
+			holder.String() + ")")
+	}
+	return nil
+}
+
+// RefreshingLock refreshes the lock it wraps in the background for as long as it is held
+type RefreshingLock struct {
+	Lock
+	name     string
+	interval time.Duration
+	stop     chan struct{}
+	wg       sync.WaitGroup
+	// mu keeps the holder from being read while the lock is being refreshed
+	mu sync.Mutex
+}
+
+// NewRefreshingLock wraps a lock so that it is refreshed every interval once acquired
+func NewRefreshingLock(l Lock, name string, interval time.Duration) *RefreshingLock {
+	return &RefreshingLock{Lock: l, name: name, interval: interval}
 }
 
-// FileLock is for file-based locks
+// TryLock tries to acquire the wrapped lock and starts refreshing it
+func (rl *RefreshingLock) TryLock() error {
+	err := rl.Lock.TryLock()
+	if err != nil {
+		return err
+	}
+
+	rl.stop = make(chan struct{})
+	rl.wg.Add(1)
+	go rl.refresh()
+	return nil
+}
+
+// Unlock stops refreshing the wrapped lock and releases it
+func (rl *RefreshingLock) Unlock() error {
+	if rl.stop != nil {
+		close(rl.stop)
+		rl.wg.Wait()
+		rl.stop = nil
+	}
+	return rl.Lock.Unlock()
+}
+
+// Holder retrieves the metadata of the wrapped lock's holder between two refreshes
+func (rl *RefreshingLock) Holder() (*LockHolder, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.Lock.Holder()
+}
+
+// refresh refreshes the wrapped lock every interval until stopped
+func (rl *RefreshingLock) refresh() {
+	defer rl.wg.Done()
+
+	ticker := time.NewTicker(rl.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rl.stop:
+			return
+		case <-ticker.C:
+			rl.mu.Lock()
+			err := rl.Lock.Refresh()
+			rl.mu.Unlock()
+			if err != nil {
+				log.Error("Couldn't refresh the lock at " + rl.name + ": " + err.Error())
+			} else {
+				log.Debug("Refreshed the lock at " + rl.name)
+			}
+		}
+	}
+}
+
+// FileLock is for file-based locks, the fencing token is persisted in a sibling file suffixed
+// with .fence unless another fence file is specified. The content of the lock as it was read along
+// with its holder tells whether someone else acquired the lock before releasing it.
 type FileLock struct {
-	path string
+	path   string
+	fence  string
+	token  int64
+	holder LockHolder
+	seen   []byte
 }
 
 // InitFileLock builds a FileLock at the path speicifed by name
@@ -49,26 +272,194 @@ func InitFileLock(name string) (Lock, error) {
 }
 
 // TryLock tries to acquire a lock on a file, returns true if the lock is already held
-func (fl FileLock) TryLock() error {
-	// need to check that the file doesn't exist since we support locks surviving process shutdown
-	if _, err := os.Stat(fl.path); err == nil {
+func (fl *FileLock) TryLock() error {
+	// the file is created exclusively since we support locks surviving process shutdown and only
+	// one contender may get it, the holder being rewritten once its fencing token is known
+	f, err := os.OpenFile(fl.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if os.IsExist(err) {
 		return LockHeldError("lock already held at " + fl.path)
 	}
+	if err != nil {
+		return err
+	}
+	holder := NewLockHolder()
+	_, err = f.Write(append(holder.Bytes(), '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		holder.FencingToken, err = fl.nextFencingToken()
+	}
+	if err == nil {
+		err = fl.writeHolder(holder)
+	}
+	if err != nil {
+		os.Remove(fl.path)
+		return err
+	}
+	fl.token = holder.FencingToken
+	fl.holder = holder
+	fl.seen = nil
+	return nil
+}
+
+// Unlock tries to release the lock on a file. The file is only removed if it still holds the
+// holder which was last read or the fencing token we got when acquiring the lock, it is removed unconditionally only when neither happened, i.e. when force-releasing a lock whose
+// holder can't be read.
+func (fl *FileLock) Unlock() error {
+	if fl.token != 0 || fl.seen != nil {
+		content, err := ioutil.ReadFile(fl.path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil && !fl.isOurs(content) {
+			return errors.New("lock at " + fl.path + " was modified by someone else, it wasn't released")
+		}
+	}
+	if err := os.Remove(fl.path); err != nil {
+		return err
+	}
+	fl.seen = nil
+	return nil
+}
+
+// isOurs checks whether the content of the lock is the one which was read or the one we acquired,
+// which refreshing it may have rewritten since it was read
+func (fl *FileLock) isOurs(content []byte) bool {
+	if fl.seen != nil && string(content) == string(fl.seen) {
+		return true
+	}
+	if fl.token == 0 {
+		return false
+	}
+	holder, err := ParseLockHolder(content)
+	return err == nil && holder.FencingToken == fl.token
+}
 
-	pid := os.Getppid()
-	err := ioutil.WriteFile(fl.path, []byte(strconv.Itoa(pid)+"\n"), 0666)
-	return err
+// Refresh rewrites the lock's metadata as long as it is still held by us
+func (fl *FileLock) Refresh() error {
+	_, holder, err := fl.readHolder()
+	if err != nil {
+		return err
+	}
+	if err := checkRefreshable(fl.path, holder, fl.token); err != nil {
+		return err
+	}
+
+	fl.holder = fl.holder.refreshed()
+	fl.seen = nil
+	return fl.writeHolder(fl.holder)
 }
 
-// Unlock tries to release the lock on a file
-func (fl FileLock) Unlock() error {
-	return os.Remove(fl.path)
+// writeHolder replaces the lock's metadata, the lock is replaced rather than rewritten so that it
+// is never seen empty
+func (fl *FileLock) writeHolder(holder LockHolder) error {
+	tmpPath := fl.path + ".refresh"
+	err := ioutil.WriteFile(tmpPath, append(holder.Bytes(), '\n'), 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, fl.path)
 }
 
-// ConsulLock is for Consul-based locks
+// FencingToken returns the token obtained when acquiring the lock
+func (fl *FileLock) FencingToken() int64 {
+	return fl.token
+}
+
+// lastFencingToken reads the token handed out by the last acquisition of the lock
+func (fl *FileLock) lastFencingToken() (int64, error) {
+	content, err := ioutil.ReadFile(fl.fencePath())
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+}
+
+// nextFencingToken hands out the token following the last one persisted in the fence file. The
+// fence file is guarded by a sibling .lock file which is created exclusively so that concurrent
+// acquisitions never get the same token, a guard left behind by a crashed process being removed
+// once stale.
+func (fl *FileLock) nextFencingToken() (int64, error) {
+	guard := fl.fencePath() + ".lock"
+	for {
+		f, err := os.OpenFile(guard, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if err == nil {
+			f.Close()
+			break
+		}
+		if !os.IsExist(err) {
+			return 0, err
+		}
+		if info, err := os.Stat(guard); err == nil && time.Since(info.ModTime()) > fileFenceGuardTimeout {
+			os.Remove(guard)
+		}
+		time.Sleep(fileFenceGuardRetryInterval)
+	}
+	defer os.Remove(guard)
+
+	token, err := fl.lastFencingToken()
+	if err != nil {
+		return 0, err
+	}
+	token++
+
+	// the fence is replaced rather than rewritten so that it is never seen empty
+	tmpPath := fl.fencePath() + ".next"
+	err = ioutil.WriteFile(tmpPath, []byte(strconv.FormatInt(token, 10)+"\n"), 0666)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmpPath, fl.fencePath()); err != nil {
+		return 0, err
+	}
+	return token, nil
+}
+
+// fencePath is the path of the file storing the last fencing token
+func (fl *FileLock) fencePath() string {
+	if fl.fence != "" {
+		return fl.fence
+	}
+	return fl.path + ".fence"
+}
+
+// Holder retrieves the metadata of the lock's holder, nil if the lock is not held. The content of
+// the lock is remembered even if it can't be parsed so that only what was read gets released.
+func (fl *FileLock) Holder() (*LockHolder, error) {
+	content, holder, err := fl.readHolder()
+	if content != nil {
+		fl.seen = content
+	}
+	return holder, err
+}
+
+// readHolder reads the content of the lock and parses its holder, both nil if the lock is not held
+func (fl *FileLock) readHolder() ([]byte, *LockHolder, error) {
+	content, err := ioutil.ReadFile(fl.path)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	holder, err := ParseLockHolder(content)
+	return content, holder, err
+}
+
+// ConsulLock is for Consul-based locks, the fencing token is the index at which the KV pair was
+// created. The index at which the pair was last modified when read along with its holder tells
+// whether someone else acquired the lock before releasing it.
 type ConsulLock struct {
-	kv  *api.KV
-	key string
+	client *api.Client
+	kv     *api.KV
+	key    string
+	token  int64
+	holder LockHolder
+	seen   uint64
 }
 
 // InitConsulLock builds a ConsulLock (a KV pair in Consul) with the name argument as key
@@ -79,11 +470,11 @@ func InitConsulLock(consulAddress, name string) (Lock, error) {
 	}
 
 	kv := client.KV()
-	return &ConsulLock{kv: kv, key: name}, nil
+	return &ConsulLock{client: client, kv: kv, key: name}, nil
 }
 
 // TryLock tries to acquire a lock from Consul
-func (cl ConsulLock) TryLock() error {
+func (cl *ConsulLock) TryLock() error {
 	p, _, err := cl.kv.Get(cl.key, nil)
 	if err != nil {
 		return err
@@ -91,13 +482,66 @@ func (cl ConsulLock) TryLock() error {
 	if p != nil {
 		return LockHeldError("lock already held at " + cl.key)
 	}
-	pid := os.Getppid()
-	_, err = cl.kv.Put(&api.KVPair{Key: cl.key, Value: []byte(strconv.Itoa(pid))}, nil)
-	return err
+
+	// a ModifyIndex of 0 only writes the pair if it doesn't exist
+	holder := NewLockHolder()
+	ok, _, err := cl.kv.CAS(&api.KVPair{Key: cl.key, Value: holder.Bytes()}, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return LockHeldError("lock already held at " + cl.key)
+	}
+
+	p, _, err = cl.kv.Get(cl.key, nil)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return errors.New("lock at " + cl.key + " was released while being acquired")
+	}
+	cl.token = int64(p.CreateIndex)
+	cl.holder = holder
+	cl.seen = 0
+	return nil
+}
+
+// Refresh rewrites the lock's metadata in Consul as long as it is still held by us
+func (cl *ConsulLock) Refresh() error {
+	p, _, err := cl.kv.Get(cl.key, nil)
+	if err != nil {
+		return err
+	}
+	var holder *LockHolder
+	if p != nil {
+		holder = &LockHolder{FencingToken: int64(p.CreateIndex)}
+	}
+	if err := checkRefreshable(cl.key, holder, cl.token); err != nil {
+		return err
+	}
+
+	cl.holder = cl.holder.refreshed()
+	cl.seen = 0
+	ok, _, err := cl.kv.CAS(
+		&api.KVPair{Key: cl.key, Value: cl.holder.Bytes(), ModifyIndex: p.ModifyIndex}, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("lock at " + cl.key + " was modified while being refreshed")
+	}
+	return nil
 }
 
-// Unlock tries to release the lock from Consul
-func (cl ConsulLock) Unlock() error {
+// FencingToken returns the token obtained when acquiring the lock
+func (cl *ConsulLock) FencingToken() int64 {
+	return cl.token
+}
+
+// Unlock tries to release the lock from Consul. The pair is only deleted if it wasn't modified
+// since its holder was last read or if it was created when we acquired the lock, it is deleted unconditionally only when neither happened, i.e. when force-releasing a lock whose
+// holder can't be read.
+func (cl *ConsulLock) Unlock() error {
 	p, _, err := cl.kv.Get(cl.key, nil)
 	if err != nil {
 		return err
@@ -105,21 +549,124 @@ func (cl ConsulLock) Unlock() error {
 	if p == nil {
 		return errors.New("lock not held")
 	}
-	_, err = cl.kv.Delete(cl.key, nil)
-	return err
+
+	if cl.token != 0 || cl.seen != 0 {
+		if (cl.seen == 0 || p.ModifyIndex != cl.seen) &&
+			(cl.token == 0 || int64(p.CreateIndex) != cl.token) {
+			return errors.New("lock at " + cl.key + " was modified by someone else, it wasn't released")
+		}
+		ok, _, err := cl.kv.DeleteCAS(p, nil)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("lock at " + cl.key + " was modified by someone else, it wasn't released")
+		}
+	} else if _, err := cl.kv.Delete(cl.key, nil); err != nil {
+		return err
+	}
+	cl.seen = 0
+
+	// slots of semaphores are bound to a session which would outlive them otherwise
+	if p.Session != "" {
+		if _, err := cl.client.Session().Destroy(p.Session, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Holder retrieves the metadata of the lock's holder from Consul, nil if the lock is not held. The
+// index of the pair is remembered even if it can't be parsed so that only what was read gets
+// released.
+func (cl *ConsulLock) Holder() (*LockHolder, error) {
+	p, _, err := cl.kv.Get(cl.key, nil)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, nil
+	}
+	cl.seen = p.ModifyIndex
+	return parseConsulHolder(p)
+}
+
+// ReleaseLock releases a lock acquired by the current user on the current host, force is needed
+// to release a lock acquired by someone else
+func ReleaseLock(l Lock, name string, force bool) error {
+	holder, err := l.Holder()
+	if err != nil {
+		return err
+	}
+	return releaseLock(l, name, holder, force)
+}
+
+// ForceReleaseLock releases a lock even if its holder metadata can't be read, force is needed
+// unless the lock was acquired by the current user on the current host
+func ForceReleaseLock(l Lock, name string, force bool) error {
+	holder, err := l.Holder()
+	if err != nil {
+		if !force {
+			return errors.New("couldn't read the holder of the lock at " + name + " (" +
+				err.Error() + "), --force is needed to release it")
+		}
+		return l.Unlock()
+	}
+	return releaseLock(l, name, holder, force)
+}
+
+// releaseLock releases a lock given its holder
+func releaseLock(l Lock, name string, holder *LockHolder, force bool) error {
+	if holder == nil {
+		return errors.New("lock not held at " + name)
+	}
+	if !force && !holder.IsCurrent() {
+		return errors.New("lock at " + name + " was acquired by someone else (" +
+			holder.String() + "), --force is needed to release it")
+	}
+	return l.Unlock()
 }
 
-// GetLock builds a file-based or consul-based lock depending on the consul varialbe
-func GetLock(lock, consul string) (Lock, error) {
+// GetLock builds a lock materialized by the backend specified in the lock config, a file or a
+// consul-based lock depending on the consul variable if no backend is specified. The AWS-based
+// locks are built from the default session of the clients.
+func GetLock(lock string, config LockConfig, clients *AwsClients) (Lock, error) {
+	if config.Slots > 1 {
+		return getSemaphore(lock, config)
+	}
+
 	var l Lock
 	var err error
-	if consul != "" {
-		l, err = InitConsulLock(consul, lock)
-	} else {
+	switch config.GetBackend() {
+	case LockBackendFile:
 		l, err = InitFileLock(lock)
+	case LockBackendConsul:
+		l, err = InitConsulLock(config.Consul, lock)
+	case LockBackendDynamoDB:
+		l, err = InitDynamoDBLock(config.Table, lock, config.Persistent, clients)
+	case LockBackendS3:
+		l, err = InitS3Lock(config.Bucket, lock, clients)
+	default:
+		err = errors.New("unknown lock backend " + config.Backend + ", supported backends are " +
+			strings.Join(lockBackends, ","))
 	}
 	if err != nil {
 		return nil, err
 	}
 	return l, nil
 }
+
+// getSemaphore builds a semaphore with the number of slots specified in the lock config, only
+// the file and consul backends support semaphores
+func getSemaphore(lock string, config LockConfig) (Lock, error) {
+	switch config.GetBackend() {
+	case LockBackendFile:
+		return InitFileSemaphore(lock, config.Slots)
+	case LockBackendConsul:
+		return InitConsulSemaphore(config.Consul, lock, config.Slots, config.Persistent)
+	default:
+		return nil, errors.New("the " + config.GetBackend() + " lock backend doesn't support " +
+			"more than one slot, supported backends are " + LockBackendFile + "," +
+			LockBackendConsul)
+	}
+}
@@ -18,7 +18,9 @@ import (
 	"os"
 	"strconv"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/sdk/testutil"
 	"github.com/stretchr/testify/assert"
@@ -79,6 +81,29 @@ func TestConsulLock(t *testing.T) {
 	assert.NotNil(err)
 	assert.Equal("lock not held", err.Error())
 
+	// a superseded holder can't release the lock
+	other, err := InitConsulLock(s.HTTPAddr, lockName)
+	assert.Nil(err)
+	err = other.TryLock()
+	assert.Nil(err)
+	err = cl.Unlock()
+	assert.NotNil(err)
+	assert.Equal("lock at "+lockName+" was modified by someone else, it wasn't released", err.Error())
+
+	// nor can someone who read a holder which was replaced since
+	reader, err := InitConsulLock(s.HTTPAddr, lockName)
+	assert.Nil(err)
+	_, err = reader.Holder()
+	assert.Nil(err)
+	err = other.Refresh()
+	assert.Nil(err)
+	err = reader.Unlock()
+	assert.NotNil(err)
+	assert.Equal("lock at "+lockName+" was modified by someone else, it wasn't released", err.Error())
+
+	err = other.Unlock()
+	assert.Nil(err)
+
 	// fail for malformed key
 	cl, err = InitConsulLock(s.HTTPAddr, "/"+lockName)
 	assert.Nil(err)
@@ -138,13 +163,13 @@ func TestGetLock(t *testing.T) {
 	lockName := "/tmp/lock"
 
 	// FileLock if consul == ""
-	lock, err := GetLock(lockName, "")
+	lock, err := GetLock(lockName, LockConfig{}, defaultAwsClients)
 	assert.NotNil(lock)
 	assert.Nil(err)
 	assert.Equal(lock, &FileLock{path: lockName})
 
 	// ConsulLock if consul != ""
-	lock, err = GetLock(lockName, s.HTTPAddr)
+	lock, err = GetLock(lockName, LockConfig{Consul: s.HTTPAddr}, defaultAwsClients)
 	assert.NotNil(lock)
 	assert.Nil(err)
 	cl, ok := lock.(*ConsulLock)
@@ -152,8 +177,242 @@ func TestGetLock(t *testing.T) {
 	assert.Equal(true, ok)
 
 	// error otherwise
-	lock, err = GetLock(lockName, "some://faulty.address")
+	lock, err = GetLock(lockName, LockConfig{Consul: "some://faulty.address"}, defaultAwsClients)
 	assert.Nil(lock)
 	assert.NotNil(err)
 	assert.Equal("Unknown protocol scheme: some", err.Error())
 }
+
+func TestGetLock_Backend(t *testing.T) {
+	assert := assert.New(t)
+
+	lockName := "/tmp/lock"
+
+	lock, err := GetLock(lockName, LockConfig{Backend: LockBackendFile}, defaultAwsClients)
+	assert.Nil(err)
+	assert.Equal(lock, &FileLock{path: lockName})
+
+	// the AWS-based locks use the clients they're given
+	clients := NewAwsClients("http://localhost:4566")
+	lock, err = GetLock(lockName, LockConfig{Backend: LockBackendDynamoDB, Table: "locks"}, clients)
+	assert.Nil(err)
+	dl, ok := lock.(*DynamoDBLock)
+	assert.Equal(true, ok)
+	assert.Equal("locks", dl.table)
+	assert.Equal(lockName, dl.key)
+	assert.Equal("http://localhost:4566", dl.svc.(*dynamodb.DynamoDB).Endpoint)
+	assert.Equal(dynamoDBLockLease, dl.lease)
+
+	// persistent locks don't expire
+	lock, err = GetLock(lockName, LockConfig{Backend: LockBackendDynamoDB, Table: "locks", Persistent: true}, clients)
+	assert.Nil(err)
+	assert.Equal(time.Duration(0), lock.(*DynamoDBLock).lease)
+
+	lock, err = GetLock(lockName, LockConfig{Backend: LockBackendS3, Bucket: "bucket"}, defaultAwsClients)
+	assert.Nil(err)
+	sl, ok := lock.(*S3Lock)
+	assert.Equal(true, ok)
+	assert.Equal("bucket", sl.bucket)
+	assert.Equal(lockName, sl.key)
+
+	lock, err = GetLock(lockName, LockConfig{Backend: LockBackendFile, Slots: 2}, defaultAwsClients)
+	assert.Nil(err)
+	fs, ok := lock.(*FileSemaphore)
+	assert.Equal(true, ok)
+	assert.Equal(2, fs.Limit())
+
+	lock, err = GetLock(lockName, LockConfig{Backend: LockBackendS3, Bucket: "bucket", Slots: 2}, defaultAwsClients)
+	assert.Nil(lock)
+	assert.NotNil(err)
+	assert.Equal("the s3 lock backend doesn't support more than one slot, supported backends are file,consul", err.Error())
+
+	lock, err = GetLock(lockName, LockConfig{Backend: "zookeeper"}, defaultAwsClients)
+	assert.Nil(lock)
+	assert.NotNil(err)
+	assert.Equal("unknown lock backend zookeeper, supported backends are file,consul,dynamodb,s3", err.Error())
+}
+
+func TestParseLockHolder(t *testing.T) {
+	assert := assert.New(t)
+
+	holder := NewLockHolder()
+	parsed, err := ParseLockHolder(holder.Bytes())
+	assert.Nil(err)
+	assert.Equal(holder.Hostname, parsed.Hostname)
+	assert.Equal(holder.User, parsed.User)
+	assert.Equal(holder.Pid, parsed.Pid)
+	assert.True(holder.AcquiredAt.Equal(parsed.AcquiredAt))
+	assert.True(parsed.IsCurrent())
+
+	// locks created by older versions only contain the pid
+	parsed, err = ParseLockHolder([]byte("1234\n"))
+	assert.Nil(err)
+	assert.Equal(&LockHolder{Pid: 1234}, parsed)
+	assert.False(parsed.IsCurrent())
+	assert.Equal("hostname: unknown, user: unknown, pid: 1234, acquired at: unknown, refreshed at: unknown,"+
+		" fencing token: 0", parsed.String())
+
+	parsed, err = ParseLockHolder([]byte("garbage"))
+	assert.Nil(parsed)
+	assert.NotNil(err)
+	assert.Equal("unrecognized lock content: garbage", err.Error())
+}
+
+func TestFileLock_Holder(t *testing.T) {
+	assert := assert.New(t)
+
+	lockPath := "/tmp/lock-holder"
+	fl, err := InitFileLock(lockPath)
+	assert.Nil(err)
+
+	holder, err := fl.Holder()
+	assert.Nil(holder)
+	assert.Nil(err)
+
+	err = fl.TryLock()
+	assert.Nil(err)
+
+	holder, err = fl.Holder()
+	assert.Nil(err)
+	assert.NotNil(holder)
+	assert.True(holder.IsCurrent())
+
+	err = fl.Unlock()
+	assert.Nil(err)
+}
+
+func TestReleaseLock(t *testing.T) {
+	assert := assert.New(t)
+
+	lockPath := "/tmp/lock-release"
+	fl, err := InitFileLock(lockPath)
+	assert.Nil(err)
+
+	err = ReleaseLock(fl, lockPath, false)
+	assert.NotNil(err)
+	assert.Equal("lock not held at "+lockPath, err.Error())
+
+	// locks acquired by the current user on the current host don't need to be forced
+	err = fl.TryLock()
+	assert.Nil(err)
+	err = ReleaseLock(fl, lockPath, false)
+	assert.Nil(err)
+
+	// locks acquired by someone else need to be forced
+	other := LockHolder{Hostname: "other-host", User: "other-user", Pid: 1}
+	err = ioutil.WriteFile(lockPath, other.Bytes(), 0666)
+	assert.Nil(err)
+	err = ReleaseLock(fl, lockPath, false)
+	assert.NotNil(err)
+	assert.Equal("lock at "+lockPath+" was acquired by someone else ("+other.String()+
+		"), --force is needed to release it", err.Error())
+	err = ReleaseLock(fl, lockPath, true)
+	assert.Nil(err)
+
+	// unreadable locks can only be force-released
+	err = ioutil.WriteFile(lockPath, []byte("garbage"), 0666)
+	assert.Nil(err)
+	err = ReleaseLock(fl, lockPath, true)
+	assert.NotNil(err)
+	assert.Equal("unrecognized lock content: garbage", err.Error())
+	err = ForceReleaseLock(fl, lockPath, false)
+	assert.NotNil(err)
+	assert.Equal("couldn't read the holder of the lock at "+lockPath+
+		" (unrecognized lock content: garbage), --force is needed to release it", err.Error())
+	err = ForceReleaseLock(fl, lockPath, true)
+	assert.Nil(err)
+
+	err = ForceReleaseLock(fl, lockPath, true)
+	assert.NotNil(err)
+	assert.Equal("lock not held at "+lockPath, err.Error())
+}
+
+func TestFileLock_FencingToken(t *testing.T) {
+	assert := assert.New(t)
+
+	lockPath := "/tmp/lock-fencing"
+	defer os.Remove(lockPath + ".fence")
+	fl, err := InitFileLock(lockPath)
+	assert.Nil(err)
+	assert.Equal(int64(0), fl.FencingToken())
+
+	err = fl.Refresh()
+	assert.NotNil(err)
+	assert.Equal("lock at "+lockPath+" was not acquired", err.Error())
+
+	err = fl.TryLock()
+	assert.Nil(err)
+	assert.Equal(int64(1), fl.FencingToken())
+
+	err = fl.Refresh()
+	assert.Nil(err)
+	holder, err := fl.Holder()
+	assert.Nil(err)
+	assert.Equal(int64(1), holder.FencingToken)
+	assert.False(holder.RefreshedAt.IsZero())
+
+	// tokens keep increasing across acquisitions
+	err = fl.Unlock()
+	assert.Nil(err)
+	err = fl.Refresh()
+	assert.NotNil(err)
+	assert.Equal("lock at "+lockPath+" is not held anymore", err.Error())
+
+	other, err := InitFileLock(lockPath)
+	assert.Nil(err)
+	err = other.TryLock()
+	assert.Nil(err)
+	assert.Equal(int64(2), other.FencingToken())
+
+	// a superseded holder can't refresh the lock
+	err = fl.Refresh()
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "lock at "+lockPath+" was acquired by someone else")
+
+	// nor release it
+	err = fl.Unlock()
+	assert.NotNil(err)
+	assert.Equal("lock at "+lockPath+" was modified by someone else, it wasn't released", err.Error())
+	holder, err = other.Holder()
+	assert.Nil(err)
+	assert.Equal(int64(2), holder.FencingToken)
+
+	err = other.Unlock()
+	assert.Nil(err)
+}
+
+func TestRefreshingLock(t *testing.T) {
+	assert := assert.New(t)
+
+	lockPath := "/tmp/lock-refreshing"
+	defer os.Remove(lockPath + ".fence")
+	fl, err := InitFileLock(lockPath)
+	assert.Nil(err)
+
+	rl := NewRefreshingLock(fl, lockPath, 10*time.Millisecond)
+	err = rl.TryLock()
+	assert.Nil(err)
+	assert.Equal(fl.FencingToken(), rl.FencingToken())
+
+	time.Sleep(50 * time.Millisecond)
+	holder, err := rl.Holder()
+	assert.Nil(err)
+	assert.False(holder.RefreshedAt.IsZero())
+
+	err = rl.Unlock()
+	assert.Nil(err)
+
+	holder, err = rl.Holder()
+	assert.Nil(err)
+	assert.Nil(holder)
+
+	// a lock refreshed after its holder was read is still ours to release
+	err = fl.TryLock()
+	assert.Nil(err)
+	_, err = fl.Holder()
+	assert.Nil(err)
+	refreshed := fl.(*FileLock)
+	assert.Nil(refreshed.writeHolder(refreshed.holder.refreshed()))
+	err = fl.Unlock()
+	assert.Nil(err)
+}
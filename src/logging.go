@@ -0,0 +1,83 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Structured fields of the log entries
+const (
+	fieldRunID     = "run_id"
+	fieldTraceID   = "trace_id"
+	fieldCommand   = "command"
+	fieldJobflowID = "jobflow_id"
+	fieldStepID    = "step_id"
+	fieldStepName  = "step_name"
+	fieldState     = "state"
+	fieldStartTime = "start_time"
+	fieldEndTime   = "end_time"
+)
+
+// logTimeFormat is the format of the times logged as fields
+const logTimeFormat = "2006-01-02T15:04:05Z"
+
+// logFormatters are the formatters of the supported log formats
+var logFormatters = map[string]func() log.Formatter{
+	"text": func() log.Formatter { return &log.TextFormatter{} },
+	"json": func() log.Formatter { return &log.JSONFormatter{} },
+}
+
+// getLogFormatter returns the formatter of a log format
+func getLogFormatter(format string) (log.Formatter, error) {
+	formatter, ok := logFormatters[format]
+	if !ok {
+		return nil, errors.New("Supported log formats are " + strings.Join(getLogFormatKeys(), ",") +
+			", provided " + format)
+	}
+	return formatter(), nil
+}
+
+func getLogFormatKeys() []string {
+	keys := make([]string, 0, len(logFormatters))
+	for k := range logFormatters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// RunContextHook adds the fields identifying a run, e.g. its id and command, to every entry
+type RunContextHook struct {
+	Fields log.Fields
+}
+
+// Levels returns the levels the hook applies to, all of them
+func (RunContextHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire adds the run fields to an entry, keeping the fields already set
+func (h RunContextHook) Fire(entry *log.Entry) error {
+	for k, v := range h.Fields {
+		if _, ok := entry.Data[k]; !ok {
+			entry.Data[k] = v
+		}
+	}
+	return nil
+}
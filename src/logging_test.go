@@ -0,0 +1,54 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetLogFormatter(t *testing.T) {
+	assert := assert.New(t)
+
+	formatter, err := getLogFormatter("json")
+	assert.Nil(err)
+	assert.IsType(&log.JSONFormatter{}, formatter)
+
+	_, err = getLogFormatter("xml")
+	assert.NotNil(err)
+	assert.Equal("Supported log formats are json,text, provided xml", err.Error())
+}
+
+func TestRunContextHook(t *testing.T) {
+	assert := assert.New(t)
+
+	var buffer bytes.Buffer
+	logger := log.New()
+	logger.SetOutput(&buffer)
+	logger.SetFormatter(&log.JSONFormatter{})
+	logger.AddHook(RunContextHook{Fields: log.Fields{fieldRunID: "run", fieldCommand: "run", fieldJobflowID: "j-default"}})
+	logger.WithFields(log.Fields{fieldJobflowID: "j-123", fieldStepID: "s-456"}).Info("Step completed")
+
+	var entry map[string]interface{}
+	assert.Nil(json.Unmarshal(buffer.Bytes(), &entry))
+	assert.Equal("Step completed", entry["msg"])
+	assert.Equal("run", entry[fieldRunID])
+	assert.Equal("run", entry[fieldCommand])
+	assert.Equal("j-123", entry[fieldJobflowID])
+	assert.Equal("s-456", entry[fieldStepID])
+}
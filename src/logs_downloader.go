@@ -22,7 +22,6 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/emr"
 	"github.com/aws/aws-sdk-go/service/emr/emriface"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -30,6 +29,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
 	"github.com/hashicorp/errwrap"
+	log "github.com/sirupsen/logrus"
 	"github.com/snowplow-devops/go-retry"
 )
 
@@ -39,26 +39,20 @@ type LogsDownloader struct {
 	EmrSvc     emriface.EMRAPI
 	S3Svc      s3iface.S3API
 	Downloader s3manageriface.DownloaderAPI
+	Observers  Observers
 }
 
 // InitLogsDownloader creates a new LogsDownloader instance
-func InitLogsDownloader(accessKeyID, secretAccessKey, region, jobflowID string) (*LogsDownloader, error) {
-	creds, err := GetCredentialsProvider(accessKeyID, secretAccessKey)
+func InitLogsDownloader(credentials *CredentialsRecord, region, jobflowID string, clients *AwsClients) (*LogsDownloader, error) {
+	emrSvc, err := clients.EMR(region, credentials)
 	if err != nil {
 		return nil, err
 	}
 
-	sess := session.Must(session.NewSession())
-
-	emrSvc := emr.New(sess, &aws.Config{
-		Region:      aws.String(region),
-		Credentials: creds,
-	})
-
-	s3Svc := s3.New(sess, &aws.Config{
-		Region:      aws.String(region),
-		Credentials: creds,
-	})
+	s3Svc, err := clients.S3(region, credentials)
+	if err != nil {
+		return nil, err
+	}
 
 	downloader := s3manager.NewDownloaderWithClient(s3Svc)
 
@@ -72,8 +66,14 @@ func InitLogsDownloader(accessKeyID, secretAccessKey, region, jobflowID string)
 
 // GetStepLogs retrieves the logs for a particular step from S3 and present them as a map where
 // keys are the original file names and values are the contents
-func (ld LogsDownloader) GetStepLogs(stepID string) (map[string]string, error) {
-	bucket, prefix, err := ld.GetBucketAndPrefix()
+func (ld LogsDownloader) GetStepLogs(stepID string) (logs map[string]string, err error) {
+	ctx, done := ld.Observers.OperationStarted(aws.BackgroundContext(), "GetStepLogs", log.Fields{
+		fieldJobflowID: ld.JobflowID,
+		fieldStepID:    stepID,
+	})
+	defer func() { done(err) }()
+
+	bucket, prefix, err := ld.getBucketAndPrefix(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -81,7 +81,7 @@ func (ld LogsDownloader) GetStepLogs(stepID string) (map[string]string, error) {
 	if err != nil {
 		return nil, errwrap.Wrapf("Couldn't create directory to store the step logs into: {{err}}", err)
 	}
-	err = ld.DownloadLogFiles(bucket, prefix, dir, stepID)
+	err = ld.downloadLogFiles(ctx, bucket, prefix, dir, stepID)
 	if err != nil {
 		return nil, errwrap.Wrapf("Couldn't download step logs: {{err}}", err)
 	}
@@ -89,15 +89,21 @@ func (ld LogsDownloader) GetStepLogs(stepID string) (map[string]string, error) {
 	if err != nil {
 		return nil, errwrap.Wrapf("Coudln't read gzipped log files: {{err}}", err)
 	}
+	ld.Observers.StepLogs(ld.JobflowID, stepID, contents)
 	return contents, nil
 }
 
 // GetBucketAndPrefix looks for the s3 bucket as well as the prefix where this EMR cluster is
 // logging to
 func (ld LogsDownloader) GetBucketAndPrefix() (string, string, error) {
+	return ld.getBucketAndPrefix(aws.BackgroundContext())
+}
+
+// getBucketAndPrefix looks for the log location of the cluster within the context of an operation
+func (ld LogsDownloader) getBucketAndPrefix(ctx aws.Context) (string, string, error) {
 	describeClusterInput := &emr.DescribeClusterInput{ClusterId: aws.String(ld.JobflowID)}
 	describeClusterOutput, err := retry.ExponentialWithInterface(3, time.Second, "emr.DescribeCluster", func() (interface{}, error) {
-		return ld.EmrSvc.DescribeCluster(describeClusterInput)
+		return ld.EmrSvc.DescribeClusterWithContext(ctx, describeClusterInput)
 	})
 	if err != nil {
 		return "", "", errwrap.Wrapf("Couldn't fetch LogUri: {{err}}", err)
@@ -118,11 +124,16 @@ func (ld LogsDownloader) GetBucketAndPrefix() (string, string, error) {
 // DownloadLogFiles takes care of downloading the log files produced by the EMR cluster on S3
 // locally to the specified directory
 func (ld LogsDownloader) DownloadLogFiles(bucket, prefix, dir, stepID string) error {
-	s3Downloader := S3Downloader{Bucket: bucket, Dir: dir, Downloader: ld.Downloader}
+	return ld.downloadLogFiles(aws.BackgroundContext(), bucket, prefix, dir, stepID)
+}
+
+// downloadLogFiles downloads the log files of a step within the context of an operation
+func (ld LogsDownloader) downloadLogFiles(ctx aws.Context, bucket, prefix, dir, stepID string) error {
+	s3Downloader := S3Downloader{Bucket: bucket, Dir: dir, Downloader: ld.Downloader, Ctx: ctx}
 	fullPrefix := filepath.Join(prefix, ld.JobflowID, "steps", stepID)
 	listObjectsInput := &s3.ListObjectsInput{
 		Bucket: aws.String(bucket),
 		Prefix: aws.String(fullPrefix),
 	}
-	return ld.S3Svc.ListObjectsPages(listObjectsInput, s3Downloader.EachPage)
+	return ld.S3Svc.ListObjectsPagesWithContext(ctx, listObjectsInput, s3Downloader.EachPage)
 }
@@ -22,6 +22,7 @@ import (
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/emr"
 	"github.com/aws/aws-sdk-go/service/emr/emriface"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -48,10 +49,18 @@ func (m *mockS3API) ListObjectsPages(input *s3.ListObjectsInput, fn func(*s3.Lis
 	return nil
 }
 
+func (m *mockS3API) ListObjectsPagesWithContext(ctx aws.Context, input *s3.ListObjectsInput, fn func(*s3.ListObjectsOutput, bool) bool, opts ...request.Option) error {
+	return m.ListObjectsPages(input, fn)
+}
+
 type mockEMRAPILogs struct {
 	emriface.EMRAPI
 }
 
+func (m *mockEMRAPILogs) DescribeClusterWithContext(ctx aws.Context, input *emr.DescribeClusterInput, opts ...request.Option) (*emr.DescribeClusterOutput, error) {
+	return m.DescribeCluster(input)
+}
+
 func (m *mockEMRAPILogs) DescribeCluster(input *emr.DescribeClusterInput) (*emr.DescribeClusterOutput, error) {
 	if *input.ClusterId == "test-get-bucket" {
 		return &emr.DescribeClusterOutput{Cluster: &emr.Cluster{LogUri: aws.String("s3://bucket/log")}},
@@ -86,11 +95,11 @@ func mockLogsDownloader(jobflowID string) *LogsDownloader {
 func TestInitLogsDownloader(t *testing.T) {
 	assert := assert.New(t)
 
-	ld, err := InitLogsDownloader("env", "env", "eu-west-1", "j-ID")
+	ld, err := InitLogsDownloader(&CredentialsRecord{AccessKeyId: "env", SecretAccessKey: "env"}, "eu-west-1", "j-ID", defaultAwsClients)
 	assert.NotNil(ld)
 	assert.Nil(err)
 
-	ld, err = InitLogsDownloader("env", "nv", "eu-west-1", "j-ID")
+	ld, err = InitLogsDownloader(&CredentialsRecord{AccessKeyId: "env", SecretAccessKey: "nv"}, "eu-west-1", "j-ID", defaultAwsClients)
 	assert.Nil(ld)
 	assert.NotNil(err)
 	assert.Equal("access-key and secret-key must both be set to 'env', or neither", err.Error())
@@ -17,8 +17,11 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -44,6 +47,8 @@ const (
 	fEmrPlaybook     = "emr-playbook"
 	fEmrCluster      = "emr-cluster"
 	fVars            = "vars"
+	fVarsFile        = "vars-file"
+	fVar             = "var"
 	fAsync           = "async"
 	fLogFailedSteps  = "log-failed-steps"
 	fLogLevel        = "log-level"
@@ -51,12 +56,52 @@ const (
 	fSoftLock        = "softLock"
 	fConsul          = "consul"
 	fSentry          = "sentry"
+	fForce           = "force"
+	fLockBackend     = "lock-backend"
+	fLockTable       = "lock-table"
+	fLockBucket      = "lock-bucket"
+	fLockSlots       = "lock-slots"
+	fProfile         = "profile"
+	fStrict          = "strict"
+	fKind            = "kind"
+	fFormat          = "format"
+	fAwsEndpoint     = "aws-endpoint"
+	fServiceEndpoint = "aws-service-endpoint"
+	fAwsProxy        = "aws-proxy"
+	fAwsCABundle     = "aws-ca-bundle"
+	fLogFormat       = "log-format"
+	fReportFile      = "report-file"
+	fJUnitReport     = "junit-report"
+	fMetricsPushURL  = "metrics-push-url"
+	fMetricsFile     = "metrics-file"
+	fMetricsJob      = "metrics-job"
+	fStatsDAddr      = "statsd-addr"
+	fOtlpEndpoint    = "otlp-endpoint"
+	fencingTokenVar  = "lockFencingToken"
 	lockHeldExitCode = 17
 	otherExitCode    = 1
 )
 
+var (
+	// runReport summarizes the command being run, see withReport
+	runReport = NewRunReport("")
+	// junitReport renders the steps being run as test cases, see withReport
+	junitReport = NewJUnitReport()
+	// runMetrics collects the Prometheus metrics of the command being run, see withReport
+	runMetrics = NewMetrics()
+	// runStatsD emits the metrics of the command being run to a StatsD agent if one is specified
+	runStatsD *StatsD
+	// runTracing records the command being run as a trace if an OTLP endpoint is specified
+	runTracing *Tracing
+	// runObservers are notified by the components of the command being run
+	runObservers = Observers{runReport}
+	// runFields identify the run in every log entry
+	runFields = log.Fields{}
+)
+
 func main() {
 	app := cli.NewApp()
+	log.AddHook(RedactionHook{})
 
 	var logLevel string
 	logLevels := map[string]log.Level{
@@ -88,14 +133,108 @@ func main() {
 				strings.Join(logLevelKeys, ",")),
 			Destination: &logLevel,
 		},
+		cli.StringFlag{
+			Name:  fLogFormat,
+			Value: "text",
+			Usage: fmt.Sprintf("logging format, possible values are %s",
+				strings.Join(getLogFormatKeys(), ",")),
+		},
+		cli.StringFlag{
+			Name:  fReportFile,
+			Usage: "File the JSON report of the command is written to once it's done, even if it failed",
+		},
+		cli.StringFlag{
+			Name:  fJUnitReport,
+			Usage: "File the steps are written to as JUnit XML test cases once the command is done",
+		},
+		cli.StringFlag{
+			Name:  fMetricsPushURL,
+			Usage: "URL of the Prometheus Pushgateway the metrics are pushed to once the command is done",
+		},
+		cli.StringFlag{
+			Name:  fMetricsFile,
+			Usage: "File the Prometheus metrics are written to for the textfile collector once the command is done",
+		},
+		cli.StringFlag{
+			Name:  fMetricsJob,
+			Value: appName,
+			Usage: "Job the metrics are pushed under to the Pushgateway",
+		},
+		cli.StringFlag{
+			Name:  fStatsDAddr,
+			Usage: "host:port of the StatsD or DogStatsD agent the metrics are sent to over UDP as the command runs",
+		},
+		cli.StringFlag{
+			Name:   fOtlpEndpoint,
+			EnvVar: "OTEL_EXPORTER_OTLP_ENDPOINT",
+			Usage:  "OTLP/HTTP endpoint the trace of the command is sent to, e.g. http://localhost:4318, joining the trace given by TRACEPARENT if any",
+		},
+		cli.StringFlag{
+			Name:  fAwsEndpoint,
+			Usage: "URL used instead of the AWS endpoints, e.g. to run against LocalStack",
+		},
+		cli.StringSliceFlag{
+			Name: fServiceEndpoint,
+			Usage: "Endpoint of a single AWS service as service=URL, possible services are " +
+				"dynamodb,emr,s3,secretsmanager,ssm,sts, can be repeated",
+		},
+		cli.StringFlag{
+			Name:  fAwsProxy,
+			Usage: "Proxy the AWS requests go through, the proxy environment variables are used otherwise",
+		},
+		cli.StringFlag{
+			Name:  fAwsCABundle,
+			Usage: "PEM file of the certificates trusted for the AWS requests on top of the system ones",
+		},
 	}
-	app.Action = func(c *cli.Context) error {
-		if level, ok := logLevels[logLevel]; ok {
-			log.SetLevel(level)
-		} else {
-			return fmt.Errorf("Supported log levels are %s, provided %s",
-				strings.Join(logLevelKeys, ","), logLevel)
+	app.Before = func(c *cli.Context) error {
+		level, ok := logLevels[logLevel]
+		if !ok {
+			return cli.NewExitError(fmt.Sprintf("Supported log levels are %s, provided %s",
+				strings.Join(logLevelKeys, ","), logLevel), otherExitCode)
+		}
+		log.SetLevel(level)
+		formatter, err := getLogFormatter(c.String(fLogFormat))
+		if err != nil {
+			return cli.NewExitError(err.Error(), otherExitCode)
+		}
+		log.SetFormatter(formatter)
+		runID, err := newUUID()
+		if err != nil {
+			return cli.NewExitError(err, otherExitCode)
+		}
+		runFields[fieldRunID] = runID
+		log.AddHook(RunContextHook{Fields: runFields})
+		runReport = NewRunReport(runID)
+		runObservers = Observers{runReport}
+		if c.String(fJUnitReport) != "" {
+			runObservers = append(runObservers, junitReport)
+		}
+		if c.String(fMetricsPushURL) != "" || c.String(fMetricsFile) != "" {
+			runObservers = append(runObservers, runMetrics)
+		}
+		if addr := c.String(fStatsDAddr); addr != "" {
+			runStatsD, err = NewStatsD(addr)
+			if err != nil {
+				return cli.NewExitError("Couldn't set up StatsD: "+err.Error(), otherExitCode)
+			}
+			runObservers = append(runObservers, runStatsD)
+		}
+		if endpoint := c.String(fOtlpEndpoint); endpoint != "" {
+			exporter, err := NewOTLPExporter(endpoint)
+			if err != nil {
+				return cli.NewExitError(err, otherExitCode)
+			}
+			runTracing = NewTracing(TraceParent(), exporter, appName, cliVersion)
+			runObservers = append(runObservers, runTracing)
 		}
+		defaultAwsClients.Observers = runObservers
+		if err = configureAwsClients(c, defaultAwsClients, level == log.DebugLevel); err != nil {
+			return cli.NewExitError(err, otherExitCode)
+		}
+		return nil
+	}
+	app.Action = func(c *cli.Context) error {
 		cli.ShowAppHelp(c)
 		return nil
 	}
@@ -106,6 +245,9 @@ func main() {
 			Flags: []cli.Flag{
 				getEmrConfigFlag(),
 				getVarsFlag(),
+				getVarFlag(),
+				getVarsFileFlag(),
+				getProfileFlag(),
 				getSentryFlag(),
 			},
 			Action: func(c *cli.Context) error {
@@ -119,15 +261,18 @@ func main() {
 					}
 				}
 
-				jobflowID, err := up(
-					c.String(fEmrConfig),
-					c.String(fVars),
-				)
+				varMap, cliVarNames, err := getVarMap(c)
 				if err != nil {
 					return exitCodeError(sentryEnabled, err)
 				}
+				warnUnusedVars(cliVarNames, varMap, c.String(fEmrConfig))
 
-				log.Info("EMR cluster launched successfully; Jobflow ID: " + jobflowID)
+				jobflowID, err := up(c.String(fEmrConfig), varMap)
+				if err != nil {
+					return exitCodeError(sentryEnabled, err)
+				}
+
+				log.WithField(fieldJobflowID, jobflowID).Info("EMR cluster launched successfully; Jobflow ID: " + jobflowID)
 				return nil
 			},
 		},
@@ -142,7 +287,14 @@ func main() {
 				getLockFlag(),
 				getSoftLockFlag(),
 				getConsulFlag(),
+				getLockBackendFlag(),
+				getLockTableFlag(),
+				getLockBucketFlag(),
+				getLockSlotsFlag(),
 				getVarsFlag(),
+				getVarFlag(),
+				getVarsFileFlag(),
+				getProfileFlag(),
 				getSentryFlag(),
 			},
 			Action: func(c *cli.Context) error {
@@ -152,8 +304,7 @@ func main() {
 				async := c.Bool(fAsync)
 				hardLock := c.String(fLock)
 				softLock := c.String(fSoftLock)
-				consul := c.String(fConsul)
-				vars := c.String(fVars)
+				lockConfig := getLockConfig(c)
 				sentry := c.String(fSentry)
 				sentryEnabled := len(sentry) > 0
 
@@ -164,17 +315,23 @@ func main() {
 					}
 				}
 
-				err := checkLockFlags(async, hardLock, softLock, consul)
+				varMap, cliVarNames, err := getVarMap(c)
 				if err != nil {
 					return exitCodeError(sentryEnabled, err)
 				}
+				warnUnusedVars(cliVarNames, varMap, emrPlaybook)
 
-				lock, err := initLock(hardLock, softLock, consul)
+				err = checkLockFlags(async, hardLock, softLock, lockConfig)
 				if err != nil {
 					return exitCodeError(sentryEnabled, err)
 				}
 
-				failedStepsIDs, err := run(emrPlaybook, jobflowID, async, vars)
+				lock, err := initLock(hardLock, softLock, lockConfig)
+				if err != nil {
+					return exitCodeError(sentryEnabled, err)
+				}
+
+				playbookRecord, failedStepsIDs, err := run(emrPlaybook, jobflowID, async, varMap, lock)
 
 				if logFailedSteps && len(failedStepsIDs) > 0 {
 					// Here we can't leverage the time spent downing the cluster to make sure log files have
@@ -183,7 +340,7 @@ func main() {
 					log.Info("Sleeping for " + strconv.Itoa(sleep) +
 						" seconds waiting for the logs to be rotated")
 					time.Sleep(time.Second * time.Duration(sleep))
-					displayFailedStepsLogs(failedStepsIDs, emrPlaybook, jobflowID, vars)
+					displayFailedStepsLogs(failedStepsIDs, playbookRecord, jobflowID)
 				}
 
 				if err != nil {
@@ -195,7 +352,7 @@ func main() {
 					lock.Unlock()
 				}
 
-				log.Info("All steps completed successfully")
+				log.WithField(fieldJobflowID, jobflowID).Info("All steps completed successfully")
 
 				return nil
 			},
@@ -207,6 +364,9 @@ func main() {
 				getEmrConfigFlag(),
 				getEmrClusterFlag(),
 				getVarsFlag(),
+				getVarFlag(),
+				getVarsFileFlag(),
+				getProfileFlag(),
 				getSentryFlag(),
 			},
 			Action: func(c *cli.Context) error {
@@ -220,11 +380,13 @@ func main() {
 					}
 				}
 
-				err := down(
-					c.String(fEmrConfig),
-					c.String(fEmrCluster),
-					c.String(fVars),
-				)
+				varMap, cliVarNames, err := getVarMap(c)
+				if err != nil {
+					return exitCodeError(sentryEnabled, err)
+				}
+				warnUnusedVars(cliVarNames, varMap, c.String(fEmrConfig))
+
+				err = down(c.String(fEmrConfig), c.String(fEmrCluster), varMap)
 				if err != nil {
 					return exitCodeError(sentryEnabled, err)
 				}
@@ -243,7 +405,14 @@ func main() {
 				getLockFlag(),
 				getSoftLockFlag(),
 				getConsulFlag(),
+				getLockBackendFlag(),
+				getLockTableFlag(),
+				getLockBucketFlag(),
+				getLockSlotsFlag(),
 				getVarsFlag(),
+				getVarFlag(),
+				getVarsFileFlag(),
+				getProfileFlag(),
 				getSentryFlag(),
 			},
 			Action: func(c *cli.Context) error {
@@ -252,8 +421,7 @@ func main() {
 				logFailedSteps := c.Bool(fLogFailedSteps)
 				hardLock := c.String(fLock)
 				softLock := c.String(fSoftLock)
-				consul := c.String(fConsul)
-				vars := c.String(fVars)
+				lockConfig := getLockConfig(c)
 				sentry := c.String(fSentry)
 				sentryEnabled := len(sentry) > 0
 
@@ -264,33 +432,50 @@ func main() {
 					}
 				}
 
-				clusterRecord, err := parseClusterRecord(emrConfig, vars)
+				if emrConfig == stdinConfig && emrPlaybook == stdinConfig {
+					return exitCodeError(sentryEnabled, errors.New("--"+fEmrConfig+" and --"+
+						fEmrPlaybook+" can't both be read from the standard input"))
+				}
+
+				varMap, cliVarNames, err := getVarMap(c)
+				if err != nil {
+					return exitCodeError(sentryEnabled, err)
+				}
+				warnUnusedVars(cliVarNames, varMap, emrConfig, emrPlaybook)
+
+				clusterRecord, err := parseClusterRecord(emrConfig, varMap)
 				if err != nil {
 					return exitCodeError(sentryEnabled, err)
 				}
 
-				playbookRecord, err := parsePlaybookRecord(emrPlaybook, vars)
+				err = checkLockFlags(false, hardLock, softLock, lockConfig)
 				if err != nil {
 					return exitCodeError(sentryEnabled, err)
 				}
 
-				err = checkLockFlags(false, hardLock, softLock, consul)
+				lock, err := initLock(hardLock, softLock, lockConfig)
 				if err != nil {
 					return exitCodeError(sentryEnabled, err)
 				}
 
-				lock, err := initLock(hardLock, softLock, consul)
+				// the playbook is parsed once the lock is held to access its fencing token,
+				// nothing ran yet so the lock is released no matter its kind
+				playbookRecord, err := parsePlaybookRecord(emrPlaybook, varMap, lock)
 				if err != nil {
+					if lock != nil {
+						lock.Unlock()
+					}
 					return exitCodeError(sentryEnabled, err)
 				}
 
-				emrCluster, err := InitEmrCluster(*clusterRecord)
+				emrCluster, err := InitEmrCluster(*clusterRecord, defaultAwsClients)
 				if err != nil {
 					if lock != nil && softLock != "" {
 						lock.Unlock()
 					}
 					return exitCodeError(sentryEnabled, err)
 				}
+				emrCluster.Observers = runObservers
 
 				jobFlowSteps, err := runJobFlowWithSteps(emrCluster, playbookRecord)
 				if err != nil {
@@ -300,7 +485,7 @@ func main() {
 					return exitCodeError(sentryEnabled, err)
 				}
 
-				log.Info("Transient EMR run with jobflow ID [" + jobFlowSteps.JobflowID + "] started successfully")
+				log.WithField(fieldJobflowID, jobFlowSteps.JobflowID).Info("Transient EMR run with jobflow ID [" + jobFlowSteps.JobflowID + "] started successfully")
 
 				log.Info("Waiting until cluster is terminated...")
 				err = emrCluster.Svc.WaitUntilClusterTerminatedWithContext(
@@ -313,6 +498,7 @@ func main() {
 						w.MaxAttempts = 26880
 					},
 				)
+				describeCluster(emrCluster, jobFlowSteps.JobflowID)
 				if err != nil {
 					if lock != nil && softLock != "" {
 						lock.Unlock()
@@ -320,12 +506,12 @@ func main() {
 					return exitCodeError(sentryEnabled, err)
 				}
 
-				log.Info("EMR cluster with ID [" + jobFlowSteps.JobflowID + "] is terminated successfully")
+				log.WithField(fieldJobflowID, jobFlowSteps.JobflowID).Info("EMR cluster with ID [" + jobFlowSteps.JobflowID + "] is terminated successfully")
 
 				failedStepIDs, err := jobFlowSteps.GetFailedStepIDs()
 
 				if logFailedSteps && len(failedStepIDs) > 0 {
-					displayFailedStepsLogs(failedStepIDs, emrPlaybook, jobFlowSteps.JobflowID, vars)
+					displayFailedStepsLogs(failedStepIDs, playbookRecord, jobFlowSteps.JobflowID)
 				}
 
 				if err != nil {
@@ -344,19 +530,204 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:  "render",
+			Usage: "Displays a cluster config or a playbook once templated, with secrets redacted",
+			Flags: []cli.Flag{
+				getEmrConfigFlag(),
+				getEmrPlaybookFlag(),
+				getVarsFlag(),
+				getVarFlag(),
+				getVarsFileFlag(),
+				getProfileFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				varMap, cliVarNames, err := getVarMap(c)
+				if err != nil {
+					return exitCodeError(false, err)
+				}
+				warnUnusedVars(cliVarNames, varMap, c.String(fEmrConfig)+c.String(fEmrPlaybook))
+
+				rendered, err := render(c.String(fEmrConfig), c.String(fEmrPlaybook), varMap)
+				if err != nil {
+					return exitCodeError(false, err)
+				}
+
+				fmt.Println(rendered)
+				return nil
+			},
+		},
+		{
+			Name:  "validate",
+			Usage: "Validates a cluster config and/or a playbook without running anything",
+			Flags: []cli.Flag{
+				getEmrConfigFlag(),
+				getEmrPlaybookFlag(),
+				getVarsFlag(),
+				getVarFlag(),
+				getVarsFileFlag(),
+				getProfileFlag(),
+				cli.BoolFlag{Name: fStrict, Usage: "Rejects the fields the schemas don't define"},
+			},
+			Action: func(c *cli.Context) error {
+				emrConfig := c.String(fEmrConfig)
+				emrPlaybook := c.String(fEmrPlaybook)
+				if emrConfig == stdinConfig && emrPlaybook == stdinConfig {
+					return exitCodeError(false, errors.New("--"+fEmrConfig+" and --"+
+						fEmrPlaybook+" can't both be read from the standard input"))
+				}
+
+				varMap, cliVarNames, err := getVarMap(c)
+				if err != nil {
+					return exitCodeError(false, err)
+				}
+				warnUnusedVars(cliVarNames, varMap, emrConfig, emrPlaybook)
+
+				err = validate(emrConfig, emrPlaybook, varMap, c.Bool(fStrict))
+				if err != nil {
+					return exitCodeError(false, err)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "schema",
+			Usage: "Exports the schemas of the cluster configs and playbooks",
+			Subcommands: []cli.Command{
+				{
+					Name:  "export",
+					Usage: "Displays the schema of the current version of a config kind",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  fKind,
+							Usage: "Kind of config, one of " + strings.Join(schemaKinds, ","),
+						},
+						cli.StringFlag{
+							Name:  fFormat,
+							Usage: "Format of the schema, one of " + strings.Join(schemaFormats, ","),
+							Value: schemaFormatJSONSchema,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.String(fKind) == "" {
+							return exitCodeError(false, flagToError(fKind))
+						}
+						schema, err := ExportSchema(c.String(fKind), c.String(fFormat))
+						if err != nil {
+							return exitCodeError(false, err)
+						}
+						fmt.Println(string(schema))
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "lock",
+			Usage: "Inspects, acquires and releases the locks used by run and run-transient",
+			Subcommands: []cli.Command{
+				{
+					Name:  "status",
+					Usage: "Displays the holder of a lock",
+					Flags: []cli.Flag{
+						getLockPathFlag(),
+						getConsulFlag(),
+						getLockBackendFlag(),
+						getLockTableFlag(),
+						getLockBucketFlag(),
+						getLockSlotsFlag(),
+					},
+					Action: func(c *cli.Context) error {
+						err := lockStatus(c.String(fLock), getLockConfig(c))
+						if err != nil {
+							return exitCodeError(false, err)
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "acquire",
+					Usage: "Acquires a lock",
+					Flags: []cli.Flag{
+						getLockPathFlag(),
+						getConsulFlag(),
+						getLockBackendFlag(),
+						getLockTableFlag(),
+						getLockBucketFlag(),
+						getLockSlotsFlag(),
+					},
+					Action: func(c *cli.Context) error {
+						err := lockAcquire(c.String(fLock), getLockConfig(c))
+						if err != nil {
+							return exitCodeError(false, err)
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "release",
+					Usage: "Releases a lock acquired by the current user on the current host",
+					Flags: []cli.Flag{
+						getLockPathFlag(),
+						getConsulFlag(),
+						getLockBackendFlag(),
+						getLockTableFlag(),
+						getLockBucketFlag(),
+						getLockSlotsFlag(),
+						getForceFlag(),
+					},
+					Action: func(c *cli.Context) error {
+						err := lockRelease(c.String(fLock), getLockConfig(c), c.Bool(fForce), false)
+						if err != nil {
+							return exitCodeError(false, err)
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "force-release",
+					Usage: "Releases a lock even if its holder can't be determined",
+					Flags: []cli.Flag{
+						getLockPathFlag(),
+						getConsulFlag(),
+						getLockBackendFlag(),
+						getLockTableFlag(),
+						getLockBucketFlag(),
+						getLockSlotsFlag(),
+						getForceFlag(),
+					},
+					Action: func(c *cli.Context) error {
+						err := lockRelease(c.String(fLock), getLockConfig(c), c.Bool(fForce), true)
+						if err != nil {
+							return exitCodeError(false, err)
+						}
+						return nil
+					},
+				},
+			},
+		},
 	}
 
+	app.Commands = withReports(app.Commands)
 	app.Run(os.Args)
 }
 
 // --- CLI Flags
 
 func getEmrConfigFlag() cli.StringFlag {
-	return cli.StringFlag{Name: fEmrConfig, Usage: "EMR config path"}
+	return cli.StringFlag{
+		Name: fEmrConfig,
+		Usage: "EMR config path, s3:// or http(s):// URL or - for the standard input, JSON (with or" +
+			" without comments) or YAML, optionally pinned with #sha256=<digest> or #etag=<ETag>",
+	}
 }
 
 func getEmrPlaybookFlag() cli.StringFlag {
-	return cli.StringFlag{Name: fEmrPlaybook, Usage: "Playbook path"}
+	return cli.StringFlag{
+		Name: fEmrPlaybook,
+		Usage: "Playbook path, s3:// or http(s):// URL or - for the standard input, JSON (with or" +
+			" without comments) or YAML, optionally pinned with #sha256=<digest> or #etag=<ETag>",
+	}
 }
 
 func getEmrClusterFlag() cli.StringFlag {
@@ -364,7 +735,36 @@ func getEmrClusterFlag() cli.StringFlag {
 }
 
 func getVarsFlag() cli.StringFlag {
-	return cli.StringFlag{Name: fVars, Usage: "Variables that will be used by the templater"}
+	return cli.StringFlag{
+		Name: fVars,
+		Usage: "Variables that will be used by the templater, as comma-separated keys and " +
+			"values. They override the variables from --" + fVarsFile + ", prefer --" + fVar +
+			" for values containing commas",
+	}
+}
+
+func getVarFlag() cli.StringSliceFlag {
+	return cli.StringSliceFlag{
+		Name: fVar,
+		Usage: "Variable that will be used by the templater, as key=value where the value can " +
+			"contain any character, can be repeated",
+	}
+}
+
+func getVarsFileFlag() cli.StringSliceFlag {
+	return cli.StringSliceFlag{
+		Name: fVarsFile,
+		Usage: "JSON, YAML or dotenv file containing variables that will be used by the " +
+			"templater, can be repeated with later files overriding earlier ones",
+	}
+}
+
+func getProfileFlag() cli.StringFlag {
+	return cli.StringFlag{
+		Name: fProfile,
+		Usage: "Profile whose overrides are applied to the configs, available to the templater as" +
+			" {{." + profileVar + "}}",
+	}
 }
 
 func getAsyncFlag() cli.BoolFlag {
@@ -380,7 +780,9 @@ func getLogFailedStepsFlag() cli.BoolFlag {
 
 func getLockFlag() cli.StringFlag {
 	usage := "Path to the lock held for the duration of the jobflow steps. This is materialized" +
-		" by a file or a KV entry in Consul depending on the --" + fConsul + " flag."
+		" by a file, a KV entry in Consul, an item in DynamoDB or an object in S3 depending on" +
+		" the --" + fLockBackend + " flag. Its fencing token is available to the playbook as" +
+		" {{." + fencingTokenVar + "}}."
 	return cli.StringFlag{
 		Name:  fLock,
 		Usage: usage,
@@ -389,14 +791,31 @@ func getLockFlag() cli.StringFlag {
 
 func getSoftLockFlag() cli.StringFlag {
 	usage := "Path to the lock held for the duration of the jobflow steps. This is materialized" +
-		" by a file or a KV entry in Consul depending on the --" + fConsul + " flag. Released no" +
-		" matter if the operation failed or succeeded."
+		" by a file, a KV entry in Consul, an item in DynamoDB or an object in S3 depending on" +
+		" the --" + fLockBackend + " flag. Released no matter if the operation failed or succeeded." +
+		" Its fencing token is available to the playbook as {{." + fencingTokenVar + "}}."
 	return cli.StringFlag{
 		Name:  fSoftLock,
 		Usage: usage,
 	}
 }
 
+func getLockPathFlag() cli.StringFlag {
+	usage := "Path to the lock. This is materialized by a file, a KV entry in Consul, an item in" +
+		" DynamoDB or an object in S3 depending on the --" + fLockBackend + " flag."
+	return cli.StringFlag{
+		Name:  fLock,
+		Usage: usage,
+	}
+}
+
+func getForceFlag() cli.BoolFlag {
+	return cli.BoolFlag{
+		Name:  fForce,
+		Usage: "Needed to release a lock acquired by another user or on another host",
+	}
+}
+
 func getConsulFlag() cli.StringFlag {
 	return cli.StringFlag{
 		Name:  fConsul,
@@ -404,6 +823,50 @@ func getConsulFlag() cli.StringFlag {
 	}
 }
 
+func getLockBackendFlag() cli.StringFlag {
+	usage := "Backend materializing the lock, possible values are " +
+		strings.Join(lockBackends, ",") + ". Defaults to " + LockBackendConsul + " if --" +
+		fConsul + " is specified and to " + LockBackendFile + " otherwise. " +
+		LockBackendDynamoDB + " locks are leased and expire if their holder stops extending them."
+	return cli.StringFlag{
+		Name:  fLockBackend,
+		Usage: usage,
+	}
+}
+
+func getLockTableFlag() cli.StringFlag {
+	return cli.StringFlag{
+		Name:  fLockTable,
+		Usage: "DynamoDB table, with a string partition key named " + dynamoDBLockKey + ", holding the locks",
+	}
+}
+
+func getLockBucketFlag() cli.StringFlag {
+	return cli.StringFlag{
+		Name:  fLockBucket,
+		Usage: "S3 bucket holding the locks",
+	}
+}
+
+func getLockSlotsFlag() cli.IntFlag {
+	return cli.IntFlag{
+		Name: fLockSlots,
+		Usage: "Number of holders allowed to hold the lock at once, only supported by the " +
+			LockBackendFile + " and " + LockBackendConsul + " lock backends",
+		Value: 1,
+	}
+}
+
+func getLockConfig(c *cli.Context) LockConfig {
+	return LockConfig{
+		Backend: c.String(fLockBackend),
+		Consul:  c.String(fConsul),
+		Table:   c.String(fLockTable),
+		Bucket:  c.String(fLockBucket),
+		Slots:   c.Int(fLockSlots),
+	}
+}
+
 func getSentryFlag() cli.StringFlag {
 	return cli.StringFlag{
 		Name:  fSentry,
@@ -414,8 +877,8 @@ func getSentryFlag() cli.StringFlag {
 // --- Commands
 
 // up launches a new EMR cluster
-func up(emrConfig string, vars string) (string, error) {
-	clusterRecord, err := parseClusterRecord(emrConfig, vars)
+func up(emrConfig string, varMap map[string]interface{}) (string, error) {
+	clusterRecord, err := parseClusterRecord(emrConfig, varMap)
 	if err != nil {
 		return "", err
 	}
@@ -424,10 +887,11 @@ func up(emrConfig string, vars string) (string, error) {
 }
 
 func upWithConfig(clusterRecord *ClusterConfig) (string, error) {
-	ec, err := InitEmrCluster(*clusterRecord)
+	ec, err := InitEmrCluster(*clusterRecord, defaultAwsClients)
 	if err != nil {
 		return "", err
 	}
+	ec.Observers = runObservers
 	jobflowID, err := ec.RunJobFlow()
 	if err != nil {
 		return "", err
@@ -443,10 +907,11 @@ func runJobFlowWithSteps(emrCluster *EmrCluster, playbookRecord *PlaybookConfig)
 		return nil, err
 	}
 
-	jobFlowSteps, err := InitJobFlowSteps(*playbookRecord, "", false)
+	jobFlowSteps, err := InitJobFlowSteps(*playbookRecord, "", false, defaultAwsClients)
 	if err != nil {
 		return nil, err
 	}
+	jobFlowSteps.Observers = runObservers
 
 	addJobFlowStepsInput, err := jobFlowSteps.GetJobFlowStepsInput()
 	if err != nil {
@@ -461,58 +926,172 @@ func runJobFlowWithSteps(emrCluster *EmrCluster, playbookRecord *PlaybookConfig)
 	}
 
 	jobFlowSteps.JobflowID = *jobFlowOutput.JobFlowId
+	emrCluster.Observers.ClusterLaunched(jobFlowSteps.JobflowID, emrCluster.Config.Name)
+	describeCluster(emrCluster, jobFlowSteps.JobflowID)
 
 	return jobFlowSteps, nil
 }
 
-// log the failed steps by printing out the different log files for each failed step
-func displayFailedStepsLogs(failedStepsIDs []string, emrPlaybook, jobflowID, vars string) {
-	playbookRecord, err := parsePlaybookRecord(emrPlaybook, vars)
-	if err != nil {
-		log.Error("Couldn't parse playbook record: " + err.Error())
+// describeCluster retrieves the state of a cluster for the observers, failures being logged as
+// they don't affect the run
+func describeCluster(ec *EmrCluster, jobflowID string) {
+	if _, err := ec.DescribeCluster(jobflowID); err != nil {
+		log.WithField(fieldJobflowID, jobflowID).Warn("Couldn't describe the EMR cluster: " + err.Error())
+	}
+}
+
+// withReports wraps the actions of commands and their subcommands with withReport
+func withReports(commands []cli.Command) []cli.Command {
+	for i, command := range commands {
+		commands[i].Subcommands = withReports(command.Subcommands)
+		if action, ok := command.Action.(func(*cli.Context) error); ok {
+			commands[i].Action = withReport(action)
+		}
+	}
+	return commands
+}
+
+// withReport wraps the action of a command so that the run and JUnit reports are written once
+// it's done, whether it failed or not
+func withReport(action func(*cli.Context) error) func(*cli.Context) error {
+	return func(c *cli.Context) error {
+		runFields[fieldCommand] = c.Command.FullName()
+		runReport.SetCommand(c.Command.FullName())
+		if runTracing != nil {
+			runFields[fieldTraceID] = runTracing.Start(c.Command.FullName(), runFields)
+		}
+		if playbook := c.String(fEmrPlaybook); playbook != "" {
+			junitReport.Name = playbook
+		}
+
+		err := action(c)
+
+		exitCode := 0
+		if coder, ok := err.(cli.ExitCoder); ok {
+			exitCode = coder.ExitCode()
+		} else if err != nil {
+			exitCode = otherExitCode
+		}
+		runReport.Finish(exitCode, err)
+		runMetrics.Finish(exitCode)
+		pushMetrics(c, c.Command.FullName())
+		closeStatsD()
+		finishTracing(exitCode, err)
+		err = writeReport(c.GlobalString(fMetricsFile), "metrics", runMetrics, err)
+		err = writeReport(c.GlobalString(fReportFile), "run report", runReport, err)
+		return writeReport(c.GlobalString(fJUnitReport), "JUnit report", junitReport, err)
+	}
+}
+
+// pushMetrics pushes the metrics of a command to the Pushgateway if one is specified, failures
+// being logged as the command is done
+func pushMetrics(c *cli.Context, command string) {
+	url := c.GlobalString(fMetricsPushURL)
+	if url == "" {
+		return
+	}
+	if err := runMetrics.Push(url, c.GlobalString(fMetricsJob), command); err != nil {
+		log.Error("Couldn't push the metrics to " + url + ": " + err.Error())
+	}
+}
+
+// closeStatsD flushes the metrics sent to the StatsD agent if one is specified, failures being
+// logged as the command is done
+func closeStatsD() {
+	if runStatsD == nil {
+		return
 	}
+	if err := runStatsD.Close(); err != nil {
+		log.Error("Couldn't flush the StatsD metrics: " + err.Error())
+	}
+}
+
+// finishTracing ends the trace of the command if an OTLP endpoint is specified and exports it,
+// failures being logged as the command is done
+func finishTracing(exitCode int, err error) {
+	if runTracing == nil {
+		return
+	}
+	runTracing.Finish(exitCode, err)
+	if err := runTracing.Shutdown(); err != nil {
+		log.Error("Couldn't export the trace: " + err.Error())
+	}
+}
+
+// tryLock tries to acquire a lock, notifying the observers of the time it took
+func tryLock(lock Lock, name string) error {
+	start := time.Now()
+	err := lock.TryLock()
+	runObservers.LockAcquired(name, time.Since(start), err)
+	return err
+}
+
+// writeReport writes a report to a file if one is specified, failing the command if it can't
+// unless it already failed
+func writeReport(path, description string, report interface{ WriteFile(string) error }, err error) error {
+	if path == "" {
+		return err
+	}
+	if writeErr := report.WriteFile(path); writeErr != nil {
+		message := "Couldn't write the " + description + " to " + path + ": " + writeErr.Error()
+		if err == nil {
+			return cli.NewExitError(message, otherExitCode)
+		}
+		log.Error(message)
+	}
+	return err
+}
+
+// log the failed steps by printing out the different log files for each failed step
+func displayFailedStepsLogs(failedStepsIDs []string, playbookRecord *PlaybookConfig, jobflowID string) {
 	logsDownloader, err := InitLogsDownloader(
-		playbookRecord.Credentials.AccessKeyId,
-		playbookRecord.Credentials.SecretAccessKey,
+		playbookRecord.Credentials,
 		playbookRecord.Region,
 		jobflowID,
+		defaultAwsClients,
 	)
 	if err != nil {
-		log.Error("Couldn't retrieve failed steps' logs: " + err.Error())
+		log.WithField(fieldJobflowID, jobflowID).Error("Couldn't retrieve failed steps' logs: " + err.Error())
+		return
 	}
+	logsDownloader.Observers = runObservers
 	for _, stepID := range failedStepsIDs {
+		stepLog := log.WithFields(log.Fields{fieldJobflowID: jobflowID, fieldStepID: stepID})
 		logs, err := logsDownloader.GetStepLogs(stepID)
 		if err != nil {
-			log.Error("Couldn't retrieve logs for step " + stepID + ": " + err.Error())
+			stepLog.Error("Couldn't retrieve logs for step " + stepID + ": " + err.Error())
 		}
 		for filename, content := range logs {
-			log.Info("Content of log file '" + filename + "' for step " + stepID + ":")
-			log.Info(content)
+			stepLog.Info("Content of log file '" + filename + "' for step " + stepID + ":")
+			stepLog.Info(content)
 		}
 	}
 }
 
-// run adds steps to an EMR cluster and return the failed steps' IDs
-func run(emrPlaybook, emrCluster string, async bool, vars string) ([]string, error) {
-	playbookRecord, err := parsePlaybookRecord(emrPlaybook, vars)
+// run adds steps to an EMR cluster and return the playbook along with the failed steps' IDs
+func run(emrPlaybook, emrCluster string, async bool, varMap map[string]interface{}, lock Lock) (*PlaybookConfig, []string, error) {
+	playbookRecord, err := parsePlaybookRecord(emrPlaybook, varMap, lock)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return runWithConfig(playbookRecord, emrCluster, async)
+	failedStepsIDs, err := runWithConfig(playbookRecord, emrCluster, async)
+	return playbookRecord, failedStepsIDs, err
 }
 
 func runWithConfig(playbookRecord *PlaybookConfig, emrCluster string, async bool) ([]string, error) {
-	jfs, err := InitJobFlowSteps(*playbookRecord, emrCluster, async)
+	jfs, err := InitJobFlowSteps(*playbookRecord, emrCluster, async, defaultAwsClients)
 	if err != nil {
 		return nil, err
 	}
+	jfs.Observers = runObservers
+	describeCluster(&EmrCluster{Svc: jfs.EmrSvc, Observers: jfs.Observers}, emrCluster)
 
 	return jfs.AddJobFlowSteps()
 }
 
 // down terminates a running EMR cluster
-func down(emrConfig string, emrCluster string, vars string) error {
+func down(emrConfig string, emrCluster string, varMap map[string]interface{}) error {
 	if emrConfig == "" {
 		return flagToError(fEmrConfig)
 	}
@@ -520,11 +1099,6 @@ func down(emrConfig string, emrCluster string, vars string) error {
 		return flagToError(fEmrCluster)
 	}
 
-	varMap, err := varsToMap(vars)
-	if err != nil {
-		return err
-	}
-
 	ar, err := InitConfigResolver()
 	if err != nil {
 		return err
@@ -534,18 +1108,189 @@ func down(emrConfig string, emrCluster string, vars string) error {
 	if err != nil {
 		return err
 	}
+	runObservers.ConfigLoaded("cluster", emrConfig, clusterRecord)
 
 	return downWithConfig(clusterRecord, emrCluster)
 }
 
 func downWithConfig(clusterRecord *ClusterConfig, emrCluster string) error {
-	ec, err := InitEmrCluster(*clusterRecord)
+	ec, err := InitEmrCluster(*clusterRecord, defaultAwsClients)
 	if err != nil {
 		return err
 	}
+	ec.Observers = runObservers
 	return ec.TerminateJobFlow(emrCluster)
 }
 
+// validate parses the configs which are specified, at least one of them is needed
+func validate(emrConfig, emrPlaybook string, varMap map[string]interface{}, strict bool) error {
+	if emrConfig == "" && emrPlaybook == "" {
+		return errors.New("--" + fEmrConfig + " and/or --" + fEmrPlaybook + " needs to be specified")
+	}
+
+	ar, err := InitConfigResolver()
+	if err != nil {
+		return err
+	}
+	ar.Strict = strict
+
+	if emrConfig != "" {
+		clusterRecord, err := ar.ParseClusterRecordFromFile(emrConfig, varMap)
+		if err != nil {
+			return invalidConfigError("invalid cluster config "+emrConfig, err)
+		}
+		runObservers.ConfigLoaded("cluster", emrConfig, clusterRecord)
+		log.Info("Cluster config " + emrConfig + " is valid")
+	}
+	if emrPlaybook != "" {
+		playbookRecord, err := ar.ParsePlaybookRecordFromFile(emrPlaybook, varMap)
+		if err != nil {
+			return invalidConfigError("invalid playbook "+emrPlaybook, err)
+		}
+		runObservers.ConfigLoaded("playbook", emrPlaybook, playbookRecord)
+		log.Info("Playbook " + emrPlaybook + " is valid")
+	}
+	return nil
+}
+
+// invalidConfigError describes why a config couldn't be parsed, validation errors already naming
+// the invalid config
+func invalidConfigError(description string, err error) error {
+	if _, ok := err.(*ValidationErrors); ok {
+		return err
+	}
+	return errors.New(description + ": " + err.Error())
+}
+
+// render templates a cluster config or a playbook, redacting the secrets it contains
+func render(emrConfig, emrPlaybook string, varMap map[string]interface{}) (string, error) {
+	if (emrConfig == "") == (emrPlaybook == "") {
+		return "", errors.New("either --" + fEmrConfig + " or --" + fEmrPlaybook +
+			" needs to be specified")
+	}
+	config := emrConfig + emrPlaybook
+
+	ar, err := InitConfigResolver()
+	if err != nil {
+		return "", err
+	}
+
+	jsonBytes, err := ar.RenderFile(config, varMap)
+	if err != nil {
+		return "", err
+	}
+
+	var indented bytes.Buffer
+	err = json.Indent(&indented, jsonBytes, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return Redact(indented.String()), nil
+}
+
+// lockStatus displays the holder of a lock
+func lockStatus(lockPath string, lockConfig LockConfig) error {
+	if lockPath == "" {
+		return flagToError(fLock)
+	}
+	err := checkLockBackendFlags(lockConfig)
+	if err != nil {
+		return err
+	}
+
+	lock, err := GetLock(lockPath, lockConfig, defaultAwsClients)
+	if err != nil {
+		return err
+	}
+
+	if semaphore, ok := lock.(Semaphore); ok {
+		return semaphoreStatus(semaphore, lockPath)
+	}
+
+	holder, err := lock.Holder()
+	if err != nil {
+		return err
+	}
+	if holder == nil {
+		log.Info("Lock at " + lockPath + " is not held")
+	} else {
+		log.Info("Lock at " + lockPath + " is held by " + holder.String())
+	}
+	return nil
+}
+
+// semaphoreStatus displays the holders of the slots of a semaphore
+func semaphoreStatus(semaphore Semaphore, lockPath string) error {
+	slots, err := semaphore.Slots()
+	if err != nil {
+		return err
+	}
+	log.Info(strconv.Itoa(len(slots)) + " of the " + strconv.Itoa(semaphore.Limit()) +
+		" slots of the lock at " + lockPath + " are held")
+	for _, slot := range slots {
+		log.Info("Slot " + slot.Name + " is held by " + slot.Holder.String())
+	}
+	return nil
+}
+
+// lockAcquire acquires a lock which will have to be released by the lock release command
+func lockAcquire(lockPath string, lockConfig LockConfig) error {
+	if lockPath == "" {
+		return flagToError(fLock)
+	}
+	err := checkLockBackendFlags(lockConfig)
+	if err != nil {
+		return err
+	}
+
+	lockConfig.Persistent = true
+	lock, err := GetLock(lockPath, lockConfig, defaultAwsClients)
+	if err != nil {
+		return err
+	}
+
+	err = tryLock(lock, lockPath)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Lock at " + lockPath + " acquired successfully with fencing token " +
+		strconv.FormatInt(lock.FencingToken(), 10))
+	return nil
+}
+
+// lockRelease releases a lock, forcefully or not
+func lockRelease(lockPath string, lockConfig LockConfig, force, forceRelease bool) error {
+	if lockPath == "" {
+		return flagToError(fLock)
+	}
+	err := checkLockBackendFlags(lockConfig)
+	if err != nil {
+		return err
+	}
+
+	lock, err := GetLock(lockPath, lockConfig, defaultAwsClients)
+	if err != nil {
+		return err
+	}
+	if _, ok := lock.(Semaphore); ok {
+		return errors.New("slots are released one at a time, pass the name of the slot given by " +
+			"lock status to --" + fLock + " without --" + fLockSlots)
+	}
+
+	if forceRelease {
+		err = ForceReleaseLock(lock, lockPath, force)
+	} else {
+		err = ReleaseLock(lock, lockPath, force)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Info("Lock at " + lockPath + " released successfully")
+	return nil
+}
+
 // --- Helpers
 
 func initializeSentry(dsn string) error {
@@ -562,11 +1307,19 @@ func flagToError(flag string) error {
 }
 
 // checkLockFlags checks the validity of the lock-related flags
-func checkLockFlags(async bool, hardLock, softLock, consul string) error {
-	if consul != "" && hardLock == "" && softLock == "" {
+func checkLockFlags(async bool, hardLock, softLock string, lockConfig LockConfig) error {
+	if lockConfig.Consul != "" && hardLock == "" && softLock == "" {
 		return errors.New(
 			"--" + fLock + " or --" + fSoftLock + " is needed to make use of --" + fConsul)
 	}
+	if lockConfig.Backend != "" && hardLock == "" && softLock == "" {
+		return errors.New(
+			"--" + fLock + " or --" + fSoftLock + " is needed to make use of --" + fLockBackend)
+	}
+	if lockConfig.Slots > 1 && hardLock == "" && softLock == "" {
+		return errors.New(
+			"--" + fLock + " or --" + fSoftLock + " is needed to make use of --" + fLockSlots)
+	}
 	if hardLock != "" && softLock != "" {
 		return errors.New("--" + fLock + " and --" + fSoftLock + " are mutually exclusive")
 	}
@@ -574,9 +1327,123 @@ func checkLockFlags(async bool, hardLock, softLock, consul string) error {
 		return errors.New(
 			"--" + fAsync + " and --" + fLock + " or --" + fSoftLock + " are not compatible")
 	}
+	return checkLockBackendFlags(lockConfig)
+}
+
+// checkLockBackendFlags checks that the flags needed by the lock backend are provided
+func checkLockBackendFlags(lockConfig LockConfig) error {
+	backend := lockConfig.GetBackend()
+	if lockConfig.Consul != "" && backend != LockBackendConsul {
+		return errors.New("--" + fConsul + " can only be used with the " + LockBackendConsul +
+			" lock backend")
+	}
+	if backend == LockBackendConsul && lockConfig.Consul == "" {
+		return flagToError(fConsul)
+	}
+	if lockConfig.Table != "" && backend != LockBackendDynamoDB {
+		return errors.New("--" + fLockTable + " can only be used with the " + LockBackendDynamoDB +
+			" lock backend")
+	}
+	if backend == LockBackendDynamoDB && lockConfig.Table == "" {
+		return flagToError(fLockTable)
+	}
+	if lockConfig.Bucket != "" && backend != LockBackendS3 {
+		return errors.New("--" + fLockBucket + " can only be used with the " + LockBackendS3 +
+			" lock backend")
+	}
+	if backend == LockBackendS3 && lockConfig.Bucket == "" {
+		return flagToError(fLockBucket)
+	}
+	if lockConfig.Slots < 1 {
+		return errors.New("--" + fLockSlots + " must be at least 1")
+	}
+	if lockConfig.Slots > 1 && backend != LockBackendFile && backend != LockBackendConsul {
+		return errors.New("--" + fLockSlots + " can only be used with the " + LockBackendFile +
+			" and " + LockBackendConsul + " lock backends")
+	}
 	return nil
 }
 
+// getVarMap merges the variables from the vars files with the ones from the command line, the
+// latter taking precedence, and sets the profile variable from --profile. The names of the
+// variables from the command line are also returned.
+func getVarMap(c *cli.Context) (map[string]interface{}, []string, error) {
+	varMap, err := LoadVarsFiles(c.StringSlice(fVarsFile))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cliVars, err := varsToMap(c.String(fVars))
+	if err != nil {
+		return nil, nil, err
+	}
+	assignments, err := ParseVarAssignments(c.StringSlice(fVar))
+	if err != nil {
+		return nil, nil, errors.New("--" + fVar + ": " + err.Error())
+	}
+	for k, v := range assignments {
+		if _, ok := cliVars[k]; ok {
+			return nil, nil, errors.New("variable " + k + " is specified in both --" + fVars +
+				" and --" + fVar)
+		}
+		cliVars[k] = v
+	}
+
+	cliVarNames := make([]string, 0, len(cliVars))
+	for k, v := range cliVars {
+		varMap[k] = v
+		cliVarNames = append(cliVarNames, k)
+	}
+	sort.Strings(cliVarNames)
+
+	if profile := c.String(fProfile); profile != "" {
+		varMap[profileVar] = profile
+	} else if _, ok := varMap[profileVar]; !ok {
+		varMap[profileVar] = ""
+	}
+	return varMap, cliVarNames, nil
+}
+
+// warnUnusedVars warns about the variables from the command line which none of the configs, nor
+// the configs they extend or include, reference
+func warnUnusedVars(cliVarNames []string, varMap map[string]interface{}, configs ...string) {
+	var specified []string
+	for _, config := range configs {
+		if config != "" {
+			specified = append(specified, config)
+		}
+	}
+	if len(specified) == 0 {
+		return
+	}
+	configs = specified
+
+	used := make(map[string]bool)
+	for _, config := range configs {
+		variables, err := ConfigVariables(config, varMap)
+		if err != nil {
+			// the configs can't be composed yet, e.g. because they need a fencing token
+			content, err := defaultConfigLoader.Load(config)
+			if err != nil {
+				return
+			}
+			variables, err = TemplateVariables(content, configName(config))
+			if err != nil {
+				return
+			}
+		}
+		for _, v := range variables {
+			used[v] = true
+		}
+	}
+
+	for _, name := range cliVarNames {
+		if !used[name] {
+			log.Warn("Variable " + name + " is not used by " + strings.Join(configs, " nor "))
+		}
+	}
+}
+
 // varsToMap converts the variables argument to a map of
 // keys and values
 func varsToMap(vars string) (map[string]interface{}, error) {
@@ -586,11 +1453,16 @@ func varsToMap(vars string) (map[string]interface{}, error) {
 
 	varsArr := strings.Split(vars, varDelim)
 	if len(varsArr)%2 != 0 {
-		return nil, errors.New("--" + fVars + " must have an even number of keys and values")
+		return nil, errors.New("--" + fVars + " must have an even number of keys and values, " +
+			"use --" + fVar + " key=value for values containing " + varDelim)
 	}
 
 	varsMap := make(map[string]interface{})
 	for i := 0; i < len(varsArr); i += 2 {
+		if _, ok := varsMap[varsArr[i]]; ok {
+			return nil, errors.New("variable " + varsArr[i] + " is specified more than once in --" +
+				fVars)
+		}
 		varsMap[varsArr[i]] = varsArr[i+1]
 	}
 
@@ -614,6 +1486,25 @@ func exitCodeError(sentryEnabled bool, err error) error {
 	}
 }
 
+// configureAwsClients applies the AWS endpoint and HTTP flags to the AWS clients, the SDK logging
+// its requests if debug is set. Remote configs are downloaded with the same proxy and CA bundle.
+func configureAwsClients(c *cli.Context, clients *AwsClients, debug bool) error {
+	serviceEndpoints, err := ParseServiceEndpoints(c.GlobalStringSlice(fServiceEndpoint))
+	if err != nil {
+		return err
+	}
+	httpClient, err := NewHTTPClient(c.GlobalString(fAwsProxy), c.GlobalString(fAwsCABundle))
+	if err != nil {
+		return err
+	}
+	clients.Endpoint = c.GlobalString(fAwsEndpoint)
+	clients.ServiceEndpoints = serviceEndpoints
+	clients.HTTPClient = httpClient
+	clients.Debug = debug
+	defaultConfigLoader.UseHTTPClient(httpClient)
+	return nil
+}
+
 // getLogLevelKeys builds an array of the available log levels
 func getLogLevelKeys(logLevels map[string]log.Level) []string {
 	keys := make([]string, 0, len(logLevels))
@@ -623,16 +1514,18 @@ func getLogLevelKeys(logLevels map[string]log.Level) []string {
 	return keys
 }
 
-// initLock tries to init a lock
-func initLock(hardLock, softLock, consul string) (Lock, error) {
+// initLock tries to init a lock, refreshed in the background for as long as it is held. Hard
+// locks are persistent as they're kept if the run fails.
+func initLock(hardLock, softLock string, lockConfig LockConfig) (Lock, error) {
 	var lock Lock
-	var err error
 	if hardLock != "" || softLock != "" {
-		lock, err = GetLock(hardLock+softLock, consul)
+		lockConfig.Persistent = hardLock != ""
+		l, err := GetLock(hardLock+softLock, lockConfig, defaultAwsClients)
 		if err != nil {
 			return nil, err
 		}
-		err := lock.TryLock()
+		lock = NewRefreshingLock(l, hardLock+softLock, lockRefreshInterval)
+		err = tryLock(lock, hardLock+softLock)
 		if err != nil {
 			return nil, err
 		}
@@ -640,15 +1533,14 @@ func initLock(hardLock, softLock, consul string) (Lock, error) {
 	return lock, nil
 }
 
-// parses a playbook record
-func parsePlaybookRecord(emrPlaybook, vars string) (*PlaybookConfig, error) {
+// parses a playbook record, exposing the fencing token of the lock if one is held
+func parsePlaybookRecord(emrPlaybook string, varMap map[string]interface{}, lock Lock) (*PlaybookConfig, error) {
 	if emrPlaybook == "" {
 		return nil, flagToError(fEmrPlaybook)
 	}
 
-	varMap, err := varsToMap(vars)
-	if err != nil {
-		return nil, err
+	if lock != nil {
+		varMap[fencingTokenVar] = lock.FencingToken()
 	}
 
 	ar, err := InitConfigResolver()
@@ -656,24 +1548,29 @@ func parsePlaybookRecord(emrPlaybook, vars string) (*PlaybookConfig, error) {
 		return nil, err
 	}
 
-	return ar.ParsePlaybookRecordFromFile(emrPlaybook, varMap)
+	playbookRecord, err := ar.ParsePlaybookRecordFromFile(emrPlaybook, varMap)
+	if err != nil {
+		return nil, err
+	}
+	runObservers.ConfigLoaded("playbook", emrPlaybook, playbookRecord)
+	return playbookRecord, nil
 }
 
 // parses a cluster record
-func parseClusterRecord(emrConfig, vars string) (*ClusterConfig, error) {
+func parseClusterRecord(emrConfig string, varMap map[string]interface{}) (*ClusterConfig, error) {
 	if emrConfig == "" {
 		return nil, flagToError(fEmrConfig)
 	}
 
-	varMap, err := varsToMap(vars)
+	ar, err := InitConfigResolver()
 	if err != nil {
 		return nil, err
 	}
 
-	ar, err := InitConfigResolver()
+	clusterRecord, err := ar.ParseClusterRecordFromFile(emrConfig, varMap)
 	if err != nil {
 		return nil, err
 	}
-
-	return ar.ParseClusterRecordFromFile(emrConfig, varMap)
+	runObservers.ConfigLoaded("cluster", emrConfig, clusterRecord)
+	return clusterRecord, nil
 }
@@ -0,0 +1,218 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/emr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+const metricsNamespace = "dataflow_runner"
+
+// Buckets of the durations, steps taking from seconds to days and lock acquisitions, a single
+// attempt which doesn't wait for the lock to be released, taking from milliseconds to seconds
+var (
+	stepDurationBuckets = prometheus.ExponentialBuckets(1, 4, 10)
+	lockAcquireBuckets  = prometheus.ExponentialBuckets(0.005, 2, 12)
+)
+
+// Outcomes of the lock acquisitions
+const (
+	lockAcquired = "acquired"
+	lockHeld     = "held"
+	lockFailed   = "failed"
+)
+
+// terminalStepStates are the states of the steps which are done
+var terminalStepStates = []string{
+	emr.StepStateCompleted,
+	emr.StepStateFailed,
+	emr.StepStateCancelled,
+	emr.StepStateInterrupted,
+}
+
+// Metrics collects the Prometheus metrics of a run, which are pushed to a Pushgateway or written
+// for the textfile collector once it's done as runs are too short-lived to be scraped
+type Metrics struct {
+	NopObserver
+	Registry *prometheus.Registry
+
+	clusterLaunch     *prometheus.GaugeVec
+	bootstrapFailures prometheus.Counter
+	stepDuration      *prometheus.HistogramVec
+	steps             *prometheus.CounterVec
+	lockAcquire       *prometheus.HistogramVec
+	lockAcquisitions  *prometheus.CounterVec
+	awsRetries        *prometheus.CounterVec
+	runDuration       prometheus.Gauge
+	exitCode          prometheus.Gauge
+	lastRun           prometheus.Gauge
+
+	start    time.Time
+	mu       sync.Mutex
+	launched map[string]bool
+	finished map[string]bool
+}
+
+// NewMetrics registers the metrics of a run starting now
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		clusterLaunch: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "cluster_launch_seconds",
+			Help:      "Time it took for the cluster to be ready once created",
+		}, []string{"cluster"}),
+		bootstrapFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "bootstrap_failures_total",
+			Help:      "Number of clusters which failed to bootstrap and were relaunched",
+		}),
+		stepDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "step_duration_seconds",
+			Help:      "Duration of the steps which are done",
+			Buckets:   stepDurationBuckets,
+		}, []string{"step", "state"}),
+		steps: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "steps_total",
+			Help:      "Number of steps which are done, by state",
+		}, []string{"state"}),
+		lockAcquire: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "lock_acquire_seconds",
+			Help:      "Time spent trying to acquire the locks once, without waiting for them to be released",
+			Buckets:   lockAcquireBuckets,
+		}, []string{"lock", "outcome"}),
+		lockAcquisitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "lock_acquisitions_total",
+			Help:      "Number of attempts to acquire the lock, by outcome",
+		}, []string{"outcome"}),
+		awsRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "aws_retries_total",
+			Help:      "Number of retries of the requests to AWS",
+		}, []string{"service", "operation"}),
+		runDuration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "run_duration_seconds",
+			Help:      "Duration of the command",
+		}),
+		exitCode: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "exit_code",
+			Help:      "Exit code of the command",
+		}),
+		lastRun: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "last_run_timestamp_seconds",
+			Help:      "Time the command finished at",
+		}),
+		start:    time.Now(),
+		launched: make(map[string]bool),
+		finished: make(map[string]bool),
+	}
+	m.Registry.MustRegister(m.clusterLaunch, m.bootstrapFailures, m.stepDuration, m.steps,
+		m.lockAcquire, m.lockAcquisitions, m.awsRetries, m.runDuration, m.exitCode, m.lastRun)
+	return m
+}
+
+// ClusterChanged records the time it took for the cluster to be ready
+func (m *Metrics) ClusterChanged(cluster *emr.Cluster) {
+	if cluster.Status == nil || cluster.Status.Timeline == nil {
+		return
+	}
+	timeline := cluster.Status.Timeline
+	if timeline.CreationDateTime == nil || timeline.ReadyDateTime == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := aws.StringValue(cluster.Id)
+	if m.launched[id] {
+		return
+	}
+	m.launched[id] = true
+	m.clusterLaunch.WithLabelValues(aws.StringValue(cluster.Name)).
+		Set(timeline.ReadyDateTime.Sub(*timeline.CreationDateTime).Seconds())
+}
+
+// ClusterBootstrapFailed counts the bootstrap failures
+func (m *Metrics) ClusterBootstrapFailed(jobflowID string) {
+	m.bootstrapFailures.Inc()
+}
+
+// StepChanged records the outcome and duration of the steps once they're done
+func (m *Metrics) StepChanged(jobflowID string, step *emr.Step) {
+	if step.Status == nil || !StringInSlice(aws.StringValue(step.Status.State), terminalStepStates) {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := jobflowID + "/" + aws.StringValue(step.Id)
+	if m.finished[id] {
+		return
+	}
+	m.finished[id] = true
+
+	state := aws.StringValue(step.Status.State)
+	m.steps.WithLabelValues(state).Inc()
+	if timeline := step.Status.Timeline; timeline != nil && timeline.StartDateTime != nil && timeline.EndDateTime != nil {
+		m.stepDuration.WithLabelValues(aws.StringValue(step.Name), state).
+			Observe(timeline.EndDateTime.Sub(*timeline.StartDateTime).Seconds())
+	}
+}
+
+// LockAcquired records the time spent trying to acquire a lock along with the outcome
+func (m *Metrics) LockAcquired(name string, duration time.Duration, err error) {
+	outcome := lockAcquired
+	if _, ok := err.(LockHeldError); ok {
+		outcome = lockHeld
+	} else if err != nil {
+		outcome = lockFailed
+	}
+	m.lockAcquire.WithLabelValues(name, outcome).Observe(duration.Seconds())
+	m.lockAcquisitions.WithLabelValues(outcome).Inc()
+}
+
+// AwsRequestRetried counts the retries of the requests to AWS
+func (m *Metrics) AwsRequestRetried(service, operation string, retries int) {
+	m.awsRetries.WithLabelValues(service, operation).Add(float64(retries))
+}
+
+// Finish records the end of the command along with its exit code
+func (m *Metrics) Finish(exitCode int) {
+	m.runDuration.Set(time.Since(m.start).Seconds())
+	m.exitCode.Set(float64(exitCode))
+	m.lastRun.SetToCurrentTime()
+}
+
+// Push pushes the metrics to a Pushgateway, replacing the metrics of the job and command
+func (m *Metrics) Push(url, job, command string) error {
+	return push.New(url, job).Grouping("command", command).Gatherer(m.Registry).Push()
+}
+
+// WriteFile writes the metrics to a file read by the textfile collector of the node exporter
+func (m *Metrics) WriteFile(path string) error {
+	return prometheus.WriteToTextfile(path, m.Registry)
+}
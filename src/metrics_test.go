@@ -0,0 +1,138 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/emr"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+)
+
+func mockMetrics() *Metrics {
+	metrics := NewMetrics()
+	observers := Observers{metrics}
+
+	created := time.Date(2019, time.October, 10, 23, 0, 0, 0, time.UTC)
+	ready := created.Add(7 * time.Minute)
+	for i := 0; i < 2; i++ {
+		observers.ClusterChanged(&emr.Cluster{Id: aws.String("j-123"), Name: aws.String("nightly"), Status: &emr.ClusterStatus{
+			State:    aws.String("WAITING"),
+			Timeline: &emr.ClusterTimeline{CreationDateTime: &created, ReadyDateTime: &ready},
+		}})
+	}
+	observers.ClusterBootstrapFailed("j-122")
+
+	end := ready.Add(90 * time.Second)
+	step := &emr.Step{Id: aws.String("s-1"), Name: aws.String("load"), Status: &emr.StepStatus{
+		State:    aws.String("COMPLETED"),
+		Timeline: &emr.StepTimeline{StartDateTime: &ready, EndDateTime: &end},
+	}}
+	// steps are counted once no matter how many times they're polled
+	observers.StepChanged("j-123", step)
+	observers.StepChanged("j-123", step)
+	// steps sharing a name are all recorded
+	shorter := ready.Add(30 * time.Second)
+	observers.StepChanged("j-123", &emr.Step{Id: aws.String("s-3"), Name: aws.String("load"), Status: &emr.StepStatus{
+		State:    aws.String("COMPLETED"),
+		Timeline: &emr.StepTimeline{StartDateTime: &ready, EndDateTime: &shorter},
+	}})
+	observers.StepChanged("j-123", &emr.Step{Id: aws.String("s-2"), Name: aws.String("check"), Status: &emr.StepStatus{
+		State: aws.String("RUNNING"),
+	}})
+
+	observers.LockAcquired("pipeline", 2*time.Second, nil)
+	observers.LockAcquired("pipeline", 3*time.Second, nil)
+	observers.LockAcquired("shared", time.Second, nil)
+	observers.LockAcquired("pipeline", time.Second, LockHeldError("lock already held at pipeline"))
+	observers.AwsRequestRetried("elasticmapreduce", "DescribeCluster", 2)
+	observers.AwsRequestRetried("elasticmapreduce", "DescribeCluster", 1)
+	metrics.Finish(1)
+	return metrics
+}
+
+func TestMetrics_WriteFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "test-metrics")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dataflow-runner.prom")
+	assert.Nil(mockMetrics().WriteFile(path))
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+
+	for _, line := range []string{
+		`dataflow_runner_cluster_launch_seconds{cluster="nightly"} 420`,
+		`dataflow_runner_bootstrap_failures_total 1`,
+		`dataflow_runner_step_duration_seconds_sum{state="COMPLETED",step="load"} 120`,
+		`dataflow_runner_step_duration_seconds_count{state="COMPLETED",step="load"} 2`,
+		`dataflow_runner_step_duration_seconds_bucket{state="COMPLETED",step="load",le="64"} 1`,
+		`dataflow_runner_steps_total{state="COMPLETED"} 2`,
+		`dataflow_runner_lock_acquire_seconds_sum{lock="pipeline",outcome="acquired"} 5`,
+		`dataflow_runner_lock_acquire_seconds_count{lock="pipeline",outcome="acquired"} 2`,
+		`dataflow_runner_lock_acquire_seconds_count{lock="shared",outcome="acquired"} 1`,
+		`dataflow_runner_lock_acquisitions_total{outcome="held"} 1`,
+		`dataflow_runner_aws_retries_total{operation="DescribeCluster",service="elasticmapreduce"} 3`,
+		`dataflow_runner_exit_code 1`,
+	} {
+		assert.Contains(string(content), line+"\n")
+	}
+	assert.NotContains(string(content), "RUNNING")
+}
+
+func TestMetrics_Push(t *testing.T) {
+	assert := assert.New(t)
+
+	var method, path string
+	families := map[string]*dto.MetricFamily{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		path = r.URL.Path
+		decoder := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		for {
+			family := &dto.MetricFamily{}
+			if err := decoder.Decode(family); err != nil {
+				if err != io.EOF {
+					w.WriteHeader(http.StatusBadRequest)
+				}
+				break
+			}
+			families[family.GetName()] = family
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	assert.Nil(mockMetrics().Push(server.URL, "nightly", "run-transient"))
+	assert.Equal(http.MethodPut, method)
+	assert.Equal("/metrics/job/nightly/command/run-transient", path)
+	assert.Equal(float64(4), families["dataflow_runner_lock_acquisitions_total"].GetMetric()[0].GetCounter().GetValue()+
+		families["dataflow_runner_lock_acquisitions_total"].GetMetric()[1].GetCounter().GetValue())
+	assert.Equal(float64(2), families["dataflow_runner_steps_total"].GetMetric()[0].GetCounter().GetValue())
+
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	assert.NotNil(mockMetrics().Push(server.URL, "nightly", "run"))
+}
@@ -0,0 +1,167 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/emr"
+	log "github.com/sirupsen/logrus"
+)
+
+// RunObserver is notified of the progress of the clusters and steps of a run
+type RunObserver interface {
+	// ConfigLoaded is called once a config, i.e. a *ClusterConfig or *PlaybookConfig, is loaded
+	// from a location
+	ConfigLoaded(kind, location string, record interface{})
+	// ClusterLaunched is called once a cluster is launched, before it's ready
+	ClusterLaunched(jobflowID, name string)
+	// ClusterChanged is called whenever the state of a cluster is retrieved
+	ClusterChanged(cluster *emr.Cluster)
+	// ClusterBootstrapFailed is called when a cluster failed to bootstrap, before it's relaunched
+	ClusterBootstrapFailed(jobflowID string)
+	// StepsSubmitted is called once steps are added to a cluster
+	StepsSubmitted(jobflowID string, steps []*emr.StepConfig, stepIDs []*string)
+	// StepChanged is called whenever the state of a step is retrieved
+	StepChanged(jobflowID string, step *emr.Step)
+	// StepLogs is called once the log files of a step are retrieved, indexed by file name
+	StepLogs(jobflowID, stepID string, logs map[string]string)
+	// LockAcquired is called once a lock was tried, duration being the time the single attempt
+	// took and err being set if it couldn't be acquired
+	LockAcquired(name string, duration time.Duration, err error)
+	// AwsRequestRetried is called when a request to AWS succeeded or failed after being retried
+	AwsRequestRetried(service, operation string, retries int)
+	// OperationStarted is called when an operation such as a request to AWS or a wait starts
+	// within the context of the operation enclosing it, if any. The returned context is the one
+	// of the operation, passed to the operations it encloses, and the returned function is called
+	// with its error, if any, once it's done.
+	OperationStarted(ctx context.Context, name string, fields log.Fields) (context.Context, func(err error))
+}
+
+// NopObserver ignores every notification, it is meant to be embedded by the observers which are
+// only interested in some of them
+type NopObserver struct{}
+
+// ConfigLoaded does nothing
+func (NopObserver) ConfigLoaded(kind, location string, record interface{}) {}
+
+// ClusterLaunched does nothing
+func (NopObserver) ClusterLaunched(jobflowID, name string) {}
+
+// ClusterChanged does nothing
+func (NopObserver) ClusterChanged(cluster *emr.Cluster) {}
+
+// ClusterBootstrapFailed does nothing
+func (NopObserver) ClusterBootstrapFailed(jobflowID string) {}
+
+// StepsSubmitted does nothing
+func (NopObserver) StepsSubmitted(jobflowID string, steps []*emr.StepConfig, stepIDs []*string) {}
+
+// StepChanged does nothing
+func (NopObserver) StepChanged(jobflowID string, step *emr.Step) {}
+
+// StepLogs does nothing
+func (NopObserver) StepLogs(jobflowID, stepID string, logs map[string]string) {}
+
+// LockAcquired does nothing
+func (NopObserver) LockAcquired(name string, duration time.Duration, err error) {}
+
+// AwsRequestRetried does nothing
+func (NopObserver) AwsRequestRetried(service, operation string, retries int) {}
+
+// OperationStarted does nothing
+func (NopObserver) OperationStarted(ctx context.Context, name string, fields log.Fields) (context.Context, func(err error)) {
+	return ctx, func(err error) {}
+}
+
+// Observers notifies every observer it holds, none for the zero value
+type Observers []RunObserver
+
+// ConfigLoaded notifies every observer
+func (o Observers) ConfigLoaded(kind, location string, record interface{}) {
+	for _, observer := range o {
+		observer.ConfigLoaded(kind, location, record)
+	}
+}
+
+// ClusterLaunched notifies every observer
+func (o Observers) ClusterLaunched(jobflowID, name string) {
+	for _, observer := range o {
+		observer.ClusterLaunched(jobflowID, name)
+	}
+}
+
+// ClusterChanged notifies every observer
+func (o Observers) ClusterChanged(cluster *emr.Cluster) {
+	for _, observer := range o {
+		observer.ClusterChanged(cluster)
+	}
+}
+
+// ClusterBootstrapFailed notifies every observer
+func (o Observers) ClusterBootstrapFailed(jobflowID string) {
+	for _, observer := range o {
+		observer.ClusterBootstrapFailed(jobflowID)
+	}
+}
+
+// StepsSubmitted notifies every observer
+func (o Observers) StepsSubmitted(jobflowID string, steps []*emr.StepConfig, stepIDs []*string) {
+	for _, observer := range o {
+		observer.StepsSubmitted(jobflowID, steps, stepIDs)
+	}
+}
+
+// StepChanged notifies every observer
+func (o Observers) StepChanged(jobflowID string, step *emr.Step) {
+	for _, observer := range o {
+		observer.StepChanged(jobflowID, step)
+	}
+}
+
+// StepLogs notifies every observer
+func (o Observers) StepLogs(jobflowID, stepID string, logs map[string]string) {
+	for _, observer := range o {
+		observer.StepLogs(jobflowID, stepID, logs)
+	}
+}
+
+// LockAcquired notifies every observer
+func (o Observers) LockAcquired(name string, duration time.Duration, err error) {
+	for _, observer := range o {
+		observer.LockAcquired(name, duration, err)
+	}
+}
+
+// AwsRequestRetried notifies every observer
+func (o Observers) AwsRequestRetried(service, operation string, retries int) {
+	for _, observer := range o {
+		observer.AwsRequestRetried(service, operation, retries)
+	}
+}
+
+// OperationStarted notifies every observer, the context of the operation being enriched by each of
+// them in turn. The returned function notifies them in turn once the operation is done.
+func (o Observers) OperationStarted(ctx context.Context, name string, fields log.Fields) (context.Context, func(err error)) {
+	done := make([]func(error), len(o))
+	for i, observer := range o {
+		ctx, done[i] = observer.OperationStarted(ctx, name, fields)
+	}
+	return ctx, func(err error) {
+		for _, d := range done {
+			d(err)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/emr"
+)
+
+// RunReport is the machine-readable summary of a command, built from the notifications of the
+// components and written once the command is done
+type RunReport struct {
+	NopObserver `json:"-"`
+
+	Command   string          `json:"command"`
+	RunID     string          `json:"runId"`
+	StartTime time.Time       `json:"startTime"`
+	EndTime   *time.Time      `json:"endTime,omitempty"`
+	ExitCode  int             `json:"exitCode"`
+	Error     string          `json:"error,omitempty"`
+	Configs   []*ReportConfig `json:"configs"`
+	JobflowID string          `json:"jobflowId,omitempty"`
+	Cluster   *ReportCluster  `json:"cluster,omitempty"`
+	Steps     []*ReportStep   `json:"steps"`
+
+	// Loader provides the configs as they were loaded, before templating
+	Loader *ConfigLoader `json:"-"`
+
+	mu sync.Mutex
+}
+
+// ReportConfig identifies a config used by a command along with the configs it extends and
+// includes
+type ReportConfig struct {
+	Kind     string          `json:"kind"`
+	Location string          `json:"location"`
+	SHA256   string          `json:"sha256"`
+	Sources  []*ReportSource `json:"sources,omitempty"`
+}
+
+// ReportSource identifies a config extended or included by a config used by a command
+type ReportSource struct {
+	Location string `json:"location"`
+	SHA256   string `json:"sha256"`
+}
+
+// ReportCluster is the state and timeline of the cluster of a command
+type ReportCluster struct {
+	ID                string     `json:"id"`
+	Name              string     `json:"name"`
+	State             string     `json:"state"`
+	StateChangeReason string     `json:"stateChangeReason,omitempty"`
+	LogURI            string     `json:"logUri,omitempty"`
+	CreationTime      *time.Time `json:"creationTime,omitempty"`
+	ReadyTime         *time.Time `json:"readyTime,omitempty"`
+	EndTime           *time.Time `json:"endTime,omitempty"`
+}
+
+// ReportStep is the outcome of a step
+type ReportStep struct {
+	ID              string     `json:"id"`
+	Name            string     `json:"name"`
+	State           string     `json:"state"`
+	StartTime       *time.Time `json:"startTime,omitempty"`
+	EndTime         *time.Time `json:"endTime,omitempty"`
+	DurationSeconds *float64   `json:"durationSeconds,omitempty"`
+	FailureReason   string     `json:"failureReason,omitempty"`
+	FailureMessage  string     `json:"failureMessage,omitempty"`
+	// LogFile is the file EMR identified as the cause of the failure
+	LogFile string `json:"logFile,omitempty"`
+	// LogLocation is the location of the logs of the step, under the log URI of the cluster
+	LogLocation string `json:"logLocation,omitempty"`
+}
+
+// NewRunReport builds the report of a run identified by runID, starting now
+func NewRunReport(runID string) *RunReport {
+	return &RunReport{
+		RunID:     runID,
+		StartTime: time.Now().UTC(),
+		Configs:   []*ReportConfig{},
+		Steps:     []*ReportStep{},
+		Loader:    defaultConfigLoader,
+	}
+}
+
+// SetCommand records the command being run
+func (r *RunReport) SetCommand(command string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Command = command
+}
+
+// ConfigLoaded records a config used by the command and the configs it was composed with. The
+// configs are hashed as they were loaded rather than the record as the latter contains the
+// resolved secrets, the digests are left empty if a config can't be loaded again.
+func (r *RunReport) ConfigLoaded(kind, location string, record interface{}) {
+	config := &ReportConfig{Kind: kind, Location: location, SHA256: r.loadedSHA256(location)}
+	for _, source := range r.Loader.Sources(location) {
+		config.Sources = append(config.Sources,
+			&ReportSource{Location: source, SHA256: r.loadedSHA256(source)})
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Configs = append(r.Configs, config)
+}
+
+// loadedSHA256 hashes a config as it was loaded, empty if it can't be loaded again
+func (r *RunReport) loadedSHA256(location string) string {
+	content, err := r.Loader.Load(location)
+	if err != nil {
+		return ""
+	}
+	return sha256Hex(string(content))
+}
+
+// ClusterChanged records the state of the cluster, the last one launched if it was relaunched.
+// Names and messages are redacted as they can echo the rendered configs.
+func (r *RunReport) ClusterChanged(cluster *emr.Cluster) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if cluster.Id != nil {
+		r.JobflowID = *cluster.Id
+	}
+	r.Cluster = &ReportCluster{
+		ID:     aws.StringValue(cluster.Id),
+		Name:   Redact(aws.StringValue(cluster.Name)),
+		LogURI: aws.StringValue(cluster.LogUri),
+	}
+	if status := cluster.Status; status != nil {
+		r.Cluster.State = aws.StringValue(status.State)
+		if status.StateChangeReason != nil {
+			r.Cluster.StateChangeReason = Redact(aws.StringValue(status.StateChangeReason.Message))
+		}
+		if timeline := status.Timeline; timeline != nil {
+			r.Cluster.CreationTime = utcTime(timeline.CreationDateTime)
+			r.Cluster.ReadyTime = utcTime(timeline.ReadyDateTime)
+			r.Cluster.EndTime = utcTime(timeline.EndDateTime)
+		}
+	}
+	for _, step := range r.Steps {
+		step.LogLocation = r.stepLogLocation(step.ID)
+	}
+}
+
+// StepsSubmitted records the steps as pending
+func (r *RunReport) StepsSubmitted(jobflowID string, steps []*emr.StepConfig, stepIDs []*string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.JobflowID = jobflowID
+	for i, stepID := range stepIDs {
+		step := r.step(aws.StringValue(stepID))
+		if i < len(steps) {
+			step.Name = Redact(aws.StringValue(steps[i].Name))
+		}
+		if step.State == "" {
+			step.State = emr.StepStatePending
+		}
+	}
+}
+
+// StepChanged records the state of a step, its name and failure being redacted
+func (r *RunReport) StepChanged(jobflowID string, step *emr.Step) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.JobflowID = jobflowID
+	reported := r.step(aws.StringValue(step.Id))
+	reported.Name = Redact(aws.StringValue(step.Name))
+	if status := step.Status; status != nil {
+		reported.State = aws.StringValue(status.State)
+		if timeline := status.Timeline; timeline != nil {
+			reported.StartTime = utcTime(timeline.StartDateTime)
+			reported.EndTime = utcTime(timeline.EndDateTime)
+			if reported.StartTime != nil && reported.EndTime != nil {
+				duration := reported.EndTime.Sub(*reported.StartTime).Seconds()
+				reported.DurationSeconds = &duration
+			}
+		}
+		if details := status.FailureDetails; details != nil {
+			reported.FailureReason = Redact(aws.StringValue(details.Reason))
+			reported.FailureMessage = Redact(aws.StringValue(details.Message))
+			reported.LogFile = aws.StringValue(details.LogFile)
+		}
+		if status.StateChangeReason != nil && reported.FailureMessage == "" {
+			reported.FailureMessage = Redact(aws.StringValue(status.StateChangeReason.Message))
+		}
+	}
+}
+
+// Finish records the end of the command along with its exit code and error if it failed
+func (r *RunReport) Finish(exitCode int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().UTC()
+	r.EndTime = &now
+	r.ExitCode = exitCode
+	if err != nil {
+		r.Error = Redact(err.Error())
+	}
+}
+
+// WriteFile writes the report as JSON to a file
+func (r *RunReport) WriteFile(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(content, '\n'), 0644)
+}
+
+// step returns the reported step with the given id, adding it if it's not reported yet
+func (r *RunReport) step(stepID string) *ReportStep {
+	for _, step := range r.Steps {
+		if step.ID == stepID {
+			return step
+		}
+	}
+	step := &ReportStep{ID: stepID, LogLocation: r.stepLogLocation(stepID)}
+	r.Steps = append(r.Steps, step)
+	return step
+}
+
+// stepLogLocation is the location EMR writes the logs of a step to, unknown if the log URI of
+// the cluster isn't
+func (r *RunReport) stepLogLocation(stepID string) string {
+	if r.Cluster == nil || r.Cluster.LogURI == "" {
+		return ""
+	}
+	return strings.TrimSuffix(r.Cluster.LogURI, "/") + "/" + r.Cluster.ID + "/steps/" + stepID + "/"
+}
+
+func utcTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	utc := t.UTC()
+	return &utc
+}
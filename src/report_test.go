@@ -0,0 +1,168 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/emr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunReport(t *testing.T) {
+	assert := assert.New(t)
+	report := NewRunReport("run-id")
+	report.SetCommand("run")
+
+	// the observers of the components are notified
+	jfs := mockJobFlowStepsWithoutPlaybook("j-COMPLETED")
+	jfs.Observers = Observers{report}
+	_, _, err := jfs.RetrieveStepState("step-id")
+	assert.Nil(err)
+	ec := mockEmrCluster(ClusterConfig{})
+	ec.Observers = Observers{report}
+	_, err = ec.DescribeCluster("j-WAITING")
+	assert.Nil(err)
+	assert.Equal("j-COMPLETED", report.JobflowID)
+	assert.Equal("WAITING", report.Cluster.State)
+	assert.Equal(1, len(report.Steps))
+	assert.Equal("COMPLETED", report.Steps[0].State)
+	assert.Equal(float64(0), *report.Steps[0].DurationSeconds)
+
+	start := time.Date(2019, time.October, 10, 23, 0, 0, 0, time.UTC)
+	end := start.Add(90 * time.Second)
+	report.ClusterChanged(&emr.Cluster{
+		Id:     aws.String("j-123"),
+		Name:   aws.String("cluster"),
+		LogUri: aws.String("s3n://logs/emr/"),
+		Status: &emr.ClusterStatus{
+			State:    aws.String("TERMINATED"),
+			Timeline: &emr.ClusterTimeline{CreationDateTime: &start, EndDateTime: &end},
+		},
+	})
+	report.StepsSubmitted("j-123", []*emr.StepConfig{{Name: aws.String("first")}, {Name: aws.String("second")}},
+		[]*string{aws.String("s-1"), aws.String("s-2")})
+	report.StepChanged("j-123", &emr.Step{
+		Id:   aws.String("s-1"),
+		Name: aws.String("first"),
+		Status: &emr.StepStatus{
+			State:          aws.String("FAILED"),
+			Timeline:       &emr.StepTimeline{StartDateTime: &start, EndDateTime: &end},
+			FailureDetails: &emr.FailureDetails{Reason: aws.String("Unknown Error."), LogFile: aws.String("s3://logs/emr/j-123/steps/s-1/stderr.gz")},
+		},
+	})
+	// the messages of EMR can echo the secrets of the arguments
+	MarkSensitive("report-secret")
+	report.StepChanged("j-123", &emr.Step{
+		Id:   aws.String("s-2"),
+		Name: aws.String("second"),
+		Status: &emr.StepStatus{
+			State:             aws.String("CANCELLED"),
+			StateChangeReason: &emr.StepStateChangeReason{Message: aws.String("cancelled --password report-secret")},
+		},
+	})
+	// the configs are hashed before their secrets are resolved
+	raw := `{"name":"playbook","password":"{{ssm "/db/password"}}"}`
+	report.Loader = NewConfigLoader()
+	report.Loader.stdin = strings.NewReader(raw)
+	report.ConfigLoaded("playbook", stdinConfig, map[string]string{"name": "playbook", "password": "secret-password"})
+	report.Finish(1, errors.New("1/2 steps failed to complete successfully"))
+
+	dir, _ := ioutil.TempDir("", "test-report")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "report.json")
+	assert.Nil(report.WriteFile(path))
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+
+	var written map[string]interface{}
+	assert.Nil(json.Unmarshal(content, &written))
+	assert.Equal("run", written["command"])
+	assert.Equal("run-id", written["runId"])
+	assert.Equal(float64(1), written["exitCode"])
+	assert.Equal("1/2 steps failed to complete successfully", written["error"])
+	assert.Equal("j-123", written["jobflowId"])
+	assert.Equal([]interface{}{map[string]interface{}{
+		"kind":     "playbook",
+		"location": stdinConfig,
+		"sha256":   sha256Hex(raw),
+	}}, written["configs"])
+	assert.Equal(map[string]interface{}{
+		"id":           "j-123",
+		"name":         "cluster",
+		"state":        "TERMINATED",
+		"logUri":       "s3n://logs/emr/",
+		"creationTime": "2019-10-10T23:00:00Z",
+		"endTime":      "2019-10-10T23:01:30Z",
+	}, written["cluster"])
+
+	steps := written["steps"].([]interface{})
+	assert.Equal(3, len(steps))
+	assert.Equal(map[string]interface{}{
+		"id":              "s-1",
+		"name":            "first",
+		"state":           "FAILED",
+		"startTime":       "2019-10-10T23:00:00Z",
+		"endTime":         "2019-10-10T23:01:30Z",
+		"durationSeconds": float64(90),
+		"failureReason":   "Unknown Error.",
+		"logFile":         "s3://logs/emr/j-123/steps/s-1/stderr.gz",
+		"logLocation":     "s3n://logs/emr/j-123/steps/s-1/",
+	}, steps[1])
+	assert.Equal(map[string]interface{}{
+		"id":             "s-2",
+		"name":           "second",
+		"state":          "CANCELLED",
+		"failureMessage": "cancelled --password " + redacted,
+		"logLocation":    "s3n://logs/emr/j-123/steps/s-2/",
+	}, steps[2])
+	assert.NotContains(string(content), "report-secret")
+}
+
+func TestRunReport_ComposedConfig(t *testing.T) {
+	assert := assert.New(t)
+	report := NewRunReport("run-id")
+	report.Loader = NewConfigLoader()
+
+	dir, _ := ioutil.TempDir("", "test-report-composed")
+	defer os.RemoveAll(dir)
+	writeConfigFile(t, dir, "base/playbook.json", basePlaybook)
+	writeConfigFile(t, dir, "base/fragment.yml", fragmentPlaybook)
+	prod := writeConfigFile(t, dir, "prod.json", prodPlaybook)
+
+	// the configs the playbook extends and includes are hashed along with it
+	ar, _ := InitConfigResolver()
+	ar.Loader = report.Loader
+	record, err := ar.ParsePlaybookRecordFromFile(prod, map[string]interface{}{"src": "s3://bucket/"})
+	assert.Nil(err)
+	report.ConfigLoaded("playbook", prod, record)
+
+	assert.Equal([]*ReportConfig{{
+		Kind:     "playbook",
+		Location: prod,
+		SHA256:   sha256Hex(prodPlaybook),
+		Sources: []*ReportSource{
+			{Location: filepath.Join(dir, "base/playbook.json"), SHA256: sha256Hex(basePlaybook)},
+			{Location: filepath.Join(dir, "base/fragment.yml"), SHA256: sha256Hex(fragmentPlaybook)},
+		},
+	}}, report.Configs)
+}
@@ -24,10 +24,11 @@ import (
 )
 
 // S3Downloader models an entity capable of downloading files from S3 at the specified bucket
-// to the specified dir
+// to the specified dir, within the context of the operation Ctx if it is set
 type S3Downloader struct {
 	Downloader  s3manageriface.DownloaderAPI
 	Bucket, Dir string
+	Ctx         aws.Context
 }
 
 // EachPage is the function to trigger on each page of s3.ListObjectsPages
@@ -60,6 +61,10 @@ func (d *S3Downloader) DownloadToFile(key string) error {
 
 	// Download the file using the AWS SDK
 	params := &s3.GetObjectInput{Bucket: aws.String(d.Bucket), Key: aws.String(key)}
-	_, err = d.Downloader.Download(fd, params)
+	ctx := d.Ctx
+	if ctx == nil {
+		ctx = aws.BackgroundContext()
+	}
+	_, err = d.Downloader.DownloadWithContext(ctx, fd, params)
 	return err
 }
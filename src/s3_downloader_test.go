@@ -53,6 +53,10 @@ func (m *mockDownloaderAPI) Download(w io.WriterAt, i *s3.GetObjectInput, option
 	return int64(0), nil
 }
 
+func (m *mockDownloaderAPI) DownloadWithContext(ctx aws.Context, w io.WriterAt, i *s3.GetObjectInput, options ...func(*s3manager.Downloader)) (int64, error) {
+	return m.Download(w, i, options...)
+}
+
 func mockS3Downloader(bucket, dir string) *S3Downloader {
 	return &S3Downloader{
 		Downloader: &mockDownloaderAPI{},
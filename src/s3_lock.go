@@ -0,0 +1,273 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// S3Lock is for S3-based locks, materialized by an object in a bucket which is only written if
+// it doesn't already exist. The fencing token is stored in a sibling object suffixed with .fence.
+// The ETag of the object as we last wrote it, or as it was read along with its holder, tells
+// whether or not the lock was modified by someone else before releasing it.
+type S3Lock struct {
+	svc    s3iface.S3API
+	bucket string
+	key    string
+	token  int64
+	holder LockHolder
+	etag   string
+	seen   string
+}
+
+// InitS3Lock builds a S3Lock (an object in a S3 bucket) with the name argument as key, the region
+// and credentials are resolved through the default chain
+func InitS3Lock(bucket, name string, clients *AwsClients) (Lock, error) {
+	sess, err := clients.DefaultSession()
+	if err != nil {
+		return nil, err
+	}
+	return &S3Lock{svc: s3.New(sess), bucket: bucket, key: name}, nil
+}
+
+// TryLock tries to acquire a lock by conditionally creating the object in S3
+func (sl *S3Lock) TryLock() error {
+	holder := NewLockHolder()
+	etag, err := sl.putObject(sl.key, holder.Bytes(), ifNoneMatch("*"))
+	if isPreconditionFailed(err) {
+		return LockHeldError("lock already held at " + sl.name())
+	}
+	if err != nil {
+		return err
+	}
+	sl.etag = etag
+
+	// the fencing token can only be incremented safely once the lock is held
+	token, err := sl.nextFencingToken()
+	if err != nil {
+		sl.Unlock()
+		return err
+	}
+
+	// the lock may have been force-released and acquired by someone else in the meantime
+	holder.FencingToken = token
+	etag, err = sl.putObject(sl.key, holder.Bytes(), ifMatch(sl.etag))
+	if isPreconditionFailed(err) {
+		sl.etag = ""
+		return LockHeldError("lock already held at " + sl.name())
+	}
+	if err != nil {
+		sl.Unlock()
+		return err
+	}
+	sl.etag = etag
+	sl.token = token
+	sl.holder = holder
+	return nil
+}
+
+// Refresh rewrites the lock's metadata in S3 as long as it is still held by us
+func (sl *S3Lock) Refresh() error {
+	content, etag, err := sl.getObject(sl.key)
+	if err != nil {
+		return err
+	}
+	var holder *LockHolder
+	if content != nil {
+		holder, err = ParseLockHolder(content)
+		if err != nil {
+			return err
+		}
+	}
+	if err := checkRefreshable(sl.name(), holder, sl.token); err != nil {
+		return err
+	}
+
+	refreshed := sl.holder.refreshed()
+	etag, err = sl.putObject(sl.key, refreshed.Bytes(), ifMatch(etag))
+	if isPreconditionFailed(err) {
+		return errors.New("lock at " + sl.name() + " was modified while being refreshed")
+	}
+	if err != nil {
+		return err
+	}
+	sl.etag = etag
+	sl.holder = refreshed
+	return nil
+}
+
+// FencingToken returns the token obtained when acquiring the lock
+func (sl *S3Lock) FencingToken() int64 {
+	return sl.token
+}
+
+// nextFencingToken increments the counter object, the write only succeeds if the counter
+// wasn't modified since it was read
+func (sl *S3Lock) nextFencingToken() (int64, error) {
+	fenceKey := sl.key + ".fence"
+	content, etag, err := sl.getObject(fenceKey)
+	if err != nil {
+		return 0, err
+	}
+
+	var token int64
+	condition := ifNoneMatch("*")
+	if content != nil {
+		token, err = strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		condition = ifMatch(etag)
+	}
+	token++
+
+	_, err = sl.putObject(fenceKey, []byte(strconv.FormatInt(token, 10)), condition)
+	if isPreconditionFailed(err) {
+		return 0, errors.New("fencing token of the lock at " + sl.name() +
+			" was modified concurrently")
+	}
+	if err != nil {
+		return 0, err
+	}
+	return token, nil
+}
+
+// getObject reads an object and its ETag, the content is nil if the object doesn't exist
+func (sl *S3Lock) getObject(key string) ([]byte, string, error) {
+	out, err := sl.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(sl.bucket),
+		Key:    aws.String(key),
+	})
+	if isS3NotFound(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer out.Body.Close()
+
+	content, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return content, aws.StringValue(out.ETag), nil
+}
+
+// putObject writes an object, subject to the conditions specified as options, and returns the
+// ETag of the written object
+func (sl *S3Lock) putObject(key string, content []byte, opts ...request.Option) (string, error) {
+	out, err := sl.svc.PutObjectWithContext(aws.BackgroundContext(), &s3.PutObjectInput{
+		Bucket:      aws.String(sl.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(content),
+		ContentType: aws.String("application/json"),
+	}, opts...)
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.ETag), nil
+}
+
+// name identifies the lock in messages
+func (sl *S3Lock) name() string {
+	return "s3://" + sl.bucket + "/" + sl.key
+}
+
+// Unlock tries to release the lock by deleting the object from S3. The object is only deleted if
+// its ETag is still the one we wrote when acquiring the lock or the one whose holder was read, it
+// is deleted unconditionally only when neither happened, i.e. when force-releasing a lock whose
+// holder can't be read.
+func (sl *S3Lock) Unlock() error {
+	_, err := sl.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(sl.bucket),
+		Key:    aws.String(sl.key),
+	})
+	if isS3NotFound(err) {
+		return errors.New("lock not held")
+	}
+	if err != nil {
+		return err
+	}
+
+	expected := sl.etag
+	if expected == "" {
+		expected = sl.seen
+	}
+	var opts []request.Option
+	if expected != "" {
+		opts = append(opts, ifMatch(expected))
+	}
+	_, err = sl.svc.DeleteObjectWithContext(aws.BackgroundContext(), &s3.DeleteObjectInput{
+		Bucket: aws.String(sl.bucket),
+		Key:    aws.String(sl.key),
+	}, opts...)
+	if isPreconditionFailed(err) {
+		return errors.New("lock at " + sl.name() + " was modified by someone else, it wasn't released")
+	}
+	if isS3NotFound(err) {
+		return errors.New("lock not held")
+	}
+	if err != nil {
+		return err
+	}
+	sl.etag = ""
+	sl.seen = ""
+	return nil
+}
+
+// Holder retrieves the metadata of the lock's holder from S3, nil if the lock is not held
+func (sl *S3Lock) Holder() (*LockHolder, error) {
+	content, etag, err := sl.getObject(sl.key)
+	if err != nil || content == nil {
+		return nil, err
+	}
+	sl.seen = etag
+	return ParseLockHolder(content)
+}
+
+// ifNoneMatch sets the If-None-Match header which is not modeled by the SDK for PutObject
+func ifNoneMatch(etag string) request.Option {
+	return func(r *request.Request) {
+		r.HTTPRequest.Header.Set("If-None-Match", etag)
+	}
+}
+
+// ifMatch sets the If-Match header which is not modeled by the SDK for PutObject
+func ifMatch(etag string) request.Option {
+	return func(r *request.Request) {
+		r.HTTPRequest.Header.Set("If-Match", etag)
+	}
+}
+
+// isPreconditionFailed checks whether or not a conditional S3 write was rejected
+func isPreconditionFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && (aerr.Code() == "PreconditionFailed" || aerr.Code() == "ConditionalRequestConflict")
+}
+
+// isS3NotFound checks whether or not a S3 call failed because the object doesn't exist
+func isS3NotFound(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && (aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound")
+}
@@ -0,0 +1,277 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockS3APILock is an in-memory bucket honoring the If-None-Match and If-Match headers on
+// PutObject and the If-Match header on DeleteObject, the ETag of an object is the number of times
+// it was written. beforePut and beforeDelete let tests interleave writes of their own.
+type mockS3APILock struct {
+	s3iface.S3API
+	objects      map[string][]byte
+	etags        map[string]int
+	beforePut    func(key string)
+	beforeDelete func(key string)
+}
+
+func newMockS3APILock() *mockS3APILock {
+	return &mockS3APILock{objects: make(map[string][]byte), etags: make(map[string]int)}
+}
+
+func (m *mockS3APILock) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	if *input.Bucket == "error" {
+		return nil, errors.New("PutObject failed")
+	}
+	if m.beforePut != nil {
+		m.beforePut(*input.Key)
+	}
+	r := &request.Request{HTTPRequest: &http.Request{Header: http.Header{}}}
+	for _, opt := range opts {
+		opt(r)
+	}
+	_, exists := m.objects[*input.Key]
+	etag := strconv.Itoa(m.etags[*input.Key])
+	ifMatch := r.HTTPRequest.Header.Get("If-Match")
+	if (exists && r.HTTPRequest.Header.Get("If-None-Match") == "*") ||
+		(ifMatch != "" && (!exists || ifMatch != etag)) {
+		return nil, awserr.New("PreconditionFailed", "At least one of the pre-conditions you specified did not hold", nil)
+	}
+	content, _ := ioutil.ReadAll(input.Body)
+	m.objects[*input.Key] = content
+	m.etags[*input.Key]++
+	return &s3.PutObjectOutput{ETag: aws.String(strconv.Itoa(m.etags[*input.Key]))}, nil
+}
+
+func (m *mockS3APILock) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	if _, ok := m.objects[*input.Key]; !ok {
+		return nil, awserr.New("NotFound", "Not Found", nil)
+	}
+	return &s3.HeadObjectOutput{ETag: aws.String(strconv.Itoa(m.etags[*input.Key]))}, nil
+}
+
+func (m *mockS3APILock) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	content, ok := m.objects[*input.Key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	return &s3.GetObjectOutput{
+		Body: ioutil.NopCloser(bytes.NewReader(content)),
+		ETag: aws.String(strconv.Itoa(m.etags[*input.Key])),
+	}, nil
+}
+
+func (m *mockS3APILock) DeleteObjectWithContext(ctx aws.Context, input *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error) {
+	if m.beforeDelete != nil {
+		m.beforeDelete(*input.Key)
+	}
+	r := &request.Request{HTTPRequest: &http.Request{Header: http.Header{}}}
+	for _, opt := range opts {
+		opt(r)
+	}
+	_, exists := m.objects[*input.Key]
+	ifMatch := r.HTTPRequest.Header.Get("If-Match")
+	if ifMatch != "" && exists && ifMatch != strconv.Itoa(m.etags[*input.Key]) {
+		return nil, awserr.New("PreconditionFailed", "At least one of the pre-conditions you specified did not hold", nil)
+	}
+	delete(m.objects, *input.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func mockS3Lock(svc *mockS3APILock, bucket, name string) *S3Lock {
+	return &S3Lock{svc: svc, bucket: bucket, key: name}
+}
+
+func TestS3Lock(t *testing.T) {
+	assert := assert.New(t)
+
+	svc := newMockS3APILock()
+	lockName := "locks/lock"
+	sl := mockS3Lock(svc, "bucket", lockName)
+
+	holder, err := sl.Holder()
+	assert.Nil(err)
+	assert.Nil(holder)
+
+	err = sl.TryLock()
+	assert.Nil(err)
+	assert.Equal(int64(1), sl.FencingToken())
+
+	holder, err = sl.Holder()
+	assert.Nil(err)
+	assert.NotNil(holder)
+	assert.True(holder.IsCurrent())
+	assert.Equal(int64(1), holder.FencingToken)
+
+	// fail if already locked
+	err = sl.TryLock()
+	assert.NotNil(err)
+	assert.Equal(LockHeldError("lock already held at s3://bucket/"+lockName), err)
+
+	// fail if already unlocked
+	err = sl.Unlock()
+	assert.Nil(err)
+
+	err = sl.Unlock()
+	assert.NotNil(err)
+	assert.Equal("lock not held", err.Error())
+
+	// fail if the bucket can't be written to
+	sl = mockS3Lock(svc, "error", lockName)
+	err = sl.TryLock()
+	assert.NotNil(err)
+	assert.Equal("PutObject failed", err.Error())
+}
+
+func TestS3Lock_Refresh(t *testing.T) {
+	assert := assert.New(t)
+
+	svc := newMockS3APILock()
+	lockName := "locks/lock"
+	sl := mockS3Lock(svc, "bucket", lockName)
+
+	err := sl.Refresh()
+	assert.NotNil(err)
+	assert.Equal("lock at s3://bucket/"+lockName+" was not acquired", err.Error())
+
+	err = sl.TryLock()
+	assert.Nil(err)
+
+	err = sl.Refresh()
+	assert.Nil(err)
+	holder, err := sl.Holder()
+	assert.Nil(err)
+	assert.False(holder.RefreshedAt.IsZero())
+
+	// tokens keep increasing across acquisitions and superseded holders can't refresh the lock
+	err = sl.Unlock()
+	assert.Nil(err)
+	err = sl.Refresh()
+	assert.NotNil(err)
+	assert.Equal("lock at s3://bucket/"+lockName+" is not held anymore", err.Error())
+
+	other := mockS3Lock(svc, "bucket", lockName)
+	err = other.TryLock()
+	assert.Nil(err)
+	assert.Equal(int64(2), other.FencingToken())
+
+	err = sl.Refresh()
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "lock at s3://bucket/"+lockName+" was acquired by someone else")
+
+	err = other.Unlock()
+	assert.Nil(err)
+}
+
+func TestS3Lock_TryLockForceReleased(t *testing.T) {
+	assert := assert.New(t)
+
+	svc := newMockS3APILock()
+	lockName := "locks/lock"
+	sl := mockS3Lock(svc, "bucket", lockName)
+
+	// someone force-releases and acquires the lock before we write our fencing token to it
+	other := mockS3Lock(svc, "bucket", lockName)
+	puts := 0
+	svc.beforePut = func(key string) {
+		if puts++; key == lockName && puts > 1 {
+			svc.beforePut = nil
+			assert.Nil(ForceReleaseLock(mockS3Lock(svc, "bucket", lockName), lockName, true))
+			assert.Nil(other.TryLock())
+		}
+	}
+	err := sl.TryLock()
+	assert.NotNil(err)
+	assert.Equal(LockHeldError("lock already held at s3://bucket/"+lockName), err)
+
+	holder, err := sl.Holder()
+	assert.Nil(err)
+	assert.Equal(other.FencingToken(), holder.FencingToken)
+
+	err = other.Unlock()
+	assert.Nil(err)
+}
+
+func TestS3Lock_UnlockChangedHands(t *testing.T) {
+	assert := assert.New(t)
+
+	svc := newMockS3APILock()
+	lockName := "locks/lock"
+	sl := mockS3Lock(svc, "bucket", lockName)
+	err := sl.TryLock()
+	assert.Nil(err)
+
+	// a lock is only released if it wasn't modified since its holder was read
+	released := mockS3Lock(svc, "bucket", lockName)
+	_, err = released.Holder()
+	assert.Nil(err)
+	err = sl.Refresh()
+	assert.Nil(err)
+	err = released.Unlock()
+	assert.NotNil(err)
+	assert.Equal("lock at s3://bucket/"+lockName+" was modified by someone else, it wasn't released", err.Error())
+	err = ReleaseLock(released, lockName, true)
+	assert.Nil(err)
+
+	// we don't release a lock acquired by someone else in the meantime
+	other := mockS3Lock(svc, "bucket", lockName)
+	err = other.TryLock()
+	assert.Nil(err)
+	err = sl.Unlock()
+	assert.NotNil(err)
+	assert.Equal("lock at s3://bucket/"+lockName+" was modified by someone else, it wasn't released", err.Error())
+	holder, err := other.Holder()
+	assert.Nil(err)
+	assert.Equal(other.FencingToken(), holder.FencingToken)
+
+	// nor one acquired by someone else between checking the lock and deleting it
+	err = other.Unlock()
+	assert.Nil(err)
+	err = sl.TryLock()
+	assert.Nil(err)
+	svc.beforeDelete = func(key string) {
+		svc.beforeDelete = nil
+		delete(svc.objects, key)
+		err := other.TryLock()
+		assert.Nil(err)
+	}
+	err = sl.Unlock()
+	assert.NotNil(err)
+	assert.Equal("lock at s3://bucket/"+lockName+" was modified by someone else, it wasn't released", err.Error())
+	holder, err = other.Holder()
+	assert.Nil(err)
+	assert.Equal(other.FencingToken(), holder.FencingToken)
+
+	// the lock is deleted unconditionally when its holder can't be read
+	svc.objects[lockName] = []byte("garbage")
+	svc.etags[lockName]++
+	err = ForceReleaseLock(mockS3Lock(svc, "bucket", lockName), lockName, true)
+	assert.Nil(err)
+	_, ok := svc.objects[lockName]
+	assert.False(ok)
+}
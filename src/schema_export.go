@@ -0,0 +1,309 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	schemaFormatJSONSchema = "jsonschema"
+	schemaFormatAvro       = "avro"
+	schemaKindCluster      = "cluster"
+	schemaKindPlaybook     = "playbook"
+	jsonSchemaDraft        = "http://json-schema.org/draft-07/schema#"
+)
+
+var (
+	schemaFormats = []string{schemaFormatJSONSchema, schemaFormatAvro}
+	schemaKinds   = []string{schemaKindCluster, schemaKindPlaybook}
+)
+
+// ExportSchema returns the schema of the current version of a config kind, either as the embedded
+// Avro schema or as the equivalent JSON Schema describing the whole self-describing config
+func ExportSchema(kind, format string) ([]byte, error) {
+	cs, err := configSchemaOfKind(kind)
+	if err != nil {
+		return nil, err
+	}
+	avsc, err := Asset(cs.assets[cs.current])
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case schemaFormatAvro:
+		return avsc, nil
+	case schemaFormatJSONSchema:
+		var avroSchema interface{}
+		if err := json.Unmarshal(avsc, &avroSchema); err != nil {
+			return nil, err
+		}
+		jsonSchema, err := configJSONSchema(cs, avroSchema)
+		if err != nil {
+			return nil, err
+		}
+		return json.MarshalIndent(jsonSchema, "", "  ")
+	default:
+		return nil, errors.New("unknown schema format " + format + ", supported formats are " +
+			strings.Join(schemaFormats, ","))
+	}
+}
+
+// configSchemaOfKind maps a config kind to its schema
+func configSchemaOfKind(kind string) (configSchema, error) {
+	switch kind {
+	case schemaKindCluster:
+		return clusterConfigSchema, nil
+	case schemaKindPlaybook:
+		return playbookConfigSchema, nil
+	default:
+		return configSchema{}, errors.New("unknown config kind " + kind + ", supported kinds are " +
+			strings.Join(schemaKinds, ","))
+	}
+}
+
+// configJSONSchema describes a self-describing config whose data follows an Avro schema, along
+// with the fields used to compose configs. The data of configs extending or including others is
+// only an overlay of the composed config so none of its fields are required and any of its values
+// can be replaced with $replace.
+func configJSONSchema(cs configSchema, avroSchema interface{}) (map[string]interface{}, error) {
+	data, _, err := avroToJSONSchema(avroSchema, make(map[string]interface{}))
+	if err != nil {
+		return nil, err
+	}
+
+	current := cs.currentKey()
+	uriPattern := "^" + regexp.QuoteMeta(igluURIPrefix+current.Vendor+"/"+current.Name+"/"+
+		current.Format+"/") + fmt.Sprintf("%d-[0-9]+-[0-9]+$", current.Version.Model)
+	stringType := map[string]interface{}{"type": "string"}
+	return map[string]interface{}{
+		"$schema":     jsonSchemaDraft,
+		"title":       cs.name,
+		"description": "Generated from " + current.String(),
+		"type":        "object",
+		"properties": map[string]interface{}{
+			"schema":   map[string]interface{}{"type": "string", "pattern": uriPattern},
+			"data":     map[string]interface{}{"type": "object"},
+			extendsKey: stringType,
+			includeKey: map[string]interface{}{
+				"oneOf": []interface{}{
+					stringType,
+					map[string]interface{}{"type": "array", "items": stringType},
+				},
+			},
+			profilesKey: map[string]interface{}{
+				"type":                 "object",
+				"additionalProperties": map[string]interface{}{"type": "object"},
+			},
+		},
+		// configs extending or including others can leave the schema and data to them
+		"anyOf": []interface{}{
+			map[string]interface{}{"required": []interface{}{"schema", "data"}},
+			map[string]interface{}{"required": []interface{}{extendsKey}},
+			map[string]interface{}{"required": []interface{}{includeKey}},
+		},
+		"if": map[string]interface{}{
+			"anyOf": []interface{}{
+				map[string]interface{}{"required": []interface{}{extendsKey}},
+				map[string]interface{}{"required": []interface{}{includeKey}},
+			},
+		},
+		"then": map[string]interface{}{
+			"properties": map[string]interface{}{"data": overlayJSONSchema(data)},
+		},
+		"else": map[string]interface{}{
+			"properties": map[string]interface{}{"data": data},
+		},
+		"additionalProperties": false,
+	}, nil
+}
+
+// overlayJSONSchema copies a JSON Schema so that it describes the overlay of a value: objects have
+// no required properties and their values can be replaced with an object holding only $replace,
+// whose value is left to the composed config. Unions become anyOf as partial objects may match
+// several of their branches.
+func overlayJSONSchema(schema map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(schema))
+	for k, v := range schema {
+		switch k {
+		case "required":
+		case "properties":
+			properties := make(map[string]interface{})
+			for name, property := range v.(map[string]interface{}) {
+				properties[name] = replaceableJSONSchema(property.(map[string]interface{}))
+			}
+			copied[k] = properties
+		case "items":
+			copied[k] = replaceableJSONSchema(v.(map[string]interface{}))
+		case "additionalProperties":
+			if values, ok := v.(map[string]interface{}); ok {
+				copied[k] = replaceableJSONSchema(values)
+			} else {
+				copied[k] = v
+			}
+		case "oneOf":
+			var branches []interface{}
+			for _, branch := range v.([]interface{}) {
+				branches = append(branches, overlayJSONSchema(branch.(map[string]interface{})))
+			}
+			copied["anyOf"] = branches
+		default:
+			copied[k] = v
+		}
+	}
+	return copied
+}
+
+// replaceableJSONSchema describes the overlay of a value or an object replacing it
+func replaceableJSONSchema(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"anyOf": []interface{}{
+			overlayJSONSchema(schema),
+			map[string]interface{}{
+				"type":                 "object",
+				"properties":           map[string]interface{}{replaceKey: map[string]interface{}{}},
+				"required":             []interface{}{replaceKey},
+				"additionalProperties": false,
+			},
+		},
+	}
+}
+
+// avroToJSONSchema converts an Avro type to JSON Schema and tells whether or not it accepts null.
+// Named types are recorded as they are defined so that later references can be inlined.
+func avroToJSONSchema(t interface{}, named map[string]interface{}) (map[string]interface{}, bool, error) {
+	switch avroType := t.(type) {
+	case string:
+		switch avroType {
+		case "null":
+			return map[string]interface{}{"type": "null"}, true, nil
+		case "boolean":
+			return map[string]interface{}{"type": "boolean"}, false, nil
+		case "int", "long":
+			return map[string]interface{}{"type": "integer"}, false, nil
+		case "float", "double":
+			return map[string]interface{}{"type": "number"}, false, nil
+		case "string", "bytes":
+			return map[string]interface{}{"type": "string"}, false, nil
+		}
+		if schema, ok := named[avroType]; ok {
+			return schema.(map[string]interface{}), false, nil
+		}
+		return nil, false, errors.New("unknown Avro type " + avroType)
+	case []interface{}:
+		var branches []interface{}
+		nullable := false
+		for _, branch := range avroType {
+			schema, isNull, err := avroToJSONSchema(branch, named)
+			if err != nil {
+				return nil, false, err
+			}
+			nullable = nullable || isNull
+			branches = append(branches, schema)
+		}
+		if len(branches) == 1 {
+			return branches[0].(map[string]interface{}), nullable, nil
+		}
+		return map[string]interface{}{"oneOf": branches}, nullable, nil
+	case map[string]interface{}:
+		return avroComplexToJSONSchema(avroType, named)
+	default:
+		return nil, false, fmt.Errorf("unsupported Avro type %v", t)
+	}
+}
+
+// avroComplexToJSONSchema converts an Avro record, array, map or enum to JSON Schema
+func avroComplexToJSONSchema(t map[string]interface{}, named map[string]interface{}) (map[string]interface{}, bool, error) {
+	var schema map[string]interface{}
+	switch t["type"] {
+	case "record":
+		properties := make(map[string]interface{})
+		var required []interface{}
+		fields, _ := t["fields"].([]interface{})
+		for _, f := range fields {
+			field, _ := f.(map[string]interface{})
+			name, _ := field["name"].(string)
+			property, nullable, err := avroToJSONSchema(field["type"], named)
+			if err != nil {
+				return nil, false, err
+			}
+			if def, ok := field["default"]; ok {
+				property = withDefault(property, def)
+			}
+			properties[name] = property
+			// missing scalars are decoded as their zero value so only objects and lists are required
+			if _, hasDefault := field["default"]; !nullable && !hasDefault && !isScalarSchema(property) {
+				required = append(required, name)
+			}
+		}
+		schema = map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+	case "array":
+		items, _, err := avroToJSONSchema(t["items"], named)
+		if err != nil {
+			return nil, false, err
+		}
+		schema = map[string]interface{}{"type": "array", "items": items}
+	case "map":
+		values, _, err := avroToJSONSchema(t["values"], named)
+		if err != nil {
+			return nil, false, err
+		}
+		schema = map[string]interface{}{"type": "object", "additionalProperties": values}
+	case "enum":
+		schema = map[string]interface{}{"type": "string", "enum": t["symbols"]}
+	case "fixed":
+		schema = map[string]interface{}{"type": "string"}
+	default:
+		return avroToJSONSchema(t["type"], named)
+	}
+
+	if name, ok := t["name"].(string); ok {
+		named[name] = schema
+	}
+	if doc, ok := t["doc"].(string); ok {
+		schema["description"] = doc
+	}
+	return schema, false, nil
+}
+
+// withDefault copies a JSON Schema adding a default value to it
+func withDefault(schema map[string]interface{}, def interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(schema)+1)
+	for k, v := range schema {
+		copied[k] = v
+	}
+	copied["default"] = def
+	return copied
+}
+
+// isScalarSchema checks whether or not a JSON Schema only describes scalar values
+func isScalarSchema(schema map[string]interface{}) bool {
+	switch schema["type"] {
+	case "string", "integer", "number", "boolean", "null":
+		return true
+	}
+	return false
+}
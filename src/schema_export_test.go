@@ -0,0 +1,268 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportSchema(t *testing.T) {
+	assert := assert.New(t)
+
+	avsc, err := ExportSchema("cluster", "avro")
+	assert.Nil(err)
+	expected, _ := Asset(clusterSchemaPath)
+	assert.Equal(expected, avsc)
+
+	exported, err := ExportSchema("playbook", "jsonschema")
+	assert.Nil(err)
+	var schema map[string]interface{}
+	assert.Nil(json.Unmarshal(exported, &schema))
+
+	assert.Equal(jsonSchemaDraft, schema["$schema"])
+	properties := schema["properties"].(map[string]interface{})
+	assert.Equal(`^iglu:com\.snowplowanalytics\.dataflowrunner/PlaybookConfig/avro/1-[0-9]+-[0-9]+$`,
+		properties["schema"].(map[string]interface{})["pattern"])
+
+	data := schema["else"].(map[string]interface{})["properties"].(map[string]interface{})["data"].(map[string]interface{})
+	assert.Equal(false, data["additionalProperties"])
+	assert.Equal([]interface{}{"credentials", "steps"}, data["required"])
+	dataProperties := data["properties"].(map[string]interface{})
+	assert.Equal(map[string]interface{}{"type": "string"}, dataProperties["region"])
+	tags := dataProperties["tags"].(map[string]interface{})["oneOf"].([]interface{})
+	assert.Equal("array", tags[0].(map[string]interface{})["type"])
+	assert.Equal(map[string]interface{}{"type": "null"}, tags[1])
+
+	// named types are inlined where they are referenced
+	exported, err = ExportSchema("cluster", "jsonschema")
+	assert.Nil(err)
+	assert.Nil(json.Unmarshal(exported, &schema))
+	instances := schema["else"].(map[string]interface{})["properties"].(map[string]interface{})["data"].(map[string]interface{})["properties"].(map[string]interface{})["ec2"].(map[string]interface{})["properties"].(map[string]interface{})["instances"].(map[string]interface{})["properties"].(map[string]interface{})
+	master := instances["master"].(map[string]interface{})["properties"].(map[string]interface{})
+	core := instances["core"].(map[string]interface{})["properties"].(map[string]interface{})
+	assert.Equal(master["ebsConfiguration"], core["ebsConfiguration"])
+
+	_, err = ExportSchema("job", "avro")
+	assert.NotNil(err)
+	assert.Equal("unknown config kind job, supported kinds are cluster,playbook", err.Error())
+	_, err = ExportSchema("cluster", "xsd")
+	assert.NotNil(err)
+	assert.Equal("unknown schema format xsd, supported formats are jsonschema,avro", err.Error())
+}
+
+func TestExportSchema_Overlays(t *testing.T) {
+	assert := assert.New(t)
+
+	exported, err := ExportSchema("playbook", "jsonschema")
+	assert.Nil(err)
+	var schema map[string]interface{}
+	assert.Nil(json.Unmarshal(exported, &schema))
+
+	ar, _ := InitConfigResolver()
+	rendered, err := ar.Render([]byte(PlaybookRecord1), map[string]interface{}{"src": "s3://bucket/"}, "")
+	assert.Nil(err)
+	assert.Nil(validateJSONSchema(schema, decodeTestJSON(t, string(rendered)), ""))
+
+	// overlays only hold the fields they override and can replace values
+	overlay := `{
+  "extends": "base/playbook.json",
+  "data": {
+    "steps": {"$replace": [{"type": "CUSTOM_JAR", "name": "Load", "jar": "load.jar"}]},
+    "tags": [{"key": "environment"}]
+  },
+  "profiles": {"prod": {"data": {"region": "eu-west-1"}}}
+}`
+	assert.Nil(validateJSONSchema(schema, decodeTestJSON(t, overlay), ""))
+	included := `{"include": "fragment.yml", "data": {"region": {"$replace": "eu-west-1"}}}`
+	assert.Nil(validateJSONSchema(schema, decodeTestJSON(t, included), ""))
+
+	// configs which don't compose others must be complete
+	complete := `{"schema": "iglu:com.snowplowanalytics.dataflowrunner/PlaybookConfig/avro/1-0-1", "data": {"region": "eu-west-1"}}`
+	assert.EqualError(validateJSONSchema(schema, decodeTestJSON(t, complete), ""), "/data: missing credentials")
+	replaced := strings.Replace(complete, `"data": {`, `"data": {"credentials": {"accessKeyId": "a", "secretAccessKey": "b"}, "steps": {"$replace": []}, `, 1)
+	assert.EqualError(validateJSONSchema(schema, decodeTestJSON(t, replaced), ""), "/data/steps: expected array")
+
+	// overlays are still checked against the fields of the schema, the replacing values only once
+	// composed
+	typo := strings.Replace(overlay, `{"key"`, `{"kye"`, 1)
+	assert.NotNil(validateJSONSchema(schema, decodeTestJSON(t, typo), ""))
+	partial := strings.Replace(overlay, `{"$replace": [`, `{"$replace": [], "extra": [`, 1)
+	assert.NotNil(validateJSONSchema(schema, decodeTestJSON(t, partial), ""))
+}
+
+// decodeTestJSON decodes a JSON document, failing the test if it is invalid
+func decodeTestJSON(t *testing.T, s string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// validateJSONSchema checks a value against the subset of JSON Schema produced by ExportSchema,
+// returning the first violation found
+func validateJSONSchema(schema map[string]interface{}, v interface{}, pointer string) error {
+	if t, ok := schema["type"].(string); ok && !hasJSONType(v, t) {
+		return fmt.Errorf("%s: expected %s", pointer, t)
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || reflect.DeepEqual(e, v)
+		}
+		if !found {
+			return fmt.Errorf("%s: not in enum", pointer)
+		}
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		if s, ok := v.(string); ok && !regexp.MustCompile(pattern).MatchString(s) {
+			return fmt.Errorf("%s: doesn't match %s", pointer, pattern)
+		}
+	}
+	if obj, ok := v.(map[string]interface{}); ok {
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := obj[name.(string)]; !ok {
+				return fmt.Errorf("%s: missing %s", pointer, name)
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		for name, value := range obj {
+			if property, ok := properties[name]; ok {
+				if err := validateJSONSchema(property.(map[string]interface{}), value, pointer+"/"+name); err != nil {
+					return err
+				}
+				continue
+			}
+			switch additional := schema["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					return fmt.Errorf("%s/%s: unknown field", pointer, name)
+				}
+			case map[string]interface{}:
+				if err := validateJSONSchema(additional, value, pointer+"/"+name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if list, ok := v.([]interface{}); ok {
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range list {
+				if err := validateJSONSchema(items, item, fmt.Sprintf("%s/%d", pointer, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if branches, ok := schema["oneOf"].([]interface{}); ok {
+		matches := 0
+		var firstErr error
+		for _, branch := range branches {
+			err := validateJSONSchema(branch.(map[string]interface{}), v, pointer)
+			if err == nil {
+				matches++
+			} else if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if matches == 0 {
+			return firstErr
+		}
+		if matches > 1 {
+			return fmt.Errorf("%s: matches several branches of oneOf", pointer)
+		}
+	}
+	if branches, ok := schema["anyOf"].([]interface{}); ok {
+		var firstErr error
+		for _, branch := range branches {
+			err := validateJSONSchema(branch.(map[string]interface{}), v, pointer)
+			if err == nil {
+				firstErr = nil
+				break
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if firstErr != nil {
+			return firstErr
+		}
+	}
+	if condition, ok := schema["if"].(map[string]interface{}); ok {
+		branch, _ := schema["else"].(map[string]interface{})
+		if validateJSONSchema(condition, v, pointer) == nil {
+			branch, _ = schema["then"].(map[string]interface{})
+		}
+		if branch != nil {
+			return validateJSONSchema(branch, v, pointer)
+		}
+	}
+	return nil
+}
+
+// hasJSONType checks whether a decoded JSON value has a JSON Schema type
+func hasJSONType(v interface{}, t string) bool {
+	switch v := v.(type) {
+	case nil:
+		return t == "null"
+	case bool:
+		return t == "boolean"
+	case float64:
+		return t == "number" || (t == "integer" && v == float64(int64(v)))
+	case string:
+		return t == "string"
+	case []interface{}:
+		return t == "array"
+	case map[string]interface{}:
+		return t == "object"
+	}
+	return false
+}
+
+func TestParsePlaybookRecord_Strict(t *testing.T) {
+	assert := assert.New(t)
+
+	ar, _ := InitConfigResolver()
+	ar.Strict = true
+
+	res, err := ar.ParsePlaybookRecord([]byte(PlaybookRecord1), nil, "")
+	assert.Nil(err)
+	assert.NotNil(res)
+
+	typos := strings.Replace(strings.Replace(PlaybookRecord1, `"jar"`, `"jars"`, 1), `"key"`, `"kye"`, 1)
+	typos = strings.Replace(typos, `"data"`, `"comment": "typos", "data"`, 1)
+	_, err = ar.ParsePlaybookRecord([]byte(typos), nil, "")
+	assert.NotNil(err)
+	assert.Equal("invalid config: /comment (line 3): unknown field; /data/steps/0/jars (line 14): unknown field; "+
+		"/data/tags/0/kye (line 39): unknown field", err.Error())
+
+	// unknown fields are dropped outside of strict mode
+	ar.Strict = false
+	res, err = ar.ParsePlaybookRecord([]byte(typos), nil, "")
+	assert.Nil(err)
+	assert.Equal("", res.Steps[0].Jar)
+
+	ar.Strict = true
+	cluster, err := ar.ParseClusterRecord([]byte(ClusterRecordWithEBS), nil, "")
+	assert.Nil(err)
+	assert.NotNil(cluster)
+}
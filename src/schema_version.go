@@ -0,0 +1,256 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	igluVendor     = "com.snowplowanalytics.dataflowrunner"
+	igluFormat     = "avro"
+	igluURIPrefix  = "iglu:"
+	schemaVerParts = 3
+)
+
+// clusterConfigSchema lists the supported versions of the cluster config schema, 1-1-0 adding the
+// security configuration and 1-1-1 the assumed roles, profiles and web identities of the
+// credentials
+var clusterConfigSchema = configSchema{
+	name:    "ClusterConfig",
+	current: SchemaVer{1, 1, 1},
+	assets: map[SchemaVer]string{
+		{1, 0, 0}: "avro/cluster-1-0-0.avsc",
+		{1, 1, 0}: "avro/cluster-1-1-0.avsc",
+		{1, 1, 1}: clusterSchemaPath,
+	},
+	migrations: map[SchemaVer]schemaMigration{
+		{1, 0, 0}: addFields("", map[string]interface{}{"securityConfiguration": ""}),
+		{1, 1, 0}: addFields("credentials", addedCredentialsFields),
+	},
+}
+
+// playbookConfigSchema lists the supported versions of the playbook schema, 1-0-1 adding the tags
+// and 1-0-2 the assumed roles, profiles and web identities of the credentials
+var playbookConfigSchema = configSchema{
+	name:    "PlaybookConfig",
+	current: SchemaVer{1, 0, 2},
+	assets: map[SchemaVer]string{
+		{1, 0, 0}: "avro/playbook-1-0-0.avsc",
+		{1, 0, 1}: "avro/playbook-1-0-1.avsc",
+		{1, 0, 2}: playbookSchemaPath,
+	},
+	migrations: map[SchemaVer]schemaMigration{
+		{1, 0, 0}: addFields("", map[string]interface{}{"tags": nil}),
+		{1, 0, 1}: addFields("credentials", addedCredentialsFields),
+	},
+}
+
+// addedCredentialsFields are the credentials fields added by ClusterConfig 1-1-1 and
+// PlaybookConfig 1-0-2 along with their default value
+var addedCredentialsFields = map[string]interface{}{
+	"profile":              "",
+	"roleArn":              "",
+	"externalId":           "",
+	"roleSessionName":      "",
+	"durationSeconds":      0,
+	"webIdentityTokenFile": "",
+	"webIdentityRoleArn":   "",
+}
+
+// SchemaVer is the MODEL-REVISION-ADDITION version of an Iglu schema
+type SchemaVer struct {
+	Model    int
+	Revision int
+	Addition int
+}
+
+// ParseSchemaVer parses a MODEL-REVISION-ADDITION version
+func ParseSchemaVer(version string) (SchemaVer, error) {
+	parts := strings.Split(version, "-")
+	if len(parts) != schemaVerParts {
+		return SchemaVer{}, errors.New("invalid SchemaVer " + version + ", expected MODEL-REVISION-ADDITION")
+	}
+	var numbers [schemaVerParts]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || (i == 0 && n == 0) {
+			return SchemaVer{}, errors.New("invalid SchemaVer " + version + ", expected MODEL-REVISION-ADDITION")
+		}
+		numbers[i] = n
+	}
+	return SchemaVer{Model: numbers[0], Revision: numbers[1], Addition: numbers[2]}, nil
+}
+
+func (v SchemaVer) String() string {
+	return fmt.Sprintf("%d-%d-%d", v.Model, v.Revision, v.Addition)
+}
+
+// Less checks whether or not a version precedes another one
+func (v SchemaVer) Less(other SchemaVer) bool {
+	if v.Model != other.Model {
+		return v.Model < other.Model
+	}
+	if v.Revision != other.Revision {
+		return v.Revision < other.Revision
+	}
+	return v.Addition < other.Addition
+}
+
+// SchemaKey identifies the schema of a self-describing record, e.g.
+// iglu:com.snowplowanalytics.dataflowrunner/ClusterConfig/avro/1-1-0
+type SchemaKey struct {
+	Vendor  string
+	Name    string
+	Format  string
+	Version SchemaVer
+}
+
+// ParseSchemaKey parses an Iglu schema URI
+func ParseSchemaKey(uri string) (*SchemaKey, error) {
+	parts := strings.Split(strings.TrimPrefix(uri, igluURIPrefix), "/")
+	if !strings.HasPrefix(uri, igluURIPrefix) || len(parts) != 4 {
+		return nil, errors.New("invalid schema " + uri +
+			", expected iglu:vendor/name/format/MODEL-REVISION-ADDITION")
+	}
+	version, err := ParseSchemaVer(parts[3])
+	if err != nil {
+		return nil, errors.New("invalid schema " + uri + ": " + err.Error())
+	}
+	return &SchemaKey{Vendor: parts[0], Name: parts[1], Format: parts[2], Version: version}, nil
+}
+
+func (k SchemaKey) String() string {
+	return igluURIPrefix + k.Vendor + "/" + k.Name + "/" + k.Format + "/" + k.Version.String()
+}
+
+// schemaMigration upgrades the data of a record to the next supported version
+type schemaMigration func(data map[string]interface{}) error
+
+// addFields builds a migration setting the fields added by the next version to their default
+// value, in the given object of the data or in the data itself if object is empty. Records which
+// already set one of them are rejected rather than read with the semantics of a version they don't
+// declare.
+func addFields(object string, defaults map[string]interface{}) schemaMigration {
+	return func(data map[string]interface{}) error {
+		target, prefix := data, ""
+		if object != "" {
+			nested, ok := data[object].(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			target, prefix = nested, object+"."
+		}
+		for _, field := range sortedKeys(defaults) {
+			if _, ok := target[field]; ok {
+				return errors.New("field " + prefix + field + " is only defined by a later version, " +
+					"the schema of the config needs to be upgraded")
+			}
+		}
+		for field, value := range defaults {
+			target[field] = value
+		}
+		return nil
+	}
+}
+
+// configSchema lists the supported versions of a config schema along with their embedded Avro
+// schema, the current version's file being the one the config type is generated from. The
+// migrations are indexed by the version they upgrade from.
+type configSchema struct {
+	name       string
+	current    SchemaVer
+	assets     map[SchemaVer]string
+	migrations map[SchemaVer]schemaMigration
+}
+
+// currentKey is the key of the current version of the schema
+func (cs configSchema) currentKey() SchemaKey {
+	return SchemaKey{Vendor: igluVendor, Name: cs.name, Format: igluFormat, Version: cs.current}
+}
+
+// versions lists the supported versions in order
+func (cs configSchema) versions() []SchemaVer {
+	versions := make([]SchemaVer, 0, len(cs.assets))
+	for v := range cs.assets {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Less(versions[j])
+	})
+	return versions
+}
+
+// resolve checks that a schema URI designates a supported version of the schema
+func (cs configSchema) resolve(uri string) (*SchemaKey, error) {
+	if uri == "" {
+		return nil, errors.New("the config has no schema, expected " + cs.currentKey().String())
+	}
+	key, err := ParseSchemaKey(uri)
+	if err != nil {
+		return nil, err
+	}
+	if key.Vendor != igluVendor || key.Name != cs.name {
+		return nil, errors.New("schema " + uri + " is not a " + cs.name + " schema, expected " +
+			cs.currentKey().String())
+	}
+	if key.Format != igluFormat {
+		return nil, errors.New("unsupported format " + key.Format + " of schema " + uri +
+			", expected " + igluFormat)
+	}
+
+	var supported []string
+	for _, v := range cs.versions() {
+		supported = append(supported, v.String())
+	}
+	if key.Version.Model != cs.current.Model {
+		return nil, errors.New("unsupported MODEL " + strconv.Itoa(key.Version.Model) + " of schema " +
+			uri + ", supported versions are " + strings.Join(supported, ","))
+	}
+	if _, ok := cs.assets[key.Version]; !ok {
+		if cs.current.Less(key.Version) {
+			return nil, errors.New("schema " + uri + " is more recent than the supported versions " +
+				strings.Join(supported, ",") + ", dataflow-runner needs to be upgraded")
+		}
+		return nil, errors.New("unsupported version " + key.Version.String() + " of schema " + uri +
+			", supported versions are " + strings.Join(supported, ","))
+	}
+	return key, nil
+}
+
+// upgrade migrates the data of a record of the given version to the current version
+func (cs configSchema) upgrade(version SchemaVer, data interface{}) error {
+	for _, v := range cs.versions() {
+		if v.Less(version) || !v.Less(cs.current) {
+			continue
+		}
+		migrate, ok := cs.migrations[v]
+		if !ok {
+			continue
+		}
+		object, ok := data.(map[string]interface{})
+		if !ok {
+			return errors.New("the data of a " + cs.name + " record must be an object")
+		}
+		if err := migrate(object); err != nil {
+			return errors.New("couldn't upgrade " + cs.name + " record from " + v.String() + ": " +
+				err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSchemaKey(t *testing.T) {
+	assert := assert.New(t)
+
+	key, err := ParseSchemaKey("iglu:com.snowplowanalytics.dataflowrunner/ClusterConfig/avro/1-1-0")
+	assert.Nil(err)
+	assert.Equal(SchemaKey{Vendor: igluVendor, Name: "ClusterConfig", Format: "avro", Version: SchemaVer{1, 1, 0}}, *key)
+	assert.Equal("iglu:com.snowplowanalytics.dataflowrunner/ClusterConfig/avro/1-1-0", key.String())
+
+	_, err = ParseSchemaKey("com.snowplowanalytics.dataflowrunner/ClusterConfig/avro/1-1-0")
+	assert.NotNil(err)
+	assert.Equal("invalid schema com.snowplowanalytics.dataflowrunner/ClusterConfig/avro/1-1-0, expected iglu:vendor/name/format/MODEL-REVISION-ADDITION", err.Error())
+
+	for _, version := range []string{"1-0", "0-1-0", "1-a-0", "1--1-0"} {
+		_, err = ParseSchemaVer(version)
+		assert.NotNil(err, version)
+	}
+
+	assert.True(SchemaVer{1, 0, 1}.Less(SchemaVer{1, 1, 0}))
+	assert.True(SchemaVer{1, 9, 9}.Less(SchemaVer{2, 0, 0}))
+	assert.False(SchemaVer{1, 1, 0}.Less(SchemaVer{1, 1, 0}))
+}
+
+func TestConfigSchema_Resolve(t *testing.T) {
+	assert := assert.New(t)
+
+	schema := "iglu:com.snowplowanalytics.dataflowrunner/ClusterConfig/avro/"
+	for uri, message := range map[string]string{
+		schema + "2-0-0": "unsupported MODEL 2 of schema " + schema + "2-0-0, supported versions are 1-0-0,1-1-0,1-1-1",
+		schema + "1-2-0": "schema " + schema + "1-2-0 is more recent than the supported versions 1-0-0,1-1-0,1-1-1, dataflow-runner needs to be upgraded",
+		schema + "1-0-5": "unsupported version 1-0-5 of schema " + schema + "1-0-5, supported versions are 1-0-0,1-1-0,1-1-1",
+		"iglu:com.snowplowanalytics.dataflowrunner/PlaybookConfig/avro/1-0-0":      "schema iglu:com.snowplowanalytics.dataflowrunner/PlaybookConfig/avro/1-0-0 is not a ClusterConfig schema, expected " + schema + "1-1-1",
+		"iglu:com.snowplowanalytics.dataflowrunner/ClusterConfig/jsonschema/1-0-0": "unsupported format jsonschema of schema iglu:com.snowplowanalytics.dataflowrunner/ClusterConfig/jsonschema/1-0-0, expected avro",
+	} {
+		_, err := clusterConfigSchema.resolve(uri)
+		assert.NotNil(err, uri)
+		if err != nil {
+			assert.Equal(message, err.Error())
+		}
+	}
+
+	key, err := clusterConfigSchema.resolve(schema + "1-0-0")
+	assert.Nil(err)
+	assert.Equal(SchemaVer{1, 0, 0}, key.Version)
+
+	ar, _ := InitConfigResolver()
+	_, err = ar.ParseClusterRecord([]byte(strings.Replace(ClusterRecord1, "1-0-0", "2-0-0", 1)), nil, "")
+	assert.NotNil(err)
+	assert.Equal("unsupported MODEL 2 of schema "+schema+"2-0-0, supported versions are 1-0-0,1-1-0,1-1-1", err.Error())
+}
+
+func TestConfigSchema_Upgrade(t *testing.T) {
+	assert := assert.New(t)
+
+	var applied []string
+	cs := configSchema{
+		name:    "PlaybookConfig",
+		current: SchemaVer{1, 2, 0},
+		assets: map[SchemaVer]string{
+			{1, 0, 0}: playbookSchemaPath,
+			{1, 1, 0}: playbookSchemaPath,
+			{1, 2, 0}: playbookSchemaPath,
+		},
+		migrations: map[SchemaVer]schemaMigration{
+			{1, 0, 0}: func(data map[string]interface{}) error {
+				applied = append(applied, "1-0-0")
+				data["region"] = data["location"]
+				delete(data, "location")
+				return nil
+			},
+			{1, 1, 0}: func(data map[string]interface{}) error {
+				applied = append(applied, "1-1-0")
+				return nil
+			},
+		},
+	}
+
+	data := map[string]interface{}{"location": "eu-west-1"}
+	err := cs.upgrade(SchemaVer{1, 0, 0}, data)
+	assert.Nil(err)
+	assert.Equal([]string{"1-0-0", "1-1-0"}, applied)
+	assert.Equal(map[string]interface{}{"region": "eu-west-1"}, data)
+
+	applied = nil
+	err = cs.upgrade(SchemaVer{1, 1, 0}, data)
+	assert.Nil(err)
+	assert.Equal([]string{"1-1-0"}, applied)
+
+	applied = nil
+	err = cs.upgrade(SchemaVer{1, 2, 0}, data)
+	assert.Nil(err)
+	assert.Nil(applied)
+
+	cs.migrations[SchemaVer{1, 1, 0}] = func(data map[string]interface{}) error {
+		return errors.New("missing field")
+	}
+	err = cs.upgrade(SchemaVer{1, 0, 0}, data)
+	assert.NotNil(err)
+	assert.Equal("couldn't upgrade PlaybookConfig record from 1-1-0: missing field", err.Error())
+}
+
+func TestParseClusterRecord_OlderVersions(t *testing.T) {
+	assert := assert.New(t)
+	ar, _ := InitConfigResolver()
+
+	// a valid record of an older version is upgraded to the current one
+	res, err := ar.ParseClusterRecord([]byte(ClusterRecord1), nil, "")
+	assert.Nil(err)
+	assert.Equal("", res.SecurityConfiguration)
+	assert.Equal("", res.Credentials.RoleArn)
+	assert.Equal(int32(0), res.Credentials.DurationSeconds)
+
+	// fields of later versions are only read with the version defining them
+	assumeRole := strings.Replace(ClusterRecord1, `"secretAccessKey": "env"`,
+		`"secretAccessKey": "env", "roleArn": "arn:aws:iam::123456789012:role/pipeline"`, 1)
+	_, err = ar.ParseClusterRecord([]byte(assumeRole), nil, "")
+	assert.NotNil(err)
+	assert.Equal("couldn't upgrade ClusterConfig record from 1-1-0: field credentials.roleArn is only defined by a later version, the schema of the config needs to be upgraded", err.Error())
+
+	res, err = ar.ParseClusterRecord([]byte(strings.Replace(assumeRole, "1-0-0", "1-1-1", 1)), nil, "")
+	assert.Nil(err)
+	assert.Equal("arn:aws:iam::123456789012:role/pipeline", res.Credentials.RoleArn)
+
+	tags := strings.Replace(PlaybookRecord1, "PlaybookConfig/avro/1-0-1", "PlaybookConfig/avro/1-0-0", 1)
+	_, err = ar.ParsePlaybookRecord([]byte(tags), nil, "")
+	assert.NotNil(err)
+	assert.Equal("couldn't upgrade PlaybookConfig record from 1-0-0: field tags is only defined by a later version, the schema of the config needs to be upgraded", err.Error())
+}
+
+func TestConfigSchema_UpgradeCluster(t *testing.T) {
+	assert := assert.New(t)
+
+	data := map[string]interface{}{
+		"name":        "emr-test-cluster",
+		"credentials": map[string]interface{}{"accessKeyId": "env", "secretAccessKey": "env"},
+	}
+	err := clusterConfigSchema.upgrade(SchemaVer{1, 0, 0}, data)
+	assert.Nil(err)
+	assert.Equal("", data["securityConfiguration"])
+	credentials := data["credentials"].(map[string]interface{})
+	assert.Equal("env", credentials["accessKeyId"])
+	for field, value := range addedCredentialsFields {
+		assert.Equal(value, credentials[field], field)
+	}
+
+	// records already setting the fields of the next version are rejected
+	data = map[string]interface{}{"securityConfiguration": "emr-security"}
+	err = clusterConfigSchema.upgrade(SchemaVer{1, 0, 0}, data)
+	assert.NotNil(err)
+	assert.Equal("couldn't upgrade ClusterConfig record from 1-0-0: field securityConfiguration is only defined by a later version, the schema of the config needs to be upgraded", err.Error())
+
+	err = clusterConfigSchema.upgrade(SchemaVer{1, 1, 0}, data)
+	assert.Nil(err)
+}
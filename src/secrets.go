@@ -0,0 +1,302 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	redacted = "********"
+	// sensitiveMinLength is the length under which values are only redacted when they make up a
+	// whole token, short values such as "1" or "true" appear inside unrelated words and numbers
+	// which redacting them would corrupt
+	sensitiveMinLength = 6
+)
+
+// secretFuncNames are the template functions resolving secrets, they need the region and
+// credentials of the config to be known
+var secretFuncNames = []string{"ssm", "secret"}
+
+// defaultSecretResolver is shared by all the configs parsed during a run so that secrets are
+// only fetched once
+var defaultSecretResolver = NewSecretResolver()
+
+// SecretClients builds the clients used to fetch secrets for a region and credentials
+type SecretClients func(region string, creds *CredentialsRecord) (ssmiface.SSMAPI, secretsmanageriface.SecretsManagerAPI, error)
+
+// SecretResolver fetches secrets from SSM Parameter Store and Secrets Manager, caching them
+type SecretResolver struct {
+	newClients SecretClients
+	mu         sync.Mutex
+	cache      map[string]string
+}
+
+// NewSecretResolver builds a SecretResolver using AWS clients
+func NewSecretResolver() *SecretResolver {
+	return &SecretResolver{newClients: newAwsSecretClients, cache: make(map[string]string)}
+}
+
+// newAwsSecretClients builds the SSM and Secrets Manager clients, sharing the session of the EMR
+// clients of the same region and credentials
+func newAwsSecretClients(region string, record *CredentialsRecord) (ssmiface.SSMAPI, secretsmanageriface.SecretsManagerAPI, error) {
+	sess, err := defaultAwsClients.Session(region, record)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ssm.New(sess), secretsmanager.New(sess), nil
+}
+
+// Funcs builds the ssm and secret template functions for a region and credentials
+func (sr *SecretResolver) Funcs(region string, creds *CredentialsRecord) template.FuncMap {
+	if creds == nil {
+		creds = &CredentialsRecord{}
+	}
+	// secrets of the same name can differ between the accounts the credentials give access to
+	scope := region + "|" + InterfaceToJSONString(creds, false)
+	var ssmSvc ssmiface.SSMAPI
+	var secretsSvc secretsmanageriface.SecretsManagerAPI
+	clients := func() error {
+		if ssmSvc != nil {
+			return nil
+		}
+		if region == "" {
+			return errors.New("a region is needed to resolve secrets")
+		}
+		var err error
+		ssmSvc, secretsSvc, err = sr.newClients(region, creds)
+		return err
+	}
+
+	return template.FuncMap{
+		// ssm reads a parameter from SSM Parameter Store, decrypting secure strings
+		"ssm": func(name string) (string, error) {
+			return sr.cached(scope+"|ssm|"+name, func() (string, error) {
+				if err := clients(); err != nil {
+					return "", err
+				}
+				out, err := ssmSvc.GetParameter(&ssm.GetParameterInput{
+					Name:           aws.String(name),
+					WithDecryption: aws.Bool(true),
+				})
+				if err != nil {
+					return "", err
+				}
+				return aws.StringValue(out.Parameter.Value), nil
+			})
+		},
+		// secret reads a secret from Secrets Manager, optionally extracting a key from its JSON
+		// content
+		"secret": func(name string, jsonKey ...string) (string, error) {
+			if len(jsonKey) > 1 {
+				return "", errors.New("secret expects at most one JSON key")
+			}
+			value, err := sr.cached(scope+"|secret|"+name, func() (string, error) {
+				if err := clients(); err != nil {
+					return "", err
+				}
+				out, err := secretsSvc.GetSecretValue(&secretsmanager.GetSecretValueInput{
+					SecretId: aws.String(name),
+				})
+				if err != nil {
+					return "", err
+				}
+				if out.SecretString == nil {
+					return "", errors.New("secret " + name + " is not a string")
+				}
+				return *out.SecretString, nil
+			})
+			if err != nil || len(jsonKey) == 0 {
+				return value, err
+			}
+			return secretJSONKey(name, value, jsonKey[0])
+		},
+	}
+}
+
+// cached fetches a secret unless it was already fetched, secrets are marked as sensitive
+func (sr *SecretResolver) cached(key string, fetch func() (string, error)) (string, error) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if value, ok := sr.cache[key]; ok {
+		return value, nil
+	}
+	value, err := fetch()
+	if err != nil {
+		return "", err
+	}
+	MarkSensitive(value)
+	sr.cache[key] = value
+	return value, nil
+}
+
+// secretJSONKey extracts a key from the JSON content of a secret, non-string values are
+// returned as JSON. The extracted value is marked as sensitive as well.
+func secretJSONKey(name, content, key string) (string, error) {
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(content), &values); err != nil {
+		return "", errors.New("secret " + name + " is not a JSON object")
+	}
+	value, ok := values[key]
+	if !ok {
+		return "", errors.New("secret " + name + " has no key " + key)
+	}
+	if s, ok := value.(string); ok {
+		MarkSensitive(s)
+		return s, nil
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	MarkSensitive(string(b))
+	return string(b), nil
+}
+
+// placeholderSecretFuncs stand in for the secret functions while the region and credentials of
+// a config are determined
+var placeholderSecretFuncs = template.FuncMap{
+	"ssm": func(name string) string {
+		return "ssm:" + name
+	},
+	"secret": func(name string, jsonKey ...string) string {
+		return "secret:" + name
+	},
+}
+
+// sensitiveValues holds the values which must not appear in the logs, ordered from the longest
+// to the shortest
+var sensitiveValues = struct {
+	sync.RWMutex
+	values  map[string]bool
+	ordered []string
+}{values: make(map[string]bool)}
+
+// MarkSensitive registers a value to be redacted by Redact, along with the forms it takes once
+// encoded in JSON
+func MarkSensitive(value string) {
+	if value == "" {
+		return
+	}
+	sensitiveValues.Lock()
+	defer sensitiveValues.Unlock()
+	for _, v := range jsonEscapedForms(value) {
+		if sensitiveValues.values[v] {
+			continue
+		}
+		sensitiveValues.values[v] = true
+		i := sort.Search(len(sensitiveValues.ordered), func(i int) bool {
+			return len(sensitiveValues.ordered[i]) < len(v)
+		})
+		sensitiveValues.ordered = append(sensitiveValues.ordered, "")
+		copy(sensitiveValues.ordered[i+1:], sensitiveValues.ordered[i:])
+		sensitiveValues.ordered[i] = v
+	}
+}
+
+// jsonEscapedForms returns a value as is and as escaped inside a JSON string, with and without
+// the escaping of HTML characters
+func jsonEscapedForms(value string) []string {
+	forms := []string{value}
+	for _, escapeHTML := range []bool{true, false} {
+		var b bytes.Buffer
+		encoder := json.NewEncoder(&b)
+		encoder.SetEscapeHTML(escapeHTML)
+		if err := encoder.Encode(value); err != nil {
+			continue
+		}
+		escaped := strings.TrimSuffix(b.String(), "\n")
+		escaped = escaped[1 : len(escaped)-1]
+		if escaped != value && escaped != forms[len(forms)-1] {
+			forms = append(forms, escaped)
+		}
+	}
+	return forms
+}
+
+// Redact replaces the sensitive values contained in a string, the longest first so that no part
+// of a value containing another one is left behind. Values shorter than sensitiveMinLength are
+// only replaced where they aren't part of a longer word or number.
+func Redact(s string) string {
+	sensitiveValues.RLock()
+	defer sensitiveValues.RUnlock()
+	for _, value := range sensitiveValues.ordered {
+		if len(value) < sensitiveMinLength {
+			s = redactTokens(s, value)
+			continue
+		}
+		s = strings.Replace(s, value, redacted, -1)
+	}
+	return s
+}
+
+// redactTokens replaces the occurrences of a value which are delimited by the bounds of the
+// string or by characters other than letters, digits and underscores
+func redactTokens(s, value string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, value)
+		if i < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		end := i + len(value)
+		if (i > 0 && isWordByte(s[i-1])) || (end < len(s) && isWordByte(s[end])) {
+			b.WriteString(s[:i+1])
+			s = s[i+1:]
+			continue
+		}
+		b.WriteString(s[:i])
+		b.WriteString(redacted)
+		s = s[end:]
+	}
+}
+
+// isWordByte checks whether or not a byte is part of a word or a number
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+// RedactionHook redacts the sensitive values from log messages and fields
+type RedactionHook struct{}
+
+// Levels returns the levels the hook applies to, all of them
+func (RedactionHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire redacts an entry before it is written
+func (RedactionHook) Fire(entry *log.Entry) error {
+	entry.Message = Redact(entry.Message)
+	for k, v := range entry.Data {
+		if s, ok := v.(string); ok {
+			entry.Data[k] = Redact(s)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockSSMAPI struct {
+	ssmiface.SSMAPI
+	parameters map[string]string
+	calls      int
+}
+
+func (m *mockSSMAPI) GetParameter(input *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+	m.calls++
+	value, ok := m.parameters[*input.Name]
+	if !ok {
+		return nil, awserr.New(ssm.ErrCodeParameterNotFound, "parameter not found", nil)
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Value: aws.String(value)}}, nil
+}
+
+type mockSecretsManagerAPI struct {
+	secretsmanageriface.SecretsManagerAPI
+	secrets map[string]string
+	calls   int
+}
+
+func (m *mockSecretsManagerAPI) GetSecretValue(input *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+	m.calls++
+	value, ok := m.secrets[*input.SecretId]
+	if !ok {
+		return nil, awserr.New(secretsmanager.ErrCodeResourceNotFoundException, "secret not found", nil)
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(value)}, nil
+}
+
+func mockSecretResolver(ssmSvc *mockSSMAPI, secretsSvc *mockSecretsManagerAPI, regions *[]string) *SecretResolver {
+	return &SecretResolver{
+		newClients: func(region string, creds *CredentialsRecord) (ssmiface.SSMAPI, secretsmanageriface.SecretsManagerAPI, error) {
+			*regions = append(*regions, region+"/"+creds.AccessKeyId+"/"+creds.SecretAccessKey)
+			return ssmSvc, secretsSvc, nil
+		},
+		cache: make(map[string]string),
+	}
+}
+
+func TestSecretResolver(t *testing.T) {
+	assert := assert.New(t)
+
+	ssmSvc := &mockSSMAPI{parameters: map[string]string{"/db/password": "ssm-password"}}
+	secretsSvc := &mockSecretsManagerAPI{secrets: map[string]string{
+		"db":    `{"user":"admin","password":"secret-password","port":5432}`,
+		"plain": "plain-secret",
+	}}
+	var regions []string
+
+	ar, _ := InitConfigResolver()
+	ar.Secrets = mockSecretResolver(ssmSvc, secretsSvc, &regions)
+
+	playbook := strings.Replace(PlaybookRecord1, `"--src",`,
+		`"{{ssm "/db/password"}}", "{{ssm "/db/password"}}", "{{secret "db" "user"}}", `+
+			`"{{secret "db" "password"}}", "{{secret "db" "port"}}", "{{secret "plain"}}", "--src",`, 1)
+	res, err := ar.ParsePlaybookRecord([]byte(playbook), nil, "")
+	assert.Nil(err)
+	assert.Equal([]string{"ssm-password", "ssm-password", "admin", "secret-password", "5432",
+		"plain-secret", "--src"}, res.Steps[0].Arguments[:7])
+
+	// the clients use the region and credentials of the config and secrets are only fetched once
+	assert.Equal([]string{"us-east-1/env/env"}, regions)
+	assert.Equal(1, ssmSvc.calls)
+	assert.Equal(2, secretsSvc.calls)
+
+	res, err = ar.ParsePlaybookRecord([]byte(playbook), nil, "")
+	assert.Nil(err)
+	assert.Equal(1, ssmSvc.calls)
+	assert.Equal(2, secretsSvc.calls)
+
+	// secrets are redacted from the rendered config
+	rendered, err := ar.Render([]byte(playbook), nil, "")
+	assert.Nil(err)
+	assert.Contains(string(rendered), "secret-password")
+	assert.NotContains(Redact(string(rendered)), "secret-password")
+	assert.NotContains(Redact(string(rendered)), "ssm-password")
+	assert.Contains(Redact(string(rendered)), `"`+redacted+`"`)
+
+	// fail for unknown secrets or keys
+	for templ, expected := range map[string]string{
+		`{{ssm "/unknown"}}`:           "ParameterNotFound: parameter not found",
+		`{{secret "unknown"}}`:         "ResourceNotFoundException: secret not found",
+		`{{secret "db" "unknown"}}`:    "secret db has no key unknown",
+		`{{secret "plain" "unknown"}}`: "secret plain is not a JSON object",
+	} {
+		playbook := strings.Replace(PlaybookRecord1, `"--src",`, `"`+templ+`", "--src",`, 1)
+		res, err = ar.ParsePlaybookRecord([]byte(playbook), nil, "")
+		assert.Nil(res)
+		assert.NotNil(err)
+		assert.Contains(err.Error(), expected)
+	}
+
+	// secrets can't be resolved without the functions provided by the ConfigResolver
+	_, err = templateRawBytesWithFuncs([]byte(`{"a":"{{ssm "/db/password"}}"}`), nil, "template", nil)
+	assert.NotNil(err)
+	assert.Equal("template: template:1: function \"ssm\" not defined", err.Error())
+}
+
+func TestSecretResolver_Scope(t *testing.T) {
+	assert := assert.New(t)
+
+	// each access key gives access to an account with its own value of the parameter
+	accounts := map[string]*mockSSMAPI{
+		"key-a": {parameters: map[string]string{"/db/password": "password-a"}},
+		"key-b": {parameters: map[string]string{"/db/password": "password-b"}},
+	}
+	sr := &SecretResolver{
+		newClients: func(region string, creds *CredentialsRecord) (ssmiface.SSMAPI, secretsmanageriface.SecretsManagerAPI, error) {
+			return accounts[creds.AccessKeyId], &mockSecretsManagerAPI{}, nil
+		},
+		cache: make(map[string]string),
+	}
+
+	for _, key := range []string{"key-a", "key-b", "key-a"} {
+		creds := &CredentialsRecord{AccessKeyId: key, SecretAccessKey: "secret"}
+		ssmFunc := sr.Funcs("us-east-1", creds)["ssm"].(func(string) (string, error))
+		value, err := ssmFunc("/db/password")
+		assert.Nil(err)
+		assert.Equal("password-"+key[len(key)-1:], value)
+	}
+	assert.Equal(1, accounts["key-a"].calls)
+	assert.Equal(1, accounts["key-b"].calls)
+}
+
+func TestRedact_ShortValues(t *testing.T) {
+	assert := assert.New(t)
+
+	// short values are redacted where they make up a whole token but not inside longer words and
+	// numbers, which redacting them would corrupt
+	MarkSensitive("4812")
+	MarkSensitive("long-secret")
+	assert.Equal(`{"pin":"`+redacted+`"} --pin=`+redacted+` `+redacted+` 548120 pin4812 4812x `+redacted,
+		Redact(`{"pin":"4812"} --pin=4812 4812 548120 pin4812 4812x long-secret`))
+
+	// short secrets fetched with ssm or secret are redacted from the rendered config
+	var regions []string
+	ar, _ := InitConfigResolver()
+	ar.Secrets = mockSecretResolver(&mockSSMAPI{parameters: map[string]string{"/db/pin": "3907"}},
+		&mockSecretsManagerAPI{}, &regions)
+	playbook := strings.Replace(PlaybookRecord1, `"--src",`, `"--pin={{ssm "/db/pin"}}", "--src",`, 1)
+	rendered, err := ar.Render([]byte(playbook), nil, "")
+	assert.Nil(err)
+	assert.Contains(string(rendered), `"--pin=3907"`)
+	assert.Contains(Redact(string(rendered)), `"--pin=`+redacted+`"`)
+	assert.NotContains(Redact(string(rendered)), "3907")
+}
+
+func TestRedact_JSONEscaped(t *testing.T) {
+	assert := assert.New(t)
+
+	// characters escaped by json.Marshal or toJson don't leave the secret readable
+	secret := `p&ss<w>rd"x\y`
+	MarkSensitive(secret)
+	for _, s := range []string{
+		secret,
+		`p\u0026ss\u003cw\u003erd\"x\\y`,
+		`p&ss<w>rd\"x\\y`,
+		InterfaceToJSONString(map[string]string{"key": secret}, false),
+	} {
+		assert.NotContains(Redact(s), "rd")
+		assert.Contains(Redact(s), redacted)
+	}
+
+	// secrets rendered through toJson are redacted from the rendered config
+	var regions []string
+	ar, _ := InitConfigResolver()
+	ar.Secrets = mockSecretResolver(&mockSSMAPI{parameters: map[string]string{"/db/escaped": `a&b<c>"d`}},
+		&mockSecretsManagerAPI{}, &regions)
+	playbook := strings.Replace(PlaybookRecord1, `"--src",`, `{{toJson (ssm "/db/escaped")}}, "--src",`, 1)
+	rendered, err := ar.Render([]byte(playbook), nil, "")
+	assert.Nil(err)
+	assert.Contains(string(rendered), `a\u0026b\u003cc\u003e\"d`)
+	assert.NotContains(Redact(string(rendered)), `c\u003e`)
+	assert.Contains(Redact(string(rendered)), `"`+redacted+`"`)
+}
+
+func TestRedact_Nested(t *testing.T) {
+	assert := assert.New(t)
+
+	// a secret contained in a longer one doesn't leave the rest of the longer one exposed,
+	// whichever was registered first
+	MarkSensitive("nested-inner")
+	MarkSensitive("outer-nested-inner-outer")
+	MarkSensitive("other-nested-inner-tail")
+	for i := 0; i < 10; i++ {
+		assert.Equal(redacted+" "+redacted+" "+redacted,
+			Redact("outer-nested-inner-outer other-nested-inner-tail nested-inner"))
+	}
+}
+
+func TestRedactionHook(t *testing.T) {
+	assert := assert.New(t)
+
+	MarkSensitive("hook-secret")
+
+	var buffer bytes.Buffer
+	logger := log.New()
+	logger.SetOutput(&buffer)
+	logger.AddHook(RedactionHook{})
+	logger.WithField("arg", "--password=hook-secret").Info("running with hook-secret")
+
+	assert.NotContains(buffer.String(), "hook-secret")
+	assert.Contains(buffer.String(), "running with "+redacted)
+	assert.Contains(buffer.String(), "--password="+redacted)
+}
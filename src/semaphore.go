@@ -0,0 +1,376 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	consulSemaphoreSessionTTL = "5m"
+	consulSemaphoreWaitTime   = time.Second
+)
+
+// Semaphore is a lock which can be held by a limited number of holders at once, each of them
+// holding one of its slots
+type Semaphore interface {
+	Lock
+	// Slots lists the slots which are currently held
+	Slots() ([]SemaphoreSlot, error)
+	// Limit is the number of slots of the semaphore
+	Limit() int
+}
+
+// SemaphoreSlot describes a held slot, its name can be used to release it as a regular lock
+type SemaphoreSlot struct {
+	Name   string
+	Holder *LockHolder
+}
+
+// semaphoreFullError is returned when all the slots of a semaphore are held
+func semaphoreFullError(limit int, name string) error {
+	return LockHeldError(fmt.Sprintf("all %d slots of the lock at %s are held", limit, name))
+}
+
+// FileSemaphore is for file-based semaphores, each slot is a file lock suffixed with .slot-N.
+// The slots share the same fence file so that fencing tokens keep increasing across slots.
+type FileSemaphore struct {
+	path  string
+	slots []*FileLock
+	held  *FileLock
+}
+
+// InitFileSemaphore builds a FileSemaphore with the given number of slots at the path specified
+// by name
+func InitFileSemaphore(name string, limit int) (Lock, error) {
+	p, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+	slots := make([]*FileLock, limit)
+	for i := range slots {
+		slots[i] = &FileLock{path: fmt.Sprintf("%s.slot-%d", p, i), fence: p + ".fence"}
+	}
+	return &FileSemaphore{path: p, slots: slots}, nil
+}
+
+// TryLock tries to acquire the first free slot of the semaphore
+func (fs *FileSemaphore) TryLock() error {
+	if fs.held != nil {
+		return LockHeldError("lock already held at " + fs.held.path)
+	}
+	for _, slot := range fs.slots {
+		err := slot.TryLock()
+		if _, ok := err.(LockHeldError); ok {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fs.held = slot
+		return nil
+	}
+	return semaphoreFullError(len(fs.slots), fs.path)
+}
+
+// Unlock releases the slot acquired through TryLock
+func (fs *FileSemaphore) Unlock() error {
+	if fs.held == nil {
+		return errors.New("lock not held")
+	}
+	err := fs.held.Unlock()
+	if err != nil {
+		return err
+	}
+	fs.held = nil
+	return nil
+}
+
+// Holder retrieves the metadata of the slot acquired through TryLock, nil if none was acquired
+func (fs *FileSemaphore) Holder() (*LockHolder, error) {
+	if fs.held == nil {
+		return nil, nil
+	}
+	return fs.held.Holder()
+}
+
+// Refresh rewrites the metadata of the slot acquired through TryLock
+func (fs *FileSemaphore) Refresh() error {
+	if fs.held == nil {
+		return errors.New("lock at " + fs.path + " was not acquired")
+	}
+	return fs.held.Refresh()
+}
+
+// FencingToken returns the token obtained when acquiring a slot
+func (fs *FileSemaphore) FencingToken() int64 {
+	if fs.held == nil {
+		return 0
+	}
+	return fs.held.FencingToken()
+}
+
+// Slots lists the slot files which exist
+func (fs *FileSemaphore) Slots() ([]SemaphoreSlot, error) {
+	var slots []SemaphoreSlot
+	for _, slot := range fs.slots {
+		holder, err := slot.Holder()
+		if err != nil {
+			return nil, err
+		}
+		if holder != nil {
+			slots = append(slots, SemaphoreSlot{Name: slot.path, Holder: holder})
+		}
+	}
+	return slots, nil
+}
+
+// Limit is the number of slot files
+func (fs *FileSemaphore) Limit() int {
+	return len(fs.slots)
+}
+
+// ConsulSemaphore is for Consul-based semaphores following the semaphore recipe: every contender
+// writes a KV pair bound to its session under the prefix and the holders are recorded in the
+// prefix's .lock pair. Slots are freed when the session of their holder expires, persistent
+// slots being bound to a session which never expires. The fencing token is the index at which
+// the contender's KV pair was created.
+type ConsulSemaphore struct {
+	client     *api.Client
+	prefix     string
+	limit      int
+	persistent bool
+	session    string
+	semaphore  *api.Semaphore
+	lost       <-chan struct{}
+	token      int64
+	holder     LockHolder
+}
+
+// InitConsulSemaphore builds a ConsulSemaphore with the given number of slots under the KV
+// prefix specified by name, persistent slots outliving the process holding them
+func InitConsulSemaphore(consulAddress, name string, limit int, persistent bool) (Lock, error) {
+	client, err := api.NewClient(&api.Config{Address: consulAddress})
+	if err != nil {
+		return nil, err
+	}
+	return &ConsulSemaphore{client: client, prefix: name, limit: limit, persistent: persistent}, nil
+}
+
+// TryLock tries to acquire a slot of the semaphore without waiting for one to be freed
+func (cs *ConsulSemaphore) TryLock() error {
+	if cs.semaphore != nil {
+		return LockHeldError("lock already held at " + cs.contenderKey())
+	}
+
+	session, err := cs.createSession()
+	if err != nil {
+		return err
+	}
+
+	holder := NewLockHolder()
+	semaphore, err := cs.client.SemaphoreOpts(&api.SemaphoreOptions{
+		Prefix:            cs.prefix,
+		Limit:             cs.limit,
+		Session:           session,
+		Value:             holder.Bytes(),
+		SemaphoreWaitTime: consulSemaphoreWaitTime,
+		SemaphoreTryOnce:  true,
+	})
+	if err != nil {
+		cs.client.Session().Destroy(session, nil)
+		return err
+	}
+
+	lost, err := semaphore.Acquire(nil)
+	if err != nil || lost == nil {
+		// destroying the session deletes our contender entry
+		cs.client.Session().Destroy(session, nil)
+		if err != nil {
+			return err
+		}
+		return semaphoreFullError(cs.limit, cs.prefix)
+	}
+
+	cs.session = session
+	cs.semaphore = semaphore
+	cs.lost = lost
+	p, _, err := cs.client.KV().Get(cs.contenderKey(), nil)
+	if err != nil {
+		cs.Unlock()
+		return err
+	}
+	if p == nil {
+		cs.Unlock()
+		return errors.New("lock at " + cs.prefix + " was released while being acquired")
+	}
+	cs.token = int64(p.CreateIndex)
+	cs.holder = holder
+	return nil
+}
+
+// Unlock releases the slot acquired through TryLock and destroys the associated session
+func (cs *ConsulSemaphore) Unlock() error {
+	if cs.semaphore == nil {
+		return errors.New("lock not held")
+	}
+
+	err := cs.semaphore.Release()
+	if err == api.ErrSemaphoreNotHeld {
+		err = nil
+	}
+	if derr := cs.semaphore.Destroy(); derr != nil && derr != api.ErrSemaphoreInUse && err == nil {
+		err = derr
+	}
+	if _, derr := cs.client.Session().Destroy(cs.session, nil); derr != nil && err == nil {
+		err = derr
+	}
+
+	cs.session = ""
+	cs.semaphore = nil
+	cs.lost = nil
+	return err
+}
+
+// Holder retrieves the metadata of the slot acquired through TryLock, nil if none was acquired
+func (cs *ConsulSemaphore) Holder() (*LockHolder, error) {
+	if cs.semaphore == nil {
+		return nil, nil
+	}
+	p, _, err := cs.client.KV().Get(cs.contenderKey(), nil)
+	if err != nil || p == nil {
+		return nil, err
+	}
+	return parseConsulHolder(p)
+}
+
+// Refresh renews the session holding the slot and rewrites the slot's metadata
+func (cs *ConsulSemaphore) Refresh() error {
+	if cs.semaphore == nil {
+		return errors.New("lock at " + cs.prefix + " was not acquired")
+	}
+	select {
+	case <-cs.lost:
+		return errors.New("lock at " + cs.contenderKey() + " is not held anymore")
+	default:
+	}
+
+	entry, _, err := cs.client.Session().Renew(cs.session, nil)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return errors.New("lock at " + cs.contenderKey() + " is not held anymore")
+	}
+
+	holder := cs.holder.refreshed()
+	ok, _, err := cs.client.KV().Acquire(&api.KVPair{
+		Key:     cs.contenderKey(),
+		Value:   holder.Bytes(),
+		Session: cs.session,
+		Flags:   api.SemaphoreFlagValue,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("lock at " + cs.contenderKey() + " is not held anymore")
+	}
+	cs.holder = holder
+	return nil
+}
+
+// FencingToken returns the token obtained when acquiring a slot
+func (cs *ConsulSemaphore) FencingToken() int64 {
+	return cs.token
+}
+
+// Slots lists the contenders recorded as holders of the semaphore whose session is still alive
+func (cs *ConsulSemaphore) Slots() ([]SemaphoreSlot, error) {
+	pairs, _, err := cs.client.KV().List(cs.prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var lock struct {
+		Holders map[string]bool
+	}
+	lockKey := path.Join(cs.prefix, api.DefaultSemaphoreKey)
+	for _, p := range pairs {
+		if p.Key == lockKey && p.Value != nil {
+			if err := json.Unmarshal(p.Value, &lock); err != nil {
+				return nil, errors.New("unrecognized semaphore content at " + lockKey + ": " +
+					string(p.Value))
+			}
+		}
+	}
+
+	var slots []SemaphoreSlot
+	for _, p := range pairs {
+		if p.Session == "" || !lock.Holders[p.Session] {
+			continue
+		}
+		holder, err := parseConsulHolder(p)
+		if err != nil {
+			return nil, err
+		}
+		slots = append(slots, SemaphoreSlot{Name: p.Key, Holder: holder})
+	}
+	return slots, nil
+}
+
+// Limit is the number of holders allowed by the semaphore
+func (cs *ConsulSemaphore) Limit() int {
+	return cs.limit
+}
+
+// createSession creates the session the slot is bound to. Nothing renews it once the process
+// exits, so the session of a persistent slot has neither a TTL nor health checks and lasts until
+// the slot is released.
+func (cs *ConsulSemaphore) createSession() (string, error) {
+	entry := &api.SessionEntry{
+		Name:     "dataflow-runner lock " + cs.prefix,
+		Behavior: api.SessionBehaviorDelete,
+	}
+	if cs.persistent {
+		session, _, err := cs.client.Session().CreateNoChecks(entry, nil)
+		return session, err
+	}
+	entry.TTL = consulSemaphoreSessionTTL
+	session, _, err := cs.client.Session().Create(entry, nil)
+	return session, err
+}
+
+// contenderKey is the key of the KV pair written by our session
+func (cs *ConsulSemaphore) contenderKey() string {
+	return path.Join(cs.prefix, cs.session)
+}
+
+// parseConsulHolder reads the holder stored in a KV pair, its fencing token being the index at
+// which the pair was created
+func parseConsulHolder(p *api.KVPair) (*LockHolder, error) {
+	holder, err := ParseLockHolder(p.Value)
+	if err != nil {
+		return nil, err
+	}
+	holder.FencingToken = int64(p.CreateIndex)
+	return holder, nil
+}
@@ -0,0 +1,221 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSemaphore(t *testing.T) {
+	assert := assert.New(t)
+
+	lockPath := "/tmp/semaphore"
+	defer os.Remove(lockPath + ".fence")
+
+	first, err := InitFileSemaphore(lockPath, 2)
+	assert.Nil(err)
+	second, err := InitFileSemaphore(lockPath, 2)
+	assert.Nil(err)
+	third, err := InitFileSemaphore(lockPath, 2)
+	assert.Nil(err)
+
+	err = first.Unlock()
+	assert.NotNil(err)
+	assert.Equal("lock not held", err.Error())
+
+	err = first.TryLock()
+	assert.Nil(err)
+	assert.Equal(int64(1), first.FencingToken())
+	err = second.TryLock()
+	assert.Nil(err)
+	assert.Equal(int64(2), second.FencingToken())
+
+	// fail if all the slots are held
+	err = third.TryLock()
+	assert.NotNil(err)
+	assert.Equal(LockHeldError("all 2 slots of the lock at "+lockPath+" are held"), err)
+	assert.Equal(int64(0), third.FencingToken())
+
+	slots, err := third.(Semaphore).Slots()
+	assert.Nil(err)
+	assert.Equal(2, len(slots))
+	assert.Equal(lockPath+".slot-0", slots[0].Name)
+	assert.Equal(int64(1), slots[0].Holder.FencingToken)
+	assert.Equal(lockPath+".slot-1", slots[1].Name)
+	assert.Equal(int64(2), slots[1].Holder.FencingToken)
+
+	err = first.Refresh()
+	assert.Nil(err)
+	holder, err := first.Holder()
+	assert.Nil(err)
+	assert.False(holder.RefreshedAt.IsZero())
+
+	// a freed slot can be acquired by someone else
+	err = first.Unlock()
+	assert.Nil(err)
+	err = third.TryLock()
+	assert.Nil(err)
+	assert.Equal(int64(3), third.FencingToken())
+
+	err = second.Unlock()
+	assert.Nil(err)
+	err = third.Unlock()
+	assert.Nil(err)
+
+	slots, err = third.(Semaphore).Slots()
+	assert.Nil(err)
+	assert.Equal(0, len(slots))
+}
+
+func TestFileSemaphore_Concurrent(t *testing.T) {
+	assert := assert.New(t)
+
+	lockPath := "/tmp/concurrent-semaphore"
+	defer os.Remove(lockPath + ".fence")
+
+	const contenders = 8
+	semaphores := make([]Lock, contenders)
+	errs := make([]error, contenders)
+	var wg sync.WaitGroup
+	for i := range semaphores {
+		semaphore, err := InitFileSemaphore(lockPath, contenders)
+		assert.Nil(err)
+		semaphores[i] = semaphore
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = semaphores[i].TryLock()
+		}(i)
+	}
+	wg.Wait()
+
+	// every contender gets its own slot and its own token
+	tokens := map[int64]bool{}
+	for i, semaphore := range semaphores {
+		assert.Nil(errs[i])
+		tokens[semaphore.FencingToken()] = true
+	}
+	assert.Equal(contenders, len(tokens))
+	for i := 1; i <= contenders; i++ {
+		assert.True(tokens[int64(i)], fmt.Sprintf("token %d was not handed out", i))
+	}
+
+	for _, semaphore := range semaphores {
+		err := semaphore.Unlock()
+		assert.Nil(err)
+	}
+}
+
+func TestConsulSemaphore(t *testing.T) {
+	assert := assert.New(t)
+
+	c, s := makeClient(t)
+	assert.NotNil(c)
+	assert.NotNil(s)
+	defer s.Stop()
+
+	lockName := "semaphore"
+
+	first, err := InitConsulSemaphore(s.HTTPAddr, lockName, 2, false)
+	assert.Nil(err)
+	second, err := InitConsulSemaphore(s.HTTPAddr, lockName, 2, false)
+	assert.Nil(err)
+	third, err := InitConsulSemaphore(s.HTTPAddr, lockName, 2, false)
+	assert.Nil(err)
+
+	err = first.TryLock()
+	assert.Nil(err)
+	assert.NotEqual(int64(0), first.FencingToken())
+	err = second.TryLock()
+	assert.Nil(err)
+	assert.True(second.FencingToken() > first.FencingToken())
+
+	// fail if all the slots are held
+	err = third.TryLock()
+	assert.NotNil(err)
+	assert.Equal(LockHeldError("all 2 slots of the lock at "+lockName+" are held"), err)
+
+	slots, err := third.(Semaphore).Slots()
+	assert.Nil(err)
+	assert.Equal(2, len(slots))
+
+	err = first.Refresh()
+	assert.Nil(err)
+
+	// a freed slot can be acquired by someone else
+	err = first.Unlock()
+	assert.Nil(err)
+	err = first.Unlock()
+	assert.NotNil(err)
+	assert.Equal("lock not held", err.Error())
+	err = third.TryLock()
+	assert.Nil(err)
+	assert.True(third.FencingToken() > second.FencingToken())
+
+	err = second.Unlock()
+	assert.Nil(err)
+	err = third.Unlock()
+	assert.Nil(err)
+}
+
+func TestConsulSemaphore_Persistent(t *testing.T) {
+	assert := assert.New(t)
+
+	c, s := makeClient(t)
+	assert.NotNil(c)
+	assert.NotNil(s)
+	defer s.Stop()
+
+	lockName := "persistent-semaphore"
+	hard, err := InitConsulSemaphore(s.HTTPAddr, lockName, 1, true)
+	assert.Nil(err)
+	err = hard.TryLock()
+	assert.Nil(err)
+
+	// nothing renews the session once the process exits, it must neither expire nor be
+	// invalidated by a health check
+	session := hard.(*ConsulSemaphore).session
+	entry, _, err := c.Session().Info(session, nil)
+	assert.Nil(err)
+	assert.NotNil(entry)
+	assert.Equal("", entry.TTL)
+	assert.Empty(entry.Checks)
+
+	other, err := InitConsulSemaphore(s.HTTPAddr, lockName, 1, false)
+	assert.Nil(err)
+	err = other.TryLock()
+	assert.Equal(LockHeldError("all 1 slots of the lock at "+lockName+" are held"), err)
+
+	// releasing the slot by its name destroys its session
+	slots, err := other.(Semaphore).Slots()
+	assert.Nil(err)
+	assert.Equal(1, len(slots))
+	slot, err := GetLock(slots[0].Name, LockConfig{Consul: s.HTTPAddr}, defaultAwsClients)
+	assert.Nil(err)
+	err = slot.Unlock()
+	assert.Nil(err)
+	entry, _, err = c.Session().Info(session, nil)
+	assert.Nil(err)
+	assert.Nil(entry)
+
+	err = other.TryLock()
+	assert.Nil(err)
+	err = other.Unlock()
+	assert.Nil(err)
+}
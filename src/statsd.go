@@ -0,0 +1,203 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/emr"
+)
+
+const statsDNamespace = metricsNamespace + "."
+
+// StatsD emits the metrics of a run to a StatsD or DogStatsD agent over UDP as they happen, tagged
+// with the name of the cluster and the tags of the playbook. Locks are acquired before the
+// playbook is parsed so their metrics are held back until the playbook is loaded, or until the
+// run is done if it never is.
+type StatsD struct {
+	NopObserver
+	Client statsd.ClientInterface
+
+	mu             sync.Mutex
+	tags           []string
+	playbookLoaded bool
+	pendingLocks   []lockAttempt
+	clusters       map[string]string
+	launched       map[string]bool
+	terminated     map[string]bool
+	finished       map[string]bool
+}
+
+// lockAttempt is an attempt to acquire a lock whose metrics aren't emitted yet
+type lockAttempt struct {
+	duration time.Duration
+	outcome  string
+}
+
+// NewStatsD builds a StatsD observer emitting to the agent listening at host:port
+func NewStatsD(addr string) (*StatsD, error) {
+	client, err := statsd.New(addr, statsd.WithNamespace(statsDNamespace), statsd.WithoutTelemetry())
+	if err != nil {
+		return nil, err
+	}
+	return &StatsD{
+		Client:     client,
+		clusters:   make(map[string]string),
+		launched:   make(map[string]bool),
+		terminated: make(map[string]bool),
+		finished:   make(map[string]bool),
+	}, nil
+}
+
+// ConfigLoaded tags the metrics with the tags of the playbook
+func (s *StatsD) ConfigLoaded(kind, location string, record interface{}) {
+	playbook, ok := record.(*PlaybookConfig)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, tag := range playbook.Tags {
+		s.tags = append(s.tags, tag.Key+":"+tag.Value)
+	}
+	s.playbookLoaded = true
+	s.flushLocks()
+}
+
+// ClusterLaunched counts the clusters launched
+func (s *StatsD) ClusterLaunched(jobflowID, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clusters[jobflowID] = name
+	s.Client.Incr("cluster.launches", s.clusterTags(jobflowID), 1)
+}
+
+// ClusterChanged records the time it took for the cluster to be ready and counts its termination
+func (s *StatsD) ClusterChanged(cluster *emr.Cluster) {
+	if cluster.Status == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := aws.StringValue(cluster.Id)
+	if cluster.Name != nil {
+		s.clusters[id] = *cluster.Name
+	}
+
+	if timeline := cluster.Status.Timeline; timeline != nil && !s.launched[id] &&
+		timeline.CreationDateTime != nil && timeline.ReadyDateTime != nil {
+		s.launched[id] = true
+		s.Client.Timing("cluster.launch_time",
+			timeline.ReadyDateTime.Sub(*timeline.CreationDateTime), s.clusterTags(id), 1)
+	}
+
+	state := aws.StringValue(cluster.Status.State)
+	if !s.terminated[id] &&
+		(state == emr.ClusterStateTerminated || state == emr.ClusterStateTerminatedWithErrors) {
+		s.terminated[id] = true
+		s.Client.Incr("cluster.terminations", append(s.clusterTags(id), "state:"+state), 1)
+	}
+}
+
+// ClusterBootstrapFailed counts the bootstrap failures
+func (s *StatsD) ClusterBootstrapFailed(jobflowID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Client.Incr("cluster.bootstrap_failures", s.clusterTags(jobflowID), 1)
+}
+
+// StepChanged counts the steps which completed or failed and records their duration
+func (s *StatsD) StepChanged(jobflowID string, step *emr.Step) {
+	if step.Status == nil || !StringInSlice(aws.StringValue(step.Status.State), terminalStepStates) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := jobflowID + "/" + aws.StringValue(step.Id)
+	if s.finished[id] {
+		return
+	}
+	s.finished[id] = true
+
+	state := aws.StringValue(step.Status.State)
+	tags := append(s.clusterTags(jobflowID), "step:"+aws.StringValue(step.Name), "state:"+state)
+	if state == emr.StepStateCompleted {
+		s.Client.Incr("step.completions", tags, 1)
+	} else {
+		s.Client.Incr("step.failures", tags, 1)
+	}
+	if timeline := step.Status.Timeline; timeline != nil && timeline.StartDateTime != nil && timeline.EndDateTime != nil {
+		s.Client.Timing("step.duration", timeline.EndDateTime.Sub(*timeline.StartDateTime), tags, 1)
+	}
+}
+
+// LockAcquired records the time spent trying to acquire the lock and counts the times it was
+// already held, once the tags of the playbook are known
+func (s *StatsD) LockAcquired(name string, duration time.Duration, err error) {
+	outcome := lockAcquired
+	if _, ok := err.(LockHeldError); ok {
+		outcome = lockHeld
+	} else if err != nil {
+		outcome = lockFailed
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pendingLocks = append(s.pendingLocks, lockAttempt{duration: duration, outcome: outcome})
+	if s.playbookLoaded {
+		s.flushLocks()
+	}
+}
+
+// Close emits the lock metrics held back, flushes the metrics which are buffered and closes the
+// connection to the agent
+func (s *StatsD) Close() error {
+	s.mu.Lock()
+	s.flushLocks()
+	s.mu.Unlock()
+	return s.Client.Close()
+}
+
+// flushLocks emits the metrics of the lock attempts held back
+func (s *StatsD) flushLocks() {
+	for _, attempt := range s.pendingLocks {
+		tags := append(s.runTags(), "outcome:"+attempt.outcome)
+		s.Client.Timing("lock.acquire_time", attempt.duration, tags, 1)
+		s.Client.Incr("lock.acquisitions", tags, 1)
+		if attempt.outcome == lockHeld {
+			s.Client.Incr("lock.contentions", s.runTags(), 1)
+		}
+	}
+	s.pendingLocks = nil
+}
+
+// runTags copies the tags of the playbook so that they can be appended to
+func (s *StatsD) runTags() []string {
+	return append([]string{}, s.tags...)
+}
+
+// clusterTags are the tags of the playbook along with the name of a cluster, if it's known
+func (s *StatsD) clusterTags(jobflowID string) []string {
+	tags := s.runTags()
+	if name, ok := s.clusters[jobflowID]; ok {
+		tags = append(tags, "cluster:"+name)
+	}
+	return tags
+}
@@ -0,0 +1,150 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/emr"
+	"github.com/stretchr/testify/assert"
+)
+
+// readStatsDLines reads the metrics received by a fake agent until none are left
+func readStatsDLines(conn net.PacketConn) []string {
+	var lines []string
+	buf := make([]byte, 65536)
+	for {
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return lines
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if line != "" {
+				lines = append(lines, line)
+			}
+		}
+	}
+}
+
+func TestStatsD(t *testing.T) {
+	assert := assert.New(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer conn.Close()
+
+	s, err := NewStatsD(conn.LocalAddr().String())
+	assert.Nil(err)
+	observers := Observers{s}
+
+	observers.ConfigLoaded("cluster", "cluster.json", &ClusterConfig{Name: "ignored"})
+	observers.ConfigLoaded("playbook", "playbook.json", &PlaybookConfig{
+		Tags: []*TagsRecord{{Key: "team", Value: "data"}},
+	})
+	observers.ClusterLaunched("j-123", "nightly")
+	created := time.Date(2019, time.October, 10, 23, 0, 0, 0, time.UTC)
+	ready := created.Add(7 * time.Minute)
+	for i := 0; i < 2; i++ {
+		observers.ClusterChanged(&emr.Cluster{Id: aws.String("j-123"), Name: aws.String("nightly"), Status: &emr.ClusterStatus{
+			State:    aws.String("WAITING"),
+			Timeline: &emr.ClusterTimeline{CreationDateTime: &created, ReadyDateTime: &ready},
+		}})
+	}
+
+	end := ready.Add(90 * time.Second)
+	step := &emr.Step{Id: aws.String("s-1"), Name: aws.String("load"), Status: &emr.StepStatus{
+		State:    aws.String("COMPLETED"),
+		Timeline: &emr.StepTimeline{StartDateTime: &ready, EndDateTime: &end},
+	}}
+	// steps are counted once no matter how many times they're polled
+	observers.StepChanged("j-123", step)
+	observers.StepChanged("j-123", step)
+	observers.StepChanged("j-123", &emr.Step{Id: aws.String("s-2"), Name: aws.String("check"), Status: &emr.StepStatus{
+		State: aws.String("FAILED"),
+	}})
+	observers.StepChanged("j-123", &emr.Step{Id: aws.String("s-3"), Name: aws.String("report"), Status: &emr.StepStatus{
+		State: aws.String("RUNNING"),
+	}})
+
+	for i := 0; i < 2; i++ {
+		observers.ClusterChanged(&emr.Cluster{Id: aws.String("j-123"), Status: &emr.ClusterStatus{
+			State: aws.String("TERMINATED"),
+		}})
+	}
+	observers.LockAcquired("pipeline", time.Second, LockHeldError("lock already held at pipeline"))
+	assert.Nil(s.Close())
+
+	lines := readStatsDLines(conn)
+	for _, line := range []string{
+		"dataflow_runner.cluster.launches:1|c|#team:data,cluster:nightly",
+		"dataflow_runner.cluster.launch_time:420000.000000|ms|#team:data,cluster:nightly",
+		"dataflow_runner.step.completions:1|c|#team:data,cluster:nightly,step:load,state:COMPLETED",
+		"dataflow_runner.step.duration:90000.000000|ms|#team:data,cluster:nightly,step:load,state:COMPLETED",
+		"dataflow_runner.step.failures:1|c|#team:data,cluster:nightly,step:check,state:FAILED",
+		"dataflow_runner.cluster.terminations:1|c|#team:data,cluster:nightly,state:TERMINATED",
+		"dataflow_runner.lock.acquire_time:1000.000000|ms|#team:data,outcome:held",
+		"dataflow_runner.lock.acquisitions:1|c|#team:data,outcome:held",
+		"dataflow_runner.lock.contentions:1|c|#team:data",
+	} {
+		assert.Contains(lines, line)
+	}
+	assert.Len(lines, 9)
+}
+
+func TestStatsD_LockBeforePlaybook(t *testing.T) {
+	assert := assert.New(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer conn.Close()
+
+	// locks are acquired before the playbook is parsed, their metrics still carry its tags
+	s, err := NewStatsD(conn.LocalAddr().String())
+	assert.Nil(err)
+	observers := Observers{s}
+	observers.LockAcquired("pipeline", time.Second, nil)
+	observers.ConfigLoaded("playbook", "playbook.json", &PlaybookConfig{
+		Tags: []*TagsRecord{{Key: "team", Value: "data"}},
+	})
+	assert.Nil(s.Close())
+	assert.ElementsMatch([]string{
+		"dataflow_runner.lock.acquire_time:1000.000000|ms|#team:data,outcome:acquired",
+		"dataflow_runner.lock.acquisitions:1|c|#team:data,outcome:acquired",
+	}, readStatsDLines(conn))
+
+	// and are emitted without them if the run ends before the playbook is loaded
+	s, err = NewStatsD(conn.LocalAddr().String())
+	assert.Nil(err)
+	observers = Observers{s}
+	observers.LockAcquired("pipeline", time.Second, LockHeldError("lock already held at pipeline"))
+	assert.Nil(s.Close())
+	assert.ElementsMatch([]string{
+		"dataflow_runner.lock.acquire_time:1000.000000|ms|#outcome:held",
+		"dataflow_runner.lock.acquisitions:1|c|#outcome:held",
+		"dataflow_runner.lock.contentions:1|c",
+	}, readStatsDLines(conn))
+}
+
+func TestNewStatsD_Fail(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := NewStatsD("no-port")
+	assert.Nil(s)
+	assert.NotNil(err)
+}
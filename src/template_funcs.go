@@ -0,0 +1,240 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The functions below complement the ones defined in templFuncs. Their last argument is the one
+// most likely to be piped, e.g. {{nowWithFormat "2006-01-02" | dateAdd "2006-01-02" "-1d"}}.
+
+// maxDateRange bounds the number of dates generated by dateRange
+const maxDateRange = 10000
+
+// dateAdd parses a date with a Go layout, shifts it by an offset and formats it with the same
+// layout. Offsets are Go durations (e.g. -6h) or numbers of days, months or years (e.g. -1d, 2M,
+// 1y).
+func dateAdd(layout, offset, date string) (string, error) {
+	t, err := time.Parse(layout, date)
+	if err != nil {
+		return "", err
+	}
+	t, err = addOffset(t, offset)
+	if err != nil {
+		return "", err
+	}
+	return t.Format(layout), nil
+}
+
+// dateTrunc truncates a date parsed with a Go layout to the start of the minute, hour, day,
+// week (starting on Monday), month or year and formats it with the same layout
+func dateTrunc(layout, unit, date string) (string, error) {
+	t, err := time.Parse(layout, date)
+	if err != nil {
+		return "", err
+	}
+
+	y, m, d := t.Date()
+	switch unit {
+	case "minute":
+		t = t.Truncate(time.Minute)
+	case "hour":
+		t = time.Date(y, m, d, t.Hour(), 0, 0, 0, t.Location())
+	case "day":
+		t = time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	case "week":
+		t = time.Date(y, m, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, t.Location())
+	case "month":
+		t = time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+	case "year":
+		t = time.Date(y, time.January, 1, 0, 0, 0, 0, t.Location())
+	default:
+		return "", errors.New("unknown unit " + unit +
+			", supported units are minute,hour,day,week,month,year")
+	}
+	return t.Format(layout), nil
+}
+
+// dateRange lists the dates from start to end included, separated by step (see dateAdd for the
+// supported steps) and formatted with a Go layout
+func dateRange(layout, step, start, end string) ([]string, error) {
+	from, err := time.Parse(layout, start)
+	if err != nil {
+		return nil, err
+	}
+	to, err := time.Parse(layout, end)
+	if err != nil {
+		return nil, err
+	}
+
+	var dates []string
+	for t := from; !t.After(to); {
+		if len(dates) == maxDateRange {
+			return nil, fmt.Errorf("date range from %s to %s has more than %d dates", start, end,
+				maxDateRange)
+		}
+		dates = append(dates, t.Format(layout))
+		next, err := addOffset(t, step)
+		if err != nil {
+			return nil, err
+		}
+		if !next.After(t) {
+			return nil, errors.New("step " + step + " of the date range must be positive")
+		}
+		t = next
+	}
+	return dates, nil
+}
+
+// addOffset shifts a time by a Go duration or a number of days (d), months (M) or years (y)
+func addOffset(t time.Time, offset string) (time.Time, error) {
+	if len(offset) > 1 {
+		n, err := strconv.Atoi(offset[:len(offset)-1])
+		if err == nil {
+			switch offset[len(offset)-1] {
+			case 'd':
+				return t.AddDate(0, 0, n), nil
+			case 'M':
+				return t.AddDate(0, n, 0), nil
+			case 'y':
+				return t.AddDate(n, 0, 0), nil
+			}
+		}
+	}
+	d, err := time.ParseDuration(offset)
+	if err != nil {
+		return t, errors.New("invalid offset " + offset +
+			", expected a duration such as 6h or a number of days, months or years such as 1d, 1M or 1y")
+	}
+	return t.Add(d), nil
+}
+
+// replaceAll replaces all the occurrences of old by new in s
+func replaceAll(old, new, s string) string {
+	return strings.Replace(s, old, new, -1)
+}
+
+// joinList concatenates the elements of a list, whatever their type, separated by sep
+func joinList(sep string, list interface{}) (string, error) {
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return "", fmt.Errorf("join expects a list, got %T", list)
+	}
+	elems := make([]string, v.Len())
+	for i := range elems {
+		elems[i] = fmt.Sprint(v.Index(i).Interface())
+	}
+	return strings.Join(elems, sep), nil
+}
+
+// splitString slices s into the substrings separated by sep
+func splitString(sep, s string) []string {
+	return strings.Split(s, sep)
+}
+
+// defaultValue returns value unless it is empty (nil, false, 0 or of length 0) in which case
+// def is returned. Missing variables can be defaulted with {{index . "var" | default "value"}}.
+func defaultValue(def, value interface{}) interface{} {
+	if isEmpty(value) {
+		return def
+	}
+	return value
+}
+
+// required fails with the given message if value is empty (see default)
+func required(message string, value interface{}) (interface{}, error) {
+	if isEmpty(value) {
+		return nil, errors.New(message)
+	}
+	return value, nil
+}
+
+// isEmpty checks whether or not a value is nil, false, 0 or of length 0
+func isEmpty(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	default:
+		return v.IsZero()
+	}
+}
+
+// toJSONString serializes a value as JSON, strings being quoted
+func toJSONString(value interface{}) (string, error) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// newUUID generates a random (version 4) UUID
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// sha256Hex hashes a string with SHA-256 and encodes the digest as hexadecimal
+func sha256Hex(s string) string {
+	digest := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(digest[:])
+}
+
+// fileContents reads a file
+func fileContents(filename string) (string, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// envOrDefault reads an environment variable, falling back on the default value if one is provided and
+// the variable is not set
+func envOrDefault(name string, def ...string) (string, error) {
+	if len(def) > 1 {
+		return "", fmt.Errorf("env expects at most one default value, got %d", len(def))
+	}
+	val, ok := os.LookupEnv(name)
+	if ok {
+		return val, nil
+	}
+	if len(def) == 1 {
+		return def[0], nil
+	}
+	return "", fmt.Errorf("environment variable %s not set", name)
+}
@@ -0,0 +1,139 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func templateString(t *testing.T, templ string, varMap map[string]interface{}) (string, error) {
+	templated, err := templateRawBytesWithFuncs([]byte(templ), varMap, "template", nil)
+	return string(templated), err
+}
+
+func TestTemplateFuncs_Dates(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := map[string]string{
+		`{{dateAdd "2006-01-02" "-1d" "2022-03-01"}}`:                                  "2022-02-28",
+		`{{"2022-01-31" | dateAdd "2006-01-02" "1M"}}`:                                 "2022-03-03",
+		`{{dateAdd "2006-01-02T15" "-6h" "2022-01-01T03"}}`:                            "2021-12-31T21",
+		`{{dateAdd "2006" "2y" "2022"}}`:                                               "2024",
+		`{{dateTrunc "2006-01-02 15:04" "hour" "2022-03-17 13:45"}}`:                   "2022-03-17 13:00",
+		`{{dateTrunc "2006-01-02" "week" "2022-03-17"}}`:                               "2022-03-14",
+		`{{dateTrunc "2006-01-02" "week" "2022-03-14"}}`:                               "2022-03-14",
+		`{{dateTrunc "2006-01-02" "month" "2022-03-17"}}`:                              "2022-03-01",
+		`{{dateTrunc "2006-01-02" "year" "2022-03-17"}}`:                               "2022-01-01",
+		`{{range dateRange "2006-01-02" "1d" "2022-02-27" "2022-03-01"}}{{.}},{{end}}`: "2022-02-27,2022-02-28,2022-03-01,",
+		`{{dateRange "2006-01-02" "1d" "2022-03-01" "2022-02-27" | len}}`:              "0",
+	}
+	for templ, expected := range tests {
+		res, err := templateString(t, templ, nil)
+		assert.Nil(err, templ)
+		assert.Equal(expected, res, templ)
+	}
+
+	errors := map[string]string{
+		`{{dateAdd "2006-01-02" "1w" "2022-03-01"}}`:                 "invalid offset 1w, expected a duration such as 6h or a number of days, months or years such as 1d, 1M or 1y",
+		`{{dateTrunc "2006-01-02" "decade" "2022-03-17"}}`:           "unknown unit decade, supported units are minute,hour,day,week,month,year",
+		`{{dateRange "2006-01-02" "-1d" "2022-01-01" "2022-01-02"}}`: "step -1d of the date range must be positive",
+		`{{dateRange "2006-01-02" "1h" "2022-01-01" "2030-01-02"}}`:  "date range from 2022-01-01 to 2030-01-02 has more than 10000 dates",
+		`{{dateAdd "2006-01-02" "1d" "01/03/2022"}}`:                 `parsing time "01/03/2022" as "2006-01-02": cannot parse "01/03/2022" as "2006"`,
+	}
+	for templ, expected := range errors {
+		_, err := templateString(t, templ, nil)
+		assert.NotNil(err, templ)
+		if err != nil {
+			assert.Contains(err.Error(), expected, templ)
+		}
+	}
+}
+
+func TestTemplateFuncs_Strings(t *testing.T) {
+	assert := assert.New(t)
+
+	varMap := map[string]interface{}{
+		"tables": []interface{}{"events", "bad_rows"},
+		"ids":    []interface{}{1, 2},
+		"empty":  "",
+		"zero":   0,
+		"object": map[string]interface{}{"a": []interface{}{"b", 1}},
+	}
+	tests := map[string]string{
+		`{{lower "ABC"}}`:                                      "abc",
+		`{{"a/b/c" | replace "/" "-"}}`:                        "a-b-c",
+		`{{join "," .tables}}`:                                 "events,bad_rows",
+		`{{join "+" .ids}}`:                                    "1+2",
+		`{{range split "," "a,b"}}[{{.}}]{{end}}`:              "[a][b]",
+		`{{.empty | default "fallback"}}`:                      "fallback",
+		`{{.zero | default 5}}`:                                "5",
+		`{{index . "missing" | default "fallback"}}`:           "fallback",
+		`{{index .tables 0 | default "fallback"}}`:             "events",
+		`{{required "tables must be set" .tables | join ","}}`: "events,bad_rows",
+		`{{toJson .object}}`:                                   `{"a":["b",1]}`,
+		`{{toJson "quoted \"string\""}}`:                       `"quoted \"string\""`,
+		`{{sha256 "abc"}}`:                                     "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+	}
+	for templ, expected := range tests {
+		res, err := templateString(t, templ, varMap)
+		assert.Nil(err, templ)
+		assert.Equal(expected, res, templ)
+	}
+
+	_, err := templateString(t, `{{required "empty must be set" .empty}}`, varMap)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "empty must be set")
+
+	_, err = templateString(t, `{{join "," .empty}}`, varMap)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "join expects a list, got string")
+
+	res, err := templateString(t, `{{uuid}}`, nil)
+	assert.Nil(err)
+	assert.Regexp(regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`), res)
+}
+
+func TestTemplateFuncs_Env(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Setenv("TEST_TEMPLATE_ENV", "value")
+	defer os.Unsetenv("TEST_TEMPLATE_ENV")
+	os.Unsetenv("TEST_TEMPLATE_ENV_UNSET")
+
+	res, err := templateString(t, `{{env "TEST_TEMPLATE_ENV" "default"}}`, nil)
+	assert.Nil(err)
+	assert.Equal("value", res)
+
+	res, err = templateString(t, `{{env "TEST_TEMPLATE_ENV_UNSET" "default"}}`, nil)
+	assert.Nil(err)
+	assert.Equal("default", res)
+
+	_, err = templateString(t, `{{env "TEST_TEMPLATE_ENV_UNSET"}}`, nil)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "environment variable TEST_TEMPLATE_ENV_UNSET not set")
+
+	file, _ := ioutil.TempFile("", "test-file-contents")
+	defer os.Remove(file.Name())
+	file.WriteString("line1\nline2")
+	file.Close()
+
+	res, err = templateString(t, `{{fileContents "`+file.Name()+`"}}`, nil)
+	assert.Nil(err)
+	assert.Equal("line1\nline2", res)
+}
@@ -455,7 +455,7 @@ var ClusterRecordWithConfigs = `{
 }`
 
 var PlaybookRecord1 = `{
-  "schema": "iglu:com.snowplowanalytics.dataflowrunner/PlaybookConfig/avro/1-0-0",
+  "schema": "iglu:com.snowplowanalytics.dataflowrunner/PlaybookConfig/avro/1-0-1",
   "data": {
     "region": "us-east-1",
     "credentials": {
@@ -498,3 +498,83 @@ var PlaybookRecord1 = `{
     ]
   }
 }`
+
+var PlaybookRecordYAML = `# same playbook as PlaybookRecord1
+schema: iglu:com.snowplowanalytics.dataflowrunner/PlaybookConfig/avro/1-0-1
+data:
+  region: us-east-1
+  credentials:
+    accessKeyId: env
+    secretAccessKey: env
+  steps:
+    - type: CUSTOM_JAR
+      name: Combine Months
+      actionOnFailure: CANCEL_AND_WAIT
+      jar: /usr/share/aws/emr/s3-dist-cp/lib/s3-dist-cp.jar
+      arguments:
+        - --src
+        - s3n://my-output-bucket/enriched/bad/
+        - --dest
+        - hdfs:///local/monthly/
+    - type: CUSTOM_JAR
+      name: Combine Months
+      actionOnFailure: CONTINUE
+      jar: s3://snowplow-hosted-assets/3-enrich/hadoop-event-recovery/snowplow-hadoop-event-recovery-0.2.0.jar
+      arguments:
+        - com.snowplowanalytics.hadoop.scalding.SnowplowEventRecoveryJob
+        - --hdfs
+        - --input
+        - hdfs:///local/monthly/*
+        - --output
+        - {{.output}}
+  tags:
+    - key: hello
+      value: world
+`
+
+var PlaybookRecordJSONC = `// same playbook as PlaybookRecord1
+{
+  "schema": "iglu:com.snowplowanalytics.dataflowrunner/PlaybookConfig/avro/1-0-1",
+  "data": {
+    "region": "us-east-1",
+    "credentials": {
+      "accessKeyId": "env", // resolved from the environment
+      "secretAccessKey": "env"
+    },
+    /* steps */
+    "steps": [
+      {
+        "type": "CUSTOM_JAR",
+        "name": "Combine Months",
+        "actionOnFailure": "CANCEL_AND_WAIT",
+        "jar": "/usr/share/aws/emr/s3-dist-cp/lib/s3-dist-cp.jar",
+        "arguments": [
+          "--src",
+          "s3n://my-output-bucket/enriched/bad/",
+          "--dest",
+          "hdfs:///local/monthly/"
+        ]
+      },
+      {
+        "type": "CUSTOM_JAR",
+        "name": "Combine Months",
+        "actionOnFailure": "CONTINUE",
+        "jar": "s3://snowplow-hosted-assets/3-enrich/hadoop-event-recovery/snowplow-hadoop-event-recovery-0.2.0.jar",
+        "arguments": [
+          "com.snowplowanalytics.hadoop.scalding.SnowplowEventRecoveryJob",
+          "--hdfs",
+          "--input",
+          "hdfs:///local/monthly/*",
+          "--output",
+          "hdfs:///local/recovery/"
+        ]
+      }
+    ],
+    "tags": [
+      {
+        "key": "hello",
+        "value": "world"
+      }
+    ]
+  }
+}`
@@ -0,0 +1,262 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/emr"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// otlpTracesPath is the path the traces are sent to, relative to the OTLP endpoint
+const otlpTracesPath = "/v1/traces"
+
+// Tracing records the run as an OpenTelemetry trace: a root span for the command whose children
+// are the requests to AWS, the waits for the cluster, the steps from their submission to their
+// completion and the downloads of their logs
+type Tracing struct {
+	NopObserver
+	Provider *sdktrace.TracerProvider
+
+	tracer  trace.Tracer
+	mu      sync.Mutex
+	ctx     context.Context
+	root    trace.Span
+	steps   map[string]trace.Span
+	running map[string]bool
+	done    map[string]bool
+}
+
+// NewOTLPExporter builds an exporter sending the spans to an OTLP/HTTP endpoint, e.g.
+// http://localhost:4318, the OTEL_EXPORTER_OTLP_* environment variables being honoured for the
+// rest of its configuration
+func NewOTLPExporter(endpoint string) (sdktrace.SpanExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, errors.New("invalid OTLP endpoint " + endpoint + ", expected http(s)://host:port")
+	}
+	options := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+		otlptracehttp.WithURLPath(strings.TrimSuffix(u.Path, "/") + otlpTracesPath),
+	}
+	if u.Scheme == "http" {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	return otlptracehttp.New(context.Background(), options...)
+}
+
+// NewTracing builds the tracing of a run of a service whose spans are exported by an exporter, the
+// trace joining the one of the parent context if there is one
+func NewTracing(parent context.Context, exporter sdktrace.SpanExporter, service, version string) *Tracing {
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String(service),
+			semconv.ServiceVersionKey.String(version),
+		)),
+	)
+	return &Tracing{
+		Provider: provider,
+		tracer:   provider.Tracer(service),
+		ctx:      parent,
+		steps:    make(map[string]trace.Span),
+		running:  make(map[string]bool),
+		done:     make(map[string]bool),
+	}
+}
+
+// TraceParent is the context of the trace given through the TRACEPARENT and TRACESTATE
+// environment variables, e.g. by the orchestrator running the command
+func TraceParent() context.Context {
+	return propagation.TraceContext{}.Extract(context.Background(), propagation.MapCarrier{
+		"traceparent": os.Getenv("TRACEPARENT"),
+		"tracestate":  os.Getenv("TRACESTATE"),
+	})
+}
+
+// Start starts the root span of a command, returning the ID of the trace
+func (t *Tracing) Start(command string, fields log.Fields) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ctx, t.root = t.tracer.Start(t.ctx, command, trace.WithAttributes(fieldAttributes(fields)...))
+	return t.root.SpanContext().TraceID().String()
+}
+
+// OperationStarted starts a span as a child of the operation whose span the context carries, if
+// any, or of the step the operation is about, the root span otherwise. The returned context
+// carries the span so that the operations it encloses are its children.
+func (t *Tracing) OperationStarted(ctx context.Context, name string, fields log.Fields) (context.Context, func(err error)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parent := t.ctx
+	if enclosing := trace.SpanFromContext(ctx); enclosing.SpanContext().IsValid() {
+		parent = trace.ContextWithSpan(parent, enclosing)
+	}
+	if stepID, ok := fields[fieldStepID].(string); ok {
+		if step, ok := t.steps[stepKey(fmt.Sprint(fields[fieldJobflowID]), stepID)]; ok {
+			parent = trace.ContextWithSpan(parent, step)
+		}
+	}
+	_, span := t.tracer.Start(parent, name, trace.WithAttributes(fieldAttributes(fields)...))
+
+	return trace.ContextWithSpan(ctx, span), func(err error) {
+		endSpan(span, err)
+	}
+}
+
+// ClusterBootstrapFailed records the bootstrap failure on the root span
+func (t *Tracing) ClusterBootstrapFailed(jobflowID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	trace.SpanFromContext(t.ctx).AddEvent("bootstrap failure",
+		trace.WithAttributes(attribute.String(fieldJobflowID, jobflowID)))
+}
+
+// StepsSubmitted starts the spans of the steps
+func (t *Tracing) StepsSubmitted(jobflowID string, steps []*emr.StepConfig, stepIDs []*string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, id := range stepIDs {
+		if i < len(steps) {
+			t.startStep(jobflowID, aws.StringValue(id), aws.StringValue(steps[i].Name), time.Now())
+		}
+	}
+}
+
+// StepChanged records when the step started running and ends its span once it's done, steps
+// which weren't submitted by the command, e.g. the ones of a transient cluster, starting their
+// span once they're first seen
+func (t *Tracing) StepChanged(jobflowID string, step *emr.Step) {
+	if step.Status == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := stepKey(jobflowID, aws.StringValue(step.Id))
+	if t.done[key] {
+		return
+	}
+	timeline := step.Status.Timeline
+	span, ok := t.steps[key]
+	if !ok {
+		start := time.Now()
+		if timeline != nil && timeline.CreationDateTime != nil {
+			start = *timeline.CreationDateTime
+		}
+		span = t.startStep(jobflowID, aws.StringValue(step.Id), aws.StringValue(step.Name), start)
+	}
+	if timeline != nil && timeline.StartDateTime != nil && !t.running[key] {
+		t.running[key] = true
+		span.AddEvent("running", trace.WithTimestamp(*timeline.StartDateTime))
+	}
+
+	state := aws.StringValue(step.Status.State)
+	if !StringInSlice(state, terminalStepStates) {
+		return
+	}
+	t.done[key] = true
+	span.SetAttributes(attribute.String(fieldState, state))
+	if state != emr.StepStateCompleted {
+		description := "step " + state
+		if details := step.Status.FailureDetails; details != nil && details.Reason != nil {
+			description = *details.Reason
+		}
+		span.SetStatus(codes.Error, Redact(description))
+	}
+	end := time.Now()
+	if timeline != nil && timeline.EndDateTime != nil {
+		end = *timeline.EndDateTime
+	}
+	span.End(trace.WithTimestamp(end))
+}
+
+// Finish ends the spans still in progress and the root span along with the outcome of the command
+func (t *Tracing) Finish(exitCode int, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, span := range t.steps {
+		if !t.done[key] {
+			t.done[key] = true
+			span.End()
+		}
+	}
+	if t.root == nil {
+		return
+	}
+	t.root.SetAttributes(attribute.Int("exit_code", exitCode))
+	endSpan(t.root, err)
+}
+
+// Shutdown exports the spans which haven't been yet
+func (t *Tracing) Shutdown() error {
+	return t.Provider.Shutdown(context.Background())
+}
+
+// startStep starts the span of a step as a child of the root span
+func (t *Tracing) startStep(jobflowID, stepID, name string, start time.Time) trace.Span {
+	_, span := t.tracer.Start(t.ctx, name, trace.WithTimestamp(start), trace.WithAttributes(
+		attribute.String(fieldJobflowID, jobflowID),
+		attribute.String(fieldStepID, stepID),
+		attribute.String(fieldStepName, name),
+	))
+	t.steps[stepKey(jobflowID, stepID)] = span
+	return span
+}
+
+// stepKey identifies a step among the ones of every cluster
+func stepKey(jobflowID, stepID string) string {
+	return jobflowID + "/" + stepID
+}
+
+// endSpan ends a span, marking it as failed along with the redacted error if there is one
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(codes.Error, Redact(err.Error()))
+	}
+	span.End()
+}
+
+// fieldAttributes converts the fields of log entries to span attributes
+func fieldAttributes(fields log.Fields) []attribute.KeyValue {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	attributes := make([]attribute.KeyValue, len(keys))
+	for i, k := range keys {
+		attributes[i] = attribute.String(k, Redact(fmt.Sprint(fields[k])))
+	}
+	return attributes
+}
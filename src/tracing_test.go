@@ -0,0 +1,209 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/emr"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// spansByName indexes the exported spans by name
+func spansByName(exporter *tracetest.InMemoryExporter) map[string]tracetest.SpanStub {
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	return spans
+}
+
+func TestTracing(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Setenv("TRACEPARENT", testTraceParent)
+	exporter := tracetest.NewInMemoryExporter()
+	tracing := NewTracing(TraceParent(), exporter, "dataflow-runner", "0.7.5")
+	observers := Observers{tracing}
+
+	traceID := tracing.Start("run-transient", log.Fields{fieldRunID: "run-1"})
+	assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", traceID)
+
+	ctx := context.Background()
+	_, done := observers.OperationStarted(ctx, "emr.RunJobFlow", log.Fields{"service": "emr", "operation": "RunJobFlow"})
+	done(nil)
+	waitCtx, wait := observers.OperationStarted(ctx, "waitForState", log.Fields{fieldJobflowID: "j-123", fieldState: "WAITING"})
+	_, done = observers.OperationStarted(waitCtx, "emr.DescribeCluster", log.Fields{"service": "emr", "operation": "DescribeCluster"})
+	done(nil)
+	wait(nil)
+	observers.ClusterBootstrapFailed("j-122")
+
+	observers.StepsSubmitted("j-123", []*emr.StepConfig{{Name: aws.String("load")}}, []*string{aws.String("s-1")})
+	start := time.Date(2019, time.October, 10, 23, 0, 0, 0, time.UTC)
+	end := start.Add(90 * time.Second)
+	running := &emr.Step{Id: aws.String("s-1"), Name: aws.String("load"), Status: &emr.StepStatus{
+		State:    aws.String("RUNNING"),
+		Timeline: &emr.StepTimeline{StartDateTime: &start},
+	}}
+	observers.StepChanged("j-123", running)
+	observers.StepChanged("j-123", running)
+	observers.StepChanged("j-123", &emr.Step{Id: aws.String("s-1"), Name: aws.String("load"), Status: &emr.StepStatus{
+		State:          aws.String("FAILED"),
+		FailureDetails: &emr.FailureDetails{Reason: aws.String("Unknown error")},
+		Timeline:       &emr.StepTimeline{StartDateTime: &start, EndDateTime: &end},
+	}})
+	_, done = observers.OperationStarted(ctx, "GetStepLogs", log.Fields{fieldJobflowID: "j-123", fieldStepID: "s-1"})
+	done(errors.New("no logs"))
+	// steps of a transient cluster are first seen once they're polled
+	observers.StepChanged("j-123", &emr.Step{Id: aws.String("s-2"), Name: aws.String("check"), Status: &emr.StepStatus{
+		State: aws.String("PENDING"),
+	}})
+
+	tracing.Finish(1, errors.New("step load failed"))
+	// the in-memory exporter forgets the spans once shut down
+	assert.Nil(tracing.Provider.ForceFlush(context.Background()))
+
+	spans := spansByName(exporter)
+	assert.Len(spans, 7)
+	root := spans["run-transient"]
+	for _, span := range spans {
+		assert.Equal(traceID, span.SpanContext.TraceID().String())
+	}
+	assert.Equal("00f067aa0ba902b7", root.Parent.SpanID().String())
+	assert.True(root.Parent.IsRemote())
+	assert.Equal(codes.Error, root.Status.Code)
+	assert.Equal("step load failed", root.Status.Description)
+	assert.Len(root.Events, 1)
+	assert.Equal("bootstrap failure", root.Events[0].Name)
+
+	assert.Equal(root.SpanContext.SpanID(), spans["emr.RunJobFlow"].Parent.SpanID())
+	assert.Equal(root.SpanContext.SpanID(), spans["waitForState"].Parent.SpanID())
+	assert.Equal(spans["waitForState"].SpanContext.SpanID(), spans["emr.DescribeCluster"].Parent.SpanID())
+
+	load := spans["load"]
+	assert.Equal(root.SpanContext.SpanID(), load.Parent.SpanID())
+	assert.Equal(end, load.EndTime)
+	assert.Len(load.Events, 1)
+	assert.Equal("running", load.Events[0].Name)
+	assert.Equal(start, load.Events[0].Time)
+	assert.Equal(codes.Error, load.Status.Code)
+	assert.Equal("Unknown error", load.Status.Description)
+	assert.Equal(load.SpanContext.SpanID(), spans["GetStepLogs"].Parent.SpanID())
+	assert.Equal("no logs", spans["GetStepLogs"].Status.Description)
+
+	// steps still in progress are ended along with the command
+	assert.Equal(root.SpanContext.SpanID(), spans["check"].Parent.SpanID())
+	assert.Equal(codes.Unset, spans["check"].Status.Code)
+}
+
+func TestTracing_ConcurrentOperations(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.Write([]byte(`{"Cluster": {"Id": "j-123", "Status": {"State": "WAITING"}}}`))
+	}))
+	defer server.Close()
+
+	exporter := tracetest.NewInMemoryExporter()
+	tracing := NewTracing(context.Background(), exporter, "dataflow-runner", "0.7.5")
+	tracing.Start("run", log.Fields{})
+	clients := NewAwsClients(server.URL)
+	clients.Observers = Observers{tracing}
+	svc, err := clients.EMR("eu-west-1", &CredentialsRecord{AccessKeyId: "access", SecretAccessKey: "secret"})
+	assert.Nil(err)
+
+	// the requests sent by overlapping operations are children of the one which sent them
+	jobflowIDs := []string{"j-1", "j-2"}
+	started := make(chan struct{}, len(jobflowIDs))
+	var wg sync.WaitGroup
+	for _, jobflowID := range jobflowIDs {
+		wg.Add(1)
+		go func(jobflowID string) {
+			defer wg.Done()
+			ctx, done := tracing.OperationStarted(context.Background(), "waitForState "+jobflowID,
+				log.Fields{fieldJobflowID: jobflowID})
+			started <- struct{}{}
+			for len(started) < len(jobflowIDs) {
+				time.Sleep(time.Millisecond)
+			}
+			_, err := svc.DescribeClusterWithContext(ctx, &emr.DescribeClusterInput{ClusterId: aws.String(jobflowID)})
+			done(err)
+		}(jobflowID)
+	}
+	wg.Wait()
+	tracing.Finish(0, nil)
+	assert.Nil(tracing.Provider.ForceFlush(context.Background()))
+
+	spans := spansByName(exporter)
+	waits := make(map[string]bool)
+	for _, span := range exporter.GetSpans() {
+		if span.Name != "emr.DescribeCluster" {
+			continue
+		}
+		for _, jobflowID := range jobflowIDs {
+			if span.Parent.SpanID() == spans["waitForState "+jobflowID].SpanContext.SpanID() {
+				waits[jobflowID] = true
+			}
+		}
+	}
+	assert.Equal(map[string]bool{"j-1": true, "j-2": true}, waits)
+	assert.Equal(spans["run"].SpanContext.SpanID(), spans["waitForState j-1"].Parent.SpanID())
+	assert.Equal(spans["run"].SpanContext.SpanID(), spans["waitForState j-2"].Parent.SpanID())
+}
+
+func TestTracing_NoTraceParent(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Setenv("TRACEPARENT", "")
+	exporter := tracetest.NewInMemoryExporter()
+	tracing := NewTracing(TraceParent(), exporter, "dataflow-runner", "0.7.5")
+	tracing.Start("up", log.Fields{})
+	tracing.Finish(0, nil)
+	// the in-memory exporter forgets the spans once shut down
+	assert.Nil(tracing.Provider.ForceFlush(context.Background()))
+
+	spans := exporter.GetSpans()
+	assert.Len(spans, 1)
+	assert.Equal(trace.SpanContext{}, spans[0].Parent)
+	assert.Equal(codes.Unset, spans[0].Status.Code)
+}
+
+func TestNewOTLPExporter(t *testing.T) {
+	assert := assert.New(t)
+
+	exporter, err := NewOTLPExporter("http://localhost:4318")
+	assert.Nil(err)
+	assert.NotNil(exporter)
+
+	for _, endpoint := range []string{"localhost:4318", "grpc://localhost:4317", "http://"} {
+		exporter, err = NewOTLPExporter(endpoint)
+		assert.Nil(exporter)
+		assert.NotNil(err)
+		assert.Equal("invalid OTLP endpoint "+endpoint+", expected http(s)://host:port", err.Error())
+	}
+}
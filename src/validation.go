@@ -0,0 +1,506 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ValidationError is an invalid field of a config, designated by its JSON pointer and by its line
+// in the templated config when it is known
+type ValidationError struct {
+	Pointer string
+	Line    int
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s (line %d): %s", e.Pointer, e.Line, e.Message)
+	}
+	return e.Pointer + ": " + e.Message
+}
+
+// ValidationErrors lists every invalid field of a config
+type ValidationErrors struct {
+	Config string
+	Errors []ValidationError
+}
+
+func (e *ValidationErrors) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		messages = append(messages, err.Error())
+	}
+	prefix := "invalid config"
+	if e.Config != "" {
+		prefix += " " + e.Config
+	}
+	return prefix + ": " + strings.Join(messages, "; ")
+}
+
+// recordValidator collects the errors of a record validated against an Avro schema
+type recordValidator struct {
+	named  map[string]interface{}
+	lines  map[string]int
+	strict bool
+	errors []ValidationError
+}
+
+// validateRecord checks a self-describing record against the Avro schema of its data, reporting
+// every type mismatch and missing required field along with, in strict mode, the fields the schema
+// doesn't define
+func validateRecord(avroSchema interface{}, record map[string]interface{}, lines map[string]int, strict bool) []ValidationError {
+	v := &recordValidator{named: make(map[string]interface{}), lines: lines, strict: strict}
+	for _, key := range sortedKeys(record) {
+		if key != "schema" && key != "data" && strict {
+			v.report("/"+escapeJSONPointer(key), "unknown field")
+		}
+	}
+	data, ok := record["data"]
+	if !ok {
+		v.report("/data", "missing required field")
+		return v.errors
+	}
+	v.validate(avroSchema, data, "/data")
+	return v.errors
+}
+
+// report records an error at a JSON pointer, missing fields being reported at the line of the
+// object they are missing from
+func (v *recordValidator) report(pointer, message string) {
+	line, ok := v.lines[pointer]
+	for parent := pointer; !ok && parent != ""; {
+		parent = parent[:strings.LastIndex(parent, "/")]
+		line, ok = v.lines[parent]
+	}
+	v.errors = append(v.errors, ValidationError{Pointer: pointer, Line: line, Message: message})
+}
+
+// validate checks a JSON value against an Avro type
+func (v *recordValidator) validate(t interface{}, value interface{}, pointer string) {
+	switch avroType := t.(type) {
+	case string:
+		if def, ok := v.named[avroType]; ok {
+			v.validate(def, value, pointer)
+			return
+		}
+		v.validatePrimitive(avroType, value, pointer)
+	case []interface{}:
+		v.validateUnion(avroType, value, pointer)
+	case map[string]interface{}:
+		if name, ok := avroType["name"].(string); ok {
+			v.named[name] = avroType
+		}
+		switch avroType["type"] {
+		case "record":
+			v.validateRecordFields(avroType, value, pointer)
+		case "array":
+			list, ok := value.([]interface{})
+			if !ok {
+				v.mismatch("a list", value, pointer)
+				return
+			}
+			for i, item := range list {
+				v.validate(avroType["items"], item, pointer+"/"+strconv.Itoa(i))
+			}
+		case "map":
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				v.mismatch("an object", value, pointer)
+				return
+			}
+			for _, key := range sortedKeys(object) {
+				v.validate(avroType["values"], object[key], pointer+"/"+escapeJSONPointer(key))
+			}
+		case "enum":
+			symbol, ok := value.(string)
+			symbols, _ := avroType["symbols"].([]interface{})
+			for _, s := range symbols {
+				if ok && s == symbol {
+					return
+				}
+			}
+			if value == nil {
+				return
+			}
+			names := make([]string, 0, len(symbols))
+			for _, s := range symbols {
+				names = append(names, fmt.Sprint(s))
+			}
+			v.report(pointer, "expected one of "+strings.Join(names, ", ")+", got "+jsonText(value))
+		case "fixed":
+			v.validatePrimitive("string", value, pointer)
+		default:
+			v.validate(avroType["type"], value, pointer)
+		}
+	}
+}
+
+// validateRecordFields checks the fields of an object against an Avro record. Scalar fields, the
+// ones which accept null and the ones with a default value can be left out, missing scalars being
+// decoded as their zero value.
+func (v *recordValidator) validateRecordFields(t map[string]interface{}, value interface{}, pointer string) {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		v.mismatch("an object", value, pointer)
+		return
+	}
+
+	defined := make(map[string]bool)
+	fields, _ := t["fields"].([]interface{})
+	for _, f := range fields {
+		field, _ := f.(map[string]interface{})
+		name, _ := field["name"].(string)
+		defined[name] = true
+		fieldPointer := pointer + "/" + escapeJSONPointer(name)
+		fieldValue, present := object[name]
+		if present && fieldValue != nil {
+			v.validate(field["type"], fieldValue, fieldPointer)
+			continue
+		}
+		if _, hasDefault := field["default"]; hasDefault || v.optional(field["type"]) {
+			continue
+		}
+		if present {
+			v.report(fieldPointer, "expected "+v.describe(field["type"])+", got null")
+		} else {
+			v.report(fieldPointer, "missing required field")
+		}
+	}
+
+	if v.strict {
+		for _, key := range sortedKeys(object) {
+			if !defined[key] {
+				v.report(pointer+"/"+escapeJSONPointer(key), "unknown field")
+			}
+		}
+	}
+}
+
+// validateUnion checks a value against the branch of a union it would be read as
+func (v *recordValidator) validateUnion(branches []interface{}, value interface{}, pointer string) {
+	var candidate interface{}
+	for _, branch := range branches {
+		if !avroKindMatches(branch, value, v.named) {
+			continue
+		}
+		if candidate == nil {
+			candidate = branch
+		}
+		// scalars of any kind match the scalar branches, the one of the right kind is preferred
+		if v.primitiveMatches(branch, value) {
+			candidate = branch
+			break
+		}
+	}
+	if candidate == nil {
+		v.mismatch(v.describe(branches), value, pointer)
+		return
+	}
+	v.validate(candidate, value, pointer)
+}
+
+// validatePrimitive checks a value against an Avro primitive type, null being accepted for the
+// scalar types as it is decoded as their zero value
+func (v *recordValidator) validatePrimitive(t string, value interface{}, pointer string) {
+	if value == nil || v.primitiveMatches(t, value) {
+		return
+	}
+	v.mismatch(v.describe(t), value, pointer)
+}
+
+// primitiveMatches checks whether or not a value is of the kind of an Avro primitive type
+func (v *recordValidator) primitiveMatches(t interface{}, value interface{}) bool {
+	switch t {
+	case "null":
+		return value == nil
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "int", "long":
+		n, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := n.Int64()
+		return err == nil
+	case "float", "double":
+		_, ok := value.(json.Number)
+		return ok
+	case "string", "bytes":
+		_, ok := value.(string)
+		return ok
+	}
+	return false
+}
+
+// optional checks whether or not a field of an Avro type can be left out
+func (v *recordValidator) optional(t interface{}) bool {
+	if name, ok := t.(string); ok {
+		if def, ok := v.named[name]; ok {
+			t = def
+		}
+	}
+	switch avroType := t.(type) {
+	case string:
+		return true
+	case []interface{}:
+		for _, branch := range avroType {
+			if branch == "null" {
+				return true
+			}
+		}
+		return false
+	case map[string]interface{}:
+		switch avroType["type"] {
+		case "record", "array", "map":
+			return false
+		case "enum", "fixed":
+			return true
+		default:
+			return v.optional(avroType["type"])
+		}
+	}
+	return false
+}
+
+// describe names the kind of values an Avro type expects
+func (v *recordValidator) describe(t interface{}) string {
+	if name, ok := t.(string); ok {
+		if def, ok := v.named[name]; ok {
+			t = def
+		}
+	}
+	switch avroType := t.(type) {
+	case string:
+		switch avroType {
+		case "null":
+			return "null"
+		case "boolean":
+			return "a boolean"
+		case "int", "long":
+			return "an integer"
+		case "float", "double":
+			return "a number"
+		default:
+			return "a string"
+		}
+	case []interface{}:
+		kinds := make([]string, 0, len(avroType))
+		for _, branch := range avroType {
+			kinds = append(kinds, v.describe(branch))
+		}
+		return strings.Join(kinds, " or ")
+	case map[string]interface{}:
+		switch avroType["type"] {
+		case "record", "map":
+			return "an object"
+		case "array":
+			return "a list"
+		case "enum", "fixed":
+			return "a string"
+		default:
+			return v.describe(avroType["type"])
+		}
+	}
+	return fmt.Sprint(t)
+}
+
+// mismatch reports a value of the wrong kind
+func (v *recordValidator) mismatch(expected string, value interface{}, pointer string) {
+	v.report(pointer, "expected "+expected+", got "+jsonKind(value))
+}
+
+// jsonKind names the kind of a JSON value
+func jsonKind(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "a boolean"
+	case json.Number, float64:
+		return "a number"
+	case string:
+		return "a string"
+	case []interface{}:
+		return "a list"
+	default:
+		return "an object"
+	}
+}
+
+// jsonText formats a JSON value for error messages
+func jsonText(value interface{}) string {
+	text, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(text)
+}
+
+// avroKindMatches checks whether or not a JSON value can be read as an Avro type
+func avroKindMatches(t interface{}, value interface{}, named map[string]interface{}) bool {
+	if name, ok := t.(string); ok {
+		if def, ok := named[name]; ok {
+			t = def
+		}
+	}
+	kind := t
+	if complexType, ok := t.(map[string]interface{}); ok {
+		kind = complexType["type"]
+	}
+	switch value.(type) {
+	case nil:
+		return kind == "null"
+	case map[string]interface{}:
+		return kind == "record" || kind == "map"
+	case []interface{}:
+		return kind == "array"
+	default:
+		return kind != "null" && kind != "record" && kind != "map" && kind != "array"
+	}
+}
+
+// sourceLines maps the JSON pointers of the fields of a templated config to their line, keys
+// giving the line of object fields and values the one of list items
+func sourceLines(content []byte, format string) map[string]int {
+	lines := make(map[string]int)
+	if format == configFormatYAML {
+		var node yaml.Node
+		if err := yaml.Unmarshal(content, &node); err == nil {
+			yamlLines(&node, "", lines)
+		}
+		return lines
+	}
+
+	content = stripJSONComments(content)
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.UseNumber()
+	jsonLines(dec, content, "", lines)
+	return lines
+}
+
+// yamlLines records the lines of the fields of a YAML node, the fields of aliased nodes and the
+// ones merged through << keep the lines of the anchored node they come from
+func yamlLines(node *yaml.Node, pointer string, lines map[string]int) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) > 0 {
+			yamlLines(node.Content[0], pointer, lines)
+		}
+	case yaml.AliasNode:
+		// anchors containing themselves were rejected when converting the document
+		yamlLines(node.Alias, pointer, lines)
+	case yaml.MappingNode:
+		// merged fields are overridden by the ones of the mapping itself
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].ShortTag() == "!!merge" {
+				yamlMergedLines(node.Content[i+1], pointer, lines)
+			}
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, item := node.Content[i], node.Content[i+1]
+			if key.ShortTag() == "!!merge" {
+				continue
+			}
+			itemPointer := pointer + "/" + escapeJSONPointer(key.Value)
+			lines[itemPointer] = key.Line
+			yamlLines(item, itemPointer, lines)
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			itemPointer := pointer + "/" + strconv.Itoa(i)
+			lines[itemPointer] = item.Line
+			yamlLines(item, itemPointer, lines)
+		}
+	}
+}
+
+// yamlMergedLines records the lines of the fields merged by a << key from a mapping or a sequence
+// of mappings, earlier mappings taking precedence over later ones
+func yamlMergedLines(node *yaml.Node, pointer string, lines map[string]int) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	switch node.Kind {
+	case yaml.MappingNode:
+		yamlLines(node, pointer, lines)
+	case yaml.SequenceNode:
+		for i := len(node.Content) - 1; i >= 0; i-- {
+			yamlMergedLines(node.Content[i], pointer, lines)
+		}
+	}
+}
+
+// jsonLines records the lines of the fields of the next JSON value of a decoder
+func jsonLines(dec *json.Decoder, content []byte, pointer string, lines map[string]int) bool {
+	lineAt := func() int {
+		return 1 + bytes.Count(content[:dec.InputOffset()], []byte("\n"))
+	}
+	token, err := dec.Token()
+	if err != nil {
+		return false
+	}
+	if _, ok := lines[pointer]; !ok {
+		lines[pointer] = lineAt()
+	}
+
+	switch token {
+	case json.Delim('{'):
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return false
+			}
+			name, _ := key.(string)
+			itemPointer := pointer + "/" + escapeJSONPointer(name)
+			lines[itemPointer] = lineAt()
+			if !jsonLines(dec, content, itemPointer, lines) {
+				return false
+			}
+		}
+		_, err = dec.Token()
+	case json.Delim('['):
+		for i := 0; dec.More(); i++ {
+			if !jsonLines(dec, content, pointer+"/"+strconv.Itoa(i), lines) {
+				return false
+			}
+		}
+		_, err = dec.Token()
+	}
+	return err == nil
+}
+
+// sortedKeys lists the keys of an object in order
+func sortedKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// escapeJSONPointer escapes a key as a JSON pointer token
+func escapeJSONPointer(key string) string {
+	return strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
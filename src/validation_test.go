@@ -0,0 +1,182 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePlaybookRecord_ValidationErrors(t *testing.T) {
+	assert := assert.New(t)
+	ar, _ := InitConfigResolver()
+
+	playbook := `{
+  "schema": "iglu:com.snowplowanalytics.dataflowrunner/PlaybookConfig/avro/1-0-1",
+  "data": {
+    "region": 1,
+    "steps": [
+      {"type": "CUSTOM_JAR", "name": "Copy", "actionOnFailure": "CONTINUE", "jar": "copy.jar", "arguments": ["--src", true]},
+      {"type": "CUSTOM_JAR", "name": "Load", "actionOnFailure": "CONTINUE", "jar": "load.jar"}
+    ],
+    "tags": "team"
+  }
+}`
+
+	_, err := ar.ParsePlaybookRecord([]byte(playbook), nil, "playbook.json")
+	assert.NotNil(err)
+	validationErrs, ok := err.(*ValidationErrors)
+	assert.True(ok)
+	assert.Equal("playbook.json", validationErrs.Config)
+	assert.Equal([]ValidationError{
+		{Pointer: "/data/region", Line: 4, Message: "expected a string, got a number"},
+		{Pointer: "/data/credentials", Line: 3, Message: "missing required field"},
+		{Pointer: "/data/steps/0/arguments/1", Line: 6, Message: "expected a string, got a boolean"},
+		{Pointer: "/data/steps/1/arguments", Line: 7, Message: "missing required field"},
+		{Pointer: "/data/tags", Line: 9, Message: "expected a list or null, got a string"},
+	}, validationErrs.Errors)
+	assert.Equal("invalid config playbook.json: /data/region (line 4): expected a string, got a number; "+
+		"/data/credentials (line 3): missing required field; "+
+		"/data/steps/0/arguments/1 (line 6): expected a string, got a boolean; "+
+		"/data/steps/1/arguments (line 7): missing required field; "+
+		"/data/tags (line 9): expected a list or null, got a string", err.Error())
+
+	_, err = ar.ParsePlaybookRecord([]byte(`{"schema": "iglu:com.snowplowanalytics.dataflowrunner/PlaybookConfig/avro/1-0-1"}`), nil, "")
+	assert.NotNil(err)
+	assert.Equal("invalid config: /data (line 1): missing required field", err.Error())
+}
+
+func TestParseClusterRecordFromFile_ValidationErrors(t *testing.T) {
+	assert := assert.New(t)
+	ar, _ := InitConfigResolver()
+
+	dir, _ := ioutil.TempDir("", "test-validation")
+	defer os.RemoveAll(dir)
+	cluster := writeConfigFile(t, dir, "cluster.yml", `schema: iglu:com.snowplowanalytics.dataflowrunner/ClusterConfig/avro/1-1-0
+data:
+  name: {{.name}}
+  logUri: s3://logs/
+  region: us-east-1
+  credentials:
+    accessKeyId: env
+    secretAccessKey: env
+  roles:
+    jobflow: EMR_EC2_DefaultRole
+    service: EMR_DefaultRole
+  ec2:
+    amiVersion: "6.1.0"
+    keyName: key
+    location:
+      vpc:
+        subnetId: subnet
+    instances:
+      master:
+        type: m4.large
+      core:
+        type: m4.large
+        count: many
+      task:
+        type: m4.large
+        count: 0
+        bid: "0.015"
+  tags: []
+  bootstrapActionConfigs: []
+  configurations: []
+  applications: ["Hadoop"]
+`)
+
+	_, err := ar.ParseClusterRecordFromFile(cluster, map[string]interface{}{"name": "cluster"})
+	assert.NotNil(err)
+	assert.Equal("invalid config "+cluster+": /data/ec2/instances/core/count (line 23): expected an integer, got a string",
+		err.Error())
+
+	// lines are the ones of the template rather than the ones of its output
+	templated := writeConfigFile(t, dir, "templated.yml", `schema: iglu:com.snowplowanalytics.dataflowrunner/PlaybookConfig/avro/1-0-1
+data:
+  region: us-east-1
+  credentials: {{toJson .credentials}}
+  steps:
+{{- range .names}}
+    - type: CUSTOM_JAR
+      name: {{.}}
+      actionOnFailure: CONTINUE
+      jar: s3://jars/job.jar
+{{- end}}
+  tags: team
+`)
+	_, err = ar.ParsePlaybookRecordFromFile(templated, map[string]interface{}{
+		"credentials": map[string]interface{}{"accessKeyId": 1, "secretAccessKey": "env"},
+		"names":       []string{"a", "b", "c"},
+	})
+	assert.NotNil(err)
+	assert.Equal("invalid config "+templated+": /data/credentials/accessKeyId (line 4): expected a string, got a number; "+
+		"/data/steps/0/arguments (line 7): missing required field; "+
+		"/data/steps/1/arguments (line 7): missing required field; "+
+		"/data/steps/2/arguments (line 7): missing required field; "+
+		"/data/tags (line 12): expected a list or null, got a string", err.Error())
+}
+
+func TestSourceLines(t *testing.T) {
+	assert := assert.New(t)
+
+	jsonc := `{
+  // the region
+  "region": "us-east-1",
+  "steps": [
+    {"name": "a"},
+    {
+      "name": "b"
+    }
+  ]
+}`
+	assert.Equal(map[string]int{
+		"":              1,
+		"/region":       3,
+		"/steps":        4,
+		"/steps/0":      5,
+		"/steps/0/name": 5,
+		"/steps/1":      6,
+		"/steps/1/name": 7,
+	}, sourceLines([]byte(jsonc), configFormatJSONC))
+
+	// merged and aliased fields have the lines of their anchor
+	yml := `defaults: &defaults
+  type: CUSTOM_JAR
+  name: default
+steps:
+  - <<: *defaults
+    name: a
+  - name: "b/c"
+  - *defaults
+`
+	assert.Equal(map[string]int{
+		"/defaults":      1,
+		"/defaults/type": 2,
+		"/defaults/name": 3,
+		"/steps":         4,
+		"/steps/0":       5,
+		"/steps/0/type":  2,
+		"/steps/0/name":  6,
+		"/steps/1":       7,
+		"/steps/1/name":  7,
+		"/steps/2":       8,
+		"/steps/2/type":  2,
+		"/steps/2/name":  3,
+	}, sourceLines([]byte(yml), configFormatYAML))
+
+	assert.Equal(map[string]int{"": 1, "/a~1b": 1}, sourceLines([]byte(`{"a/b": 1}`), configFormatJSON))
+}
@@ -0,0 +1,193 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var varsFileExtensions = []string{".json", ".yaml", ".yml", ".env"}
+
+// LoadVarsFiles loads the template variables contained in the files, variables from later files
+// override the ones from earlier files
+func LoadVarsFiles(files []string) (map[string]interface{}, error) {
+	varMap := make(map[string]interface{})
+	for _, file := range files {
+		fileVars, err := LoadVarsFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range fileVars {
+			varMap[k] = v
+		}
+	}
+	return varMap, nil
+}
+
+// ParseVarAssignments parses key=value assignments, the key ending at the first = so that values
+// can contain any character. A key can only be assigned once.
+func ParseVarAssignments(assignments []string) (map[string]interface{}, error) {
+	varMap := make(map[string]interface{})
+	for _, assignment := range assignments {
+		kv := strings.SplitN(assignment, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.New("invalid variable " + assignment + ", expected key=value")
+		}
+		if _, ok := varMap[kv[0]]; ok {
+			return nil, errors.New("variable " + kv[0] + " is specified more than once")
+		}
+		varMap[kv[0]] = kv[1]
+	}
+	return varMap, nil
+}
+
+// LoadVarsFile loads the template variables contained in a JSON, YAML or dotenv file depending
+// on its extension, values from JSON and YAML files keep their types
+func LoadVarsFile(file string) (map[string]interface{}, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var varMap map[string]interface{}
+	switch ext := strings.ToLower(filepath.Ext(file)); {
+	case ext == ".json":
+		varMap, err = parseJSONVars(content)
+	case ext == ".yaml" || ext == ".yml":
+		varMap, err = parseYAMLVars(content)
+	case ext == ".env" || filepath.Base(file) == ".env":
+		varMap, err = parseDotenvVars(content)
+	default:
+		return nil, errors.New("unsupported format for vars file " + file +
+			", supported extensions are " + strings.Join(varsFileExtensions, ","))
+	}
+	if err != nil {
+		return nil, errors.New("couldn't parse vars file " + file + ": " + err.Error())
+	}
+	if varMap == nil {
+		return map[string]interface{}{}, nil
+	}
+	return varMap, nil
+}
+
+// parseYAMLVars parses a YAML mapping
+func parseYAMLVars(content []byte) (map[string]interface{}, error) {
+	document, err := parseYAML(content)
+	if err != nil || document == nil {
+		return nil, err
+	}
+	varMap, ok := document.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("expected a mapping of variables")
+	}
+	return varMap, nil
+}
+
+// parseJSONVars parses a JSON object, integers are kept as such instead of being turned into
+// floats
+func parseJSONVars(content []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+
+	var varMap map[string]interface{}
+	if err := decoder.Decode(&varMap); err != nil {
+		return nil, err
+	}
+	return fromJSONNumbers(varMap).(map[string]interface{}), nil
+}
+
+// fromJSONNumbers replaces the json.Number values by int64 or float64 values
+func fromJSONNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = fromJSONNumbers(item)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = fromJSONNumbers(item)
+		}
+		return v
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	default:
+		return v
+	}
+}
+
+// parseDotenvVars parses KEY=VALUE lines, optionally prefixed with export. Values can be single
+// or double quoted, escape sequences being interpreted in double quoted values only. Lines
+// starting with # are ignored, as is anything following # in unquoted values.
+func parseDotenvVars(content []byte) (map[string]interface{}, error) {
+	varMap := make(map[string]interface{})
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		kv := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || key == "" {
+			return nil, errors.New("line " + strconv.Itoa(lineNumber) + ": expected KEY=VALUE")
+		}
+
+		value, err := parseDotenvValue(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, errors.New("line " + strconv.Itoa(lineNumber) + ": " + err.Error())
+		}
+		varMap[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return varMap, nil
+}
+
+// parseDotenvValue unquotes a dotenv value
+func parseDotenvValue(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		end := strings.LastIndex(value, `"`)
+		if end == 0 {
+			return "", errors.New("unterminated double quoted value")
+		}
+		return strconv.Unquote(value[:end+1])
+	case strings.HasPrefix(value, "'"):
+		end := strings.LastIndex(value, "'")
+		if end == 0 {
+			return "", errors.New("unterminated single quoted value")
+		}
+		return value[1:end], nil
+	default:
+		if i := strings.Index(value, " #"); i >= 0 {
+			value = value[:i]
+		}
+		return strings.TrimSpace(value), nil
+	}
+}
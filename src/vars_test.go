@@ -0,0 +1,152 @@
+//
+// Copyright (c) 2016-2022 Snowplow Analytics Ltd. All rights reserved.
+//
+// This program is licensed to you under the Apache License Version 2.0,
+// and you may not use this file except in compliance with the Apache License Version 2.0.
+// You may obtain a copy of the Apache License Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0.
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the Apache License Version 2.0 is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the Apache License Version 2.0 for the specific language governing permissions and limitations there under.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeVarsFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseVarAssignments(t *testing.T) {
+	assert := assert.New(t)
+
+	varMap, err := ParseVarAssignments([]string{"path=s3://bucket/a,b", "json={\"a\":\"b=c\"}", "empty="})
+	assert.Nil(err)
+	assert.Equal(map[string]interface{}{
+		"path":  "s3://bucket/a,b",
+		"json":  `{"a":"b=c"}`,
+		"empty": "",
+	}, varMap)
+
+	varMap, err = ParseVarAssignments([]string{"a=1", "a=2"})
+	assert.Nil(varMap)
+	assert.NotNil(err)
+	assert.Equal("variable a is specified more than once", err.Error())
+
+	for _, assignment := range []string{"a", "=b"} {
+		varMap, err = ParseVarAssignments([]string{assignment})
+		assert.Nil(varMap)
+		assert.NotNil(err)
+		assert.Equal("invalid variable "+assignment+", expected key=value", err.Error())
+	}
+}
+
+func TestLoadVarsFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "test-vars-file")
+	defer os.RemoveAll(dir)
+
+	jsonFile := writeVarsFile(t, dir, "vars.json",
+		`{"count": 3, "ratio": 0.5, "dates": ["2022-01-01", "2022-01-02"], "db": {"name": "atomic"}}`)
+	varMap, err := LoadVarsFile(jsonFile)
+	assert.Nil(err)
+	assert.Equal(map[string]interface{}{
+		"count": int64(3),
+		"ratio": 0.5,
+		"dates": []interface{}{"2022-01-01", "2022-01-02"},
+		"db":    map[string]interface{}{"name": "atomic"},
+	}, varMap)
+
+	yamlFile := writeVarsFile(t, dir, "vars.yml",
+		"count: 3\nenabled: true\ntables:\n  - events\n  - bad_rows\n")
+	varMap, err = LoadVarsFile(yamlFile)
+	assert.Nil(err)
+	assert.Equal(map[string]interface{}{
+		"count":   3,
+		"enabled": true,
+		"tables":  []interface{}{"events", "bad_rows"},
+	}, varMap)
+
+	dotenvFile := writeVarsFile(t, dir, "vars.env", "# comment\n\nexport A=1\nB = some value # comment\n"+
+		`C="a, \"quoted\"\nvalue"`+"\nD='single # quoted'\n")
+	varMap, err = LoadVarsFile(dotenvFile)
+	assert.Nil(err)
+	assert.Equal(map[string]interface{}{
+		"A": "1",
+		"B": "some value",
+		"C": "a, \"quoted\"\nvalue",
+		"D": "single # quoted",
+	}, varMap)
+
+	emptyFile := writeVarsFile(t, dir, "empty.yaml", "")
+	varMap, err = LoadVarsFile(emptyFile)
+	assert.Nil(err)
+	assert.Equal(map[string]interface{}{}, varMap)
+
+	// fail for unsupported or invalid files
+	tomlFile := writeVarsFile(t, dir, "vars.toml", "a = 1")
+	varMap, err = LoadVarsFile(tomlFile)
+	assert.Nil(varMap)
+	assert.NotNil(err)
+	assert.Equal("unsupported format for vars file "+tomlFile+
+		", supported extensions are .json,.yaml,.yml,.env", err.Error())
+
+	invalidFile := writeVarsFile(t, dir, "invalid.env", "A=1\nB\n")
+	varMap, err = LoadVarsFile(invalidFile)
+	assert.Nil(varMap)
+	assert.NotNil(err)
+	assert.Equal("couldn't parse vars file "+invalidFile+": line 2: expected KEY=VALUE", err.Error())
+
+	listFile := writeVarsFile(t, dir, "list.json", `["a"]`)
+	varMap, err = LoadVarsFile(listFile)
+	assert.Nil(varMap)
+	assert.NotNil(err)
+	assert.Equal("couldn't parse vars file "+listFile+
+		": json: cannot unmarshal array into Go value of type map[string]interface {}", err.Error())
+
+	varMap, err = LoadVarsFile(filepath.Join(dir, "missing.json"))
+	assert.Nil(varMap)
+	assert.NotNil(err)
+}
+
+func TestLoadVarsFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "test-vars-files")
+	defer os.RemoveAll(dir)
+
+	first := writeVarsFile(t, dir, "first.yaml", "a: 1\nb: 2\n")
+	second := writeVarsFile(t, dir, "second.env", "b=3\nc=4\n")
+
+	// later files override earlier ones
+	varMap, err := LoadVarsFiles([]string{first, second})
+	assert.Nil(err)
+	assert.Equal(map[string]interface{}{"a": 1, "b": "3", "c": "4"}, varMap)
+
+	varMap, err = LoadVarsFiles(nil)
+	assert.Nil(err)
+	assert.Equal(map[string]interface{}{}, varMap)
+
+	// typed values can be used in templates
+	varMap, err = LoadVarsFiles([]string{writeVarsFile(t, dir, "dates.yaml",
+		"dates: [2022-01-01, 2022-01-02]\nbackfill: false\n")})
+	assert.Nil(err)
+	templated, err := templateRawBytesWithFuncs(
+		[]byte(`{{range .dates}}{{.}},{{end}}{{if .backfill}}backfill{{end}}`), varMap, "", nil)
+	assert.Nil(err)
+	assert.Equal("2022-01-01,2022-01-02,", string(templated))
+}